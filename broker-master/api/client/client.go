@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"sync"
 	"time"
 
 	pb "therealbroker/api/proto"
+	"therealbroker/pkg/auth"
 
 	"google.golang.org/grpc"
 )
@@ -27,7 +29,12 @@ type Job struct {
 }
 
 func main() {
-	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock())
+	opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithBlock()}
+	//	Brokers with authentication need the token of the caller
+	if token := os.Getenv("BROKER_TOKEN"); token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(auth.TokenCredentials(token)))
+	}
+	conn, err := grpc.Dial(address, opts...)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
@@ -63,6 +70,8 @@ func worker(wg *sync.WaitGroup, jobs <-chan Job, client pb.BrokerClient) {
 		switch job.jobType {
 		case "publish":
 			publishMessages(client, job.count)
+		case "publish_batch":
+			publishBatch(client, job.count)
 		case "subscribe":
 			subscribeMessages(client, job.count)
 		case "fetch":
@@ -86,6 +95,31 @@ func publishMessages(client pb.BrokerClient, count int) {
 	}
 }
 
+func publishBatch(client pb.BrokerClient, count int) {
+	stream, err := client.PublishBatch(context.Background())
+	if err != nil {
+		log.Printf("PublishBatch failed: %v", err)
+		return
+	}
+	for i := 0; i < count; i++ {
+		err := stream.Send(&pb.PublishRequest{
+			Subject:           "test",
+			Body:              []byte("message"),
+			ExpirationSeconds: int32(i),
+		})
+		if err != nil {
+			log.Printf("PublishBatch failed: %v", err)
+			return
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Printf("PublishBatch failed: %v", err)
+	} else {
+		log.Printf("Published %d messages in a batch", len(response.Ids))
+	}
+}
+
 func subscribeMessages(client pb.BrokerClient, count int) {
 	for i := 0; i < count; i++ {
 		stream, err := client.Subscribe(context.Background(), &pb.SubscribeRequest{Subject: "test"})
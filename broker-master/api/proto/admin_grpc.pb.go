@@ -0,0 +1,330 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.12.4
+// source: admin.proto
+
+package proto
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	BrokerAdmin_ListSubjects_FullMethodName         = "/broker.BrokerAdmin/ListSubjects"
+	BrokerAdmin_ListSubscribers_FullMethodName      = "/broker.BrokerAdmin/ListSubscribers"
+	BrokerAdmin_DescribeSubscriber_FullMethodName   = "/broker.BrokerAdmin/DescribeSubscriber"
+	BrokerAdmin_PurgeSubject_FullMethodName         = "/broker.BrokerAdmin/PurgeSubject"
+	BrokerAdmin_DeleteMessage_FullMethodName        = "/broker.BrokerAdmin/DeleteMessage"
+	BrokerAdmin_DisconnectSubscriber_FullMethodName = "/broker.BrokerAdmin/DisconnectSubscriber"
+)
+
+// BrokerAdminClient is the client API for BrokerAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BrokerAdminClient interface {
+	// ListSubjects returns the subjects with stored messages or subscribers
+	// If broker is closed, should return Unavailable
+	ListSubjects(ctx context.Context, in *ListSubjectsRequest, opts ...grpc.CallOption) (*ListSubjectsResponse, error)
+	// ListSubscribers returns the subscribers of a subject
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid, should return InvalidArgument
+	ListSubscribers(ctx context.Context, in *ListSubscribersRequest, opts ...grpc.CallOption) (*ListSubscribersResponse, error)
+	// DescribeSubscriber returns the buffer and the counters of a subscriber
+	// If broker is closed, should return Unavailable
+	// If no subscriber has the id, should return NotFound
+	DescribeSubscriber(ctx context.Context, in *DescribeSubscriberRequest, opts ...grpc.CallOption) (*SubscriberInfo, error)
+	// PurgeSubject removes every stored message of a subject
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid or has wildcards, should return InvalidArgument
+	PurgeSubject(ctx context.Context, in *PurgeSubjectRequest, opts ...grpc.CallOption) (*PurgeSubjectResponse, error)
+	// DeleteMessage removes one stored message of a subject
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid or has wildcards, should return InvalidArgument
+	// If the id is expired or not present, should return InvalidArgument
+	DeleteMessage(ctx context.Context, in *DeleteMessageRequest, opts ...grpc.CallOption) (*DeleteMessageResponse, error)
+	// DisconnectSubscriber ends the stream of a subscriber
+	// If broker is closed, should return Unavailable
+	// If no subscriber has the id, should return NotFound
+	DisconnectSubscriber(ctx context.Context, in *DisconnectSubscriberRequest, opts ...grpc.CallOption) (*DisconnectSubscriberResponse, error)
+}
+
+type brokerAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBrokerAdminClient(cc grpc.ClientConnInterface) BrokerAdminClient {
+	return &brokerAdminClient{cc}
+}
+
+func (c *brokerAdminClient) ListSubjects(ctx context.Context, in *ListSubjectsRequest, opts ...grpc.CallOption) (*ListSubjectsResponse, error) {
+	out := new(ListSubjectsResponse)
+	err := c.cc.Invoke(ctx, BrokerAdmin_ListSubjects_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerAdminClient) ListSubscribers(ctx context.Context, in *ListSubscribersRequest, opts ...grpc.CallOption) (*ListSubscribersResponse, error) {
+	out := new(ListSubscribersResponse)
+	err := c.cc.Invoke(ctx, BrokerAdmin_ListSubscribers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerAdminClient) DescribeSubscriber(ctx context.Context, in *DescribeSubscriberRequest, opts ...grpc.CallOption) (*SubscriberInfo, error) {
+	out := new(SubscriberInfo)
+	err := c.cc.Invoke(ctx, BrokerAdmin_DescribeSubscriber_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerAdminClient) PurgeSubject(ctx context.Context, in *PurgeSubjectRequest, opts ...grpc.CallOption) (*PurgeSubjectResponse, error) {
+	out := new(PurgeSubjectResponse)
+	err := c.cc.Invoke(ctx, BrokerAdmin_PurgeSubject_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerAdminClient) DeleteMessage(ctx context.Context, in *DeleteMessageRequest, opts ...grpc.CallOption) (*DeleteMessageResponse, error) {
+	out := new(DeleteMessageResponse)
+	err := c.cc.Invoke(ctx, BrokerAdmin_DeleteMessage_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerAdminClient) DisconnectSubscriber(ctx context.Context, in *DisconnectSubscriberRequest, opts ...grpc.CallOption) (*DisconnectSubscriberResponse, error) {
+	out := new(DisconnectSubscriberResponse)
+	err := c.cc.Invoke(ctx, BrokerAdmin_DisconnectSubscriber_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BrokerAdminServer is the server API for BrokerAdmin service.
+// All implementations must embed UnimplementedBrokerAdminServer
+// for forward compatibility
+type BrokerAdminServer interface {
+	// ListSubjects returns the subjects with stored messages or subscribers
+	// If broker is closed, should return Unavailable
+	ListSubjects(context.Context, *ListSubjectsRequest) (*ListSubjectsResponse, error)
+	// ListSubscribers returns the subscribers of a subject
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid, should return InvalidArgument
+	ListSubscribers(context.Context, *ListSubscribersRequest) (*ListSubscribersResponse, error)
+	// DescribeSubscriber returns the buffer and the counters of a subscriber
+	// If broker is closed, should return Unavailable
+	// If no subscriber has the id, should return NotFound
+	DescribeSubscriber(context.Context, *DescribeSubscriberRequest) (*SubscriberInfo, error)
+	// PurgeSubject removes every stored message of a subject
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid or has wildcards, should return InvalidArgument
+	PurgeSubject(context.Context, *PurgeSubjectRequest) (*PurgeSubjectResponse, error)
+	// DeleteMessage removes one stored message of a subject
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid or has wildcards, should return InvalidArgument
+	// If the id is expired or not present, should return InvalidArgument
+	DeleteMessage(context.Context, *DeleteMessageRequest) (*DeleteMessageResponse, error)
+	// DisconnectSubscriber ends the stream of a subscriber
+	// If broker is closed, should return Unavailable
+	// If no subscriber has the id, should return NotFound
+	DisconnectSubscriber(context.Context, *DisconnectSubscriberRequest) (*DisconnectSubscriberResponse, error)
+	mustEmbedUnimplementedBrokerAdminServer()
+}
+
+// UnimplementedBrokerAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedBrokerAdminServer struct {
+}
+
+func (UnimplementedBrokerAdminServer) ListSubjects(context.Context, *ListSubjectsRequest) (*ListSubjectsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSubjects not implemented")
+}
+func (UnimplementedBrokerAdminServer) ListSubscribers(context.Context, *ListSubscribersRequest) (*ListSubscribersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSubscribers not implemented")
+}
+func (UnimplementedBrokerAdminServer) DescribeSubscriber(context.Context, *DescribeSubscriberRequest) (*SubscriberInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DescribeSubscriber not implemented")
+}
+func (UnimplementedBrokerAdminServer) PurgeSubject(context.Context, *PurgeSubjectRequest) (*PurgeSubjectResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PurgeSubject not implemented")
+}
+func (UnimplementedBrokerAdminServer) DeleteMessage(context.Context, *DeleteMessageRequest) (*DeleteMessageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMessage not implemented")
+}
+func (UnimplementedBrokerAdminServer) DisconnectSubscriber(context.Context, *DisconnectSubscriberRequest) (*DisconnectSubscriberResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DisconnectSubscriber not implemented")
+}
+func (UnimplementedBrokerAdminServer) mustEmbedUnimplementedBrokerAdminServer() {}
+
+// UnsafeBrokerAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BrokerAdminServer will
+// result in compilation errors.
+type UnsafeBrokerAdminServer interface {
+	mustEmbedUnimplementedBrokerAdminServer()
+}
+
+func RegisterBrokerAdminServer(s grpc.ServiceRegistrar, srv BrokerAdminServer) {
+	s.RegisterService(&BrokerAdmin_ServiceDesc, srv)
+}
+
+func _BrokerAdmin_ListSubjects_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSubjectsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerAdminServer).ListSubjects(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BrokerAdmin_ListSubjects_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerAdminServer).ListSubjects(ctx, req.(*ListSubjectsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BrokerAdmin_ListSubscribers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSubscribersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerAdminServer).ListSubscribers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BrokerAdmin_ListSubscribers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerAdminServer).ListSubscribers(ctx, req.(*ListSubscribersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BrokerAdmin_DescribeSubscriber_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DescribeSubscriberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerAdminServer).DescribeSubscriber(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BrokerAdmin_DescribeSubscriber_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerAdminServer).DescribeSubscriber(ctx, req.(*DescribeSubscriberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BrokerAdmin_PurgeSubject_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeSubjectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerAdminServer).PurgeSubject(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BrokerAdmin_PurgeSubject_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerAdminServer).PurgeSubject(ctx, req.(*PurgeSubjectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BrokerAdmin_DeleteMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerAdminServer).DeleteMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BrokerAdmin_DeleteMessage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerAdminServer).DeleteMessage(ctx, req.(*DeleteMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BrokerAdmin_DisconnectSubscriber_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DisconnectSubscriberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerAdminServer).DisconnectSubscriber(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: BrokerAdmin_DisconnectSubscriber_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerAdminServer).DisconnectSubscriber(ctx, req.(*DisconnectSubscriberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// BrokerAdmin_ServiceDesc is the grpc.ServiceDesc for BrokerAdmin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var BrokerAdmin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "broker.BrokerAdmin",
+	HandlerType: (*BrokerAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSubjects",
+			Handler:    _BrokerAdmin_ListSubjects_Handler,
+		},
+		{
+			MethodName: "ListSubscribers",
+			Handler:    _BrokerAdmin_ListSubscribers_Handler,
+		},
+		{
+			MethodName: "DescribeSubscriber",
+			Handler:    _BrokerAdmin_DescribeSubscriber_Handler,
+		},
+		{
+			MethodName: "PurgeSubject",
+			Handler:    _BrokerAdmin_PurgeSubject_Handler,
+		},
+		{
+			MethodName: "DeleteMessage",
+			Handler:    _BrokerAdmin_DeleteMessage_Handler,
+		},
+		{
+			MethodName: "DisconnectSubscriber",
+			Handler:    _BrokerAdmin_DisconnectSubscriber_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
@@ -19,9 +19,13 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	Broker_Publish_FullMethodName   = "/broker.Broker/Publish"
-	Broker_Subscribe_FullMethodName = "/broker.Broker/Subscribe"
-	Broker_Fetch_FullMethodName     = "/broker.Broker/Fetch"
+	Broker_Publish_FullMethodName       = "/broker.Broker/Publish"
+	Broker_PublishBatch_FullMethodName  = "/broker.Broker/PublishBatch"
+	Broker_Subscribe_FullMethodName     = "/broker.Broker/Subscribe"
+	Broker_Fetch_FullMethodName         = "/broker.Broker/Fetch"
+	Broker_Ack_FullMethodName           = "/broker.Broker/Ack"
+	Broker_Request_FullMethodName       = "/broker.Broker/Request"
+	Broker_SetDeadLetter_FullMethodName = "/broker.Broker/SetDeadLetter"
 )
 
 // BrokerClient is the client API for Broker service.
@@ -30,8 +34,17 @@ const (
 type BrokerClient interface {
 	// Publish returns an id if the delivery is successful
 	// If broker is closed, should return Unavailable
+	// If the subject is not valid or has wildcards, should return InvalidArgument
 	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// PublishBatch publishes every streamed message once the stream is closed
+	// and returns their ids in the order they were sent, the order within
+	// each subject is preserved
+	// If broker is closed, should return Unavailable
+	// If a subject is not valid, should return InvalidArgument
+	PublishBatch(ctx context.Context, opts ...grpc.CallOption) (Broker_PublishBatchClient, error)
 	// Subscribe returns an stream of messages
+	// The subject can use "*" for one token and ">" for the rest of the subject
+	// If group is set, the stream only gets its share of the messages
 	// If broker is closed, should return Unavailable
 	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Broker_SubscribeClient, error)
 	// Fetch returns the proper message body, if its present
@@ -39,6 +52,23 @@ type BrokerClient interface {
 	// If the provided id is expired or not present,
 	// should return InvalidArgument
 	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*MessageResponse, error)
+	// Ack confirms a message received on a subscription with ackWaitSeconds
+	// If broker is closed, should return Unavailable
+	// If the consumer is not subscribed, should return NotFound
+	// If the id is not waiting for an ack, should return InvalidArgument
+	Ack(ctx context.Context, in *AckRequest, opts ...grpc.CallOption) (*AckResponse, error)
+	// Request publishes the message with an inbox subject in its Reply-To
+	// header and returns the first reply, responders publish it to the inbox
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid, should return InvalidArgument
+	// If nobody is subscribed to the subject, should return NotFound
+	// If no reply comes before the timeout, should return DeadlineExceeded
+	Request(ctx context.Context, in *RequestRequest, opts ...grpc.CallOption) (*MessageResponse, error)
+	// SetDeadLetter names the subject that gets the undeliverable messages
+	// of a subject, an empty deadLetterSubject turns it off
+	// If broker is closed, should return Unavailable
+	// If a subject is not valid, should return InvalidArgument
+	SetDeadLetter(ctx context.Context, in *SetDeadLetterRequest, opts ...grpc.CallOption) (*SetDeadLetterResponse, error)
 }
 
 type brokerClient struct {
@@ -58,8 +88,42 @@ func (c *brokerClient) Publish(ctx context.Context, in *PublishRequest, opts ...
 	return out, nil
 }
 
+func (c *brokerClient) PublishBatch(ctx context.Context, opts ...grpc.CallOption) (Broker_PublishBatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[0], Broker_PublishBatch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &brokerPublishBatchClient{stream}
+	return x, nil
+}
+
+type Broker_PublishBatchClient interface {
+	Send(*PublishRequest) error
+	CloseAndRecv() (*PublishBatchResponse, error)
+	grpc.ClientStream
+}
+
+type brokerPublishBatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *brokerPublishBatchClient) Send(m *PublishRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *brokerPublishBatchClient) CloseAndRecv() (*PublishBatchResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(PublishBatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *brokerClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Broker_SubscribeClient, error) {
-	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[0], Broker_Subscribe_FullMethodName, opts...)
+	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[1], Broker_Subscribe_FullMethodName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -99,14 +163,50 @@ func (c *brokerClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc
 	return out, nil
 }
 
+func (c *brokerClient) Ack(ctx context.Context, in *AckRequest, opts ...grpc.CallOption) (*AckResponse, error) {
+	out := new(AckResponse)
+	err := c.cc.Invoke(ctx, Broker_Ack_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) Request(ctx context.Context, in *RequestRequest, opts ...grpc.CallOption) (*MessageResponse, error) {
+	out := new(MessageResponse)
+	err := c.cc.Invoke(ctx, Broker_Request_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) SetDeadLetter(ctx context.Context, in *SetDeadLetterRequest, opts ...grpc.CallOption) (*SetDeadLetterResponse, error) {
+	out := new(SetDeadLetterResponse)
+	err := c.cc.Invoke(ctx, Broker_SetDeadLetter_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BrokerServer is the server API for Broker service.
 // All implementations must embed UnimplementedBrokerServer
 // for forward compatibility
 type BrokerServer interface {
 	// Publish returns an id if the delivery is successful
 	// If broker is closed, should return Unavailable
+	// If the subject is not valid or has wildcards, should return InvalidArgument
 	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// PublishBatch publishes every streamed message once the stream is closed
+	// and returns their ids in the order they were sent, the order within
+	// each subject is preserved
+	// If broker is closed, should return Unavailable
+	// If a subject is not valid, should return InvalidArgument
+	PublishBatch(Broker_PublishBatchServer) error
 	// Subscribe returns an stream of messages
+	// The subject can use "*" for one token and ">" for the rest of the subject
+	// If group is set, the stream only gets its share of the messages
 	// If broker is closed, should return Unavailable
 	Subscribe(*SubscribeRequest, Broker_SubscribeServer) error
 	// Fetch returns the proper message body, if its present
@@ -114,6 +214,23 @@ type BrokerServer interface {
 	// If the provided id is expired or not present,
 	// should return InvalidArgument
 	Fetch(context.Context, *FetchRequest) (*MessageResponse, error)
+	// Ack confirms a message received on a subscription with ackWaitSeconds
+	// If broker is closed, should return Unavailable
+	// If the consumer is not subscribed, should return NotFound
+	// If the id is not waiting for an ack, should return InvalidArgument
+	Ack(context.Context, *AckRequest) (*AckResponse, error)
+	// Request publishes the message with an inbox subject in its Reply-To
+	// header and returns the first reply, responders publish it to the inbox
+	// If broker is closed, should return Unavailable
+	// If the subject is not valid, should return InvalidArgument
+	// If nobody is subscribed to the subject, should return NotFound
+	// If no reply comes before the timeout, should return DeadlineExceeded
+	Request(context.Context, *RequestRequest) (*MessageResponse, error)
+	// SetDeadLetter names the subject that gets the undeliverable messages
+	// of a subject, an empty deadLetterSubject turns it off
+	// If broker is closed, should return Unavailable
+	// If a subject is not valid, should return InvalidArgument
+	SetDeadLetter(context.Context, *SetDeadLetterRequest) (*SetDeadLetterResponse, error)
 	mustEmbedUnimplementedBrokerServer()
 }
 
@@ -124,12 +241,24 @@ type UnimplementedBrokerServer struct {
 func (UnimplementedBrokerServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
 }
+func (UnimplementedBrokerServer) PublishBatch(Broker_PublishBatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method PublishBatch not implemented")
+}
 func (UnimplementedBrokerServer) Subscribe(*SubscribeRequest, Broker_SubscribeServer) error {
 	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
 }
 func (UnimplementedBrokerServer) Fetch(context.Context, *FetchRequest) (*MessageResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Fetch not implemented")
 }
+func (UnimplementedBrokerServer) Ack(context.Context, *AckRequest) (*AckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ack not implemented")
+}
+func (UnimplementedBrokerServer) Request(context.Context, *RequestRequest) (*MessageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Request not implemented")
+}
+func (UnimplementedBrokerServer) SetDeadLetter(context.Context, *SetDeadLetterRequest) (*SetDeadLetterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetDeadLetter not implemented")
+}
 func (UnimplementedBrokerServer) mustEmbedUnimplementedBrokerServer() {}
 
 // UnsafeBrokerServer may be embedded to opt out of forward compatibility for this service.
@@ -161,6 +290,32 @@ func _Broker_Publish_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Broker_PublishBatch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BrokerServer).PublishBatch(&brokerPublishBatchServer{stream})
+}
+
+type Broker_PublishBatchServer interface {
+	SendAndClose(*PublishBatchResponse) error
+	Recv() (*PublishRequest, error)
+	grpc.ServerStream
+}
+
+type brokerPublishBatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerPublishBatchServer) SendAndClose(m *PublishBatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *brokerPublishBatchServer) Recv() (*PublishRequest, error) {
+	m := new(PublishRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _Broker_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(SubscribeRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -200,6 +355,60 @@ func _Broker_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interf
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Broker_Ack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Ack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Broker_Ack_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Ack(ctx, req.(*AckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_Request_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RequestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Request(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Broker_Request_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Request(ctx, req.(*RequestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_SetDeadLetter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetDeadLetterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).SetDeadLetter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Broker_SetDeadLetter_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).SetDeadLetter(ctx, req.(*SetDeadLetterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Broker_ServiceDesc is the grpc.ServiceDesc for Broker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -215,8 +424,25 @@ var Broker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Fetch",
 			Handler:    _Broker_Fetch_Handler,
 		},
+		{
+			MethodName: "Ack",
+			Handler:    _Broker_Ack_Handler,
+		},
+		{
+			MethodName: "Request",
+			Handler:    _Broker_Request_Handler,
+		},
+		{
+			MethodName: "SetDeadLetter",
+			Handler:    _Broker_SetDeadLetter_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PublishBatch",
+			Handler:       _Broker_PublishBatch_Handler,
+			ClientStreams: true,
+		},
 		{
 			StreamName:    "Subscribe",
 			Handler:       _Broker_Subscribe_Handler,
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/middleware"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type AdminServer struct {
+	proto.UnimplementedBrokerAdminServer
+	admin broker.Admin
+}
+
+func NewAdminServer(admin broker.Admin) *AdminServer {
+	return &AdminServer{admin: admin}
+}
+
+func (s *AdminServer) ListSubjects(ctx context.Context, request *proto.ListSubjectsRequest) (*proto.ListSubjectsResponse, error) {
+	spanCtx, finish, err := s.start(ctx, "list_subjects")
+	if err != nil {
+		return nil, err
+	}
+
+	subjects, err := s.admin.Subjects(spanCtx)
+	if err = finish(err); err != nil {
+		return nil, err
+	}
+
+	response := &proto.ListSubjectsResponse{Subjects: make([]*proto.SubjectInfo, len(subjects))}
+	for i, subject := range subjects {
+		response.Subjects[i] = &proto.SubjectInfo{
+			Subject:     subject.Subject,
+			Messages:    int64(subject.Messages),
+			Subscribers: int32(subject.Subscribers),
+		}
+	}
+	return response, nil
+}
+
+func (s *AdminServer) ListSubscribers(ctx context.Context, request *proto.ListSubscribersRequest) (*proto.ListSubscribersResponse, error) {
+	spanCtx, finish, err := s.start(ctx, "list_subscribers")
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers, err := s.admin.Subscribers(spanCtx, request.GetSubject())
+	if err = finish(err); err != nil {
+		return nil, err
+	}
+
+	response := &proto.ListSubscribersResponse{Subscribers: make([]*proto.SubscriberInfo, len(subscribers))}
+	for i, subscriber := range subscribers {
+		response.Subscribers[i] = subscriberResponse(subscriber)
+	}
+	return response, nil
+}
+
+func (s *AdminServer) DescribeSubscriber(ctx context.Context, request *proto.DescribeSubscriberRequest) (*proto.SubscriberInfo, error) {
+	spanCtx, finish, err := s.start(ctx, "describe_subscriber")
+	if err != nil {
+		return nil, err
+	}
+
+	subscriber, err := s.admin.DescribeSubscriber(spanCtx, request.GetId())
+	if err = finish(err); err != nil {
+		return nil, err
+	}
+	return subscriberResponse(subscriber), nil
+}
+
+func (s *AdminServer) PurgeSubject(ctx context.Context, request *proto.PurgeSubjectRequest) (*proto.PurgeSubjectResponse, error) {
+	spanCtx, finish, err := s.start(ctx, "purge_subject")
+	if err != nil {
+		return nil, err
+	}
+
+	purged, err := s.admin.PurgeSubject(spanCtx, request.GetSubject())
+	if err = finish(err); err != nil {
+		return nil, err
+	}
+	return &proto.PurgeSubjectResponse{Purged: int64(purged)}, nil
+}
+
+func (s *AdminServer) DeleteMessage(ctx context.Context, request *proto.DeleteMessageRequest) (*proto.DeleteMessageResponse, error) {
+	spanCtx, finish, err := s.start(ctx, "delete_message")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.admin.DeleteMessage(spanCtx, request.GetSubject(), int(request.GetId()))
+	if err = finish(err); err != nil {
+		return nil, err
+	}
+	return &proto.DeleteMessageResponse{}, nil
+}
+
+func (s *AdminServer) DisconnectSubscriber(ctx context.Context, request *proto.DisconnectSubscriberRequest) (*proto.DisconnectSubscriberResponse, error) {
+	spanCtx, finish, err := s.start(ctx, "disconnect_subscriber")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.admin.DisconnectSubscriber(spanCtx, request.GetId())
+	if err = finish(err); err != nil {
+		return nil, err
+	}
+	return &proto.DisconnectSubscriberResponse{}, nil
+}
+
+// start opens the span of an admin call, finish records the metrics of the
+// call and turns the error of the broker into its status.
+func (s *AdminServer) start(ctx context.Context, method string) (context.Context, func(error) error, error) {
+	span, err := middleware.StartSpanFromGRPC(ctx, "Admin "+method+" gRPC Broker Server")
+	if err != nil {
+		return nil, nil, err
+	}
+	startTime := time.Now()
+
+	finish := func(err error) error {
+		span.Finish()
+		middleware.MethodDuration.WithLabelValues(method).Observe(float64(time.Since(startTime).Microseconds()))
+		if err != nil {
+			middleware.MethodCount.WithLabelValues(method, "failed").Observe(float64(time.Since(startTime)))
+			return adminStatus(err)
+		}
+		middleware.MethodCount.WithLabelValues(method, "successful").Observe(float64(time.Since(startTime)))
+		return nil
+	}
+	return opentracing.ContextWithSpan(ctx, span), finish, nil
+}
+
+func adminStatus(err error) error {
+	switch err {
+	case broker.ErrInvalidSubject:
+		return status.Errorf(codes.InvalidArgument, "Invalid subject")
+	case broker.ErrInvalidID, broker.ErrExpiredID:
+		return status.Errorf(codes.InvalidArgument, "Invalid ID")
+	case broker.ErrUnknownSubscriber:
+		return status.Errorf(codes.NotFound, "Unknown subscriber")
+	default:
+		return otherStatus(err)
+	}
+}
+
+func subscriberResponse(subscriber broker.SubscriberInfo) *proto.SubscriberInfo {
+	return &proto.SubscriberInfo{
+		Id:            subscriber.ID,
+		Subject:       subscriber.Subject,
+		Group:         subscriber.Group,
+		Consumer:      subscriber.Consumer,
+		Buffered:      int32(subscriber.Buffered),
+		BufferedBytes: int64(subscriber.BufferedBytes),
+		Delivered:     subscriber.Delivered,
+		Dropped:       subscriber.Dropped,
+		Unacked:       int32(subscriber.Unacked),
+	}
+}
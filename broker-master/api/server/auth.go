@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticator checks the token of every call and the ACL grants of its
+// identity on the subjects of the call.
+type Authenticator struct {
+	key []byte
+	acl auth.ACL
+}
+
+func NewAuthenticator(key []byte, acl auth.ACL) *Authenticator {
+	return &Authenticator{key: key, acl: acl}
+}
+
+func (a *Authenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		claims, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.authorize(claims, req); err != nil {
+			return nil, err
+		}
+		return handler(auth.NewContext(ctx, claims), req)
+	}
+}
+
+func (a *Authenticator) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		claims, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{
+			ServerStream:  ss,
+			ctx:           auth.NewContext(ss.Context(), claims),
+			authenticator: a,
+			claims:        claims,
+		})
+	}
+}
+
+// authorizedStream checks every message received on a stream, like each
+// publish of a batch.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx           context.Context
+	authenticator *Authenticator
+	claims        auth.Claims
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.authenticator.authorize(s.claims, m)
+}
+
+func (a *Authenticator) authenticate(ctx context.Context) (auth.Claims, error) {
+	token, ok := auth.TokenFromContext(ctx)
+	if !ok {
+		return auth.Claims{}, status.Errorf(codes.Unauthenticated, "Missing token")
+	}
+	claims, err := auth.ParseToken(token, a.key)
+	if err != nil {
+		return auth.Claims{}, status.Errorf(codes.Unauthenticated, "Invalid token")
+	}
+	return claims, nil
+}
+
+// authorize checks the grants a request needs, brokers are allowed every
+// call and only they may use the calls between brokers.
+func (a *Authenticator) authorize(claims auth.Claims, req interface{}) error {
+	if claims.Peer {
+		return nil
+	}
+
+	var allowed bool
+	switch r := req.(type) {
+	case *proto.PublishRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionPublish, r.GetSubject())
+	case *proto.RequestRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionPublish, r.GetSubject())
+	case *proto.SubscribeRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionSubscribe, r.GetSubject())
+	case *proto.AckRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionSubscribe, r.GetSubject())
+	case *proto.FetchRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionFetch, r.GetSubject())
+	case *proto.SetDeadLetterRequest:
+		//	The messages of the subject are moved to the dead-letter subject
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionSubscribe, r.GetSubject()) &&
+			(r.GetDeadLetterSubject() == "" || a.acl.Allowed(claims.Subject, auth.ActionPublish, r.GetDeadLetterSubject()))
+	case *proto.ListSubscribersRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionAdmin, r.GetSubject())
+	case *proto.PurgeSubjectRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionAdmin, r.GetSubject())
+	case *proto.DeleteMessageRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionAdmin, r.GetSubject())
+	case *proto.ListSubjectsRequest, *proto.DescribeSubscriberRequest, *proto.DisconnectSubscriberRequest:
+		allowed = a.acl.Allowed(claims.Subject, auth.ActionAdmin, ">")
+	}
+	if !allowed {
+		return status.Errorf(codes.PermissionDenied, "Permission denied")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func callWithToken(t *testing.T, a *Authenticator, token string, req interface{}) codes.Code {
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(auth.MetadataKey, auth.Bearer(token)))
+	}
+	_, err := a.UnaryInterceptor()(ctx, req, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	return status.Code(err)
+}
+
+func TestAuthenticatorShouldCheckTokenAndGrants(t *testing.T) {
+	key := []byte("secret")
+	a := NewAuthenticator(key, auth.ACL{
+		"team-a": {{Actions: []auth.Action{auth.ActionPublish}, Subjects: []string{"team-a.>"}}},
+	})
+	teamA, _ := auth.SignToken(auth.Claims{Subject: "team-a"}, key)
+	peer, _ := auth.SignToken(auth.Claims{Subject: "broker", Peer: true}, key)
+
+	assert.Equal(t, codes.Unauthenticated, callWithToken(t, a, "", &proto.PublishRequest{Subject: "team-a.orders"}))
+	assert.Equal(t, codes.Unauthenticated, callWithToken(t, a, teamA+"x", &proto.PublishRequest{Subject: "team-a.orders"}))
+	assert.Equal(t, codes.OK, callWithToken(t, a, teamA, &proto.PublishRequest{Subject: "team-a.orders"}))
+	assert.Equal(t, codes.PermissionDenied, callWithToken(t, a, teamA, &proto.PublishRequest{Subject: "team-b.orders"}))
+	assert.Equal(t, codes.PermissionDenied, callWithToken(t, a, teamA, &proto.FetchRequest{Subject: "team-a.orders"}))
+	assert.Equal(t, codes.PermissionDenied, callWithToken(t, a, teamA, &proto.AppendEntriesRequest{}))
+	assert.Equal(t, codes.OK, callWithToken(t, a, peer, &proto.AppendEntriesRequest{}))
+}
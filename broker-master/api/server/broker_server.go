@@ -2,26 +2,53 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
 	"sync"
 	"therealbroker/api/proto"
-	brokerModule "therealbroker/internal/broker"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
 	"therealbroker/pkg/middleware"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 type ImplementedBrokerServer struct {
 	proto.UnimplementedBrokerServer
 	broker broker.Broker
+	// shutdown is closed once the server starts shutting down, so the
+	// subscriptions ended by it are told apart from slow subscribers
+	shutdown     chan struct{}
+	shutdownOnce *sync.Once
 }
 
-func NewImplementedServer() proto.BrokerServer {
+func NewImplementedServer(b broker.Broker) *ImplementedBrokerServer {
 	return &ImplementedBrokerServer{
-		broker: brokerModule.NewModule(),
+		broker:       b,
+		shutdown:     make(chan struct{}),
+		shutdownOnce: &sync.Once{},
+	}
+}
+
+// Close stops the broker from accepting publishes, writes the pending
+// storage batches and ends every subscription with Unavailable.
+func (s ImplementedBrokerServer) Close() error {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+	return s.broker.Close()
+}
+
+func (s ImplementedBrokerServer) shuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -34,17 +61,23 @@ func (s ImplementedBrokerServer) Publish(ctx context.Context, request *proto.Pub
 	spanCtx := opentracing.ContextWithSpan(ctx, span)
 	defer span.Finish()
 	startTime := time.Now()
-	defer middleware.MethodDuration.WithLabelValues("publish").Observe(float64(time.Since(startTime).Microseconds()))
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("publish").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
 	publishedMessage := broker.Message{
-		Body:       string(request.GetBody()),
-		Expiration: time.Duration(request.GetExpirationSeconds()),
+		Body:           string(request.GetBody()),
+		Headers:        request.GetHeaders(),
+		Expiration:     time.Duration(request.GetExpirationSeconds()) * time.Second,
+		DeliverAt:      deliverAt(request.GetDeliverAtUnixMilli(), request.GetDelayMillis()),
+		IdempotencyKey: request.GetIdempotencyKey(),
+		Encoding:       request.GetEncoding(),
 	}
 
 	msgId, err := s.broker.Publish(spanCtx, request.GetSubject(), publishedMessage)
 	if err != nil {
 
 		middleware.MethodCount.WithLabelValues("publish", "failed").Observe(float64(time.Since(startTime)))
-		return nil, status.Errorf(codes.Unavailable, "Broker is closed")
+		return nil, publishStatus(err)
 
 	}
 
@@ -54,6 +87,79 @@ func (s ImplementedBrokerServer) Publish(ctx context.Context, request *proto.Pub
 	return reponse, nil
 }
 
+// publishBatchSize is the number of streamed messages handed to the broker
+// at once, so a long stream does not wait for its end in memory.
+const publishBatchSize = 1000
+
+func (s ImplementedBrokerServer) PublishBatch(stream proto.Broker_PublishBatchServer) error {
+	span, err := middleware.StartSpanFromGRPC(stream.Context(), "PublishBatch gRPC Broker Server")
+	if err != nil {
+		return err
+	}
+	spanCtx := opentracing.ContextWithSpan(stream.Context(), span)
+	defer span.Finish()
+	startTime := time.Now()
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("publish_batch").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
+
+	//	Every chunk of the stream is committed before the next one is read,
+	//	a failing chunk returns the ids of the messages committed so far in
+	//	the details of its status, 0 for the ones that were not
+	ids := make([]int32, 0)
+	batch := make([]broker.Message, 0, publishBatchSize)
+	publish := func() error {
+		published, err := s.broker.PublishBatch(spanCtx, batch)
+		for i := range batch {
+			var id int
+			if i < len(published) {
+				id = published[i]
+			}
+			ids = append(ids, int32(id))
+		}
+		if err != nil {
+			middleware.MethodCount.WithLabelValues("publish_batch", "failed").Observe(float64(time.Since(startTime)))
+			return committedStatus(publishStatus(err), ids)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			middleware.MethodCount.WithLabelValues("publish_batch", "failed").Observe(float64(time.Since(startTime)))
+			return err
+		}
+
+		batch = append(batch, broker.Message{
+			Subject:        request.GetSubject(),
+			Body:           string(request.GetBody()),
+			Headers:        request.GetHeaders(),
+			Expiration:     time.Duration(request.GetExpirationSeconds()) * time.Second,
+			DeliverAt:      deliverAt(request.GetDeliverAtUnixMilli(), request.GetDelayMillis()),
+			IdempotencyKey: request.GetIdempotencyKey(),
+			Encoding:       request.GetEncoding(),
+		})
+		if len(batch) == publishBatchSize {
+			if err := publish(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := publish(); err != nil {
+			return err
+		}
+	}
+
+	middleware.MethodCount.WithLabelValues("publish_batch", "successful").Observe(float64(time.Since(startTime)))
+	return stream.SendAndClose(&proto.PublishBatchResponse{Ids: ids})
+}
+
 func (s ImplementedBrokerServer) Subscribe(request *proto.SubscribeRequest, stream proto.Broker_SubscribeServer) error {
 	span, err := middleware.StartSpanFromGRPC(stream.Context(), "Subscribe gRPC Broker Server")
 	if err != nil {
@@ -63,15 +169,41 @@ func (s ImplementedBrokerServer) Subscribe(request *proto.SubscribeRequest, stre
 	defer span.Finish()
 
 	startTime := time.Now()
-	defer middleware.MethodDuration.WithLabelValues("subscirbe").Observe(float64(time.Since(startTime).Microseconds()))
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("subscirbe").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
 
 	var subErr error
 	middleware.ActiveSubscribers.Inc()
 
-	messageChan, err := s.broker.Subscribe(spanCtx, request.GetSubject())
+	ackWait := time.Duration(request.GetAckWaitSeconds()) * time.Second
+	if request.GetAckWaitMillis() > 0 {
+		ackWait = time.Duration(request.GetAckWaitMillis()) * time.Millisecond
+	}
+	messageChan, err := s.broker.SubscribeWithOptions(spanCtx, request.GetSubject(), broker.SubscribeOptions{
+		Group:      request.GetGroup(),
+		Consumer:   request.GetConsumer(),
+		AckWait:    ackWait,
+		MaxDeliver: int(request.GetMaxDeliver()),
+
+		DeliverPolicy: broker.DeliverPolicy(request.GetDeliverPolicy()),
+		LastN:         int(request.GetLastN()),
+		StartID:       int(request.GetStartId()),
+		StartTime:     time.Unix(0, request.GetStartTimeUnixMilli()*int64(time.Millisecond)),
+
+		Backpressure: broker.Backpressure(request.GetBackpressure()),
+		BufferSize:   int(request.GetBufferSize()),
+		BufferBytes:  int(request.GetBufferBytes()),
+		BlockTimeout: time.Duration(request.GetBlockTimeoutMillis()) * time.Millisecond,
+	})
 	if err != nil {
 		middleware.MethodCount.WithLabelValues("subscribe", "failed").Observe(float64(time.Since(startTime)))
-		return status.Errorf(codes.Unavailable, "Broker is closed ")
+		return subscribeStatus(err)
+	}
+	//	Tells the caller the subscription is made before any message, the
+	//	brokers that forward subscriptions wait for it
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
 	}
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -85,13 +217,27 @@ func (s ImplementedBrokerServer) Subscribe(request *proto.SubscribeRequest, stre
 			select {
 			case msg, ok := <-messageChan:
 				if !ok {
+					//	The broker closed the channel on shutdown, because the
+					//	subscriber was too slow or because an admin disconnected it
+					if s.shuttingDown() {
+						subErr = status.Errorf(codes.Unavailable, "Broker is shutting down")
+					} else if ctx.Err() == nil {
+						subErr = status.Errorf(codes.ResourceExhausted, "Slow subscriber disconnected")
+					}
 					return
 				}
-				go func(m broker.Message) {
-					if err := stream.Send(&(proto.MessageResponse{Body: []byte(m.Body)})); err != nil {
-						subErr = err
+				//	Sending in order keeps the backpressure of the subscriber
+				//	on the broker side instead of piling up here
+				if err := stream.Send(messageResponse(msg, request.GetAcceptEncodings())); err != nil {
+					subErr = err
+					subject := msg.Subject
+					if subject == "" {
+						subject = request.GetSubject()
 					}
-				}(msg)
+					deadLetterCtx := opentracing.ContextWithSpan(context.Background(), span)
+					_ = s.broker.DeadLetter(deadLetterCtx, subject, msg, broker.ReasonSendFailed, 1)
+					return
+				}
 			case <-ctx.Done():
 				return
 			}
@@ -107,6 +253,40 @@ func (s ImplementedBrokerServer) Subscribe(request *proto.SubscribeRequest, stre
 	return subErr
 }
 
+// deliverAt holds a published message back until the requested time or for
+// the requested delay, whichever ends later. A time that has passed
+// already sends the message right away.
+func deliverAt(atUnixMilli int64, delayMillis int64) time.Time {
+	now := time.Now()
+	at := time.Unix(0, atUnixMilli*int64(time.Millisecond))
+	if delayed := now.Add(time.Duration(delayMillis) * time.Millisecond); delayed.After(at) {
+		at = delayed
+	}
+	if !at.After(now) {
+		return time.Time{}
+	}
+	return at
+}
+
+// messageResponse decompresses the body unless the caller accepts its
+// encoding, a body that does not decompress is sent as it is stored.
+func messageResponse(msg broker.Message, accepted []string) *proto.MessageResponse {
+	if raw, err := compression.Decode(msg, accepted); err == nil {
+		msg = raw
+	}
+	response := &proto.MessageResponse{
+		Body:     []byte(msg.Body),
+		Id:       int32(msg.ID),
+		Subject:  msg.Subject,
+		Headers:  msg.Headers,
+		Encoding: msg.Encoding,
+	}
+	if !msg.Timestamp.IsZero() {
+		response.TimestampUnixMilli = msg.Timestamp.UnixNano() / int64(time.Millisecond)
+	}
+	return response
+}
+
 func (s ImplementedBrokerServer) Fetch(ctx context.Context, request *proto.FetchRequest) (*proto.MessageResponse, error) {
 	span, err := middleware.StartSpanFromGRPC(ctx, "Fetch gRPC Broker Server")
 	if err != nil {
@@ -117,23 +297,187 @@ func (s ImplementedBrokerServer) Fetch(ctx context.Context, request *proto.Fetch
 	defer span.Finish()
 
 	startTime := time.Now()
-	defer middleware.MethodDuration.WithLabelValues("fetch").Observe(float64(time.Since(startTime).Microseconds()))
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("fetch").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
 
 	message, err := s.broker.Fetch(spanCtx, request.GetSubject(), int(request.GetId()))
 	if err != nil {
 		middleware.MethodCount.WithLabelValues("fetch", "failed").Observe(float64(time.Since(startTime)))
+		return nil, fetchStatus(err)
+	}
+	response := messageResponse(message, request.GetAcceptEncodings())
+
+	middleware.MethodCount.WithLabelValues("fetch", "successful").Observe(float64(time.Since(startTime)))
+	return response, nil
+
+}
+
+func (s ImplementedBrokerServer) Ack(ctx context.Context, request *proto.AckRequest) (*proto.AckResponse, error) {
+	span, err := middleware.StartSpanFromGRPC(ctx, "Ack gRPC Broker Server")
+	if err != nil {
+		return nil, err
+	}
+	spanCtx := opentracing.ContextWithSpan(ctx, span)
+	defer span.Finish()
+
+	startTime := time.Now()
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("ack").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
+
+	err = s.broker.Ack(spanCtx, request.GetSubject(), request.GetConsumer(), int(request.GetId()))
+	if err != nil {
+		middleware.MethodCount.WithLabelValues("ack", "failed").Observe(float64(time.Since(startTime)))
 		switch err {
 		case broker.ErrUnavailable:
-			return nil, status.Errorf(codes.Unavailable, "Broker is closed")
-		case broker.ErrExpiredID:
-			return nil, status.Errorf(codes.InvalidArgument, "Expired Message")
+			return nil, brokerStatus(codes.Unavailable, broker.ErrUnavailable, "Broker is closed")
+		case broker.ErrUnknownConsumer:
+			return nil, brokerStatus(codes.NotFound, broker.ErrUnknownConsumer, "Unknown consumer")
 		case broker.ErrInvalidID:
-			return nil, status.Errorf(codes.InvalidArgument, "Invalid ID")
+			return nil, brokerStatus(codes.InvalidArgument, broker.ErrInvalidID, "Invalid ID")
+		default:
+			return nil, otherStatus(err)
 		}
 	}
-	response := &proto.MessageResponse{Body: []byte(message.Body)}
 
-	middleware.MethodCount.WithLabelValues("fetch", "successful").Observe(float64(time.Since(startTime)))
-	return response, nil
+	middleware.MethodCount.WithLabelValues("ack", "successful").Observe(float64(time.Since(startTime)))
+	return &proto.AckResponse{}, nil
+}
+
+func (s ImplementedBrokerServer) Request(ctx context.Context, request *proto.RequestRequest) (*proto.MessageResponse, error) {
+	span, err := middleware.StartSpanFromGRPC(ctx, "Request gRPC Broker Server")
+	if err != nil {
+		return nil, err
+	}
+	spanCtx := opentracing.ContextWithSpan(ctx, span)
+	defer span.Finish()
+
+	startTime := time.Now()
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("request").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
+
+	requestMessage := broker.Message{
+		Body:    string(request.GetBody()),
+		Headers: request.GetHeaders(),
+	}
+	timeout := time.Duration(request.GetTimeoutMillis()) * time.Millisecond
+
+	reply, err := s.broker.Request(spanCtx, request.GetSubject(), requestMessage, timeout)
+	if err != nil {
+		middleware.MethodCount.WithLabelValues("request", "failed").Observe(float64(time.Since(startTime)))
+		switch err {
+		case broker.ErrInvalidSubject:
+			return nil, brokerStatus(codes.InvalidArgument, broker.ErrInvalidSubject, "Invalid subject")
+		case broker.ErrNoResponders:
+			return nil, brokerStatus(codes.NotFound, broker.ErrNoResponders, "No responders")
+		case broker.ErrRequestTimeout:
+			return nil, brokerStatus(codes.DeadlineExceeded, broker.ErrRequestTimeout, "Request timed out")
+		default:
+			return nil, otherStatus(err)
+		}
+	}
+
+	middleware.MethodCount.WithLabelValues("request", "successful").Observe(float64(time.Since(startTime)))
+	return messageResponse(reply, request.GetAcceptEncodings()), nil
+}
+
+func (s ImplementedBrokerServer) SetDeadLetter(ctx context.Context, request *proto.SetDeadLetterRequest) (*proto.SetDeadLetterResponse, error) {
+	span, err := middleware.StartSpanFromGRPC(ctx, "SetDeadLetter gRPC Broker Server")
+	if err != nil {
+		return nil, err
+	}
+	spanCtx := opentracing.ContextWithSpan(ctx, span)
+	defer span.Finish()
+
+	startTime := time.Now()
+	defer func() {
+		middleware.MethodDuration.WithLabelValues("set_dead_letter").Observe(float64(time.Since(startTime).Microseconds()))
+	}()
+
+	err = s.broker.SetDeadLetter(spanCtx, request.GetSubject(), request.GetDeadLetterSubject())
+	if err != nil {
+		middleware.MethodCount.WithLabelValues("set_dead_letter", "failed").Observe(float64(time.Since(startTime)))
+		if err == broker.ErrInvalidSubject {
+			return nil, brokerStatus(codes.InvalidArgument, broker.ErrInvalidSubject, "Invalid subject")
+		}
+		return nil, otherStatus(err)
+	}
 
+	middleware.MethodCount.WithLabelValues("set_dead_letter", "successful").Observe(float64(time.Since(startTime)))
+	return &proto.SetDeadLetterResponse{}, nil
+}
+
+// The errors of the broker are mapped to their status by the functions
+// below, the gateway maps them the same way before turning them into HTTP.
+
+func publishStatus(err error) error {
+	switch err {
+	case broker.ErrInvalidSubject:
+		return brokerStatus(codes.InvalidArgument, broker.ErrInvalidSubject, "Invalid subject")
+	case broker.ErrSubjectFull:
+		return brokerStatus(codes.ResourceExhausted, broker.ErrSubjectFull, "Subject is full")
+	case broker.ErrInvalidEncoding:
+		return brokerStatus(codes.InvalidArgument, broker.ErrInvalidEncoding, "Invalid encoding")
+	}
+	return otherStatus(err)
+}
+
+func subscribeStatus(err error) error {
+	switch err {
+	case broker.ErrInvalidConsumer:
+		return brokerStatus(codes.InvalidArgument, broker.ErrInvalidConsumer, "Invalid consumer")
+	case broker.ErrInvalidOptions:
+		return brokerStatus(codes.InvalidArgument, broker.ErrInvalidOptions, "Invalid subscribe options")
+	case broker.ErrInvalidSubject:
+		return brokerStatus(codes.InvalidArgument, broker.ErrInvalidSubject, "Invalid subject")
+	}
+	return otherStatus(err)
+}
+
+func fetchStatus(err error) error {
+	switch err {
+	case broker.ErrExpiredID:
+		return brokerStatus(codes.InvalidArgument, broker.ErrExpiredID, "Expired Message")
+	case broker.ErrInvalidID:
+		return brokerStatus(codes.InvalidArgument, broker.ErrInvalidID, "Invalid ID")
+	}
+	return otherStatus(err)
+}
+
+// brokerStatus is the status of an error of the broker, its details name
+// the error so a broker that forwarded the call returns the same one.
+func brokerStatus(c codes.Code, err error, message string) error {
+	st, detailErr := status.New(c, message).WithDetails(&proto.ErrorDetail{Code: broker.ErrorCode(err)})
+	if detailErr != nil {
+		return status.Error(c, message)
+	}
+	return st.Err()
+}
+
+// committedStatus adds the ids of the messages of a batch committed before
+// it failed to its status.
+func committedStatus(err error, ids []int32) error {
+	st, detailErr := status.Convert(err).WithDetails(&proto.PublishBatchResponse{Ids: ids})
+	if detailErr != nil {
+		return err
+	}
+	return st.Err()
+}
+
+// otherStatus maps the errors every call can fail with: a closed broker,
+// a cancelled call, the status of a call forwarded to another broker, and
+// anything else, like a failing storage, as an internal error.
+func otherStatus(err error) error {
+	if err == broker.ErrUnavailable {
+		return brokerStatus(codes.Unavailable, broker.ErrUnavailable, "Broker is closed")
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Err()
+	}
+	return status.Error(codes.Internal, err.Error())
 }
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusShouldKeepCauseOfUnknownErrors(t *testing.T) {
+	assert.Equal(t, codes.Unavailable, status.Code(publishStatus(broker.ErrUnavailable)))
+	assert.Equal(t, codes.Canceled, status.Code(subscribeStatus(context.Canceled)))
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(fetchStatus(fmt.Errorf("fetch: %w", context.DeadlineExceeded))))
+	assert.Equal(t, codes.NotFound, status.Code(publishStatus(status.Error(codes.NotFound, "forwarded"))))
+
+	st := status.Convert(publishStatus(errors.New("connection refused")))
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Equal(t, "connection refused", st.Message())
+}
+
+func TestCommittedStatusShouldCarryTheIdsOfTheBatch(t *testing.T) {
+	st := status.Convert(committedStatus(publishStatus(broker.ErrSubjectFull), []int32{1, 2, 0}))
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	var ids []int32
+	var code string
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *proto.PublishBatchResponse:
+			ids = detail.GetIds()
+		case *proto.ErrorDetail:
+			code = detail.GetCode()
+		}
+	}
+	assert.Equal(t, []int32{1, 2, 0}, ids)
+	assert.Equal(t, broker.ErrorCode(broker.ErrSubjectFull), code)
+}
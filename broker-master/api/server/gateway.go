@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// keepAliveInterval is how often an idle event stream gets a comment, so
+// proxies do not close it
+const keepAliveInterval = 15 * time.Second
+
+// idempotencyKeyHeader carries the idempotency key of a publish
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Gateway serves the broker over HTTP with JSON bodies:
+//
+//	POST /subjects/{subject}/messages       publishes a message
+//	GET  /subjects/{subject}/messages/{id}  fetches a message
+//	GET  /subjects/{subject}/events         streams new messages as Server-Sent Events
+//	GET  /ws                                opens a WebSocket to publish and subscribe
+//
+// Errors are mapped to their status like on the gRPC server and then to
+// the matching HTTP status. Callers send their token in the Authorization
+// header, and the same grants and limits apply to them.
+type Gateway struct {
+	broker        broker.Broker
+	authenticator *Authenticator
+	limiter       *RateLimiter
+}
+
+// NewGateway returns the HTTP gateway of the broker, callers are anonymous
+// when authenticator is nil and unlimited when limiter is nil.
+func NewGateway(b broker.Broker, authenticator *Authenticator, limiter *RateLimiter) *Gateway {
+	return &Gateway{broker: b, authenticator: authenticator, limiter: limiter}
+}
+
+// publishJSON is the body of a publish, expirationSeconds of 0 does not
+// keep the message and deliverAtUnixMilli or delayMillis hold it back.
+// The idempotencyKey may also come in the Idempotency-Key header
+type publishJSON struct {
+	Body               string            `json:"body"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	ExpirationSeconds  int64             `json:"expirationSeconds,omitempty"`
+	DeliverAtUnixMilli int64             `json:"deliverAtUnixMilli,omitempty"`
+	DelayMillis        int64             `json:"delayMillis,omitempty"`
+	IdempotencyKey     string            `json:"idempotencyKey,omitempty"`
+}
+
+type publishedJSON struct {
+	ID int `json:"id"`
+}
+
+type messageJSON struct {
+	ID                 int               `json:"id"`
+	Subject            string            `json:"subject,omitempty"`
+	Body               string            `json:"body"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	TimestampUnixMilli int64             `json:"timestampUnixMilli,omitempty"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ws" {
+		g.route(w, r, http.MethodGet, func() { g.socket(w, r) })
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/subjects/") || parts[0] == "" || len(parts) < 2 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	subject := parts[0]
+
+	switch {
+	case len(parts) == 2 && parts[1] == "messages":
+		g.route(w, r, http.MethodPost, func() { g.publish(w, r, subject) })
+	case len(parts) == 3 && parts[1] == "messages":
+		g.route(w, r, http.MethodGet, func() { g.fetch(w, r, subject, parts[2]) })
+	case len(parts) == 2 && parts[1] == "events":
+		g.route(w, r, http.MethodGet, func() { g.events(w, r, subject) })
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (g *Gateway) route(w http.ResponseWriter, r *http.Request, method string, handle func()) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	handle()
+}
+
+func (g *Gateway) publish(w http.ResponseWriter, r *http.Request, subject string) {
+	var body publishJSON
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid body")
+		return
+	}
+
+	ctx, release, err := g.admit(r, &proto.PublishRequest{Subject: subject, Body: []byte(body.Body)})
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	defer release()
+
+	if body.IdempotencyKey == "" {
+		body.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+	}
+	id, err := g.broker.Publish(ctx, subject, broker.Message{
+		Body:           body.Body,
+		Headers:        body.Headers,
+		Expiration:     time.Duration(body.ExpirationSeconds) * time.Second,
+		DeliverAt:      deliverAt(body.DeliverAtUnixMilli, body.DelayMillis),
+		IdempotencyKey: body.IdempotencyKey,
+	})
+	if err != nil {
+		writeStatus(w, publishStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, publishedJSON{ID: id})
+}
+
+func (g *Gateway) fetch(w http.ResponseWriter, r *http.Request, subject string, rawID string) {
+	id, err := strconv.Atoi(rawID)
+	if err != nil {
+		writeStatus(w, fetchStatus(broker.ErrInvalidID))
+		return
+	}
+
+	ctx, release, err := g.admit(r, &proto.FetchRequest{Subject: subject, Id: int32(id)})
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	defer release()
+
+	msg, err := g.broker.Fetch(ctx, subject, id)
+	if err != nil {
+		writeStatus(w, fetchStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, newMessageJSON(msg))
+}
+
+// events streams the messages published on the subject from now on, a
+// reconnecting client that sends Last-Event-ID gets the stored messages it
+// missed first.
+func (g *Gateway) events(w http.ResponseWriter, r *http.Request, subject string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	opts := broker.SubscribeOptions{}
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		id, err := strconv.Atoi(lastID)
+		if err != nil {
+			writeStatus(w, subscribeStatus(broker.ErrInvalidOptions))
+			return
+		}
+		opts.DeliverPolicy, opts.StartID = broker.DeliverFromID, id+1
+	}
+
+	ctx, release, err := g.admit(r, &proto.SubscribeRequest{Subject: subject})
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages, err := g.broker.SubscribeWithOptions(ctx, subject, opts)
+	if err != nil {
+		writeStatus(w, subscribeStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(newMessageJSON(msg))
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", msg.ID, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// admit runs the checks of the gRPC interceptors on the request, release
+// gives back the subscription it holds once the request is done.
+func (g *Gateway) admit(r *http.Request, req interface{}) (context.Context, func(), error) {
+	ctx, err := g.authenticate(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := g.check(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, release, nil
+}
+
+// authenticate returns the context of the request with the peer and the
+// claims of the caller, like the gRPC server sees them.
+func (g *Gateway) authenticate(r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(auth.MetadataKey, authorization))
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+	}
+	if g.authenticator == nil {
+		return ctx, nil
+	}
+
+	claims, err := g.authenticator.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewContext(ctx, claims), nil
+}
+
+// check authorizes req for the caller authenticated in ctx and counts it
+// against the limits.
+func (g *Gateway) check(ctx context.Context, req interface{}) (func(), error) {
+	if g.authenticator != nil {
+		claims, _ := auth.FromContext(ctx)
+		if err := g.authenticator.authorize(claims, req); err != nil {
+			return nil, err
+		}
+	}
+
+	release := func() {}
+	if g.limiter == nil {
+		return release, nil
+	}
+	client, exempt := clientOf(ctx)
+	if exempt {
+		return release, nil
+	}
+	if subscribe, ok := req.(*proto.SubscribeRequest); ok {
+		if err := g.limiter.subscribe(client, subscribe.GetSubject()); err != nil {
+			return nil, err
+		}
+		return func() { g.limiter.unsubscribe(client, subscribe.GetSubject()) }, nil
+	}
+	if err := g.limiter.limit(client, req); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// newMessageJSON sends the bodies raw, a JSON string can not carry a
+// compressed one.
+func newMessageJSON(msg broker.Message) messageJSON {
+	if raw, err := compression.Decode(msg, nil); err == nil {
+		msg = raw
+	}
+	response := messageJSON{
+		ID:      msg.ID,
+		Subject: msg.Subject,
+		Body:    msg.Body,
+		Headers: msg.Headers,
+	}
+	if !msg.Timestamp.IsZero() {
+		response.TimestampUnixMilli = msg.Timestamp.UnixNano() / int64(time.Millisecond)
+	}
+	return response
+}
+
+// httpStatuses maps the codes the broker server returns to HTTP
+var httpStatuses = map[codes.Code]int{
+	codes.InvalidArgument:   http.StatusBadRequest,
+	codes.NotFound:          http.StatusNotFound,
+	codes.Unauthenticated:   http.StatusUnauthorized,
+	codes.PermissionDenied:  http.StatusForbidden,
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+	codes.DeadlineExceeded:  http.StatusGatewayTimeout,
+	codes.Unavailable:       http.StatusServiceUnavailable,
+	codes.Canceled:          http.StatusRequestTimeout,
+}
+
+func writeStatus(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code, ok := httpStatuses[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	writeError(w, code, strings.TrimSpace(st.Message()))
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, errorJSON{Error: message})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
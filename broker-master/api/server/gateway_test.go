@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	brokerModule "therealbroker/internal/broker"
+	"therealbroker/pkg/auth"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startGateway(t *testing.T, authenticator *Authenticator) *httptest.Server {
+	module := brokerModule.NewModule()
+	server := httptest.NewServer(NewGateway(module, authenticator, nil))
+	t.Cleanup(func() {
+		_ = module.Close()
+		server.Close()
+	})
+	return server
+}
+
+func publishOverHTTP(t *testing.T, server *httptest.Server, subject string, body string) (int, publishedJSON) {
+	response, err := http.Post(server.URL+"/subjects/"+subject+"/messages", "application/json", strings.NewReader(body))
+	assert.Nil(t, err)
+	defer response.Body.Close()
+
+	var published publishedJSON
+	_ = json.NewDecoder(response.Body).Decode(&published)
+	return response.StatusCode, published
+}
+
+func TestGatewayShouldPublishAndFetch(t *testing.T) {
+	server := startGateway(t, nil)
+
+	code, published := publishOverHTTP(t, server, "orders", `{"body": "hello", "headers": {"a": "b"}, "expirationSeconds": 10}`)
+	assert.Equal(t, http.StatusCreated, code)
+
+	response, err := http.Get(server.URL + "/subjects/orders/messages/" + strconv.Itoa(published.ID))
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	var msg messageJSON
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&msg))
+	assert.Equal(t, published.ID, msg.ID)
+	assert.Equal(t, "hello", msg.Body)
+	assert.Equal(t, map[string]string{"a": "b"}, msg.Headers)
+}
+
+func TestGatewayShouldMapErrors(t *testing.T) {
+	server := startGateway(t, nil)
+
+	code, _ := publishOverHTTP(t, server, "orders.*", `{"body": "hello"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = publishOverHTTP(t, server, "orders", `not json`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	for path, expected := range map[string]int{
+		"/subjects/orders/messages/42":  http.StatusBadRequest,
+		"/subjects/orders/messages/abc": http.StatusBadRequest,
+		"/subjects/orders/messages":     http.StatusMethodNotAllowed,
+		"/subjects/orders":              http.StatusNotFound,
+		"/other":                        http.StatusNotFound,
+	} {
+		response, err := http.Get(server.URL + path)
+		assert.Nil(t, err)
+		response.Body.Close()
+		assert.Equal(t, expected, response.StatusCode, path)
+	}
+}
+
+func TestGatewayShouldStreamEvents(t *testing.T) {
+	server := startGateway(t, nil)
+
+	response, err := http.Get(server.URL + "/subjects/orders/events")
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	_, published := publishOverHTTP(t, server, "orders", `{"body": "hello"}`)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	expected := []string{"id: " + strconv.Itoa(published.ID), "event: message"}
+	for _, line := range expected {
+		select {
+		case received := <-lines:
+			assert.Equal(t, line, received)
+		case <-time.After(time.Second):
+			assert.Fail(t, "Event was not streamed")
+			return
+		}
+	}
+	var msg messageJSON
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(<-lines, "data: ")), &msg))
+	assert.Equal(t, "hello", msg.Body)
+}
+
+func TestGatewayShouldAuthenticateCallers(t *testing.T) {
+	key := []byte("secret")
+	server := startGateway(t, NewAuthenticator(key, auth.ACL{
+		"team-a": {{Actions: []auth.Action{auth.ActionPublish}, Subjects: []string{"team-a.>"}}},
+	}))
+	token, _ := auth.SignToken(auth.Claims{Subject: "team-a"}, key)
+
+	publish := func(subject string, token string) int {
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/subjects/"+subject+"/messages", strings.NewReader(`{"body": "hello"}`))
+		if token != "" {
+			request.Header.Set("Authorization", auth.Bearer(token))
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, publish("team-a.orders", ""))
+	assert.Equal(t, http.StatusForbidden, publish("team-b.orders", token))
+	assert.Equal(t, http.StatusCreated, publish("team-a.orders", token))
+}
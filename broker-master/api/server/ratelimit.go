@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/middleware"
+	"therealbroker/pkg/ratelimit"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Limits are the limits of every client and of every subject, a zero
+// leaves the limit out.
+type Limits struct {
+	ClientPublishes      float64
+	ClientBytes          float64
+	ClientSubscriptions  int
+	SubjectPublishes     float64
+	SubjectBytes         float64
+	SubjectSubscriptions int
+}
+
+// RateLimiter limits the publishes and bytes a second and the concurrent
+// subscriptions of the callers, keyed by their identity and by subject.
+// Clients are told apart by the subject of their token, or by their
+// address when they are anonymous. The calls brokers make between them
+// were already counted by the broker the client called.
+type RateLimiter struct {
+	clientPublishes      *ratelimit.Limiter
+	clientBytes          *ratelimit.Limiter
+	clientSubscriptions  *ratelimit.Counter
+	subjectPublishes     *ratelimit.Limiter
+	subjectBytes         *ratelimit.Limiter
+	subjectSubscriptions *ratelimit.Counter
+}
+
+func NewRateLimiter(limits Limits) *RateLimiter {
+	return &RateLimiter{
+		clientPublishes:      ratelimit.NewLimiter(limits.ClientPublishes, 0),
+		clientBytes:          ratelimit.NewLimiter(limits.ClientBytes, 0),
+		clientSubscriptions:  ratelimit.NewCounter(limits.ClientSubscriptions),
+		subjectPublishes:     ratelimit.NewLimiter(limits.SubjectPublishes, 0),
+		subjectBytes:         ratelimit.NewLimiter(limits.SubjectBytes, 0),
+		subjectSubscriptions: ratelimit.NewCounter(limits.SubjectSubscriptions),
+	}
+}
+
+func (r *RateLimiter) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		client, exempt := clientOf(ctx)
+		if !exempt {
+			if err := r.limit(client, req); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (r *RateLimiter) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		client, exempt := clientOf(ss.Context())
+		if exempt {
+			return handler(srv, ss)
+		}
+		stream := &limitedStream{ServerStream: ss, limiter: r, client: client}
+		defer stream.release()
+		return handler(srv, stream)
+	}
+}
+
+// limitedStream checks every message received on a stream, like each
+// publish of a batch, and holds the subscription of the stream until the
+// stream ends.
+type limitedStream struct {
+	grpc.ServerStream
+	limiter  *RateLimiter
+	client   string
+	subjects []string
+	sync.Mutex
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if req, ok := m.(*proto.SubscribeRequest); ok {
+		if err := s.limiter.subscribe(s.client, req.GetSubject()); err != nil {
+			return err
+		}
+		s.Lock()
+		s.subjects = append(s.subjects, req.GetSubject())
+		s.Unlock()
+		return nil
+	}
+	return s.limiter.limit(s.client, m)
+}
+
+func (s *limitedStream) release() {
+	s.Lock()
+	defer s.Unlock()
+	for _, subject := range s.subjects {
+		s.limiter.unsubscribe(s.client, subject)
+	}
+	s.subjects = nil
+}
+
+// limit counts the publishes of a request against the limits of the client
+// and of the subject, the other requests are not limited.
+func (r *RateLimiter) limit(client string, req interface{}) error {
+	switch req := req.(type) {
+	case *proto.PublishRequest:
+		return r.publish(client, req.GetSubject(), len(req.GetBody()))
+	case *proto.RequestRequest:
+		return r.publish(client, req.GetSubject(), len(req.GetBody()))
+	}
+	return nil
+}
+
+// publish takes the tokens of a publish from every limit, or from none of
+// them when one of the limits is reached.
+func (r *RateLimiter) publish(client string, subject string, size int) error {
+	takes := []struct {
+		limit   string
+		limiter *ratelimit.Limiter
+		key     string
+		n       float64
+	}{
+		{"client_publishes", r.clientPublishes, client, 1},
+		{"client_bytes", r.clientBytes, client, float64(size)},
+		{"subject_publishes", r.subjectPublishes, subject, 1},
+		{"subject_bytes", r.subjectBytes, subject, float64(size)},
+	}
+	for i, take := range takes {
+		if take.limiter.Allow(take.key, take.n) {
+			continue
+		}
+		for _, taken := range takes[:i] {
+			taken.limiter.Refund(taken.key, taken.n)
+		}
+		return rateLimited(take.limit)
+	}
+	return nil
+}
+
+func (r *RateLimiter) subscribe(client string, subject string) error {
+	if !r.clientSubscriptions.Acquire(client) {
+		return rateLimited("client_subscriptions")
+	}
+	if !r.subjectSubscriptions.Acquire(subject) {
+		r.clientSubscriptions.Release(client)
+		return rateLimited("subject_subscriptions")
+	}
+	return nil
+}
+
+func (r *RateLimiter) unsubscribe(client string, subject string) {
+	r.clientSubscriptions.Release(client)
+	r.subjectSubscriptions.Release(subject)
+}
+
+func rateLimited(limit string) error {
+	middleware.RateLimitedCalls.WithLabelValues(limit).Inc()
+	return status.Errorf(codes.ResourceExhausted, "Rate limit exceeded")
+}
+
+// clientOf returns the identity the limits of a call are kept for, exempt
+// is true for the calls of other brokers.
+func clientOf(ctx context.Context) (client string, exempt bool) {
+	if claims, ok := auth.FromContext(ctx); ok {
+		return claims.Subject, claims.Peer
+	}
+	//	Without authentication the brokers can only be told by the mark of
+	//	the calls they forward
+	if middleware.Forwarded(ctx) {
+		return "", true
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host, false
+		}
+		return p.Addr.String(), false
+	}
+	return "anonymous", false
+}
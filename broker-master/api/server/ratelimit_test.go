@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/middleware"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func publishAs(r *RateLimiter, ctx context.Context, subject string, body string) codes.Code {
+	_, err := r.UnaryInterceptor()(ctx, &proto.PublishRequest{Subject: subject, Body: []byte(body)}, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	return status.Code(err)
+}
+
+func TestRateLimiterShouldLimitClientsAndSubjects(t *testing.T) {
+	r := NewRateLimiter(Limits{ClientPublishes: 2, SubjectPublishes: 3})
+	alice := auth.NewContext(context.Background(), auth.Claims{Subject: "alice"})
+	bob := auth.NewContext(context.Background(), auth.Claims{Subject: "bob"})
+
+	assert.Equal(t, codes.OK, publishAs(r, alice, "orders", "a"))
+	assert.Equal(t, codes.OK, publishAs(r, alice, "orders", "a"))
+	assert.Equal(t, codes.ResourceExhausted, publishAs(r, alice, "payments", "a"))
+
+	assert.Equal(t, codes.OK, publishAs(r, bob, "orders", "a"))
+	assert.Equal(t, codes.ResourceExhausted, publishAs(r, bob, "orders", "a"))
+	assert.Equal(t, codes.OK, publishAs(r, bob, "payments", "a"))
+}
+
+func TestRateLimiterShouldLimitBytes(t *testing.T) {
+	r := NewRateLimiter(Limits{ClientBytes: 10})
+	ctx := auth.NewContext(context.Background(), auth.Claims{Subject: "alice"})
+
+	assert.Equal(t, codes.OK, publishAs(r, ctx, "orders", "0123456789"))
+	assert.Equal(t, codes.ResourceExhausted, publishAs(r, ctx, "orders", "0"))
+}
+
+func TestRateLimiterShouldNotLimitBrokers(t *testing.T) {
+	r := NewRateLimiter(Limits{ClientPublishes: 1})
+	peer := auth.NewContext(context.Background(), auth.Claims{Subject: "broker", Peer: true})
+	forwarded := metadata.NewIncomingContext(context.Background(), metadata.Pairs(middleware.ForwardedKey, "broker-0:8080"))
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, codes.OK, publishAs(r, peer, "orders", "a"))
+		assert.Equal(t, codes.OK, publishAs(r, forwarded, "orders", "a"))
+	}
+}
+
+type subscribeStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	subject string
+}
+
+func (s *subscribeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *subscribeStream) RecvMsg(m interface{}) error {
+	m.(*proto.SubscribeRequest).Subject = s.subject
+	return nil
+}
+
+func TestRateLimiterShouldLimitConcurrentSubscriptions(t *testing.T) {
+	r := NewRateLimiter(Limits{ClientSubscriptions: 1})
+	ctx := auth.NewContext(context.Background(), auth.Claims{Subject: "alice"})
+
+	subscribed := make(chan struct{})
+	unsubscribe := make(chan struct{})
+	done := make(chan error)
+	subscribe := func(held chan struct{}) error {
+		return r.StreamInterceptor()(nil, &subscribeStream{ctx: ctx, subject: "orders"}, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+			if err := stream.RecvMsg(&proto.SubscribeRequest{}); err != nil {
+				return err
+			}
+			if held != nil {
+				close(subscribed)
+				<-held
+			}
+			return nil
+		})
+	}
+
+	go func() {
+		done <- subscribe(unsubscribe)
+	}()
+	<-subscribed
+	assert.Equal(t, codes.ResourceExhausted, status.Code(subscribe(nil)))
+
+	close(unsubscribe)
+	assert.NoError(t, <-done)
+	assert.NoError(t, subscribe(nil))
+}
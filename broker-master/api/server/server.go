@@ -7,11 +7,25 @@ import (
 	"google.golang.org/grpc"
 )
 
-func NewBrokerServer(brokerServer proto.BrokerServer) *grpc.Server {
+// NewBrokerServer returns the gRPC server of the broker, callers are
+// anonymous when authenticator is nil and unlimited when limiter is nil.
+func NewBrokerServer(brokerServer proto.BrokerServer, authenticator *Authenticator, limiter *RateLimiter) *grpc.Server {
 	grpcMetrics := grpc_prometheus.NewServerMetrics()
+	unary := []grpc.UnaryServerInterceptor{grpcMetrics.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{grpcMetrics.StreamServerInterceptor()}
+	if authenticator != nil {
+		unary = append(unary, authenticator.UnaryInterceptor())
+		stream = append(stream, authenticator.StreamInterceptor())
+	}
+	//	Limits come after authentication, they are kept by the identity of
+	//	the caller
+	if limiter != nil {
+		unary = append(unary, limiter.UnaryInterceptor())
+		stream = append(stream, limiter.StreamInterceptor())
+	}
 	grpcServer := grpc.NewServer(
-		grpc.UnaryInterceptor(grpcMetrics.UnaryServerInterceptor()),
-		grpc.StreamInterceptor(grpcMetrics.StreamServerInterceptor()),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
 	)
 	grpc_prometheus.Register(grpcServer)
 	proto.RegisterBrokerServer(grpcServer, brokerServer)
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/status"
+)
+
+// Frame types of the WebSocket protocol. Clients send subscribe,
+// unsubscribe and publish frames, the gateway answers each of them with
+// subscribed, unsubscribed, published or error and sends message frames
+// for every subscription of the socket.
+const (
+	frameSubscribe    = "subscribe"
+	frameUnsubscribe  = "unsubscribe"
+	framePublish      = "publish"
+	frameSubscribed   = "subscribed"
+	frameUnsubscribed = "unsubscribed"
+	framePublished    = "published"
+	frameMessage      = "message"
+	frameError        = "error"
+)
+
+// frameJSON is a frame of the WebSocket protocol in either direction. ID
+// is picked by the client, it names a subscription of the socket or is
+// echoed in the answer of a publish.
+type frameJSON struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// Group of a subscribe
+	Group string `json:"group,omitempty"`
+	// Body, Headers, ExpirationSeconds, the delay and the idempotency key
+	// of a publish
+	Body               string            `json:"body,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	ExpirationSeconds  int64             `json:"expirationSeconds,omitempty"`
+	DeliverAtUnixMilli int64             `json:"deliverAtUnixMilli,omitempty"`
+	DelayMillis        int64             `json:"delayMillis,omitempty"`
+	IdempotencyKey     string            `json:"idempotencyKey,omitempty"`
+	// Message of a message frame, or only its ID once it is published
+	Message *messageJSON `json:"message,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// socket is a WebSocket connection of the gateway with its subscriptions,
+// they all end when the connection closes.
+type socket struct {
+	gateway *Gateway
+	conn    *websocket.Conn
+	// ctx carries the caller and is done once the connection closes
+	ctx context.Context
+
+	writes sync.Mutex
+
+	mu            sync.Mutex
+	subscriptions map[string]context.CancelFunc
+	relays        sync.WaitGroup
+}
+
+// socket upgrades the request to a WebSocket once the caller is
+// authenticated. Browsers can not set headers on a WebSocket, so the token
+// may be sent in the token query parameter as well.
+func (g *Gateway) socket(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", auth.Bearer(token))
+	}
+	ctx, err := g.authenticate(r)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+
+	//	The handshake of websocket.Server does not check the origin, the
+	//	token is what protects the socket
+	websocket.Server{Handler: func(conn *websocket.Conn) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		s := &socket{gateway: g, conn: conn, ctx: ctx, subscriptions: map[string]context.CancelFunc{}}
+		s.serve()
+		cancel()
+		s.relays.Wait()
+	}}.ServeHTTP(w, r)
+}
+
+func (s *socket) serve() {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(s.conn, &data); err != nil {
+			return
+		}
+		var frame frameJSON
+		if err := json.Unmarshal(data, &frame); err != nil {
+			s.send(frameJSON{Type: frameError, Error: "Invalid frame"})
+			continue
+		}
+
+		switch frame.Type {
+		case frameSubscribe:
+			s.subscribe(frame)
+		case frameUnsubscribe:
+			s.unsubscribe(frame)
+		case framePublish:
+			s.publish(frame)
+		default:
+			s.send(frameJSON{Type: frameError, ID: frame.ID, Error: "Unknown frame type"})
+		}
+	}
+}
+
+func (s *socket) subscribe(frame frameJSON) {
+	s.mu.Lock()
+	_, taken := s.subscriptions[frame.ID]
+	s.mu.Unlock()
+	if frame.ID == "" || taken {
+		s.send(frameJSON{Type: frameError, ID: frame.ID, Error: "Subscriptions need an id that is not taken on the socket"})
+		return
+	}
+
+	release, err := s.gateway.check(s.ctx, &proto.SubscribeRequest{Subject: frame.Subject, Group: frame.Group})
+	if err != nil {
+		s.fail(frame.ID, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	messages, err := s.gateway.broker.SubscribeWithOptions(ctx, frame.Subject, broker.SubscribeOptions{Group: frame.Group})
+	if err != nil {
+		cancel()
+		release()
+		s.fail(frame.ID, subscribeStatus(err))
+		return
+	}
+
+	s.mu.Lock()
+	s.subscriptions[frame.ID] = cancel
+	s.mu.Unlock()
+	s.send(frameJSON{Type: frameSubscribed, ID: frame.ID, Subject: frame.Subject})
+
+	s.relays.Add(1)
+	go func() {
+		defer s.relays.Done()
+		defer release()
+		for msg := range messages {
+			msg := newMessageJSON(msg)
+			s.send(frameJSON{Type: frameMessage, ID: frame.ID, Message: &msg})
+		}
+
+		//	The broker ends the subscription when it closes, the client is
+		//	told unless it asked for it
+		s.mu.Lock()
+		_, open := s.subscriptions[frame.ID]
+		delete(s.subscriptions, frame.ID)
+		s.mu.Unlock()
+		if open && s.ctx.Err() == nil {
+			s.send(frameJSON{Type: frameError, ID: frame.ID, Error: "Subscription ended"})
+		}
+		cancel()
+	}()
+}
+
+func (s *socket) unsubscribe(frame frameJSON) {
+	s.mu.Lock()
+	cancel, ok := s.subscriptions[frame.ID]
+	delete(s.subscriptions, frame.ID)
+	s.mu.Unlock()
+	if !ok {
+		s.send(frameJSON{Type: frameError, ID: frame.ID, Error: "Unknown subscription"})
+		return
+	}
+	cancel()
+	s.send(frameJSON{Type: frameUnsubscribed, ID: frame.ID})
+}
+
+func (s *socket) publish(frame frameJSON) {
+	release, err := s.gateway.check(s.ctx, &proto.PublishRequest{Subject: frame.Subject, Body: []byte(frame.Body)})
+	if err != nil {
+		s.fail(frame.ID, err)
+		return
+	}
+	defer release()
+
+	id, err := s.gateway.broker.Publish(s.ctx, frame.Subject, broker.Message{
+		Body:           frame.Body,
+		Headers:        frame.Headers,
+		Expiration:     time.Duration(frame.ExpirationSeconds) * time.Second,
+		DeliverAt:      deliverAt(frame.DeliverAtUnixMilli, frame.DelayMillis),
+		IdempotencyKey: frame.IdempotencyKey,
+	})
+	if err != nil {
+		s.fail(frame.ID, publishStatus(err))
+		return
+	}
+	s.send(frameJSON{Type: framePublished, ID: frame.ID, Subject: frame.Subject, Message: &messageJSON{ID: id}})
+}
+
+func (s *socket) fail(id string, err error) {
+	s.send(frameJSON{Type: frameError, ID: id, Error: strings.TrimSpace(status.Convert(err).Message())})
+}
+
+// send writes the frame, the relays of the subscriptions and the answers
+// share the connection. Failed writes are left to the read loop, which
+// ends once the connection is gone.
+func (s *socket) send(frame frameJSON) {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+	_ = websocket.JSON.Send(s.conn, frame)
+}
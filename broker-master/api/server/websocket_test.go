@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	brokerModule "therealbroker/internal/broker"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func dialSocket(t *testing.T, url string) *websocket.Conn {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(url, "http"), "", "http://localhost/")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, frame frameJSON) {
+	assert.Nil(t, websocket.JSON.Send(conn, frame))
+}
+
+func receiveFrame(t *testing.T, conn *websocket.Conn) frameJSON {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame frameJSON
+	assert.Nil(t, websocket.JSON.Receive(conn, &frame))
+	return frame
+}
+
+func TestSocketShouldPublishAndSubscribe(t *testing.T) {
+	server := startGateway(t, nil)
+	conn := dialSocket(t, server.URL+"/ws")
+
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "orders", Subject: "orders.*"})
+	assert.Equal(t, frameJSON{Type: frameSubscribed, ID: "orders", Subject: "orders.*"}, receiveFrame(t, conn))
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "users", Subject: "users"})
+	assert.Equal(t, frameSubscribed, receiveFrame(t, conn).Type)
+
+	sendFrame(t, conn, frameJSON{Type: framePublish, ID: "p1", Subject: "orders.new", Body: "hello", Headers: map[string]string{"a": "b"}})
+	sendFrame(t, conn, frameJSON{Type: framePublish, ID: "p2", Subject: "users", Body: "alice"})
+
+	//	The answers and the messages of both subscriptions share the socket
+	got := map[string]frameJSON{}
+	for i := 0; i < 4; i++ {
+		frame := receiveFrame(t, conn)
+		got[frame.Type+"/"+frame.ID] = frame
+	}
+	published := got[framePublished+"/p1"]
+	assert.NotNil(t, published.Message)
+	order := got[frameMessage+"/orders"]
+	assert.NotNil(t, order.Message)
+	assert.Equal(t, published.Message.ID, order.Message.ID)
+	assert.Equal(t, "orders.new", order.Message.Subject)
+	assert.Equal(t, "hello", order.Message.Body)
+	assert.Equal(t, map[string]string{"a": "b"}, order.Message.Headers)
+	assert.Equal(t, "alice", got[frameMessage+"/users"].Message.Body)
+	assert.Contains(t, got, framePublished+"/p2")
+}
+
+func TestSocketShouldUnsubscribe(t *testing.T) {
+	server := startGateway(t, nil)
+	conn := dialSocket(t, server.URL+"/ws")
+
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "orders", Subject: "orders"})
+	assert.Equal(t, frameSubscribed, receiveFrame(t, conn).Type)
+	sendFrame(t, conn, frameJSON{Type: frameUnsubscribe, ID: "orders"})
+	assert.Equal(t, frameJSON{Type: frameUnsubscribed, ID: "orders"}, receiveFrame(t, conn))
+
+	//	Only the answer of the publish comes back
+	sendFrame(t, conn, frameJSON{Type: framePublish, ID: "p1", Subject: "orders", Body: "hello"})
+	assert.Equal(t, framePublished, receiveFrame(t, conn).Type)
+	sendFrame(t, conn, frameJSON{Type: frameUnsubscribe, ID: "orders"})
+	assert.Equal(t, frameJSON{Type: frameError, ID: "orders", Error: "Unknown subscription"}, receiveFrame(t, conn))
+}
+
+func TestSocketShouldReportInvalidFrames(t *testing.T) {
+	server := startGateway(t, nil)
+	conn := dialSocket(t, server.URL+"/ws")
+
+	assert.Nil(t, websocket.Message.Send(conn, "not json"))
+	assert.Equal(t, frameJSON{Type: frameError, Error: "Invalid frame"}, receiveFrame(t, conn))
+
+	sendFrame(t, conn, frameJSON{Type: "ping", ID: "1"})
+	assert.Equal(t, frameError, receiveFrame(t, conn).Type)
+
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, Subject: "orders"})
+	assert.Equal(t, frameError, receiveFrame(t, conn).Type)
+
+	sendFrame(t, conn, frameJSON{Type: framePublish, ID: "p1", Subject: "orders.*", Body: "hello"})
+	frame := receiveFrame(t, conn)
+	assert.Equal(t, frameError, frame.Type)
+	assert.Equal(t, "p1", frame.ID)
+}
+
+func TestSocketShouldEndSubscriptionsOnClose(t *testing.T) {
+	module := brokerModule.NewModule()
+	admin := module.(broker.Admin)
+	server := httptest.NewServer(NewGateway(module, nil, nil))
+	t.Cleanup(func() {
+		_ = module.Close()
+		server.Close()
+	})
+	conn := dialSocket(t, server.URL+"/ws")
+
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "a", Subject: "orders"})
+	assert.Equal(t, frameSubscribed, receiveFrame(t, conn).Type)
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "b", Subject: "orders"})
+	assert.Equal(t, frameSubscribed, receiveFrame(t, conn).Type)
+	subscribers, err := admin.Subscribers(context.Background(), "orders")
+	assert.Nil(t, err)
+	assert.Len(t, subscribers, 2)
+
+	assert.Nil(t, conn.Close())
+	assert.Eventually(t, func() bool {
+		subscribers, _ := admin.Subscribers(context.Background(), "orders")
+		return len(subscribers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSocketShouldAuthenticateCallers(t *testing.T) {
+	key := []byte("secret")
+	server := startGateway(t, NewAuthenticator(key, auth.ACL{
+		"team-a": {{Actions: []auth.Action{auth.ActionPublish, auth.ActionSubscribe}, Subjects: []string{"team-a.>"}}},
+	}))
+	token, _ := auth.SignToken(auth.Claims{Subject: "team-a"}, key)
+
+	response, err := http.Get(server.URL + "/ws")
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	//	Browsers send the token in the query
+	conn := dialSocket(t, server.URL+"/ws?token="+token)
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "b", Subject: "team-b.orders"})
+	assert.Equal(t, frameError, receiveFrame(t, conn).Type)
+	sendFrame(t, conn, frameJSON{Type: frameSubscribe, ID: "a", Subject: "team-a.orders"})
+	assert.Equal(t, frameSubscribed, receiveFrame(t, conn).Type)
+	sendFrame(t, conn, frameJSON{Type: framePublish, ID: "p1", Subject: "team-b.orders", Body: "hello"})
+	assert.Equal(t, frameError, receiveFrame(t, conn).Type)
+}
@@ -4,8 +4,11 @@ var cfg *Config
 
 type Config struct {
 	Broker struct {
-		Port        int    `env:"APPLICATION_PORT" env-deafult:"8081" env-description:"Broker app port for gRPC"`
-		StorageType string `env:"STORAGE_TYPE" env-deafult:"NOT_PERSISTED" env-description:"it must be one of (POSTGRES, CASSANDRA, NOT_PERSISTED)"`
+		Port            int    `env:"APPLICATION_PORT" env-deafult:"8081" env-description:"Broker app port for gRPC"`
+		StorageType     string `env:"STORAGE_TYPE" env-deafult:"NOT_PERSISTED" env-description:"it must be one of (POSTGRES, CASSANDRA, SCYLLA, FILE_LOG, NOT_PERSISTED)"`
+		GatewayPort     int    `env:"GATEWAY_PORT" env-default:"8082" env-description:"Broker app port for the HTTP/JSON gateway"`
+		ShutdownTimeout int    `env:"SHUTDOWN_TIMEOUT_SECONDS" env-default:"10" env-description:"How long open calls get to finish on shutdown"`
+		DedupWindow     int    `env:"DEDUP_WINDOW_SECONDS" env-default:"120" env-description:"How long the idempotency keys of the publishes are remembered, 0 turns deduplication off"`
 	}
 
 	PostgresDB struct {
@@ -20,6 +23,56 @@ type Config struct {
 		Port int `env:"APPLICATION_PROM_PORT" env-deafult:"9091" env-description:"Defined metrics for each RPC"`
 	}
 
+	Cluster struct {
+		NodeID            string `env:"CLUSTER_NODE_ID" env-description:"Id of this broker within the cluster, the pod name in the StatefulSet"`
+		Peers             string `env:"CLUSTER_PEERS" env-description:"Members of the cluster as id=host:port separated by commas, empty runs a broker of its own"`
+		ElectionTimeout   int    `env:"CLUSTER_ELECTION_TIMEOUT_MILLIS" env-default:"300" env-description:"How long followers wait for the leader before an election"`
+		HeartbeatInterval int    `env:"CLUSTER_HEARTBEAT_INTERVAL_MILLIS" env-default:"50" env-description:"How often the leader sends its heartbeat"`
+		ProposeTimeout    int    `env:"CLUSTER_PROPOSE_TIMEOUT_MILLIS" env-default:"5000" env-description:"How long a publish waits for a quorum"`
+		Dir               string `env:"CLUSTER_DIR" env-default:"./data/raft" env-description:"Directory that keeps the term, vote and log of the broker in the cluster"`
+		Groups            int    `env:"CLUSTER_GROUPS" env-default:"4" env-description:"Raft groups the subjects are spread over, each elects a leader of its own. Every broker must run the same number"`
+	}
+
+	Sharding struct {
+		Self            string `env:"SHARD_SELF" env-description:"Address of this broker as the other shards reach it, e.g. the pod ip with the broker port"`
+		Peers           string `env:"SHARD_PEERS" env-description:"Addresses of the shards as host:port separated by commas"`
+		DNSName         string `env:"SHARD_DNS_NAME" env-description:"DNS name the shards are discovered by instead of SHARD_PEERS, e.g. a headless service"`
+		RefreshInterval int    `env:"SHARD_REFRESH_INTERVAL_SECONDS" env-default:"10" env-description:"How often the shards are discovered again"`
+	}
+
+	Auth struct {
+		SigningKey string `env:"AUTH_SIGNING_KEY" env-description:"Key the HS256 tokens of the callers are signed with, empty accepts anonymous callers"`
+		ACLFile    string `env:"AUTH_ACL_FILE" env-description:"JSON file with the subjects every identity may publish, subscribe or fetch"`
+	}
+
+	RateLimit struct {
+		ClientPublishes      float64 `env:"RATE_LIMIT_CLIENT_PUBLISHES" env-default:"0" env-description:"Publishes a second of every client, 0 is unlimited"`
+		ClientBytes          float64 `env:"RATE_LIMIT_CLIENT_BYTES" env-default:"0" env-description:"Published bytes a second of every client, 0 is unlimited"`
+		ClientSubscriptions  int     `env:"RATE_LIMIT_CLIENT_SUBSCRIPTIONS" env-default:"0" env-description:"Concurrent subscriptions of every client, 0 is unlimited"`
+		SubjectPublishes     float64 `env:"RATE_LIMIT_SUBJECT_PUBLISHES" env-default:"0" env-description:"Publishes a second on every subject, 0 is unlimited"`
+		SubjectBytes         float64 `env:"RATE_LIMIT_SUBJECT_BYTES" env-default:"0" env-description:"Published bytes a second on every subject, 0 is unlimited"`
+		SubjectSubscriptions int     `env:"RATE_LIMIT_SUBJECT_SUBSCRIPTIONS" env-default:"0" env-description:"Concurrent subscriptions of every subject, 0 is unlimited"`
+	}
+
+	Retention struct {
+		MaxMessages int    `env:"RETENTION_MAX_MESSAGES" env-default:"0" env-description:"Messages every subject keeps, 0 is unlimited"`
+		MaxBytes    int64  `env:"RETENTION_MAX_BYTES" env-default:"0" env-description:"Bytes of message bodies every subject keeps as they are stored, sealed ones included, 0 is unlimited"`
+		MaxAge      int    `env:"RETENTION_MAX_AGE_SECONDS" env-default:"0" env-description:"How long every subject keeps its messages, 0 is unlimited"`
+		Policy      string `env:"RETENTION_POLICY" env-default:"DISCARD_OLD" env-description:"it must be one of (DISCARD_OLD, REJECT_NEW), what a subject does once it reaches a limit"`
+		File        string `env:"RETENTION_FILE" env-description:"JSON file with the limits of single subjects, in place of the ones above"`
+		Interval    int    `env:"RETENTION_INTERVAL_SECONDS" env-default:"60" env-description:"How often the limits are enforced on the stored messages"`
+	}
+
+	Compression struct {
+		Encoding string `env:"COMPRESSION_ENCODING" env-description:"it must be empty or snappy, how the bodies of every subject are compressed"`
+		File     string `env:"COMPRESSION_FILE" env-description:"JSON file with the encoding of single subjects, in place of the one above"`
+		MinBytes int    `env:"COMPRESSION_MIN_BYTES" env-default:"512" env-description:"Smallest body that is compressed"`
+	}
+
+	Encryption struct {
+		KeyringFile string `env:"ENCRYPTION_KEYRING_FILE" env-description:"JSON file with the keys the stored bodies are sealed with and the active one, empty stores them in plaintext"`
+	}
+
 	Jaeger struct {
 		ServiceName string `env:"JAEGER_SERVICE" env-deafult:"brokerService" env-description:"Jaeger service name for Golang client"`
 		Host        string `env:"JAEGER_HOST" env-default:"localhost" env-description:"Jaeger host for service"`
@@ -47,6 +100,12 @@ type Config struct {
 		TimeThreshold int    `env:"SCYLLA_TIME" env-default:"10" env-description:"Scylla time ticker for batch threshold"`
 	}
 
+	FileLog struct {
+		Dir          string `env:"FILELOG_DIR" env-default:"./data/broker" env-description:"Directory that keeps the append-only log segments"`
+		SegmentSize  int64  `env:"FILELOG_SEGMENT_SIZE" env-default:"67108864" env-description:"Maximum size of a log segment in bytes before rolling to a new one"`
+		SyncInterval int    `env:"FILELOG_SYNC_INTERVAL" env-default:"1000" env-description:"File log fsync interval in milliseconds"`
+	}
+
 	Graylog struct {
 	}
 }
@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"sync"
+	"therealbroker/pkg/broker"
+	"time"
+)
+
+// ackKey names a message of the subscriber, messages of wildcard
+// subscriptions carry their subject and the others leave it empty.
+type ackKey struct {
+	subject string
+	id      int
+}
+
+// inFlight is a message that has been handed to an acknowledged
+// subscriber and is waiting for its ack.
+type inFlight struct {
+	msg        broker.Message
+	deliveries int
+	deadline   time.Time
+}
+
+// ackTracker keeps the unacked messages of one subscriber and sends them
+// again once their ack wait is over.
+type ackTracker struct {
+	ackWait    time.Duration
+	maxDeliver int
+	pending    map[ackKey]*inFlight
+	stop       chan struct{}
+	// onGiveUp gets the messages that reached MaxDeliver
+	onGiveUp func(msg broker.Message, deliveries int)
+	sync.Mutex
+}
+
+func newAckTracker(opts broker.SubscribeOptions) *ackTracker {
+	return &ackTracker{
+		ackWait:    opts.AckWait,
+		maxDeliver: opts.MaxDeliver,
+		pending:    make(map[ackKey]*inFlight),
+		stop:       make(chan struct{}),
+	}
+}
+
+// track records the message before it is sent, so an ack can not arrive
+// before the message is tracked.
+func (t *ackTracker) track(msg broker.Message) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.pending[ackKey{subject: msg.Subject, id: msg.ID}] = &inFlight{
+		msg:      msg,
+		deadline: time.Now().Add(t.ackWait),
+	}
+}
+
+// delivered counts the delivery attempt of a tracked message, keep decides
+// whether a message that was not sent is still sent again later.
+func (t *ackTracker) delivered(msg broker.Message, sent bool, keep bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := ackKey{subject: msg.Subject, id: msg.ID}
+	tracked, ok := t.pending[key]
+	switch {
+	case !ok:
+	case sent:
+		tracked.deliveries++
+	case !keep:
+		delete(t.pending, key)
+	}
+}
+
+// ack takes the subject the message was published on when the subscriber
+// has a wildcard subject, and an empty one otherwise.
+func (t *ackTracker) ack(subject string, id int) error {
+	t.Lock()
+	defer t.Unlock()
+
+	key := ackKey{subject: subject, id: id}
+	if _, ok := t.pending[key]; !ok {
+		return broker.ErrInvalidID
+	}
+	delete(t.pending, key)
+	return nil
+}
+
+// redeliver sends every message whose ack wait is over once more. Messages
+// that reached MaxDeliver are given up on.
+func (t *ackTracker) redeliver(sub *Subscriber) {
+	ticker := time.NewTicker(t.ackWait / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.Lock()
+			for key, msg := range t.pending {
+				if now.Before(msg.deadline) {
+					continue
+				}
+				if t.maxDeliver > 0 && msg.deliveries >= t.maxDeliver {
+					delete(t.pending, key)
+					if t.onGiveUp != nil {
+						t.onGiveUp(msg.msg, msg.deliveries)
+					}
+					continue
+				}
+				if sub.buffer.offer(msg.msg, false) == offerSent {
+					msg.deliveries++
+				}
+				msg.deadline = now.Add(t.ackWait)
+			}
+			t.Unlock()
+		}
+	}
+}
+
+func (t *ackTracker) unacked() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.pending)
+}
@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"therealbroker/pkg/broker"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Subjects merges the stored messages of the storage with the subscribers
+// of the queues. The subjects are sorted.
+func (m *Module) Subjects(ctx context.Context) ([]broker.SubjectInfo, error) {
+	if m.isClosed() {
+		return nil, broker.ErrUnavailable
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "List subjects in Broker Module")
+	defer span.Finish()
+
+	counts, err := m.db.Subjects(spanCtx)
+	if err != nil {
+		return nil, err
+	}
+	subjects := make(map[string]*broker.SubjectInfo, len(counts))
+	for subject, count := range counts {
+		subjects[subject] = &broker.SubjectInfo{Subject: subject, Messages: count}
+	}
+
+	m.RLock()
+	for subject, queue := range m.queue {
+		info, ok := subjects[subject]
+		if !ok {
+			info = &broker.SubjectInfo{Subject: subject}
+			subjects[subject] = info
+		}
+		info.Subscribers = len(queue.all())
+	}
+	m.RUnlock()
+
+	infos := make([]broker.SubjectInfo, 0, len(subjects))
+	for _, info := range subjects {
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Subject < infos[j].Subject
+	})
+	return infos, nil
+}
+
+func (m *Module) Subscribers(ctx context.Context, subject string) ([]broker.SubscriberInfo, error) {
+	if m.isClosed() {
+		return nil, broker.ErrUnavailable
+	}
+	if !validSubject(subject, true) {
+		return nil, broker.ErrInvalidSubject
+	}
+
+	m.RLock()
+	var subs []*Subscriber
+	if queue, ok := m.queue[subject]; ok {
+		subs = queue.all()
+	}
+	m.RUnlock()
+
+	infos := make([]broker.SubscriberInfo, 0, len(subs))
+	for _, sub := range subs {
+		infos = append(infos, sub.info(subject))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos, nil
+}
+
+func (m *Module) DescribeSubscriber(ctx context.Context, id uint64) (broker.SubscriberInfo, error) {
+	if m.isClosed() {
+		return broker.SubscriberInfo{}, broker.ErrUnavailable
+	}
+
+	subject, sub := m.subscriber(id)
+	if sub == nil {
+		return broker.SubscriberInfo{}, broker.ErrUnknownSubscriber
+	}
+	return sub.info(subject), nil
+}
+
+// PurgeSubject is replicated in a cluster, so the messages are removed
+// from the storage of every broker.
+func (m *Module) PurgeSubject(ctx context.Context, subject string) (int, error) {
+	if m.isClosed() {
+		return 0, broker.ErrUnavailable
+	}
+	if !validSubject(subject, false) {
+		return 0, broker.ErrInvalidSubject
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Purge subject in Broker Module")
+	defer span.Finish()
+
+	if m.cluster != nil {
+		result, err := m.replicateResult(spanCtx, command{Op: opPurge, Subject: subject})
+		return result.Count, err
+	}
+	return m.db.PurgeSubject(spanCtx, subject)
+}
+
+// DeleteMessage fails like Fetch for messages that are not stored, it is
+// replicated in a cluster like PurgeSubject.
+func (m *Module) DeleteMessage(ctx context.Context, subject string, id int) error {
+	if m.isClosed() {
+		return broker.ErrUnavailable
+	}
+	if !validSubject(subject, false) {
+		return broker.ErrInvalidSubject
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Delete message in Broker Module")
+	defer span.Finish()
+
+	if _, err := m.db.FetchMessage(spanCtx, id, subject); err != nil {
+		return err
+	}
+	if m.cluster != nil {
+		_, err := m.replicate(spanCtx, command{Op: opDeleteMessage, Subject: subject, ID: id})
+		return err
+	}
+	m.db.DeleteMessage(subject, id)
+	return nil
+}
+
+func (m *Module) DisconnectSubscriber(ctx context.Context, id uint64) error {
+	if m.isClosed() {
+		return broker.ErrUnavailable
+	}
+
+	subject, sub := m.subscriber(id)
+	if sub == nil {
+		return broker.ErrUnknownSubscriber
+	}
+	m.unsubscribe(subject, sub)
+	return nil
+}
+
+// subscriber looks the subscriber up by its id, with the subject it is
+// subscribed to.
+func (m *Module) subscriber(id uint64) (string, *Subscriber) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for subject, queue := range m.queue {
+		for _, sub := range queue.all() {
+			if sub.id == id {
+				return subject, sub
+			}
+		}
+	}
+	return "", nil
+}
+
+// The admin of a shard acts on the subjects and subscribers the shard holds
+// itself, operators call the shard that owns the subject.
+
+func (s *ShardedModule) Subjects(ctx context.Context) ([]broker.SubjectInfo, error) {
+	return s.local.Subjects(ctx)
+}
+
+func (s *ShardedModule) Subscribers(ctx context.Context, subject string) ([]broker.SubscriberInfo, error) {
+	return s.local.Subscribers(ctx, subject)
+}
+
+func (s *ShardedModule) DescribeSubscriber(ctx context.Context, id uint64) (broker.SubscriberInfo, error) {
+	return s.local.DescribeSubscriber(ctx, id)
+}
+
+func (s *ShardedModule) PurgeSubject(ctx context.Context, subject string) (int, error) {
+	return s.local.PurgeSubject(ctx, subject)
+}
+
+func (s *ShardedModule) DeleteMessage(ctx context.Context, subject string, id int) error {
+	return s.local.DeleteMessage(ctx, subject, id)
+}
+
+func (s *ShardedModule) DisconnectSubscriber(ctx context.Context, id uint64) error {
+	return s.local.DisconnectSubscriber(ctx, id)
+}
@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"testing"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminShouldListSubjectsAndSubscribers(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+
+	_, _ = module.Subscribe(mainCtx, "orders")
+	_, _ = module.SubscribeWithOptions(mainCtx, "orders", broker.SubscribeOptions{Group: "workers"})
+	_, _ = module.Subscribe(mainCtx, "orders.>")
+	_, _ = module.Publish(mainCtx, "orders", createMessageWithExpire(time.Second*10))
+	_, _ = module.Publish(mainCtx, "orders", createMessageWithExpire(time.Second*10))
+	_, _ = module.Publish(mainCtx, "payments", createMessageWithExpire(time.Second*10))
+	_, _ = module.Publish(mainCtx, "payments", createMessage())
+
+	subjects, err := module.Subjects(mainCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, []broker.SubjectInfo{
+		{Subject: "orders", Messages: 2, Subscribers: 2},
+		{Subject: "orders.>", Subscribers: 1},
+		{Subject: "payments", Messages: 1},
+	}, subjects)
+
+	subscribers, err := module.Subscribers(mainCtx, "orders")
+	assert.Nil(t, err)
+	assert.Len(t, subscribers, 2)
+	assert.Equal(t, "", subscribers[0].Group)
+	assert.Equal(t, "workers", subscribers[1].Group)
+}
+
+func TestAdminShouldDescribeSubscriber(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+
+	sub, _ := module.SubscribeWithOptions(mainCtx, "orders", broker.SubscribeOptions{BufferSize: 2})
+	for i := 0; i < 4; i++ {
+		_, _ = module.Publish(mainCtx, "orders", createMessage())
+	}
+	<-sub
+
+	subscribers, _ := module.Subscribers(mainCtx, "orders")
+	assert.Eventually(t, func() bool {
+		info, err := module.DescribeSubscriber(mainCtx, subscribers[0].ID)
+		return err == nil && info.Delivered == 1 && info.Buffered == 1 && info.Dropped == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := module.DescribeSubscriber(mainCtx, subscribers[0].ID+1)
+	assert.Equal(t, broker.ErrUnknownSubscriber, err)
+}
+
+func TestAdminShouldPurgeSubjectAndDeleteMessage(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+
+	first, _ := module.Publish(mainCtx, "orders", createMessageWithExpire(time.Second*10))
+	_, _ = module.Publish(mainCtx, "orders", createMessageWithExpire(time.Second*10))
+	kept, _ := module.Publish(mainCtx, "payments", createMessageWithExpire(time.Second*10))
+	deleted, _ := module.Publish(mainCtx, "payments", createMessageWithExpire(time.Second*10))
+
+	purged, err := module.PurgeSubject(mainCtx, "orders")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, purged)
+	_, err = module.Fetch(mainCtx, "orders", first)
+	assert.Equal(t, broker.ErrExpiredID, err)
+
+	assert.Nil(t, module.DeleteMessage(mainCtx, "payments", deleted))
+	assert.Equal(t, broker.ErrExpiredID, module.DeleteMessage(mainCtx, "payments", deleted))
+	assert.Equal(t, broker.ErrInvalidID, module.DeleteMessage(mainCtx, "payments", deleted+1))
+	_, err = module.Fetch(mainCtx, "payments", kept)
+	assert.Nil(t, err)
+
+	_, err = module.PurgeSubject(mainCtx, "orders.*")
+	assert.Equal(t, broker.ErrInvalidSubject, err)
+}
+
+func TestAdminShouldDisconnectSubscriber(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+
+	sub, _ := module.Subscribe(mainCtx, "orders")
+	other, _ := module.Subscribe(mainCtx, "orders")
+	subscribers, _ := module.Subscribers(mainCtx, "orders")
+
+	assert.Nil(t, module.DisconnectSubscriber(mainCtx, subscribers[0].ID))
+	assert.Equal(t, broker.ErrUnknownSubscriber, module.DisconnectSubscriber(mainCtx, subscribers[0].ID))
+
+	select {
+	case _, ok := <-sub:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Subscriber was not disconnected")
+	}
+
+	_, _ = module.Publish(mainCtx, "orders", createMessage())
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		assert.Fail(t, "Other subscriber did not get the message")
+	}
+}
@@ -0,0 +1,340 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/middleware"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultBufferSize   = 200
+	defaultBlockTimeout = time.Second
+	// blockRetryInterval is how often a blocked publish looks for room, the
+	// subscriber reads the channel without telling the buffer
+	blockRetryInterval = 2 * time.Millisecond
+)
+
+// offerResult is what became of a message offered to a buffer
+type offerResult int
+
+const (
+	offerRefused offerResult = iota
+	offerSent
+	// offerBlocked leaves the message to the Block policy, the caller waits
+	// for room with block once it holds no locks
+	offerBlocked
+)
+
+// messageBuffer holds the messages of one subscriber until it reads them.
+// The messages go straight into the buffered channel of the subscriber,
+// the backpressure policy only applies once the channel is full or the
+// bytes waiting in it reach BufferBytes.
+type messageBuffer struct {
+	out chan broker.Message
+	// sizes are the body sizes of the messages in the channel, oldest
+	// first, kept only when BufferBytes is set. The ones the subscriber
+	// read are trimmed by settle
+	sizes []int
+	bytes int
+	// sent counts the messages put in the channel, evicted the ones
+	// DropOldest took back out of it
+	sent    uint64
+	evicted uint64
+	// dropped counts the messages the buffer dropped
+	dropped uint64
+	// droppedCounter is the metric of the drops under the policy
+	droppedCounter prometheus.Counter
+
+	maxBytes     int
+	policy       broker.Backpressure
+	blockTimeout time.Duration
+	// onDisconnect removes the subscriber from the broker, it is called
+	// once the buffer is closed by the Disconnect policy
+	onDisconnect func()
+	// onDrop gets every message the buffer drops
+	onDrop func(msg broker.Message)
+
+	done   chan struct{}
+	closed bool
+	// Without BufferBytes the publishers send under the read lock, the
+	// write lock keeps them off a channel that is being closed or evicted
+	sync.RWMutex
+}
+
+func newMessageBuffer(opts broker.SubscribeOptions) *messageBuffer {
+	maxCount := opts.BufferSize
+	if maxCount <= 0 {
+		maxCount = defaultBufferSize
+	}
+	blockTimeout := opts.BlockTimeout
+	if blockTimeout <= 0 {
+		blockTimeout = defaultBlockTimeout
+	}
+	return &messageBuffer{
+		out:            make(chan broker.Message, maxCount),
+		droppedCounter: droppedCounters[opts.Backpressure],
+		maxBytes:       opts.BufferBytes,
+		policy:         opts.Backpressure,
+		blockTimeout:   blockTimeout,
+		done:           make(chan struct{}),
+	}
+}
+
+// offer puts the message in the buffer. When the buffer is full and
+// final is false the message is refused right away, otherwise the
+// backpressure policy of the subscriber decides what happens to it.
+func (b *messageBuffer) offer(msg broker.Message, final bool) offerResult {
+	//	Refuse right away when nothing but dropping the message can happen,
+	//	so publishers do not queue on the lock of a subscriber that is behind
+	if (!final || b.policy == broker.DropNewest) && len(b.out) >= cap(b.out) {
+		if final {
+			b.drop(msg)
+		}
+		return offerRefused
+	}
+	if b.maxBytes <= 0 {
+		if b.send(msg) {
+			return offerSent
+		}
+		if !final {
+			return offerRefused
+		}
+	}
+
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return offerRefused
+	}
+	if b.fits(msg) {
+		b.put(msg)
+		b.Unlock()
+		return offerSent
+	}
+	if !final {
+		b.Unlock()
+		return offerRefused
+	}
+
+	switch b.policy {
+	case broker.DropOldest:
+		for !b.fits(msg) {
+			b.evict()
+		}
+		b.put(msg)
+		b.Unlock()
+		return offerSent
+
+	case broker.Block:
+		b.Unlock()
+		return offerBlocked
+
+	case broker.Disconnect:
+		lost := b.drain()
+		b.closeLocked()
+		b.Unlock()
+		middleware.DisconnectedSubscribers.Inc()
+		for _, buffered := range lost {
+			b.drop(buffered)
+		}
+		if b.onDisconnect != nil {
+			go b.onDisconnect()
+		}
+
+	default:
+		b.Unlock()
+	}
+
+	b.drop(msg)
+	return offerRefused
+}
+
+// block waits up to the block timeout for room for a message the Block
+// policy left, and drops it when there is still none.
+func (b *messageBuffer) block(msg broker.Message) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.blockTimeout)
+	defer cancel()
+	if b.wait(ctx.Done(), msg) {
+		return true
+	}
+	b.drop(msg)
+	return false
+}
+
+// push waits for room in the buffer until the context is done, no matter
+// the backpressure policy. It is used for the messages that must not be
+// dropped, like the replayed ones.
+func (b *messageBuffer) push(ctx context.Context, msg broker.Message) bool {
+	return b.wait(ctx.Done(), msg)
+}
+
+// wait puts the message in the buffer as soon as there is room for it,
+// giving up when stop is closed or the buffer is closed.
+func (b *messageBuffer) wait(stop <-chan struct{}, msg broker.Message) bool {
+	var retry *time.Ticker
+	for {
+		b.Lock()
+		if b.closed {
+			b.Unlock()
+			return false
+		}
+		if b.fits(msg) {
+			b.put(msg)
+			b.Unlock()
+			return true
+		}
+		b.Unlock()
+
+		if retry == nil {
+			retry = time.NewTicker(blockRetryInterval)
+			defer retry.Stop()
+		}
+		select {
+		case <-retry.C:
+		case <-stop:
+			return false
+		case <-b.done:
+			return false
+		}
+	}
+}
+
+// send puts the message in the channel if it has room, without waiting
+// for the buffers that do not count bytes.
+func (b *messageBuffer) send(msg broker.Message) bool {
+	b.RLock()
+	defer b.RUnlock()
+	if b.closed {
+		return false
+	}
+	select {
+	case b.out <- msg:
+		atomic.AddUint64(&b.sent, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+// settle forgets the sizes of the messages the subscriber has read, the
+// caller holds the lock.
+func (b *messageBuffer) settle() {
+	if b.maxBytes <= 0 {
+		return
+	}
+	for len(b.sizes) > len(b.out) {
+		b.bytes -= b.sizes[0]
+		b.sizes = b.sizes[1:]
+	}
+}
+
+// fits tells whether the message is within the limits of the buffer, a
+// message larger than BufferBytes still goes into an empty buffer.
+func (b *messageBuffer) fits(msg broker.Message) bool {
+	b.settle()
+	waiting := len(b.out)
+	if waiting >= cap(b.out) {
+		return false
+	}
+	return b.maxBytes <= 0 || waiting == 0 || b.bytes+len(msg.Body) <= b.maxBytes
+}
+
+// put sends the message to the channel, which has room since the holder
+// of the lock is the only one sending to it.
+func (b *messageBuffer) put(msg broker.Message) {
+	b.out <- msg
+	if b.maxBytes > 0 {
+		b.sizes = append(b.sizes, len(msg.Body))
+		b.bytes += len(msg.Body)
+	}
+	atomic.AddUint64(&b.sent, 1)
+}
+
+// evict drops the oldest message in the channel, unless the subscriber
+// has just read it.
+func (b *messageBuffer) evict() {
+	b.settle()
+	select {
+	case oldest := <-b.out:
+		b.evicted++
+		if len(b.sizes) > 0 {
+			b.bytes -= b.sizes[0]
+			b.sizes = b.sizes[1:]
+		}
+		b.drop(oldest)
+	default:
+	}
+}
+
+// drain takes the messages the subscriber has not read out of the channel,
+// which must still be open.
+func (b *messageBuffer) drain() []broker.Message {
+	var lost []broker.Message
+	for {
+		select {
+		case msg := <-b.out:
+			lost = append(lost, msg)
+		default:
+			return lost
+		}
+	}
+}
+
+func (b *messageBuffer) close() {
+	b.Lock()
+	defer b.Unlock()
+	if !b.closed {
+		b.drain()
+		b.closeLocked()
+	}
+}
+
+// closeLocked closes the channel, the callers take the messages still in
+// it out first so the subscriber sees the end right away.
+func (b *messageBuffer) closeLocked() {
+	if b.closed {
+		return
+	}
+	b.closed = true
+	b.sizes = nil
+	b.bytes = 0
+	close(b.done)
+	close(b.out)
+}
+
+// droppedCounters are looked up once, a publish can drop a message for
+// every subscriber of the subject that is behind.
+var droppedCounters = map[broker.Backpressure]prometheus.Counter{
+	broker.DropNewest: middleware.DroppedMessages.WithLabelValues(broker.DropNewest.String()),
+	broker.DropOldest: middleware.DroppedMessages.WithLabelValues(broker.DropOldest.String()),
+	broker.Block:      middleware.DroppedMessages.WithLabelValues(broker.Block.String()),
+	broker.Disconnect: middleware.DroppedMessages.WithLabelValues(broker.Disconnect.String()),
+}
+
+// stats returns the messages and bytes waiting in the buffer, and how many
+// messages the subscriber has taken. The bytes are only counted when
+// BufferBytes is set.
+func (b *messageBuffer) stats() (int, int, uint64) {
+	b.Lock()
+	defer b.Unlock()
+	sent := atomic.LoadUint64(&b.sent)
+	if b.closed {
+		return 0, 0, sent - b.evicted
+	}
+	b.settle()
+	waiting := len(b.out)
+	return waiting, b.bytes, sent - b.evicted - uint64(waiting)
+}
+
+func (b *messageBuffer) drop(msg broker.Message) {
+	atomic.AddUint64(&b.dropped, 1)
+	b.droppedCounter.Inc()
+	if b.onDrop != nil {
+		b.onDrop(msg)
+	}
+}
@@ -0,0 +1,435 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"therealbroker/internal/cluster"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/database"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Operations of the commands in the cluster log
+const (
+	opPublish       = "publish"
+	opSetDeadLetter = "set_dead_letter"
+	opPurge         = "purge"
+	opDeleteMessage = "delete_message"
+)
+
+// command is a change kept in the log of the cluster, every broker applies
+// it to its own storage and subscribers in the order of the log.
+type command struct {
+	Op string
+	// Messages of opPublish, each one with its Subject, timestamp and the
+	// ID the leader has given it
+	Messages []broker.Message
+	// Arguments of opSetDeadLetter, opPurge and opDeleteMessage
+	Subject    string
+	DeadLetter string
+	ID         int
+	// UpTo is the last id opPurge removes, the leader sets it
+	UpTo int
+	// Rejected is the code of the error the leader has refused an
+	// opPublish with, every broker returns it instead of storing it
+	Rejected string
+}
+
+type commandResult struct {
+	IDs []int
+	// Count of the messages removed by opPurge
+	Count int
+	Err   string
+	// Code names Err when it is an error of the broker, so the leader
+	// returns the same error as a broker on its own
+	Code string
+}
+
+// NewClusterModule returns a broker that is a member of the Raft groups
+// with the peers of the config. Publishes succeed once a quorum of the
+// brokers has them, and every broker stores them and sends them to its own
+// subscribers, so the ids are the same on all of them. The subjects are
+// spread over the groups, and the leader of the group of a subject orders
+// its publishes. The groups are started, they still have to be registered
+// on the gRPC server of the broker.
+func NewClusterModule(cfg cluster.Config, groups int) (broker.Broker, *cluster.Groups, error) {
+	m := newModule()
+	g, err := cluster.NewGroups(cfg, groups, func(int) cluster.StateMachine {
+		return newClusterMachine(m)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	m.cluster = g
+	g.Start()
+	return m, g, nil
+}
+
+// replicate commits the command through the group of its subject and
+// returns the ids the leader has given to its messages.
+func (m *Module) replicate(ctx context.Context, cmd command) ([]int, error) {
+	if cmd.Op == opPublish {
+		return m.replicatePublish(ctx, cmd.Messages)
+	}
+	result, err := m.replicateResult(ctx, cmd)
+	return result.IDs, err
+}
+
+// replicatePublish commits the messages through the groups of their
+// subjects at the same time, and returns their ids in the order of the
+// batch. A batch over several groups may be committed in part when one of
+// them fails, the ids of the groups that committed come with the error.
+func (m *Module) replicatePublish(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	positions := make(map[*cluster.Node][]int)
+	nodes := make([]*cluster.Node, 0)
+	for i, msg := range msgs {
+		node := m.cluster.Of(msg.Subject)
+		if _, ok := positions[node]; !ok {
+			nodes = append(nodes, node)
+		}
+		positions[node] = append(positions[node], i)
+	}
+	if len(nodes) == 1 {
+		result, err := m.propose(ctx, nodes[0], command{Op: opPublish, Messages: msgs})
+		return result.IDs, err
+	}
+
+	ids := make([]int, len(msgs))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		batch := make([]broker.Message, len(positions[node]))
+		for j, position := range positions[node] {
+			batch[j] = msgs[position]
+		}
+		wg.Add(1)
+		go func(i int, node *cluster.Node, batch []broker.Message) {
+			defer wg.Done()
+			result, err := m.propose(ctx, node, command{Op: opPublish, Messages: batch})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for j, position := range positions[node] {
+				ids[position] = result.IDs[j]
+			}
+		}(i, node, batch)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return ids, err
+		}
+	}
+	return ids, nil
+}
+
+// replicateResult commits the command through the group of its subject
+// and returns the result of applying it on the leader.
+func (m *Module) replicateResult(ctx context.Context, cmd command) (commandResult, error) {
+	return m.propose(ctx, m.cluster.Of(cmd.Subject), cmd)
+}
+
+// propose commits the command through the group of the node and returns
+// the result of applying it on the leader.
+func (m *Module) propose(ctx context.Context, node *cluster.Node, cmd command) (commandResult, error) {
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Replicate command to the cluster")
+	defer span.Finish()
+
+	var result commandResult
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return result, err
+	}
+	raw, err := node.Propose(spanCtx, data)
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		return result, broker.ErrUnavailable
+	}
+
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return commandResult{}, err
+	}
+	if err := broker.ErrorOf(result.Code); err != nil {
+		return commandResult{}, err
+	}
+	if result.Err != "" {
+		return commandResult{}, errors.New(result.Err)
+	}
+	return result, nil
+}
+
+// pendingKey is an idempotency key the leader has given an id to, whose
+// publish is not applied yet.
+type pendingKey struct {
+	id int
+	at time.Time
+}
+
+// clusterMachine applies the log of the cluster to the module. The leader
+// gives the messages their ids before their publish is appended, so every
+// broker stores a message with the same id. A publish applied again after
+// a restart leaves the messages that are stored already alone.
+type clusterMachine struct {
+	m *Module
+	sync.Mutex
+	// given is the last id the leader has given on every subject, the
+	// storage has the ones applied
+	given map[string]int
+	keys  map[dedupKey]pendingKey
+	// pending are the messages given an id and not applied yet, they
+	// count against the retention of their subjects
+	pending []broker.Message
+}
+
+func newClusterMachine(m *Module) *clusterMachine {
+	return &clusterMachine{
+		m:     m,
+		given: make(map[string]int),
+		keys:  make(map[dedupKey]pendingKey),
+	}
+}
+
+// Prepare gives the messages of a publish their ids, or rejects it when
+// they do not fit in the retention of their subjects, and gives the purge
+// the last id it removes.
+func (c *clusterMachine) Prepare(data []byte) ([]byte, error) {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	switch cmd.Op {
+	case opPublish:
+		if err := c.give(cmd.Messages); err != nil {
+			cmd.Rejected = broker.ErrorCode(err)
+		}
+	case opPurge:
+		cmd.UpTo = c.lastLocked(cmd.Subject)
+	default:
+		c.Unlock()
+		return data, nil
+	}
+	c.Unlock()
+	return json.Marshal(cmd)
+}
+
+// give sets the ids of the messages, a message with the key of one given
+// an id within the window gets the same id and is not stored again. The
+// messages that are stored must fit along with the pending ones, or none
+// of them is given an id. The caller holds the lock.
+func (c *clusterMachine) give(msgs []broker.Message) error {
+	dedup := c.m.dedup
+	given := make(map[string]int)
+	keys := make(map[dedupKey]pendingKey)
+	fresh := make([]broker.Message, 0, len(msgs))
+	for i := range msgs {
+		msg := &msgs[i]
+		key, keyed := dedup.keyOf(*msg, msg.Subject)
+		if keyed {
+			if pending, ok := keys[key]; ok {
+				msg.ID = pending.id
+				continue
+			}
+			if pending, ok := c.keys[key]; ok && !pending.at.Add(dedup.window).Before(msg.Timestamp) {
+				msg.ID = pending.id
+				continue
+			}
+			if id, ok := dedup.stored(key, msg.Timestamp); ok {
+				msg.ID = id
+				continue
+			}
+		}
+
+		last, ok := given[msg.Subject]
+		if !ok {
+			last = c.lastLocked(msg.Subject)
+		}
+		msg.ID = last + 1
+		given[msg.Subject] = msg.ID
+		if keyed {
+			keys[key] = pendingKey{id: msg.ID, at: msg.Timestamp}
+		}
+		fresh = append(fresh, *msg)
+	}
+
+	if err := c.m.db.Admits(append(c.unappliedLocked(), fresh...)); err != nil {
+		return err
+	}
+	for subject, id := range given {
+		c.given[subject] = id
+	}
+	for key, pending := range keys {
+		c.keys[key] = pending
+	}
+	c.pending = append(c.pending, fresh...)
+	return nil
+}
+
+// unappliedLocked drops the pending messages the storage has now, and
+// returns the rest.
+func (c *clusterMachine) unappliedLocked() []broker.Message {
+	unapplied := c.pending[:0]
+	for _, msg := range c.pending {
+		if msg.ID > c.m.db.LastID(msg.Subject) {
+			unapplied = append(unapplied, msg)
+		}
+	}
+	c.pending = unapplied
+	return append([]broker.Message(nil), unapplied...)
+}
+
+// lastLocked is the last id of the subject, given or applied.
+func (c *clusterMachine) lastLocked(subject string) int {
+	last := c.m.db.LastID(subject)
+	if c.given[subject] > last {
+		return c.given[subject]
+	}
+	return last
+}
+
+// Lead starts over from the ids of the publishes in the log of the new
+// leader, the ones a former leader gave and lost are given again.
+func (c *clusterMachine) Lead(commands [][]byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.given = make(map[string]int)
+	c.keys = make(map[dedupKey]pendingKey)
+	c.pending = nil
+	for _, data := range commands {
+		var cmd command
+		if err := json.Unmarshal(data, &cmd); err != nil || cmd.Op != opPublish || cmd.Rejected != "" {
+			continue
+		}
+		c.pending = append(c.pending, cmd.Messages...)
+		for _, msg := range cmd.Messages {
+			if msg.ID > c.given[msg.Subject] {
+				c.given[msg.Subject] = msg.ID
+			}
+			if key, ok := c.m.dedup.keyOf(msg, msg.Subject); ok {
+				if _, ok := c.keys[key]; !ok {
+					c.keys[key] = pendingKey{id: msg.ID, at: msg.Timestamp}
+				}
+			}
+		}
+	}
+}
+
+// Apply runs a committed command on this broker, it is called in the order
+// of the log on every member of the cluster.
+func (c *clusterMachine) Apply(data []byte) []byte {
+	var cmd command
+	var result commandResult
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		result.Err = err.Error()
+		return encodeResult(result)
+	}
+
+	ctx := context.Background()
+	var err error
+	switch {
+	case cmd.Rejected != "":
+		err = broker.ErrorOf(cmd.Rejected)
+	case cmd.Op == opPublish:
+		result.IDs, err = c.publish(ctx, cmd.Messages)
+	case cmd.Op == opSetDeadLetter:
+		c.m.deadLetters.set(cmd.Subject, cmd.DeadLetter)
+	case cmd.Op == opPurge:
+		result.Count, err = c.purge(ctx, cmd.Subject, cmd.UpTo)
+	case cmd.Op == opDeleteMessage:
+		c.m.db.DeleteMessage(cmd.Subject, cmd.ID)
+	}
+	if err != nil {
+		result.Err, result.Code = err.Error(), broker.ErrorCode(err)
+	}
+	return encodeResult(result)
+}
+
+// publish stores the messages with the ids the leader gave them and sends
+// them to the subscribers. A message with an id its subject has already is
+// stored already, or shares the key of a message stored before, and only
+// gets its id back.
+func (c *clusterMachine) publish(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	m := c.m
+	ids := make([]int, len(msgs))
+	fresh := make([]broker.Message, 0, len(msgs))
+	freshIDs := make([]int, 0, len(msgs))
+	last := make(map[string]int)
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+		stored, ok := last[msg.Subject]
+		if !ok {
+			stored = m.db.LastID(msg.Subject)
+		}
+		if msg.ID > stored {
+			fresh = append(fresh, msg)
+			freshIDs = append(freshIDs, msg.ID)
+			stored = msg.ID
+		}
+		last[msg.Subject] = stored
+	}
+	if len(fresh) == 0 {
+		return ids, nil
+	}
+
+	storeSpan, storeCtx := opentracing.StartSpanFromContext(ctx, "Store Replicated Batch")
+	_, err := m.db.AddMessages(storeCtx, fresh)
+	storeSpan.Finish()
+	if err != nil {
+		return nil, err
+	}
+	m.dedup.remember(append([]broker.Message(nil), fresh...))
+	c.Lock()
+	for _, msg := range fresh {
+		if key, ok := m.dedup.keyOf(msg, msg.Subject); ok && c.keys[key].id == msg.ID {
+			delete(c.keys, key)
+		}
+	}
+	c.Unlock()
+
+	m.send(ctx, fresh, freshIDs)
+	return ids, nil
+}
+
+// purge removes the messages of the subject up to the last one the leader
+// saw. Applied again after a restart, it leaves the messages published
+// after it alone.
+func (c *clusterMachine) purge(ctx context.Context, subject string, upTo int) (int, error) {
+	db := c.m.db
+	if db.LastID(subject) <= upTo {
+		return db.PurgeSubject(ctx, subject)
+	}
+	msgs, err := db.GetMessagesBySubject(ctx, subject, database.ReplayFilter{})
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]database.MessageKey, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.ID <= upTo {
+			keys = append(keys, database.MessageKey{Subject: subject, ID: msg.ID})
+		}
+	}
+	db.DeleteMessages(keys)
+	return len(keys), nil
+}
+
+// Sync writes the pending batches of the storage, the in-memory storage
+// starts empty after a restart and has the whole log applied again.
+func (c *clusterMachine) Sync() error {
+	if c.m.storageType == GOLANG_MAP {
+		return cluster.ErrVolatile
+	}
+	return c.m.db.Flush()
+}
+
+func encodeResult(result commandResult) []byte {
+	data, _ := json.Marshal(result)
+	return data
+}
@@ -0,0 +1,261 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"therealbroker/api/proto"
+	"therealbroker/config"
+	"therealbroker/internal/cluster"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/database"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// startClusterModules runs brokers that form a cluster of 3 groups
+// in-process over loopback, and waits until they agree on the leaders.
+func startClusterModules(t *testing.T, size int) []broker.Broker {
+	listeners := make([]net.Listener, size)
+	peers := make([]cluster.Peer, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[i] = listener
+		peers[i] = cluster.Peer{ID: fmt.Sprintf("broker-%d", i), Address: listener.Addr().String()}
+	}
+
+	modules := make([]broker.Broker, size)
+	groups := make([]*cluster.Groups, size)
+	for i := range modules {
+		others := append(append([]cluster.Peer{}, peers[:i]...), peers[i+1:]...)
+		module, group, err := NewClusterModule(cluster.Config{
+			ID:                peers[i].ID,
+			Peers:             others,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+			ProposeTimeout:    time.Second,
+		}, 3)
+		assert.Nil(t, err)
+		server := grpc.NewServer()
+		proto.RegisterRaftServer(server, group)
+		go func(listener net.Listener) {
+			_ = server.Serve(listener)
+		}(listeners[i])
+		t.Cleanup(func() {
+			_ = module.Close()
+			server.Stop()
+		})
+		modules[i], groups[i] = module, group
+	}
+
+	assert.Eventually(t, func() bool {
+		leaders := groups[0].Leaders()
+		for _, group := range groups {
+			for i, leader := range group.Leaders() {
+				if leader == "" || leader != leaders[i] {
+					return false
+				}
+			}
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+	return modules
+}
+
+func TestClusterPublishShouldReachSubscribersOfEveryBroker(t *testing.T) {
+	modules := startClusterModules(t, 3)
+	subs := make([]<-chan broker.Message, len(modules))
+	for i, module := range modules {
+		subs[i], _ = module.Subscribe(mainCtx, "ali")
+	}
+
+	msg := createMessage()
+	id, err := modules[1].Publish(mainCtx, "ali", msg)
+	assert.Nil(t, err)
+	for _, sub := range subs {
+		select {
+		case received := <-sub:
+			assert.Equal(t, id, received.ID)
+			assert.Equal(t, msg.Body, received.Body)
+		case <-time.After(time.Second):
+			assert.Fail(t, "Replicated message was not delivered")
+		}
+	}
+}
+
+func TestClusterShouldNotReuseIdsAcrossBrokers(t *testing.T) {
+	modules := startClusterModules(t, 3)
+
+	ids := make(map[int]bool)
+	for _, module := range modules {
+		id, err := module.Publish(mainCtx, "ali", createMessage())
+		assert.Nil(t, err)
+		assert.False(t, ids[id])
+		ids[id] = true
+	}
+	batch, err := modules[2].PublishBatch(mainCtx, []broker.Message{
+		{Subject: "ali", Body: "first"},
+		{Subject: "ali", Body: "second"},
+	})
+	assert.Nil(t, err)
+	for _, id := range batch {
+		assert.False(t, ids[id])
+		ids[id] = true
+	}
+}
+
+func TestClusterBatchOverGroupsShouldKeepItsOrder(t *testing.T) {
+	modules := startClusterModules(t, 3)
+	groups := modules[0].(*Module).cluster
+	other := "ali"
+	for i := 0; groups.Of(other) == groups.Of("maryam"); i++ {
+		other = fmt.Sprint("ali-", i)
+	}
+
+	ids, err := modules[1].PublishBatch(mainCtx, []broker.Message{
+		{Subject: other, Body: "first", Expiration: 10 * time.Second},
+		{Subject: "maryam", Body: "second", Expiration: 10 * time.Second},
+		{Subject: other, Body: "third", Expiration: 10 * time.Second},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 1, 2}, ids)
+	for _, module := range modules {
+		assert.Eventually(t, func() bool {
+			third, err := module.Fetch(mainCtx, other, 2)
+			if err != nil || third.Body != "third" {
+				return false
+			}
+			second, err := module.Fetch(mainCtx, "maryam", 1)
+			return err == nil && second.Body == "second"
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestClusterPurgeShouldReachEveryBroker(t *testing.T) {
+	modules := startClusterModules(t, 3)
+
+	id, err := modules[0].Publish(mainCtx, "ali", createMessageWithExpire(time.Second*10))
+	assert.Nil(t, err)
+	purged, err := modules[1].(broker.Admin).PurgeSubject(mainCtx, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+
+	for _, module := range modules {
+		assert.Eventually(t, func() bool {
+			_, err := module.Fetch(mainCtx, "ali", id)
+			return err == broker.ErrExpiredID
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+// prepared is a command as the leader appends it to the log
+func prepared(t *testing.T, machine *clusterMachine, cmd command) []byte {
+	data, err := json.Marshal(cmd)
+	assert.Nil(t, err)
+	data, err = machine.Prepare(data)
+	assert.Nil(t, err)
+	return data
+}
+
+func TestClusterPublishAppliedAgainShouldBeStoredOnce(t *testing.T) {
+	m := newModule()
+	defer m.Close()
+	machine := newClusterMachine(m)
+	sub, _ := m.Subscribe(mainCtx, "ali")
+
+	msg := createMessageWithExpire(10 * time.Second)
+	msg.Subject, msg.IdempotencyKey, msg.Timestamp = "ali", "first", time.Now()
+	other := createMessage()
+	other.Subject = "ali"
+	publish := prepared(t, machine, command{Op: opPublish, Messages: []broker.Message{msg, other}})
+	//	The retry is given the id of the first message before it is applied
+	retry := prepared(t, machine, command{Op: opPublish, Messages: []broker.Message{msg}})
+
+	var result commandResult
+	for _, data := range [][]byte{publish, publish, retry} {
+		assert.Nil(t, json.Unmarshal(machine.Apply(data), &result))
+		assert.Equal(t, "", result.Err)
+		assert.Equal(t, 1, result.IDs[0])
+	}
+	assert.Equal(t, 2, m.db.LastID("ali"))
+	assert.Equal(t, 1, (<-sub).ID)
+	assert.Equal(t, 2, (<-sub).ID)
+	select {
+	case received := <-sub:
+		assert.Fail(t, "Message was sent again", received.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClusterPurgeAppliedAgainShouldKeepLaterMessages(t *testing.T) {
+	m := newModule()
+	defer m.Close()
+	machine := newClusterMachine(m)
+
+	msg := createMessageWithExpire(10 * time.Second)
+	msg.Subject = "ali"
+	machine.Apply(prepared(t, machine, command{Op: opPublish, Messages: []broker.Message{msg}}))
+	purge := prepared(t, machine, command{Op: opPurge, Subject: "ali"})
+	machine.Apply(purge)
+	machine.Apply(prepared(t, machine, command{Op: opPublish, Messages: []broker.Message{msg}}))
+	machine.Apply(purge)
+
+	_, err := m.Fetch(mainCtx, "ali", 1)
+	assert.Equal(t, broker.ErrExpiredID, err)
+	fetched, err := m.Fetch(mainCtx, "ali", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Body, fetched.Body)
+}
+
+func TestNewLeaderShouldGiveIdsAfterTheOnesInItsLog(t *testing.T) {
+	m := newModule()
+	defer m.Close()
+	former := newClusterMachine(m)
+	msg := createMessage()
+	msg.Subject = "ali"
+	pending := prepared(t, former, command{Op: opPublish, Messages: []broker.Message{msg, msg}})
+
+	machine := newClusterMachine(m)
+	machine.Lead([][]byte{pending})
+	var cmd command
+	assert.Nil(t, json.Unmarshal(prepared(t, machine, command{Op: opPublish, Messages: []broker.Message{msg}}), &cmd))
+	assert.Equal(t, 3, cmd.Messages[0].ID)
+}
+
+func TestClusterPublishShouldBeAdmittedByTheLeaderAlone(t *testing.T) {
+	previous := config.GetConfigInstance()
+	defer config.SetConfigInstance(previous)
+	limited := func(messages int) *Module {
+		cfg := &config.Config{}
+		cfg.Retention.MaxMessages, cfg.Retention.Policy = messages, string(database.RejectNew)
+		config.SetConfigInstance(cfg)
+		return newModule()
+	}
+	leader, follower := limited(2), limited(1)
+	defer leader.Close()
+	defer follower.Close()
+	leading, following := newClusterMachine(leader), newClusterMachine(follower)
+
+	publishes := make([][]byte, 3)
+	for i := range publishes {
+		msg := createMessageWithExpire(10 * time.Second)
+		msg.Subject = "ali"
+		publishes[i] = prepared(t, leading, command{Op: opPublish, Messages: []broker.Message{msg}})
+	}
+
+	//	The follower keeps fewer messages, yet stores what the leader admitted
+	for _, machine := range []*clusterMachine{leading, following} {
+		var result commandResult
+		for _, publish := range publishes[:2] {
+			assert.Nil(t, json.Unmarshal(machine.Apply(publish), &result))
+			assert.Equal(t, "", result.Err)
+		}
+		assert.Nil(t, json.Unmarshal(machine.Apply(publishes[2]), &result))
+		assert.Equal(t, broker.ErrorCode(broker.ErrSubjectFull), result.Code)
+		assert.Equal(t, 2, machine.m.db.LastID("ali"))
+	}
+}
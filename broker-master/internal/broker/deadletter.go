@@ -0,0 +1,270 @@
+package broker
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// deadLetterExpiration keeps the dead letters of fire & forget messages
+// fetchable for a week
+const deadLetterExpiration = 7 * 24 * time.Hour
+
+const (
+	// maxDeadLetterBatch caps the dead letters published in one batch, the
+	// rest follow right after
+	maxDeadLetterBatch = 1024
+	// maxPendingDeadLetters caps the dead letters waiting to be moved, a
+	// subscriber that drops faster than they are published loses the rest
+	// instead of piling them up in memory
+	maxPendingDeadLetters = 100000
+)
+
+// deadLetterSubjects maps a subject to the subject its undeliverable
+// messages are moved to. It is read for every dropped message on the
+// delivery path, so the map is replaced on every change and read without
+// a lock.
+type deadLetterSubjects struct {
+	subjects atomic.Value
+	// writing serializes the changes
+	writing sync.Mutex
+}
+
+func newDeadLetterSubjects() *deadLetterSubjects {
+	d := &deadLetterSubjects{}
+	d.subjects.Store(map[string]string{})
+	return d
+}
+
+func (d *deadLetterSubjects) get(subject string) (string, bool) {
+	deadLetter, ok := d.subjects.Load().(map[string]string)[subject]
+	return deadLetter, ok
+}
+
+func (d *deadLetterSubjects) set(subject string, deadLetter string) {
+	d.writing.Lock()
+	defer d.writing.Unlock()
+
+	current := d.subjects.Load().(map[string]string)
+	subjects := make(map[string]string, len(current)+1)
+	for key, value := range current {
+		subjects[key] = value
+	}
+	if deadLetter == "" {
+		delete(subjects, subject)
+	} else {
+		subjects[subject] = deadLetter
+	}
+	d.subjects.Store(subjects)
+}
+
+func (m *Module) SetDeadLetter(ctx context.Context, subject string, deadLetter string) error {
+	if m.isClosed() {
+		return broker.ErrUnavailable
+	}
+	if !validSubject(subject, false) {
+		return broker.ErrInvalidSubject
+	}
+	if deadLetter != "" && (!validSubject(deadLetter, false) || deadLetter == subject) {
+		return broker.ErrInvalidSubject
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Set dead-letter subject in Broker Module")
+	defer span.Finish()
+
+	if m.cluster != nil {
+		_, err := m.replicate(spanCtx, command{Op: opSetDeadLetter, Subject: subject, DeadLetter: deadLetter})
+		return err
+	}
+	m.deadLetters.set(subject, deadLetter)
+	return nil
+}
+
+func (m *Module) DeadLetter(ctx context.Context, subject string, msg broker.Message, reason string, deliveries int) error {
+	if m.isClosed() {
+		return broker.ErrUnavailable
+	}
+
+	letter, ok := m.deadLetterMessage(deadLetter{subject: subject, msg: msg, reason: reason, deliveries: deliveries})
+	if !ok {
+		return nil
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Move message to dead-letter subject")
+	defer span.Finish()
+
+	deadLetterSubject := letter.Subject
+	letter.Subject = ""
+	_, err := m.deadLetterPublisher().Publish(spanCtx, deadLetterSubject, letter)
+	return err
+}
+
+// deadLetter is a message that could not be delivered on its subject
+type deadLetter struct {
+	subject    string
+	msg        broker.Message
+	reason     string
+	deliveries int
+}
+
+// deadLetterMessage is the message moved to the dead-letter subject of the
+// subject, with the dead-letter subject as its Subject. It is false when
+// the subject has none or the message is a dead letter already, so
+// subjects that point at each other can not loop.
+func (m *Module) deadLetterMessage(letter deadLetter) (broker.Message, bool) {
+	deadLetterSubject, ok := m.deadLetters.get(letter.subject)
+	if !ok {
+		return broker.Message{}, false
+	}
+	if _, failed := letter.msg.Headers[broker.HeaderFailureReason]; failed {
+		return broker.Message{}, false
+	}
+
+	headers := make(map[string]string, len(letter.msg.Headers)+3)
+	for key, value := range letter.msg.Headers {
+		headers[key] = value
+	}
+	headers[broker.HeaderOriginalSubject] = letter.subject
+	headers[broker.HeaderFailureReason] = letter.reason
+	headers[broker.HeaderDeliveryCount] = strconv.Itoa(letter.deliveries)
+
+	expiration := letter.msg.Expiration
+	if expiration == 0 {
+		expiration = deadLetterExpiration
+	}
+	return broker.Message{
+		Subject:    deadLetterSubject,
+		Body:       letter.msg.Body,
+		Headers:    headers,
+		Expiration: expiration,
+		Encoding:   letter.msg.Encoding,
+	}, true
+}
+
+// deadLetterPublisher publishes the dead letters, through the owner of
+// their subject when the subjects are sharded.
+func (m *Module) deadLetterPublisher() broker.Broker {
+	if m.router != nil {
+		return m.router
+	}
+	return m
+}
+
+// deadLetterLater is used on the delivery path, the message is queued and
+// moved to the dead-letter subject once the locks held there are released.
+func (m *Module) deadLetterLater(subject string, msg broker.Message, reason string, deliveries int) {
+	if _, ok := m.deadLetters.get(subject); !ok {
+		return
+	}
+	m.deadLetterMover.add(deadLetter{subject: subject, msg: msg, reason: reason, deliveries: deliveries})
+}
+
+// moveDeadLetters publishes the dead letters queued on the delivery path
+// in one batch.
+func (m *Module) moveDeadLetters(letters []deadLetter) {
+	batch := make([]broker.Message, 0, len(letters))
+	for _, letter := range letters {
+		if msg, ok := m.deadLetterMessage(letter); ok {
+			batch = append(batch, msg)
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	_, _ = m.deadLetterPublisher().PublishBatch(context.Background(), batch)
+}
+
+// deadLetterMover takes the dead letters off the delivery path. They wait
+// in a queue, and one goroutine moves them in batches.
+type deadLetterMover struct {
+	sync.Mutex
+	pending []deadLetter
+	move    func(letters []deadLetter)
+	// wake tells the goroutine there are dead letters waiting
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newDeadLetterMover(move func(letters []deadLetter)) *deadLetterMover {
+	d := &deadLetterMover{
+		move:    move,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *deadLetterMover) add(letter deadLetter) {
+	d.Lock()
+	if len(d.pending) >= maxPendingDeadLetters {
+		d.Unlock()
+		return
+	}
+	d.pending = append(d.pending, letter)
+	d.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the dead letters waiting, up to a batch.
+func (d *deadLetterMover) next() []deadLetter {
+	d.Lock()
+	defer d.Unlock()
+
+	n := len(d.pending)
+	if n > maxDeadLetterBatch {
+		n = maxDeadLetterBatch
+	}
+	letters := append([]deadLetter(nil), d.pending[:n]...)
+	d.pending = d.pending[n:]
+	if len(d.pending) == 0 {
+		d.pending = nil
+	}
+	return letters
+}
+
+func (d *deadLetterMover) run() {
+	defer close(d.stopped)
+
+	for {
+		if letters := d.next(); len(letters) > 0 {
+			d.move(letters)
+			continue
+		}
+		select {
+		case <-d.wake:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// close stops the goroutine, the dead letters still waiting are lost like
+// the messages buffered for the subscribers.
+func (d *deadLetterMover) close() {
+	d.once.Do(func() {
+		close(d.stop)
+		<-d.stopped
+	})
+}
+
+// publishedSubject is the subject a message delivered to a subscription
+// of subscribed was published on.
+func publishedSubject(subscribed string, msg broker.Message) string {
+	if msg.Subject != "" {
+		return msg.Subject
+	}
+	return subscribed
+}
@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"therealbroker/pkg/broker"
+	"time"
+)
+
+// dedupKey is an idempotency key on its subject, the same key on two
+// subjects names two messages.
+type dedupKey struct {
+	subject string
+	key     string
+}
+
+// dedupEntry is a key seen within the window and the id its message got.
+type dedupEntry struct {
+	id int
+	at time.Time
+	// stored is closed once the message has its id, publishes with the
+	// same key wait for it
+	stored chan struct{}
+	// pending is set until the message has its id, under the lock
+	pending bool
+	failed  bool
+}
+
+// dedup remembers the idempotency keys published within the window, so a
+// retried publish gets the id of the first one instead of a second message.
+// The times are the timestamps of the messages, which every broker of a
+// cluster agrees on.
+type dedup struct {
+	sync.Mutex
+	window  time.Duration
+	entries map[dedupKey]*dedupEntry
+	// order keeps the stored keys oldest first, so the ones past the
+	// window are forgotten
+	order []dedupSeen
+}
+
+type dedupSeen struct {
+	key   dedupKey
+	entry *dedupEntry
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{window: window, entries: make(map[dedupKey]*dedupEntry)}
+}
+
+// keyOf is the key of the message, false when it has none or the window
+// is off.
+func (d *dedup) keyOf(msg broker.Message, subject string) (dedupKey, bool) {
+	if d.window <= 0 || msg.IdempotencyKey == "" {
+		return dedupKey{}, false
+	}
+	return dedupKey{subject: subject, key: msg.IdempotencyKey}, true
+}
+
+// claim returns the id of the message published with the key within the
+// window, waiting for it while that message is being stored. Otherwise
+// the key is claimed and the caller reports the id with done.
+func (d *dedup) claim(key dedupKey, now time.Time) (int, bool) {
+	for {
+		d.Lock()
+		d.forget(now)
+		entry, ok := d.entries[key]
+		if !ok || (!entry.pending && entry.at.Add(d.window).Before(now)) {
+			d.entries[key] = &dedupEntry{at: now, stored: make(chan struct{}), pending: true}
+			d.Unlock()
+			return 0, false
+		}
+		d.Unlock()
+
+		<-entry.stored
+		if !entry.failed {
+			return entry.id, true
+		}
+	}
+}
+
+// claimBatch claims the keys of the batch in a fixed order, so batches
+// sharing keys do not wait for each other in a loop. It returns the ids of
+// the keys published before and the keys the batch has claimed.
+func (d *dedup) claimBatch(batch []broker.Message, now time.Time) (map[dedupKey]int, []dedupKey) {
+	keys := make([]dedupKey, 0)
+	seen := make(map[dedupKey]bool)
+	for _, msg := range batch {
+		if key, ok := d.keyOf(msg, msg.Subject); ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].subject != keys[j].subject {
+			return keys[i].subject < keys[j].subject
+		}
+		return keys[i].key < keys[j].key
+	})
+
+	published := make(map[dedupKey]int)
+	claimed := make([]dedupKey, 0)
+	for _, key := range keys {
+		if id, ok := d.claim(key, now); ok {
+			published[key] = id
+		} else {
+			claimed = append(claimed, key)
+		}
+	}
+	return published, claimed
+}
+
+// stored returns the id of the message stored with the key within the
+// window, without claiming the key. The leader of a cluster checks it
+// before it gives a message its id.
+func (d *dedup) stored(key dedupKey, now time.Time) (int, bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.forget(now)
+	entry, ok := d.entries[key]
+	if !ok || entry.pending || entry.at.Add(d.window).Before(now) {
+		return 0, false
+	}
+	return entry.id, true
+}
+
+// done stores the id of a claimed key, or releases the key when its
+// message could not be stored.
+func (d *dedup) done(key dedupKey, id int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	entry := d.entries[key]
+	entry.pending = false
+	if err != nil {
+		entry.failed = true
+		delete(d.entries, key)
+	} else {
+		entry.id = id
+		d.order = append(d.order, dedupSeen{key: key, entry: entry})
+	}
+	close(entry.stored)
+}
+
+// remember adds the keys stored before a restart, or by the publishes of a
+// cluster, the first message of every key wins.
+func (d *dedup) remember(msgs []broker.Message) {
+	d.Lock()
+	defer d.Unlock()
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Timestamp.Before(msgs[j].Timestamp)
+	})
+	if len(msgs) > 0 {
+		d.forget(msgs[0].Timestamp)
+	}
+	for _, msg := range msgs {
+		key, ok := d.keyOf(msg, msg.Subject)
+		if !ok {
+			continue
+		}
+		if _, ok := d.entries[key]; ok {
+			continue
+		}
+		entry := &dedupEntry{id: msg.ID, at: msg.Timestamp, stored: make(chan struct{})}
+		close(entry.stored)
+		d.entries[key] = entry
+		d.order = append(d.order, dedupSeen{key: key, entry: entry})
+	}
+}
+
+// forget drops the keys past the window, the caller holds the lock.
+func (d *dedup) forget(now time.Time) {
+	for len(d.order) > 0 && d.order[0].entry.at.Add(d.window).Before(now) {
+		seen := d.order[0]
+		if d.entries[seen.key] == seen.entry {
+			delete(d.entries, seen.key)
+		}
+		d.order = d.order[1:]
+	}
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"container/heap"
+	"sync"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/database"
+	"time"
+)
+
+// delayed holds the messages published with a DeliverAt back until they
+// are due and then sends them to the subscribers. Like the expiry, one
+// goroutine and one timer serve every subject of the module.
+type delayed struct {
+	sync.Mutex
+	deadlines deadlineHeap
+	deliver   func(subject string, msg broker.Message)
+	// wake tells the goroutine the earliest deadline changed
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newDelayed(deliver func(subject string, msg broker.Message)) *delayed {
+	d := &delayed{
+		deliver: deliver,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// schedule sends the stored message once its DeliverAt passes.
+func (d *delayed) schedule(subject string, msg broker.Message) {
+	d.Lock()
+	earliest := d.deadlines.Len() == 0 || msg.DeliverAt.Before(d.deadlines[0].at)
+	heap.Push(&d.deadlines, deadline{at: msg.DeliverAt, key: database.MessageKey{Subject: subject, ID: msg.ID}, msg: msg})
+	d.Unlock()
+
+	if earliest {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pending is the number of messages waiting to be sent
+func (d *delayed) pending() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.deadlines.Len()
+}
+
+// due pops the messages that are due, in the order they are due, and
+// returns the next deadline when there is one.
+func (d *delayed) due(now time.Time) ([]deadline, time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	var messages []deadline
+	for d.deadlines.Len() > 0 && !d.deadlines[0].at.After(now) {
+		messages = append(messages, heap.Pop(&d.deadlines).(deadline))
+	}
+	if d.deadlines.Len() == 0 {
+		return messages, time.Time{}
+	}
+	return messages, d.deadlines[0].at
+}
+
+func (d *delayed) run() {
+	defer close(d.stopped)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		messages, next := d.due(time.Now())
+		for _, due := range messages {
+			d.deliver(due.key.Subject, due.msg)
+		}
+
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(next))
+			wait = timer.C
+		}
+		select {
+		case <-wait:
+		case <-d.wake:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// close stops sending and waits for the messages being sent. The messages
+// still waiting stay in the storage, the persistent ones are scheduled
+// again when the broker starts.
+func (d *delayed) close() {
+	d.once.Do(func() { close(d.stop) })
+	<-d.stopped
+}
@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"container/heap"
+	"sync"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/database"
+	"time"
+)
+
+// maxExpiryBatch caps the messages removed from the storage in one call,
+// the rest of the due ones follow right after
+const maxExpiryBatch = 1024
+
+// expiry removes the messages from the storage once their expiration
+// passes. One goroutine and one timer serve every subject of the module,
+// the deadlines wait in a min-heap and the messages that are due together
+// are removed in one batch.
+type expiry struct {
+	sync.Mutex
+	deadlines deadlineHeap
+	remove    func(keys []database.MessageKey)
+	// wake tells the goroutine the earliest deadline changed
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+type deadline struct {
+	at  time.Time
+	key database.MessageKey
+	// msg is the message a delayed delivery sends
+	msg broker.Message
+}
+
+type deadlineHeap []deadline
+
+func (h deadlineHeap) Len() int            { return len(h) }
+func (h deadlineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x interface{}) { *h = append(*h, x.(deadline)) }
+
+// Less keeps the messages due at the same time in the order of their ids
+func (h deadlineHeap) Less(i, j int) bool {
+	return h[i].at.Before(h[j].at) || h[i].at.Equal(h[j].at) && h[i].key.ID < h[j].key.ID
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+func newExpiry(remove func(keys []database.MessageKey)) *expiry {
+	e := &expiry{
+		remove:  remove,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// schedule removes the message once expiration passes, messages without
+// an expiration are not kept in the first place.
+func (e *expiry) schedule(subject string, id int, expiration time.Duration) {
+	if expiration <= 0 {
+		return
+	}
+
+	at := time.Now().Add(expiration)
+	e.Lock()
+	earliest := e.deadlines.Len() == 0 || at.Before(e.deadlines[0].at)
+	heap.Push(&e.deadlines, deadline{at: at, key: database.MessageKey{Subject: subject, ID: id}})
+	e.Unlock()
+
+	if earliest {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pending is the number of messages waiting for their deadline
+func (e *expiry) pending() int {
+	e.Lock()
+	defer e.Unlock()
+	return e.deadlines.Len()
+}
+
+// due pops the messages whose deadline passed, up to a batch, and returns
+// the next deadline when there is one.
+func (e *expiry) due(now time.Time) ([]database.MessageKey, time.Time) {
+	e.Lock()
+	defer e.Unlock()
+
+	var keys []database.MessageKey
+	for e.deadlines.Len() > 0 && !e.deadlines[0].at.After(now) && len(keys) < maxExpiryBatch {
+		keys = append(keys, heap.Pop(&e.deadlines).(deadline).key)
+	}
+	if e.deadlines.Len() == 0 {
+		return keys, time.Time{}
+	}
+	return keys, e.deadlines[0].at
+}
+
+func (e *expiry) run() {
+	defer close(e.stopped)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		keys, next := e.due(time.Now())
+		if len(keys) > 0 {
+			e.remove(keys)
+			continue
+		}
+
+		//	Sleep until the earliest deadline, or until a new message
+		//	comes before it
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(next))
+			wait = timer.C
+		}
+		select {
+		case <-wait:
+		case <-e.wake:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// close stops removing messages and waits for the batch being removed.
+// The messages still waiting stay in the storage, Postgres and the file
+// log mark them expired when they start again.
+func (e *expiry) close() {
+	e.once.Do(func() { close(e.stop) })
+	<-e.stopped
+}
@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/database"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type removedKeys struct {
+	sync.Mutex
+	batches [][]database.MessageKey
+}
+
+func (r *removedKeys) remove(keys []database.MessageKey) {
+	r.Lock()
+	defer r.Unlock()
+	r.batches = append(r.batches, keys)
+}
+
+func (r *removedKeys) all() []database.MessageKey {
+	r.Lock()
+	defer r.Unlock()
+	var keys []database.MessageKey
+	for _, batch := range r.batches {
+		keys = append(keys, batch...)
+	}
+	return keys
+}
+
+func TestExpiryShouldRemoveDueMessagesInBatches(t *testing.T) {
+	removed := &removedKeys{}
+	e := newExpiry(removed.remove)
+	defer e.close()
+
+	for id := 0; id < 3*maxExpiryBatch; id++ {
+		e.schedule("ali", id, 50*time.Millisecond)
+	}
+	e.schedule("ali", -1, time.Hour)
+	e.schedule("ali", -2, 0)
+
+	assert.Eventually(t, func() bool { return e.pending() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, removed.all(), 3*maxExpiryBatch)
+	removed.Lock()
+	for _, batch := range removed.batches {
+		assert.LessOrEqual(t, len(batch), maxExpiryBatch)
+	}
+	assert.Less(t, len(removed.batches), 3*maxExpiryBatch)
+	removed.Unlock()
+}
+
+func TestExpiryShouldWakeForEarlierDeadline(t *testing.T) {
+	removed := &removedKeys{}
+	e := newExpiry(removed.remove)
+	defer e.close()
+
+	e.schedule("ali", 1, time.Hour)
+	time.Sleep(10 * time.Millisecond)
+	e.schedule("maryam", 2, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return len(removed.all()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []database.MessageKey{{Subject: "maryam", ID: 2}}, removed.all())
+}
+
+func TestExpiringMessagesShouldNotHoldGoroutines(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10000; i++ {
+		_, err := module.Publish(mainCtx, "ali", createMessageWithExpire(time.Hour))
+		assert.Nil(t, err)
+	}
+	assert.Less(t, runtime.NumGoroutine(), before+100)
+	assert.Equal(t, 10000, module.expiry.pending())
+}
+
+func TestExpiredBatchShouldNotBeFetchable(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+
+	batch := []broker.Message{
+		{Subject: "ali", Body: "short", Expiration: 50 * time.Millisecond},
+		{Subject: "maryam", Body: "long", Expiration: time.Hour},
+	}
+	ids, err := module.PublishBatch(mainCtx, batch)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := module.Fetch(mainCtx, "ali", ids[0])
+		return err == broker.ErrExpiredID
+	}, 5*time.Second, 10*time.Millisecond)
+	msg, err := module.Fetch(mainCtx, "maryam", ids[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "long", msg.Body)
+}
@@ -2,10 +2,12 @@ package broker
 
 import (
 	"context"
-	"errors"
 	"sync"
+	"sync/atomic"
 	"therealbroker/config"
+	"therealbroker/internal/cluster"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
 	"therealbroker/pkg/database"
 
 	"time"
@@ -17,165 +19,590 @@ const (
 	POSTGRES   = "POSTGRES"
 	CASSANDRA  = "CASSANDRA"
 	SCYLLA     = "SCYLLA"
+	FILE_LOG   = "FILE_LOG"
 	GOLANG_MAP = "NOT_PERSISTED"
 )
 
-type Subscriber struct {
-	channMsg chan broker.Message
-}
-
-type Queue struct {
-	queueName string
-	subs      []Subscriber
-}
-
 type Module struct {
-	// TODO: Add required fields
-	queue       map[string]Queue
-	messages    map[int]broker.Message
-	closed      bool
-	pgDb        database.DB
-	cassandraDb database.DB
-	scyllaDb    database.DB
+	queue       map[string]*Queue
+	subjects    *subjectTree
+	deadLetters *deadLetterSubjects
+	// deadLetterMover moves the messages the subscribers drop or give up on
+	deadLetterMover *deadLetterMover
+	inboxes         *inboxes
+	// expiry removes the stored messages once they expire
+	expiry *expiry
+	// delayed sends the messages published with a DeliverAt once they are due
+	delayed *delayed
+	// dedup gives the retries of a publish the id of the first one
+	dedup *dedup
+	// compression compresses the bodies once when they are published, they
+	// are stored and sent compressed
+	compression compression.Subjects
+	// lastSubscriberID is the id of the newest subscriber
+	lastSubscriberID uint64
+	// cluster replicates the publishes to the other brokers, nil on a
+	// broker of its own
+	cluster *cluster.Groups
+	// router publishes the messages the module moves on its own, like dead
+	// letters, to the owner of their subject when the subjects are sharded
+	router broker.Broker
+	closed int32
+	// publishing is held by every publish, so Close can wait for the
+	// ones already past the closed check before flushing the storage
+	publishing  sync.RWMutex
+	db          database.DB
 	storageType string
 	sync.RWMutex
 }
 
 func NewModule() broker.Broker {
-	return &Module{
-		queue:       make(map[string]Queue),
-		messages:    make(map[int]broker.Message),
-		storageType: config.GetConfigInstance().Broker.StorageType,
-		pgDb:        database.GetDatabaseInstance(),
-		cassandraDb: database.GetCassandraInstance(),
-		scyllaDb:    database.GetScyllaInstance(),
+	return newModule()
+}
+
+func newModule() *Module {
+	storageType := storageType()
+	db := storage(storageType)
+	//	The encodings are checked when the broker starts
+	subjectEncodings, _ := compression.Load(config.GetConfigInstance())
+	m := &Module{
+		queue:       make(map[string]*Queue),
+		subjects:    newSubjectTree(),
+		deadLetters: newDeadLetterSubjects(),
+		inboxes:     newInboxes(),
+		expiry:      newExpiry(db.DeleteMessages),
+		dedup:       newDedup(database.DedupWindow(config.GetConfigInstance())),
+		compression: subjectEncodings,
+		storageType: storageType,
+		db:          db,
+	}
+	m.delayed = newDelayed(m.deliver)
+	m.deadLetterMover = newDeadLetterMover(m.moveDeadLetters)
+
+	//	The keys published within the window before a restart still count
+	if m.dedup.window > 0 {
+		if keyed, err := db.KeyedMessages(context.Background(), time.Now().Add(-m.dedup.window)); err == nil {
+			m.dedup.remember(keyed)
+		}
+	}
+
+	//	Delayed messages stored before a restart are still sent when due,
+	//	the ones that came due while the broker was down are left for replay
+	if pending, err := db.DelayedMessages(context.Background(), time.Now()); err == nil {
+		for _, msg := range pending {
+			subject := msg.Subject
+			msg.Subject = ""
+			m.delayed.schedule(subject, msg)
+			m.expiry.schedule(subject, msg.ID, keptFor(msg))
+		}
+	}
+	return m
+}
+
+// storageType falls back to the in-memory storage when no configuration
+// has been loaded, e.g. when the module is used on its own in tests.
+func storageType() string {
+	cfg := config.GetConfigInstance()
+	if cfg == nil || cfg.Broker.StorageType == "" {
+		return GOLANG_MAP
+	}
+	return cfg.Broker.StorageType
+}
+
+// storage picks the database instance the messages are kept in, every
+// storage type behaves the same way behind the database.DB interface.
+func storage(storageType string) database.DB {
+	switch storageType {
+	case POSTGRES:
+		return database.GetDatabaseInstance()
+	case CASSANDRA:
+		return database.GetCassandraInstance()
+	case SCYLLA:
+		return database.GetScyllaInstance()
+	case FILE_LOG:
+		return database.GetFileLogInstance()
+	default:
+		return database.NewMemoryDB()
 	}
 }
 
+// Close stops accepting calls, closes the channel of every subscriber and
+// writes the pending batches of the storage. Closing again does nothing.
 func (m *Module) Close() error {
-	if m.closed {
-		return broker.ErrUnavailable
+	if !atomic.CompareAndSwapInt32(&m.closed, 0, 1) {
+		return nil
+	}
+
+	m.Lock()
+	for subject, queue := range m.queue {
+		for _, sub := range queue.all() {
+			sub.close()
+		}
+		delete(m.queue, subject)
+		m.subjects.remove(subject)
+	}
+	m.Unlock()
+	//	Stopped before waiting for the publishes, its own ones fail now
+	m.deadLetterMover.close()
+
+	m.publishing.Lock()
+	defer m.publishing.Unlock()
+	if m.cluster != nil {
+		m.cluster.Stop()
+	}
+	m.delayed.close()
+	m.expiry.close()
+	if err := m.db.Flush(); err != nil {
+		return err
+	}
+	//	The in-memory storage belongs to the module, the others are shared
+	//	and closed by their owner
+	if m.storageType == GOLANG_MAP {
+		return m.db.Close()
 	}
-	m.closed = true
 	return nil
 }
 
+func (m *Module) isClosed() bool {
+	return atomic.LoadInt32(&m.closed) == 1
+}
+
 func (m *Module) Publish(ctx context.Context, subject string, msg broker.Message) (int, error) {
-	if m.closed {
+	m.publishing.RLock()
+	defer m.publishing.RUnlock()
+	if m.isClosed() {
 		return -1, broker.ErrUnavailable
 	}
+	if !validSubject(subject, false) {
+		return -1, broker.ErrInvalidSubject
+	}
 
 	select {
 	case <-ctx.Done():
 		return -1, ctx.Err()
 	default:
 
-		//	Send new published message to subscribers
-		sendSpan, _ := opentracing.StartSpanFromContext(ctx, "Send Published Message to Subscribers")
-		for _, sub := range m.queue[subject].subs {
-			if len(sub.channMsg) != cap(sub.channMsg) {
-				sub.channMsg <- msg
-			}
+		msg.ID, msg.Subject = 0, ""
+		msg.Timestamp = time.Now().Truncate(time.Millisecond)
+		msg.DeliverAt = dueTime(msg)
+		msg, err := m.compression.Compress(subject, msg)
+		if err != nil {
+			return -1, err
 		}
-		sendSpan.Finish()
-
-		//	Store new message
-		storeSpan, storeCtx := opentracing.StartSpanFromContext(ctx, "Store Published Message")
-		var newMsgId int
-		var errInsertMsg error
-		switch m.storageType {
-		case GOLANG_MAP:
-			m.Lock()
-			newMsgId = len(m.messages)
-			m.messages[newMsgId] = msg
-			m.Unlock()
-		case POSTGRES:
-			newMsgId, errInsertMsg = m.pgDb.AddMessage(storeCtx, msg, subject)
-			if errInsertMsg != nil {
-				return -1, errInsertMsg
+
+		//	In a cluster the message is stored and sent by every broker
+		//	once a quorum has it in the log
+		if m.cluster != nil {
+			msg.Subject = subject
+			ids, err := m.replicate(ctx, command{Op: opPublish, Messages: []broker.Message{msg}})
+			if err != nil {
+				return -1, err
 			}
-		case CASSANDRA:
-			newMsgId, _ = m.cassandraDb.AddMessage(storeCtx, msg, subject)
-		case SCYLLA:
-			newMsgId, _ = m.scyllaDb.AddMessage(storeCtx, msg, subject)
+			return ids[0], nil
 		}
-		storeSpan.Finish()
+		return m.publish(ctx, subject, msg)
+	}
 
-		//	Check Expiration
-		if msg.Expiration != 0 {
-			go func(msgId int, subjct string, ticker time.Duration) {
+}
+
+// publish stores the message and sends it to the subscribers of the
+// subject, the message already has its timestamp.
+func (m *Module) publish(ctx context.Context, subject string, msg broker.Message) (int, error) {
+	//	A retry within the dedup window gets the id of the first publish
+	key, keyed := m.dedup.keyOf(msg, subject)
+	if keyed {
+		if id, ok := m.dedup.claim(key, msg.Timestamp); ok {
+			return id, nil
+		}
+	}
+
+	//	Store new message
+	storeSpan, storeCtx := opentracing.StartSpanFromContext(ctx, "Store Published Message")
+	newMsgId, errInsertMsg := m.db.AddMessage(storeCtx, msg, subject)
+	storeSpan.Finish()
+	if keyed {
+		m.dedup.done(key, newMsgId, errInsertMsg)
+	}
+	if errInsertMsg != nil {
+		return -1, errInsertMsg
+	}
+
+	//	Send new published message to subscribers, after it is stored
+	//	so they get its id, or hold it back until it is due
+	msg.ID, msg.IdempotencyKey = newMsgId, ""
+	sendSpan, _ := opentracing.StartSpanFromContext(ctx, "Send Published Message to Subscribers")
+	if msg.DeliverAt.IsZero() {
+		m.deliver(subject, msg)
+	} else {
+		m.delayed.schedule(subject, msg)
+	}
+	sendSpan.Finish()
+
+	m.expiry.schedule(subject, newMsgId, keptFor(msg))
+
+	return newMsgId, nil
+}
+
+// deliver sends a stored message to the subscribers of its subject.
+func (m *Module) deliver(subject string, msg broker.Message) {
+	var blocked []blockedMessage
+	m.RLock()
+	for _, queue := range m.subjects.match(subject) {
+		blocked = queue.deliver(subject, msg, msg.ID, blocked)
+	}
+	m.RUnlock()
+	waitForRoom(blocked)
+}
+
+// waitForRoom waits for the subscribers that block, after the lock of the
+// module is released so a slow subscriber does not hold up the others.
+func waitForRoom(blocked []blockedMessage) {
+	for _, held := range blocked {
+		held.sub.block(held.msg, held.id)
+	}
+}
+
+// dueTime is the DeliverAt of a published message with the precision of
+// its timestamp, zero when the message is not held back.
+func dueTime(msg broker.Message) time.Time {
+	at := msg.DeliverAt.Truncate(time.Millisecond)
+	if !at.After(msg.Timestamp) {
+		return time.Time{}
+	}
+	return at
+}
+
+// keptFor is how long the storage keeps the message from now on, the
+// expiration of a delayed message counts from the time it is due.
+func keptFor(msg broker.Message) time.Duration {
+	if msg.DeliverAt.IsZero() {
+		return msg.Expiration
+	}
+	return time.Until(msg.DeliverAt) + msg.Expiration
+}
+
+func (m *Module) PublishBatch(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	m.publishing.RLock()
+	defer m.publishing.RUnlock()
+	if m.isClosed() {
+		return nil, broker.ErrUnavailable
+	}
+	for _, msg := range msgs {
+		if !validSubject(msg.Subject, false) {
+			return nil, broker.ErrInvalidSubject
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+
+		timestamp := time.Now().Truncate(time.Millisecond)
+		batch := make([]broker.Message, len(msgs))
+		for i, msg := range msgs {
+			msg.ID = 0
+			msg.Timestamp = timestamp
+			msg.DeliverAt = dueTime(msg)
+			msg, err := m.compression.Compress(msg.Subject, msg)
+			if err != nil {
+				return nil, err
+			}
+			batch[i] = msg
+		}
+		if m.cluster != nil {
+			return m.replicate(ctx, command{Op: opPublish, Messages: batch})
+		}
+		return m.publishBatch(ctx, batch)
+	}
+}
 
-				expireTime := time.NewTicker(ticker * time.Second)
-				defer expireTime.Stop()
+// publishBatch stores the messages at once and sends them in the order of
+// the batch, which keeps the order within each subject. Messages with a key
+// published before, or earlier in the batch, get the id of the first one.
+func (m *Module) publishBatch(ctx context.Context, batch []broker.Message) ([]int, error) {
+	var timestamp time.Time
+	if len(batch) > 0 {
+		timestamp = batch[0].Timestamp
+	}
+	published, claimed := m.dedup.claimBatch(batch, timestamp)
+	fresh := make([]broker.Message, 0, len(batch))
+	positions := make(map[dedupKey]int)
+	for _, msg := range batch {
+		if key, ok := m.dedup.keyOf(msg, msg.Subject); ok {
+			if _, ok := published[key]; ok {
+				continue
+			}
+			if _, ok := positions[key]; ok {
+				continue
+			}
+			positions[key] = len(fresh)
+		}
+		fresh = append(fresh, msg)
+	}
 
-				<-expireTime.C
-				switch m.storageType {
-				case GOLANG_MAP:
-					m.Lock()
-					delete(m.messages, msgId)
-					m.Unlock()
-				case POSTGRES:
-					m.pgDb.DeleteMessage(subjct, msgId)
-				case CASSANDRA:
-					m.cassandraDb.DeleteMessage(subjct, msgId)
-				case SCYLLA:
-					m.scyllaDb.DeleteMessage(subjct, msgId)
-				}
+	storeSpan, storeCtx := opentracing.StartSpanFromContext(ctx, "Store Published Batch")
+	freshIDs, errInsertMsgs := m.db.AddMessages(storeCtx, fresh)
+	storeSpan.Finish()
+	for _, key := range claimed {
+		var id int
+		if errInsertMsgs == nil {
+			id = freshIDs[positions[key]]
+		}
+		m.dedup.done(key, id, errInsertMsgs)
+	}
+	if errInsertMsgs != nil {
+		return nil, errInsertMsgs
+	}
 
-			}(newMsgId, subject, msg.Expiration)
+	batchIDs := make([]int, 0, len(batch))
+	next := 0
+	for _, msg := range batch {
+		key, ok := m.dedup.keyOf(msg, msg.Subject)
+		switch {
+		case ok && published[key] > 0:
+			batchIDs = append(batchIDs, published[key])
+		case ok && positions[key] < next:
+			batchIDs = append(batchIDs, freshIDs[positions[key]])
+		default:
+			batchIDs = append(batchIDs, freshIDs[next])
+			next++
 		}
+	}
+	m.send(ctx, fresh, freshIDs)
+	return batchIDs, nil
+}
 
-		return newMsgId, nil
+// send hands the stored messages of a batch to the subscribers of their
+// Subject in order, or holds them back until they are due, and schedules
+// their expiration.
+func (m *Module) send(ctx context.Context, batch []broker.Message, ids []int) {
+	sendSpan, _ := opentracing.StartSpanFromContext(ctx, "Send Published Batch to Subscribers")
+	var blocked []blockedMessage
+	m.RLock()
+	for i, msg := range batch {
+		subject := msg.Subject
+		msg.ID, msg.Subject, msg.IdempotencyKey = ids[i], "", ""
+		if !msg.DeliverAt.IsZero() {
+			m.delayed.schedule(subject, msg)
+			continue
+		}
+		for _, queue := range m.subjects.match(subject) {
+			blocked = queue.deliver(subject, msg, ids[i], blocked)
+		}
 	}
+	m.RUnlock()
+	waitForRoom(blocked)
+	sendSpan.Finish()
 
+	for i, msg := range batch {
+		m.expiry.schedule(msg.Subject, ids[i], keptFor(msg))
+	}
 }
 
 func (m *Module) Subscribe(ctx context.Context, subject string) (<-chan broker.Message, error) {
+	return m.SubscribeWithOptions(ctx, subject, broker.SubscribeOptions{})
+}
+
+func (m *Module) SubscribeWithOptions(ctx context.Context, subject string, opts broker.SubscribeOptions) (<-chan broker.Message, error) {
 
-	if m.closed {
+	if m.isClosed() {
 		return nil, broker.ErrUnavailable
 	}
+	if !validSubject(subject, true) {
+		return nil, broker.ErrInvalidSubject
+	}
 
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
+		if opts.AckWait > 0 && opts.Consumer == "" {
+			return nil, broker.ErrInvalidConsumer
+		}
+		if !validBackpressure(opts) {
+			return nil, broker.ErrInvalidOptions
+		}
+		filter, replay, err := replayFilter(opts)
+		if err != nil {
+			return nil, err
+		}
+		//	Stored messages are looked up by their exact subject
+		if replay && hasWildcard(subject) {
+			return nil, broker.ErrInvalidOptions
+		}
+
 		subSpan, _ := opentracing.StartSpanFromContext(ctx, "Add new Subscriber")
-		chanMsg := make(chan broker.Message, 200)
+		sub := &Subscriber{
+			id:       atomic.AddUint64(&m.lastSubscriberID, 1),
+			buffer:   newMessageBuffer(opts),
+			group:    opts.Group,
+			consumer: opts.Consumer,
+		}
+		sub.buffer.onDisconnect = func() {
+			m.unsubscribe(subject, sub)
+		}
+		//	Messages that can not be delivered go to the dead-letter subject,
+		//	acked ones only once they are given up on
+		if opts.AckWait > 0 {
+			sub.acks = newAckTracker(opts)
+			sub.acks.onGiveUp = func(msg broker.Message, deliveries int) {
+				m.deadLetterLater(publishedSubject(subject, msg), msg, broker.ReasonMaxDeliver, deliveries)
+			}
+		} else {
+			sub.buffer.onDrop = func(msg broker.Message) {
+				m.deadLetterLater(publishedSubject(subject, msg), msg, broker.ReasonBufferFull, 0)
+			}
+		}
+		if replay {
+			sub.replaying = 1
+		}
 		m.Lock()
-		m.queue[subject] = Queue{
-			queueName: subject,
-			subs:      append(m.queue[subject].subs, Subscriber{channMsg: chanMsg}),
+		//	Close may have emptied the queues since the check above
+		if m.isClosed() {
+			m.Unlock()
+			subSpan.Finish()
+			return nil, broker.ErrUnavailable
 		}
+		queue, ok := m.queue[subject]
+		if !ok {
+			queue = newQueue(subject)
+			m.queue[subject] = queue
+			m.subjects.insert(subject, queue)
+		}
+		errAdd := queue.add(sub)
 		m.Unlock()
 		subSpan.Finish()
+		if errAdd != nil {
+			return nil, errAdd
+		}
 
-		go func(ctx context.Context, channel chan broker.Message, subj string) {
-			switch m.storageType {
-			case POSTGRES:
-				messages, _ := m.pgDb.GetMessagesBySubject(ctx, subj)
-				for _, msg := range messages {
-					channel <- msg
-				}
-			case CASSANDRA:
-				messages, _ := m.cassandraDb.GetMessagesBySubject(ctx, subj)
-				for _, msg := range messages {
-					channel <- msg
-				}
-			case SCYLLA:
-				messages, _ := m.scyllaDb.GetMessagesBySubject(ctx, subj)
-				for _, msg := range messages {
-					channel <- msg
-				}
+		if sub.acks != nil {
+			go sub.acks.redeliver(sub)
+		}
+
+		//	Stop sending messages to the subscriber once its context is done
+		if done := ctx.Done(); done != nil {
+			go func() {
+				<-done
+				m.unsubscribe(subject, sub)
+			}()
+		}
+
+		if replay {
+			go m.replay(ctx, sub, subject, filter)
+		}
+
+		return sub.buffer.out, nil
+	}
+}
+
+// replayFilter turns the deliver policy into the filter of the stored
+// messages, replay is false when only new messages are wanted.
+func replayFilter(opts broker.SubscribeOptions) (database.ReplayFilter, bool, error) {
+	if opts.DeliverPolicy != broker.DeliverNew && opts.Group != "" {
+		return database.ReplayFilter{}, false, broker.ErrInvalidOptions
+	}
+
+	switch opts.DeliverPolicy {
+	case broker.DeliverNew:
+		return database.ReplayFilter{}, false, nil
+	case broker.DeliverAll:
+		return database.ReplayFilter{}, true, nil
+	case broker.DeliverLastN:
+		if opts.LastN <= 0 {
+			return database.ReplayFilter{}, false, broker.ErrInvalidOptions
+		}
+		return database.ReplayFilter{LastN: opts.LastN}, true, nil
+	case broker.DeliverFromID:
+		return database.ReplayFilter{FromID: opts.StartID}, true, nil
+	case broker.DeliverFromTime:
+		return database.ReplayFilter{FromTime: opts.StartTime}, true, nil
+	default:
+		return database.ReplayFilter{}, false, broker.ErrInvalidOptions
+	}
+}
+
+func validBackpressure(opts broker.SubscribeOptions) bool {
+	return opts.Backpressure >= broker.DropNewest && opts.Backpressure <= broker.Disconnect &&
+		opts.BufferSize >= 0 && opts.BufferBytes >= 0
+}
+
+// replay sends the stored messages to a subscriber that has been collecting
+// the live ones meanwhile, then hands it over to live delivery. Live messages
+// that are part of the replayed ones are skipped by their id.
+func (m *Module) replay(ctx context.Context, sub *Subscriber, subject string, filter database.ReplayFilter) {
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Replay stored messages to Subscriber")
+	defer span.Finish()
+
+	//	Messages that are not due yet reach the subscriber when they are
+	replayed := make([]int, 0)
+	now := time.Now()
+	messages, err := m.db.GetMessagesBySubject(spanCtx, subject, filter)
+	if err == nil {
+		for _, msg := range messages {
+			if msg.DeliverAt.After(now) {
+				continue
+			}
+			if !sub.push(ctx, msg, msg.ID) {
+				return
+			}
+			replayed = append(replayed, msg.ID)
+		}
+	}
+	sub.finishReplay(ctx, replayed)
+}
+
+func (m *Module) unsubscribe(subject string, sub *Subscriber) {
+	m.Lock()
+	defer m.Unlock()
+
+	sub.close()
+	queue, ok := m.queue[subject]
+	if !ok {
+		return
+	}
+	queue.remove(sub)
+	if queue.empty() {
+		delete(m.queue, subject)
+		m.subjects.remove(subject)
+	}
+}
+
+func (m *Module) Ack(ctx context.Context, subject string, consumer string, id int) error {
+	if m.isClosed() {
+		return broker.ErrUnavailable
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "Ack message in Broker Module")
+	defer span.Finish()
+
+	m.RLock()
+	var sub *Subscriber
+	var published string
+	if queue, ok := m.queue[subject]; ok && !queue.wildcard {
+		sub = queue.consumers[consumer]
+	}
+	//	Ids are only unique within a subject, consumers of a wildcard
+	//	subject ack with the subject the message was published on
+	if sub == nil && validSubject(subject, false) {
+		for _, queue := range m.subjects.match(subject) {
+			if queue.wildcard && queue.consumers[consumer] != nil {
+				sub, published = queue.consumers[consumer], subject
+				break
 			}
-		}(ctx, chanMsg, subject)
+		}
+	}
+	m.RUnlock()
 
-		return chanMsg, nil
+	if sub == nil || sub.acks == nil {
+		return broker.ErrUnknownConsumer
 	}
+	return sub.acks.ack(published, id)
 }
 
 func (m *Module) Fetch(ctx context.Context, subject string, id int) (broker.Message, error) {
-	if m.closed {
+	if m.isClosed() {
 		return broker.Message{}, broker.ErrUnavailable
 	}
 
@@ -185,38 +612,12 @@ func (m *Module) Fetch(ctx context.Context, subject string, id int) (broker.Mess
 	default:
 
 		retrieveSpan, retrieveCtx := opentracing.StartSpanFromContext(ctx, "Retrieve message in fetch method Broker Module")
+		defer retrieveSpan.Finish()
 
-		var msg broker.Message
-		var errRetrieving error
-		var messageExist bool
-
-		switch m.storageType {
-
-		case GOLANG_MAP:
-			m.RLock()
-			msg, messageExist = m.messages[id]
-			m.RUnlock()
-
-			if !messageExist {
-				return broker.Message{}, errors.New(broker.ErrInvalidID.Error() + " or " + broker.ErrExpiredID.Error())
-			}
-		case POSTGRES:
-			msg, errRetrieving = m.pgDb.FetchMessage(retrieveCtx, id, subject)
-			if errRetrieving != nil {
-				return broker.Message{}, errRetrieving
-			}
-		case CASSANDRA:
-			msg, errRetrieving = m.cassandraDb.FetchMessage(retrieveCtx, id, subject)
-			if errRetrieving != nil {
-				return broker.Message{}, errRetrieving
-			}
-		case SCYLLA:
-			msg, errRetrieving = m.scyllaDb.FetchMessage(retrieveCtx, id, subject)
-			if errRetrieving != nil {
-				return broker.Message{}, errRetrieving
-			}
+		msg, errRetrieving := m.db.FetchMessage(retrieveCtx, id, subject)
+		if errRetrieving != nil {
+			return broker.Message{}, errRetrieving
 		}
-		retrieveSpan.Finish()
 
 		return msg, nil
 
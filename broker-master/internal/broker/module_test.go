@@ -3,9 +3,11 @@ package broker
 import (
 	"context"
 	"math/rand"
+	"strings"
 	"sync"
 	"testing"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -26,26 +28,29 @@ func TestMain(m *testing.M) {
 func TestPublishShouldFailOnClosed(t *testing.T) {
 	msg := createMessage()
 
-	err := service.Close()
+	module := NewModule()
+	err := module.Close()
 	assert.Nil(t, err)
 
-	_, err = service.Publish(mainCtx, "ali", msg)
+	_, err = module.Publish(mainCtx, "ali", msg)
 	assert.Equal(t, broker.ErrUnavailable, err)
 }
 
 func TestSubscribeShouldFailOnClosed(t *testing.T) {
-	err := service.Close()
+	module := NewModule()
+	err := module.Close()
 	assert.Nil(t, err)
 
-	_, err = service.Subscribe(mainCtx, "ali")
+	_, err = module.Subscribe(mainCtx, "ali")
 	assert.Equal(t, broker.ErrUnavailable, err)
 }
 
 func TestFetchShouldFailOnClosed(t *testing.T) {
-	err := service.Close()
+	module := NewModule()
+	err := module.Close()
 	assert.Nil(t, err)
 
-	_, err = service.Fetch(mainCtx, "ali", rand.Intn(100))
+	_, err = module.Fetch(mainCtx, "ali", rand.Intn(100))
 	assert.Equal(t, broker.ErrUnavailable, err)
 }
 
@@ -68,10 +73,11 @@ func TestPublishShouldSendMessageToSubscribedChan(t *testing.T) {
 	msg := createMessage()
 
 	sub, _ := service.Subscribe(mainCtx, "ali")
-	_, _ = service.Publish(mainCtx, "ali", msg)
+	id, _ := service.Publish(mainCtx, "ali", msg)
 	in := <-sub
 
-	assert.Equal(t, msg, in)
+	assert.False(t, in.Timestamp.IsZero())
+	assert.Equal(t, published(msg, id, in.Timestamp), in)
 }
 
 func TestPublishShouldSendMessageToSubscribedChans(t *testing.T) {
@@ -80,11 +86,12 @@ func TestPublishShouldSendMessageToSubscribedChans(t *testing.T) {
 	sub1, _ := service.Subscribe(mainCtx, "ali")
 	sub2, _ := service.Subscribe(mainCtx, "ali")
 	sub3, _ := service.Subscribe(mainCtx, "ali")
-	_, _ = service.Publish(mainCtx, "ali", msg)
+	id, _ := service.Publish(mainCtx, "ali", msg)
 	in1 := <-sub1
 	in2 := <-sub2
 	in3 := <-sub3
 
+	msg = published(msg, id, in1.Timestamp)
 	assert.Equal(t, msg, in1)
 	assert.Equal(t, msg, in2)
 	assert.Equal(t, msg, in3)
@@ -93,15 +100,16 @@ func TestPublishShouldSendMessageToSubscribedChans(t *testing.T) {
 func TestPublishShouldPreserveOrder(t *testing.T) {
 	n := 50
 	messages := make([]broker.Message, n)
+	ids := make([]int, n)
 	sub, _ := service.Subscribe(mainCtx, "ali")
 	for i := 0; i < n; i++ {
 		messages[i] = createMessage()
-		_, _ = service.Publish(mainCtx, "ali", messages[i])
+		ids[i], _ = service.Publish(mainCtx, "ali", messages[i])
 	}
 
 	for i := 0; i < n; i++ {
 		msg := <-sub
-		assert.Equal(t, messages[i], msg)
+		assert.Equal(t, published(messages[i], ids[i], msg.Timestamp), msg)
 	}
 }
 
@@ -110,10 +118,10 @@ func TestPublishShouldNotSendToOtherSubscriptions(t *testing.T) {
 	ali, _ := service.Subscribe(mainCtx, "ali")
 	maryam, _ := service.Subscribe(mainCtx, "maryam")
 
-	_, _ = service.Publish(mainCtx, "ali", msg)
+	id, _ := service.Publish(mainCtx, "ali", msg)
 	select {
 	case m := <-ali:
-		assert.Equal(t, msg, m)
+		assert.Equal(t, published(msg, id, m.Timestamp), m)
 	case <-maryam:
 		assert.Fail(t, "Wrong message received")
 	}
@@ -124,7 +132,7 @@ func TestNonExpiredMessageShouldBeFetchable(t *testing.T) {
 	id, _ := service.Publish(mainCtx, "ali", msg)
 	fMsg, _ := service.Fetch(mainCtx, "ali", id)
 
-	assert.Equal(t, msg, fMsg)
+	assert.Equal(t, published(msg, id, fMsg.Timestamp), fMsg)
 }
 
 func TestExpiredMessageShouldNotBeFetchable(t *testing.T) {
@@ -307,6 +315,576 @@ func TestDataRace(t *testing.T) {
 	wg.Wait()
 }
 
+func TestQueueGroupShouldSplitMessagesBetweenMembers(t *testing.T) {
+	module := NewModule()
+	group := broker.SubscribeOptions{Group: "workers"}
+
+	sub1, _ := module.SubscribeWithOptions(mainCtx, "ali", group)
+	sub2, _ := module.SubscribeWithOptions(mainCtx, "ali", group)
+	all, _ := module.Subscribe(mainCtx, "ali")
+
+	n := 10
+	for i := 0; i < n; i++ {
+		_, err := module.Publish(mainCtx, "ali", createMessage())
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, n/2, len(drain(sub1)))
+	assert.Equal(t, n/2, len(drain(sub2)))
+	assert.Equal(t, n, len(drain(all)))
+}
+
+func TestQueueGroupShouldSkipCancelledMembers(t *testing.T) {
+	module := NewModule()
+	group := broker.SubscribeOptions{Group: "workers"}
+
+	ctx, cancel := context.WithCancel(mainCtx)
+	gone, _ := module.SubscribeWithOptions(ctx, "ali", group)
+	alive, _ := module.SubscribeWithOptions(mainCtx, "ali", group)
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		m := module.(*Module)
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.queue["ali"].groups["workers"].members) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		_, _ = module.Publish(mainCtx, "ali", createMessage())
+	}
+	assert.Equal(t, 0, len(drain(gone)))
+	assert.Equal(t, 4, len(drain(alive)))
+}
+
+func TestUnackedMessageShouldBeRedelivered(t *testing.T) {
+	module := NewModule()
+	sub, err := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{
+		Consumer: "worker",
+		AckWait:  100 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+
+	msg := createMessage()
+	id, _ := module.Publish(mainCtx, "ali", msg)
+
+	first := <-sub
+	assert.Equal(t, id, first.ID)
+	assert.Equal(t, msg.Body, first.Body)
+
+	select {
+	case again := <-sub:
+		assert.Equal(t, first, again)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Unacked message was not redelivered")
+	}
+
+	assert.Nil(t, module.Ack(mainCtx, "ali", "worker", id))
+	select {
+	case <-sub:
+		assert.Fail(t, "Acked message was redelivered")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestUnackedMessageShouldStopAfterMaxDeliver(t *testing.T) {
+	module := NewModule()
+	sub, _ := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{
+		Consumer:   "worker",
+		AckWait:    50 * time.Millisecond,
+		MaxDeliver: 2,
+	})
+
+	id, _ := module.Publish(mainCtx, "ali", createMessage())
+	<-sub
+	<-sub
+	select {
+	case <-sub:
+		assert.Fail(t, "Message was delivered more than MaxDeliver")
+	case <-time.After(300 * time.Millisecond):
+	}
+	assert.Equal(t, broker.ErrInvalidID, module.Ack(mainCtx, "ali", "worker", id))
+}
+
+func TestAckShouldTellWildcardMessagesApartBySubject(t *testing.T) {
+	module := NewModule()
+	sub, _ := module.SubscribeWithOptions(mainCtx, "ali.*", broker.SubscribeOptions{
+		Consumer: "worker",
+		AckWait:  100 * time.Millisecond,
+	})
+
+	first, _ := module.Publish(mainCtx, "ali.a", createMessage())
+	second, _ := module.Publish(mainCtx, "ali.b", createMessage())
+	assert.Equal(t, first, second)
+	<-sub
+	<-sub
+
+	assert.Nil(t, module.Ack(mainCtx, "ali.a", "worker", first))
+	assert.Equal(t, broker.ErrInvalidID, module.Ack(mainCtx, "ali.a", "worker", first))
+	select {
+	case again := <-sub:
+		assert.Equal(t, "ali.b", again.Subject)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Unacked message was not redelivered")
+	}
+	assert.Nil(t, module.Ack(mainCtx, "ali.b", "worker", second))
+}
+
+func TestAckShouldFailForUnknownConsumer(t *testing.T) {
+	module := NewModule()
+	_, err := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{AckWait: time.Second})
+	assert.Equal(t, broker.ErrInvalidConsumer, err)
+
+	err = module.Ack(mainCtx, "ali", "nobody", 0)
+	assert.Equal(t, broker.ErrUnknownConsumer, err)
+}
+
+func TestDeliverPoliciesShouldReplayStoredMessages(t *testing.T) {
+	module := NewModule()
+	ids := make([]int, 5)
+	messages := make([]broker.Message, 5)
+	//	The module counts expirations in seconds
+	for i := range messages {
+		messages[i] = createMessageWithExpire(time.Second * 10)
+		ids[i], _ = module.Publish(mainCtx, "ali", messages[i])
+	}
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	late := createMessageWithExpire(time.Second * 10)
+	lateID, _ := module.Publish(mainCtx, "ali", late)
+
+	cases := []struct {
+		opts     broker.SubscribeOptions
+		expected []int
+	}{
+		{broker.SubscribeOptions{DeliverPolicy: broker.DeliverAll}, append(ids, lateID)},
+		{broker.SubscribeOptions{DeliverPolicy: broker.DeliverLastN, LastN: 2}, []int{ids[4], lateID}},
+		{broker.SubscribeOptions{DeliverPolicy: broker.DeliverFromID, StartID: ids[3]}, []int{ids[3], ids[4], lateID}},
+		{broker.SubscribeOptions{DeliverPolicy: broker.DeliverFromTime, StartTime: middle}, []int{lateID}},
+	}
+	for _, c := range cases {
+		sub, err := module.SubscribeWithOptions(mainCtx, "ali", c.opts)
+		assert.Nil(t, err)
+		for _, id := range c.expected {
+			msg := <-sub
+			assert.Equal(t, id, msg.ID)
+		}
+
+		live := createMessage()
+		_, _ = module.Publish(mainCtx, "ali", live)
+		assert.Equal(t, live.Body, (<-sub).Body)
+	}
+}
+
+func TestDelayedMessageShouldWaitUntilDue(t *testing.T) {
+	module := NewModule()
+	defer module.Close()
+	sub, _ := module.Subscribe(mainCtx, "ali")
+
+	msg := createMessageWithExpire(time.Second * 10)
+	msg.DeliverAt = time.Now().Add(200 * time.Millisecond)
+	id, err := module.Publish(mainCtx, "ali", msg)
+	assert.Nil(t, err)
+	now := createMessage()
+	_, _ = module.Publish(mainCtx, "ali", now)
+
+	assert.Equal(t, now.Body, (<-sub).Body)
+	select {
+	case <-sub:
+		assert.Fail(t, "Delayed message was sent early")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	in := <-sub
+	assert.Equal(t, id, in.ID)
+	assert.False(t, time.Now().Before(in.DeliverAt))
+
+	//	A replay only gets the messages that are due
+	late := createMessageWithExpire(time.Second * 10)
+	late.DeliverAt = time.Now().Add(time.Hour)
+	_, _ = module.Publish(mainCtx, "ali", late)
+	replay, _ := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{DeliverPolicy: broker.DeliverAll})
+	messages := drain(replay)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, id, messages[0].ID)
+}
+
+func TestDeliverPolicyShouldBeRejectedForGroups(t *testing.T) {
+	module := NewModule()
+	_, err := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{
+		Group:         "workers",
+		DeliverPolicy: broker.DeliverAll,
+	})
+	assert.Equal(t, broker.ErrInvalidOptions, err)
+
+	_, err = module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{DeliverPolicy: broker.DeliverLastN})
+	assert.Equal(t, broker.ErrInvalidOptions, err)
+}
+
+func TestWildcardSubscriptionsShouldGetMatchingSubjects(t *testing.T) {
+	module := NewModule()
+	created, _ := module.Subscribe(mainCtx, "orders.*.created")
+	orders, _ := module.Subscribe(mainCtx, "orders.>")
+	exact, _ := module.Subscribe(mainCtx, "orders.eu.created")
+
+	msg := createMessage()
+	id, _ := module.Publish(mainCtx, "orders.eu.created", msg)
+	_, _ = module.Publish(mainCtx, "orders.us.cancelled", createMessage())
+	_, _ = module.Publish(mainCtx, "orders", createMessage())
+
+	in := drain(created)
+	assert.Equal(t, 2, len(drain(orders)))
+	exactIn := drain(exact)
+	assert.Equal(t, 1, len(exactIn))
+	assert.Equal(t, published(msg, id, exactIn[0].Timestamp), exactIn[0])
+
+	assert.Equal(t, 1, len(in))
+	assert.Equal(t, "orders.eu.created", in[0].Subject)
+	assert.Equal(t, msg.Body, in[0].Body)
+}
+
+func TestInvalidSubjectsShouldBeRejected(t *testing.T) {
+	module := NewModule()
+	for _, subject := range []string{"", "orders..created", "orders.*", "orders.>"} {
+		_, err := module.Publish(mainCtx, subject, createMessage())
+		assert.Equal(t, broker.ErrInvalidSubject, err, subject)
+	}
+	for _, subject := range []string{"", "orders.", "orders.>.created"} {
+		_, err := module.Subscribe(mainCtx, subject)
+		assert.Equal(t, broker.ErrInvalidSubject, err, subject)
+	}
+
+	_, err := module.SubscribeWithOptions(mainCtx, "orders.*", broker.SubscribeOptions{DeliverPolicy: broker.DeliverAll})
+	assert.Equal(t, broker.ErrInvalidOptions, err)
+}
+
+func TestWildcardSubscriptionShouldBeRemovedOnCancel(t *testing.T) {
+	module := NewModule()
+	ctx, cancel := context.WithCancel(mainCtx)
+	sub, _ := module.Subscribe(ctx, "orders.*.created")
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		m := module.(*Module)
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.subjects.root.children) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, _ = module.Publish(mainCtx, "orders.eu.created", createMessage())
+	assert.Equal(t, 0, len(drain(sub)))
+}
+
+func TestBackpressureShouldDropMessagesOfFullBuffer(t *testing.T) {
+	cases := []struct {
+		opts     broker.SubscribeOptions
+		expected []int
+	}{
+		{broker.SubscribeOptions{BufferSize: 2}, []int{0, 1}},
+		{broker.SubscribeOptions{BufferSize: 2, Backpressure: broker.DropOldest}, []int{1, 2}},
+		{broker.SubscribeOptions{BufferBytes: 20}, []int{0}},
+		{broker.SubscribeOptions{BufferSize: 1, Backpressure: broker.Block, BlockTimeout: 50 * time.Millisecond}, []int{0}},
+	}
+	for _, c := range cases {
+		module := NewModule()
+		sub, _ := module.SubscribeWithOptions(mainCtx, "ali", c.opts)
+
+		messages := []broker.Message{createMessage(), createMessage(), createMessage()}
+		for i, msg := range messages {
+			messages[i].ID, _ = module.Publish(mainCtx, "ali", msg)
+		}
+
+		var expected, received []int
+		for _, i := range c.expected {
+			expected = append(expected, messages[i].ID)
+		}
+		for _, msg := range drain(sub) {
+			received = append(received, msg.ID)
+		}
+		assert.Equal(t, expected, received, c.opts.Backpressure.String())
+	}
+}
+
+func TestBlockBackpressureShouldWaitForSubscriber(t *testing.T) {
+	module := NewModule()
+	sub, _ := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{
+		BufferSize:   1,
+		Backpressure: broker.Block,
+		BlockTimeout: time.Second,
+	})
+
+	first, _ := module.Publish(mainCtx, "ali", createMessage())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, first, (<-sub).ID)
+	}()
+
+	start := time.Now()
+	second, _ := module.Publish(mainCtx, "ali", createMessage())
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, second, (<-sub).ID)
+}
+
+func TestDisconnectBackpressureShouldCloseSubscription(t *testing.T) {
+	module := NewModule()
+	sub, _ := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{
+		BufferSize:   1,
+		Backpressure: broker.Disconnect,
+	})
+
+	_, _ = module.Publish(mainCtx, "ali", createMessage())
+	_, _ = module.Publish(mainCtx, "ali", createMessage())
+
+	drain(sub)
+	select {
+	case _, ok := <-sub:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Slow subscriber was not disconnected")
+	}
+	assert.Eventually(t, func() bool {
+		m := module.(*Module)
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.queue) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDeadLetterShouldGetDroppedMessages(t *testing.T) {
+	module := NewModule()
+	assert.Nil(t, module.SetDeadLetter(mainCtx, "ali", "ali.dead"))
+	dead, _ := module.Subscribe(mainCtx, "ali.dead")
+	_, _ = module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{BufferSize: 1})
+
+	_, _ = module.Publish(mainCtx, "ali", createMessage())
+	lost := createMessage()
+	_, _ = module.Publish(mainCtx, "ali", lost)
+
+	select {
+	case msg := <-dead:
+		assert.Equal(t, lost.Body, msg.Body)
+		assert.Equal(t, map[string]string{
+			broker.HeaderOriginalSubject: "ali",
+			broker.HeaderFailureReason:   broker.ReasonBufferFull,
+			broker.HeaderDeliveryCount:   "0",
+		}, msg.Headers)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Dropped message was not dead-lettered")
+	}
+}
+
+func TestDeadLetterShouldGetMessagesPastMaxDeliver(t *testing.T) {
+	module := NewModule()
+	assert.Nil(t, module.SetDeadLetter(mainCtx, "ali", "ali.dead"))
+	dead, _ := module.Subscribe(mainCtx, "ali.dead")
+	sub, _ := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{
+		Consumer:   "worker",
+		AckWait:    50 * time.Millisecond,
+		MaxDeliver: 1,
+	})
+
+	msg := createMessage()
+	msg.Headers = map[string]string{"Content-Type": "text/plain"}
+	_, _ = module.Publish(mainCtx, "ali", msg)
+	<-sub
+
+	select {
+	case poison := <-dead:
+		assert.Equal(t, msg.Body, poison.Body)
+		assert.Equal(t, "text/plain", poison.Headers["Content-Type"])
+		assert.Equal(t, broker.ReasonMaxDeliver, poison.Headers[broker.HeaderFailureReason])
+		assert.Equal(t, "1", poison.Headers[broker.HeaderDeliveryCount])
+	case <-time.After(time.Second):
+		assert.Fail(t, "Poison message was not dead-lettered")
+	}
+}
+
+func TestSetDeadLetterShouldRejectInvalidSubjects(t *testing.T) {
+	module := NewModule()
+	assert.Equal(t, broker.ErrInvalidSubject, module.SetDeadLetter(mainCtx, "ali", "ali"))
+	assert.Equal(t, broker.ErrInvalidSubject, module.SetDeadLetter(mainCtx, "ali.*", "ali.dead"))
+	assert.Equal(t, broker.ErrInvalidSubject, module.SetDeadLetter(mainCtx, "ali", "ali.>"))
+	assert.Nil(t, module.SetDeadLetter(mainCtx, "ali", ""))
+}
+
+func TestPublishBatchShouldKeepOrderWithinSubjects(t *testing.T) {
+	module := NewModule()
+	ali, _ := module.Subscribe(mainCtx, "ali")
+	maryam, _ := module.Subscribe(mainCtx, "maryam")
+
+	batch := make([]broker.Message, 6)
+	for i := range batch {
+		batch[i] = createMessage()
+		batch[i].Subject = []string{"ali", "maryam"}[i%2]
+	}
+	ids, err := module.PublishBatch(mainCtx, batch)
+	assert.Nil(t, err)
+	assert.Equal(t, len(batch), len(ids))
+
+	for i, in := range append(drain(ali), drain(maryam)...) {
+		j := []int{0, 2, 4, 1, 3, 5}[i]
+		assert.Equal(t, ids[j], in.ID)
+		assert.Equal(t, batch[j].Body, in.Body)
+		assert.Equal(t, "", in.Subject)
+	}
+
+	_, err = module.PublishBatch(mainCtx, []broker.Message{{Subject: "ali"}, {Subject: "ali.*"}})
+	assert.Equal(t, broker.ErrInvalidSubject, err)
+}
+
+func TestIDsShouldCountPerSubject(t *testing.T) {
+	module := NewModule()
+	for i := 1; i <= 3; i++ {
+		id, err := module.Publish(mainCtx, "ali", createMessageWithExpire(time.Second*10))
+		assert.Nil(t, err)
+		assert.Equal(t, i, id)
+		id, err = module.Publish(mainCtx, "maryam", createMessage())
+		assert.Nil(t, err)
+		assert.Equal(t, i, id)
+	}
+
+	ids, err := module.PublishBatch(mainCtx, []broker.Message{
+		{Subject: "maryam", Body: "fourth"},
+		{Subject: "ali", Body: "fourth", Expiration: time.Second * 10},
+		{Subject: "ali", Body: "fifth", Expiration: time.Second * 10},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{4, 4, 5}, ids)
+
+	msg, err := module.Fetch(mainCtx, "ali", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, "fifth", msg.Body)
+	_, err = module.Fetch(mainCtx, "ali", 6)
+	assert.Equal(t, broker.ErrInvalidID, err)
+	_, err = module.Fetch(mainCtx, "maryam", 4)
+	assert.Equal(t, broker.ErrExpiredID, err)
+}
+
+func TestPublishWithSameKeyShouldGetFirstID(t *testing.T) {
+	module := NewModule()
+	defer module.Close()
+	sub, _ := module.Subscribe(mainCtx, "ali")
+
+	msg := createMessageWithExpire(time.Second * 10)
+	msg.IdempotencyKey = "order-1"
+	id, err := module.Publish(mainCtx, "ali", msg)
+	assert.Nil(t, err)
+	retried, err := module.Publish(mainCtx, "ali", msg)
+	assert.Nil(t, err)
+	assert.Equal(t, id, retried)
+
+	//	The same key on another subject is another message
+	other, _ := module.Publish(mainCtx, "reza", msg)
+	assert.Equal(t, 1, other)
+
+	messages := drain(sub)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "", messages[0].IdempotencyKey)
+}
+
+func TestPublishBatchShouldSkipKnownKeys(t *testing.T) {
+	module := NewModule()
+	defer module.Close()
+	sub, _ := module.Subscribe(mainCtx, "ali")
+
+	first := createMessage()
+	first.IdempotencyKey = "first"
+	id, _ := module.Publish(mainCtx, "ali", first)
+
+	second := createMessage()
+	second.IdempotencyKey = "second"
+	batch := []broker.Message{first, second, second, createMessage()}
+	for i := range batch {
+		batch[i].Subject = "ali"
+	}
+	ids, err := module.PublishBatch(mainCtx, batch)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{id, id + 1, id + 1, id + 2}, ids)
+
+	messages := drain(sub)
+	assert.Equal(t, 3, len(messages))
+}
+
+func TestPublishShouldCompressBodiesOfSubject(t *testing.T) {
+	module := newModule()
+	defer module.Close()
+	module.compression = compression.Subjects{Subjects: map[string]string{"ali": compression.Snappy}}
+	sub, _ := module.Subscribe(mainCtx, "ali")
+
+	body := strings.Repeat(randomString(16), 16)
+	id, err := module.Publish(mainCtx, "ali", broker.Message{Body: body, Expiration: time.Second * 10})
+	assert.Nil(t, err)
+
+	in := <-sub
+	assert.Equal(t, compression.Snappy, in.Encoding)
+	raw, err := compression.Decode(in, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, body, raw.Body)
+
+	fetched, _ := module.Fetch(mainCtx, "ali", id)
+	assert.Equal(t, in, fetched)
+}
+
+func TestRequestShouldGetReplyOfResponder(t *testing.T) {
+	module := NewModule()
+	requests, _ := module.Subscribe(mainCtx, "ali.rpc")
+	go func() {
+		request := <-requests
+		reply := createMessage()
+		reply.Body = "re: " + request.Body
+		_, _ = broker.Reply(mainCtx, module, request, reply)
+	}()
+
+	request := createMessage()
+	reply, err := module.Request(mainCtx, "ali.rpc", request, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "re: "+request.Body, reply.Body)
+
+	//	The inbox is removed once the reply is in
+	m := module.(*Module)
+	assert.Eventually(t, func() bool {
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.queue) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRequestShouldTimeOutWithoutReply(t *testing.T) {
+	module := NewModule()
+	_, _ = module.Subscribe(mainCtx, "ali.rpc")
+
+	_, err := module.Request(mainCtx, "ali.rpc", createMessage(), 50*time.Millisecond)
+	assert.Equal(t, broker.ErrRequestTimeout, err)
+
+	_, err = module.Request(mainCtx, "hassan.rpc", createMessage(), 50*time.Millisecond)
+	assert.Equal(t, broker.ErrNoResponders, err)
+
+	_, err = broker.Reply(mainCtx, module, createMessage(), createMessage())
+	assert.Equal(t, broker.ErrNoReplyTo, err)
+}
+
+func TestCloseShouldEndSubscriptions(t *testing.T) {
+	module := NewModule()
+	sub, _ := module.Subscribe(mainCtx, "ali")
+	member, _ := module.SubscribeWithOptions(mainCtx, "ali", broker.SubscribeOptions{Group: "workers"})
+	_, _ = module.Publish(mainCtx, "ali", createMessage())
+
+	assert.Nil(t, module.Close())
+	assert.Nil(t, module.Close())
+
+	for _, ch := range []<-chan broker.Message{sub, member} {
+		drain(ch)
+		select {
+		case _, ok := <-ch:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			assert.Fail(t, "Subscription was not closed")
+		}
+	}
+	_, err := module.Publish(mainCtx, "ali", createMessage())
+	assert.Equal(t, broker.ErrUnavailable, err)
+}
+
 func BenchmarkPublish(b *testing.B) {
 	b.ResetTimer()
 
@@ -325,6 +903,22 @@ func BenchmarkSubscribe(b *testing.B) {
 	}
 }
 
+// drain reads the messages of the subscription until it stays quiet.
+func drain(sub <-chan broker.Message) []broker.Message {
+	var messages []broker.Message
+	for {
+		select {
+		case msg, ok := <-sub:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, msg)
+		case <-time.After(50 * time.Millisecond):
+			return messages
+		}
+	}
+}
+
 func randomString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
@@ -333,6 +927,13 @@ func randomString(n int) string {
 	return string(b)
 }
 
+// published is the message as the broker hands it out once it is published.
+func published(msg broker.Message, id int, timestamp time.Time) broker.Message {
+	msg.ID = id
+	msg.Timestamp = timestamp
+	return msg
+}
+
 func createMessage() broker.Message {
 	body := randomString(16)
 
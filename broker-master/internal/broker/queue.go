@@ -0,0 +1,270 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"therealbroker/pkg/broker"
+)
+
+type Subscriber struct {
+	// id names the subscriber for the admin
+	id       uint64
+	buffer   *messageBuffer
+	group    string
+	consumer string
+	// acks is nil unless the subscriber has asked for acknowledgements
+	acks      *ackTracker
+	closeOnce sync.Once
+
+	// While the stored messages are replayed, live messages wait in
+	// the backlog so they reach the subscriber after the replayed ones
+	replaying int32
+	backlog   []liveMessage
+	replayMu  sync.Mutex
+}
+
+type liveMessage struct {
+	msg broker.Message
+	id  int
+}
+
+// blockedMessage is a message a subscriber with the Block policy had no
+// room for, it waits for room once the locks of the delivery are released.
+type blockedMessage struct {
+	sub *Subscriber
+	liveMessage
+}
+
+// queueGroup keeps the members of a load-balanced subscription, every
+// message published on the subject is handed to one of them in turn.
+type queueGroup struct {
+	members []*Subscriber
+	next    uint64
+}
+
+type Queue struct {
+	queueName string
+	// wildcard queues tell their subscribers the subject of each message
+	wildcard  bool
+	subs      []*Subscriber
+	groups    map[string]*queueGroup
+	consumers map[string]*Subscriber
+}
+
+func newQueue(subject string) *Queue {
+	return &Queue{
+		queueName: subject,
+		wildcard:  hasWildcard(subject),
+		subs:      make([]*Subscriber, 0),
+		groups:    make(map[string]*queueGroup),
+		consumers: make(map[string]*Subscriber),
+	}
+}
+
+func (q *Queue) add(sub *Subscriber) error {
+	if sub.consumer != "" {
+		if _, ok := q.consumers[sub.consumer]; ok {
+			return broker.ErrInvalidConsumer
+		}
+		q.consumers[sub.consumer] = sub
+	}
+
+	if sub.group == "" {
+		q.subs = append(q.subs, sub)
+		return nil
+	}
+
+	group, ok := q.groups[sub.group]
+	if !ok {
+		group = &queueGroup{}
+		q.groups[sub.group] = group
+	}
+	group.members = append(group.members, sub)
+	return nil
+}
+
+func (q *Queue) remove(sub *Subscriber) {
+	if sub.consumer != "" && q.consumers[sub.consumer] == sub {
+		delete(q.consumers, sub.consumer)
+	}
+
+	if sub.group == "" {
+		q.subs = without(q.subs, sub)
+		return
+	}
+
+	group, ok := q.groups[sub.group]
+	if !ok {
+		return
+	}
+	group.members = without(group.members, sub)
+	if len(group.members) == 0 {
+		delete(q.groups, sub.group)
+	}
+}
+
+// all returns the plain subscribers and the members of every group.
+func (q *Queue) all() []*Subscriber {
+	subs := append([]*Subscriber{}, q.subs...)
+	for _, group := range q.groups {
+		subs = append(subs, group.members...)
+	}
+	return subs
+}
+
+func (q *Queue) empty() bool {
+	return len(q.subs) == 0 && len(q.groups) == 0
+}
+
+// deliver sends the message to every plain subscriber and to one member of
+// each group. Subscribers with a full buffer are skipped, inside a group the
+// message moves on to the next member that still has room. Acknowledged
+// subscribers keep the message in flight even if it could not be sent, so
+// it is sent again later instead of being lost. The messages the Block
+// policy holds back are appended to blocked.
+func (q *Queue) deliver(subject string, msg broker.Message, id int, blocked []blockedMessage) []blockedMessage {
+	if q.wildcard {
+		msg.Subject = subject
+	}
+
+	for _, sub := range q.subs {
+		if sub.send(msg, id, true) == offerBlocked {
+			blocked = append(blocked, blockedMessage{sub: sub, liveMessage: liveMessage{msg: msg, id: id}})
+		}
+	}
+
+	for _, group := range q.groups {
+		start := atomic.AddUint64(&group.next, 1) - 1
+		sent := false
+		for i := 0; i < len(group.members) && !sent; i++ {
+			member := group.members[(start+uint64(i))%uint64(len(group.members))]
+			sent = member.send(msg, id, false) == offerSent
+		}
+		if !sent {
+			member := group.members[start%uint64(len(group.members))]
+			if member.send(msg, id, true) == offerBlocked {
+				blocked = append(blocked, blockedMessage{sub: member, liveMessage: liveMessage{msg: msg, id: id}})
+			}
+		}
+	}
+	return blocked
+}
+
+// send offers the message to the subscriber and tracks it when acks are on.
+// final tells that the subscriber is the last one to try, so a full buffer
+// applies its backpressure policy, and an acked message that still could
+// not be buffered is tracked to be sent again once its ack wait is over.
+func (s *Subscriber) send(msg broker.Message, id int, final bool) offerResult {
+	if atomic.LoadInt32(&s.replaying) == 1 {
+		s.replayMu.Lock()
+		if s.replaying == 1 {
+			s.backlog = append(s.backlog, liveMessage{msg: msg, id: id})
+			s.replayMu.Unlock()
+			return offerSent
+		}
+		s.replayMu.Unlock()
+	}
+
+	if s.acks == nil {
+		return s.buffer.offer(msg, final)
+	}
+
+	msg.ID = id
+	s.acks.track(msg)
+	result := s.buffer.offer(msg, final)
+	if result != offerBlocked {
+		s.acks.delivered(msg, result == offerSent, final)
+	}
+	return result
+}
+
+// block waits for room for a message the Block policy held back, the
+// caller holds no locks.
+func (s *Subscriber) block(msg broker.Message, id int) {
+	if s.acks == nil {
+		s.buffer.block(msg)
+		return
+	}
+
+	msg.ID = id
+	sent := s.buffer.block(msg)
+	s.acks.delivered(msg, sent, true)
+}
+
+// push waits until there is room for the message or its context is done.
+func (s *Subscriber) push(ctx context.Context, msg broker.Message, id int) bool {
+	if s.acks == nil {
+		return s.buffer.push(ctx, msg)
+	}
+
+	msg.ID = id
+	s.acks.track(msg)
+	sent := s.buffer.push(ctx, msg)
+	s.acks.delivered(msg, sent, false)
+	return sent
+}
+
+// finishReplay sends the live messages collected during the replay, except
+// the ones that were already replayed, and then turns live delivery on.
+// The replayed ids are in order, a delayed message that came due during
+// the replay may have a smaller id than the last one replayed.
+func (s *Subscriber) finishReplay(ctx context.Context, replayed []int) {
+	for {
+		s.replayMu.Lock()
+		backlog := s.backlog
+		s.backlog = nil
+		if len(backlog) == 0 {
+			atomic.StoreInt32(&s.replaying, 0)
+			s.replayMu.Unlock()
+			return
+		}
+		s.replayMu.Unlock()
+
+		for _, live := range backlog {
+			if i := sort.SearchInts(replayed, live.id); i < len(replayed) && replayed[i] == live.id {
+				continue
+			}
+			if !s.push(ctx, live.msg, live.id) {
+				return
+			}
+		}
+	}
+}
+
+// info describes the subscriber to the admin.
+func (s *Subscriber) info(subject string) broker.SubscriberInfo {
+	info := broker.SubscriberInfo{
+		ID:       s.id,
+		Subject:  subject,
+		Group:    s.group,
+		Consumer: s.consumer,
+		Dropped:  atomic.LoadUint64(&s.buffer.dropped),
+	}
+	info.Buffered, info.BufferedBytes, info.Delivered = s.buffer.stats()
+	if s.acks != nil {
+		info.Unacked = s.acks.unacked()
+	}
+	return info
+}
+
+// close stops the deliveries to the subscriber and closes its channel.
+func (s *Subscriber) close() {
+	s.closeOnce.Do(func() {
+		s.buffer.close()
+		if s.acks != nil {
+			close(s.acks.stop)
+		}
+	})
+}
+
+func without(subs []*Subscriber, sub *Subscriber) []*Subscriber {
+	kept := make([]*Subscriber, 0, len(subs))
+	for _, s := range subs {
+		if s != sub {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// inboxPrefix starts the subjects requests get their replies on
+const inboxPrefix = "_INBOX"
+
+// inboxes hands out unique inbox subjects, a random token per module keeps
+// them apart from the inboxes of other broker instances.
+type inboxes struct {
+	token string
+	next  uint64
+}
+
+func newInboxes() *inboxes {
+	token := make([]byte, 8)
+	_, _ = rand.Read(token)
+	return &inboxes{token: hex.EncodeToString(token)}
+}
+
+func (i *inboxes) new() string {
+	return inboxPrefix + "." + i.token + "." + strconv.FormatUint(atomic.AddUint64(&i.next, 1), 10)
+}
+
+func (m *Module) Request(ctx context.Context, subject string, msg broker.Message, timeout time.Duration) (broker.Message, error) {
+	if m.isClosed() {
+		return broker.Message{}, broker.ErrUnavailable
+	}
+	if !validSubject(subject, false) {
+		return broker.Message{}, broker.ErrInvalidSubject
+	}
+
+	m.RLock()
+	responders := len(m.subjects.match(subject))
+	m.RUnlock()
+	if responders == 0 {
+		return broker.Message{}, broker.ErrNoResponders
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Request in Broker Module")
+	defer span.Finish()
+
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		spanCtx, cancelTimeout = context.WithTimeout(spanCtx, timeout)
+		defer cancelTimeout()
+	}
+
+	//	Listen on the inbox before the request goes out, and remove the
+	//	inbox once the reply is in or the request is given up on
+	inboxCtx, cancelInbox := context.WithCancel(spanCtx)
+	defer cancelInbox()
+	inbox := m.inboxes.new()
+	replies, err := m.Subscribe(inboxCtx, inbox)
+	if err != nil {
+		return broker.Message{}, err
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[broker.HeaderReplyTo] = inbox
+	msg.Headers = headers
+	if _, err := m.Publish(spanCtx, subject, msg); err != nil {
+		return broker.Message{}, err
+	}
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			return broker.Message{}, broker.ErrUnavailable
+		}
+		return reply, nil
+	case <-spanCtx.Done():
+		if ctx.Err() != nil {
+			return broker.Message{}, ctx.Err()
+		}
+		return broker.Message{}, broker.ErrRequestTimeout
+	}
+}
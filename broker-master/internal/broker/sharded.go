@@ -0,0 +1,798 @@
+package broker
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"therealbroker/api/proto"
+	"therealbroker/internal/sharding"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
+	"therealbroker/pkg/database"
+	"therealbroker/pkg/middleware"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultRefreshInterval is used when the config leaves it out
+const defaultRefreshInterval = 10 * time.Second
+
+// upstreamRetryInterval is how long a subscription waits before it tries
+// again to subscribe on a peer it has lost or on the new owners of its
+// subject
+const upstreamRetryInterval = time.Second
+
+// ShardedModule spreads the subjects over its peers, every subject is owned
+// by one of them, picked by consistent hashing. Calls for subjects owned by
+// another peer are forwarded to it over gRPC, wildcard subscriptions are
+// made on every peer. Inboxes are owned by the peer that created them.
+//
+// When the peers change, the subscriptions move to the new owners of their
+// subjects and get the messages published from then on. Stored messages
+// stay with the peer that stored them.
+type ShardedModule struct {
+	local *Module
+	self  string
+	ring  *sharding.Ring
+	cfg   sharding.Config
+
+	peers   map[string]*peerClient
+	peersMu sync.Mutex
+
+	subs   map[*shardedSubscription]struct{}
+	subsMu sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type peerClient struct {
+	conn   *grpc.ClientConn
+	client proto.BrokerClient
+}
+
+// shardedSubscription relays the messages of its upstreams, the
+// subscriptions on the owners of its subject, to a single channel.
+type shardedSubscription struct {
+	ctx     context.Context
+	subject string
+	opts    broker.SubscribeOptions
+	out     chan broker.Message
+
+	upstreams map[string]context.CancelFunc
+	active    int
+	closed    bool
+	sync.Mutex
+}
+
+// NewShardedModule returns a broker that owns its share of the subjects
+// among the peers of the config, which are looked up again periodically
+// when they come from DNS.
+func NewShardedModule(cfg sharding.Config) (*ShardedModule, error) {
+	s := &ShardedModule{
+		local: newModule(),
+		self:  cfg.Self,
+		ring:  sharding.NewRing(nil),
+		cfg:   cfg,
+		peers: make(map[string]*peerClient),
+		subs:  make(map[*shardedSubscription]struct{}),
+		stop:  make(chan struct{}),
+	}
+	//	Inboxes name their peer, so replies find their way back to it
+	s.local.inboxes.token = hex.EncodeToString([]byte(cfg.Self))
+	s.local.router = s
+
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+		s.cfg.RefreshInterval = defaultRefreshInterval
+	}
+	peers := cfg.Peers
+	if cfg.DNSName != "" {
+		var err error
+		peers, err = sharding.LookupPeers(context.Background(), cfg.DNSName, cfg.Port)
+		if err != nil {
+			return nil, err
+		}
+		go s.refreshPeers()
+	}
+	s.SetPeers(peers)
+	return s, nil
+}
+
+// SetPeers replaces the peers the subjects are spread over, this node is
+// always one of them. The subscriptions whose subject changes owner are
+// moved to the new one.
+func (s *ShardedModule) SetPeers(peers []string) {
+	if !s.ring.Set(append(append([]string{}, peers...), s.self)) {
+		return
+	}
+
+	s.peersMu.Lock()
+	for address, peer := range s.peers {
+		if !s.ring.Has(address) {
+			_ = peer.conn.Close()
+			delete(s.peers, address)
+		}
+	}
+	s.peersMu.Unlock()
+
+	s.subsMu.Lock()
+	subs := make([]*shardedSubscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.subsMu.Unlock()
+	for _, sub := range subs {
+		s.rebalance(sub)
+	}
+}
+
+func (s *ShardedModule) refreshPeers() {
+	ticker := time.NewTicker(s.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		peers, err := sharding.LookupPeers(context.Background(), s.cfg.DNSName, s.cfg.Port)
+		if err == nil && len(peers) > 0 {
+			s.SetPeers(peers)
+		}
+	}
+}
+
+func (s *ShardedModule) Close() error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	err := s.local.Close()
+
+	s.peersMu.Lock()
+	for address, peer := range s.peers {
+		_ = peer.conn.Close()
+		delete(s.peers, address)
+	}
+	s.peersMu.Unlock()
+	return err
+}
+
+func (s *ShardedModule) Publish(ctx context.Context, subject string, msg broker.Message) (int, error) {
+	owner, local := s.owner(ctx, subject)
+	if local {
+		return s.local.Publish(ctx, subject, msg)
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Forward publish to the owner")
+	defer span.Finish()
+
+	client, err := s.client(owner)
+	if err != nil {
+		return -1, err
+	}
+	response, err := client.Publish(s.outgoing(spanCtx), publishRequest(subject, msg))
+	if err != nil {
+		return -1, s.peerError(owner, err)
+	}
+	return int(response.GetId()), nil
+}
+
+func (s *ShardedModule) PublishBatch(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	if middleware.Forwarded(ctx) {
+		return s.local.PublishBatch(ctx, msgs)
+	}
+	for _, msg := range msgs {
+		if !validSubject(msg.Subject, false) {
+			return nil, broker.ErrInvalidSubject
+		}
+	}
+
+	//	Every owner gets its part of the batch, a subject is in one part
+	//	so its order is kept
+	parts := make(map[string][]int)
+	for i, msg := range msgs {
+		owner, _ := s.owner(ctx, msg.Subject)
+		parts[owner] = append(parts[owner], i)
+	}
+
+	//	Every part is tried even when one fails, the parts that are
+	//	committed keep their ids so a retry can leave them out
+	ids := make([]int, len(msgs))
+	var failed error
+	for owner, indexes := range parts {
+		part := make([]broker.Message, len(indexes))
+		for i, index := range indexes {
+			part[i] = msgs[index]
+		}
+
+		var partIds []int
+		var err error
+		if owner == s.self || owner == "" {
+			partIds, err = s.local.PublishBatch(ctx, part)
+		} else {
+			partIds, err = s.forwardBatch(ctx, owner, part)
+		}
+		for i, index := range indexes {
+			if i < len(partIds) {
+				ids[index] = partIds[i]
+			}
+		}
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return ids, failed
+}
+
+func (s *ShardedModule) forwardBatch(ctx context.Context, owner string, msgs []broker.Message) ([]int, error) {
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Forward publish batch to the owner")
+	defer span.Finish()
+
+	client, err := s.client(owner)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.PublishBatch(s.outgoing(spanCtx))
+	if err != nil {
+		return nil, s.peerError(owner, err)
+	}
+	for _, msg := range msgs {
+		if err := stream.Send(publishRequest(msg.Subject, msg)); err != nil {
+			//	Send only tells the stream has ended, its status tells why
+			if err == io.EOF {
+				if _, err = stream.CloseAndRecv(); err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			return nil, s.peerError(owner, err)
+		}
+	}
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		//	The owner tells the ids of the messages it committed before
+		//	failing
+		if st, ok := status.FromError(err); ok {
+			for _, detail := range st.Details() {
+				if committed, ok := detail.(*proto.PublishBatchResponse); ok {
+					response = committed
+				}
+			}
+		}
+		return batchIds(response), s.peerError(owner, err)
+	}
+	return batchIds(response), nil
+}
+
+// batchIds are the ids of a batch response, nil without one.
+func batchIds(response *proto.PublishBatchResponse) []int {
+	if response == nil {
+		return nil
+	}
+	ids := make([]int, len(response.GetIds()))
+	for i, id := range response.GetIds() {
+		ids[i] = int(id)
+	}
+	return ids
+}
+
+func (s *ShardedModule) Subscribe(ctx context.Context, subject string) (<-chan broker.Message, error) {
+	return s.SubscribeWithOptions(ctx, subject, broker.SubscribeOptions{})
+}
+
+func (s *ShardedModule) SubscribeWithOptions(ctx context.Context, subject string, opts broker.SubscribeOptions) (<-chan broker.Message, error) {
+	if middleware.Forwarded(ctx) {
+		return s.local.SubscribeWithOptions(ctx, subject, opts)
+	}
+	if s.local.isClosed() {
+		return nil, broker.ErrUnavailable
+	}
+	if !validSubject(subject, true) {
+		return nil, broker.ErrInvalidSubject
+	}
+
+	sub := &shardedSubscription{
+		ctx:       ctx,
+		subject:   subject,
+		opts:      opts,
+		out:       make(chan broker.Message),
+		upstreams: make(map[string]context.CancelFunc),
+	}
+	sub.Lock()
+	for _, owner := range s.owners(subject) {
+		if err := s.subscribeUpstream(sub, owner, opts); err != nil {
+			for _, cancel := range sub.upstreams {
+				cancel()
+			}
+			sub.closed = true
+			sub.Unlock()
+			return nil, err
+		}
+	}
+	sub.Unlock()
+
+	s.subsMu.Lock()
+	s.subs[sub] = struct{}{}
+	s.subsMu.Unlock()
+
+	//	Stop the upstreams once the subscriber is gone
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			s.forget(sub)
+		}()
+	}
+	return sub.out, nil
+}
+
+func (s *ShardedModule) forget(sub *shardedSubscription) {
+	s.subsMu.Lock()
+	delete(s.subs, sub)
+	s.subsMu.Unlock()
+}
+
+// owners are the peers a subscription to the subject is made on, all of
+// them for wildcards since the subjects they match are spread over them.
+func (s *ShardedModule) owners(subject string) []string {
+	if hasWildcard(subject) {
+		return s.ring.Peers()
+	}
+	owner := s.ownerOf(subject)
+	if owner == "" {
+		owner = s.self
+	}
+	return []string{owner}
+}
+
+// rebalance moves the subscription to the current owners of its subject,
+// the new upstreams only get the messages published from now on. The old
+// upstreams are kept until every new one is made, a move that fails is
+// tried again later.
+func (s *ShardedModule) rebalance(sub *shardedSubscription) {
+	sub.Lock()
+	defer sub.Unlock()
+	if sub.closed || sub.ctx.Err() != nil {
+		return
+	}
+
+	opts := sub.opts
+	opts.DeliverPolicy = broker.DeliverNew
+	owners := make(map[string]bool)
+	moved := true
+	for _, owner := range s.owners(sub.subject) {
+		owners[owner] = true
+		if _, ok := sub.upstreams[owner]; !ok {
+			if err := s.subscribeUpstream(sub, owner, opts); err != nil {
+				moved = false
+			}
+		}
+	}
+	if !moved {
+		time.AfterFunc(upstreamRetryInterval, func() {
+			select {
+			case <-s.stop:
+			default:
+				s.rebalance(sub)
+			}
+		})
+		return
+	}
+	for owner, cancel := range sub.upstreams {
+		if !owners[owner] {
+			delete(sub.upstreams, owner)
+			cancel()
+		}
+	}
+}
+
+// subscribeUpstream subscribes on the owner and relays its messages, the
+// caller holds the lock of the subscription.
+func (s *ShardedModule) subscribeUpstream(sub *shardedSubscription, owner string, opts broker.SubscribeOptions) error {
+	upCtx, cancel := context.WithCancel(sub.ctx)
+
+	var messages <-chan broker.Message
+	var err error
+	if owner == s.self {
+		messages, err = s.local.SubscribeWithOptions(upCtx, sub.subject, opts)
+	} else {
+		messages, err = s.subscribeRemote(upCtx, owner, sub.subject, opts)
+	}
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	sub.upstreams[owner] = cancel
+	sub.active++
+	go s.relay(sub, upCtx, messages)
+	return nil
+}
+
+// subscribeRemote subscribes on the owner and relays the messages of the
+// stream. A stream that breaks off is subscribed again once the owner can
+// be reached, from the message after the last one relayed unless the ids
+// are spread over subjects or group members.
+func (s *ShardedModule) subscribeRemote(ctx context.Context, owner string, subject string, opts broker.SubscribeOptions) (<-chan broker.Message, error) {
+	stream, err := s.openRemote(ctx, owner, subject, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(chan broker.Message)
+	go func() {
+		defer close(messages)
+		for {
+			response, err := stream.Recv()
+			if err != nil {
+				if !s.lost(ctx, err) {
+					return
+				}
+				s.evict(owner)
+				if stream = s.resubscribe(ctx, owner, subject, opts); stream == nil {
+					return
+				}
+				continue
+			}
+
+			msg := messageFromResponse(response)
+			if !hasWildcard(subject) && opts.Group == "" {
+				opts.DeliverPolicy = broker.DeliverFromID
+				opts.StartID = msg.ID + 1
+			} else {
+				opts.DeliverPolicy = broker.DeliverNew
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// openRemote subscribes on the owner and waits until it has subscribed.
+func (s *ShardedModule) openRemote(ctx context.Context, owner string, subject string, opts broker.SubscribeOptions) (proto.Broker_SubscribeClient, error) {
+	client, err := s.client(owner)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.Subscribe(s.outgoing(ctx), subscribeRequest(subject, opts))
+	if err != nil {
+		return nil, s.peerError(owner, err)
+	}
+
+	//	The owner sends the headers once it has subscribed, without them
+	//	the stream has ended with the error of the subscription
+	if header, err := stream.Header(); err != nil || header == nil {
+		if _, err = stream.Recv(); err == io.EOF || err == nil {
+			err = broker.ErrUnavailable
+		}
+		return nil, s.peerError(owner, err)
+	}
+	return stream, nil
+}
+
+// lost tells whether a stream broke off with the connection to its owner,
+// rather than being ended by the owner or by the subscriber. A stream on a
+// connection that another call has evicted is canceled while its own
+// context is not.
+func (s *ShardedModule) lost(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// resubscribe subscribes on the owner again until it works, it is nil once
+// the subscription or the broker is gone.
+func (s *ShardedModule) resubscribe(ctx context.Context, owner string, subject string, opts broker.SubscribeOptions) proto.Broker_SubscribeClient {
+	retry := time.NewTicker(upstreamRetryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-retry.C:
+		case <-ctx.Done():
+			return nil
+		case <-s.stop:
+			return nil
+		}
+		if stream, err := s.openRemote(ctx, owner, subject, opts); err == nil {
+			return stream
+		}
+	}
+}
+
+// relay hands the messages of one upstream to the subscription, the channel
+// of the subscription is closed once its last upstream has ended.
+func (s *ShardedModule) relay(sub *shardedSubscription, ctx context.Context, messages <-chan broker.Message) {
+	defer func() {
+		sub.Lock()
+		sub.active--
+		ended := sub.active == 0 && !sub.closed
+		if ended {
+			sub.closed = true
+			close(sub.out)
+		}
+		sub.Unlock()
+		if ended {
+			s.forget(sub)
+		}
+	}()
+
+	for msg := range messages {
+		select {
+		case sub.out <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *ShardedModule) Ack(ctx context.Context, subject string, consumer string, id int) error {
+	if middleware.Forwarded(ctx) {
+		return s.local.Ack(ctx, subject, consumer, id)
+	}
+
+	//	The message of a wildcard subscription can be on any of the peers
+	err := broker.ErrUnknownConsumer
+	for _, owner := range s.owners(subject) {
+		if owner == s.self {
+			err = s.local.Ack(ctx, subject, consumer, id)
+		} else {
+			err = s.forwardAck(ctx, owner, subject, consumer, id)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *ShardedModule) forwardAck(ctx context.Context, owner string, subject string, consumer string, id int) error {
+	client, err := s.client(owner)
+	if err != nil {
+		return err
+	}
+	_, err = client.Ack(s.outgoing(ctx), &proto.AckRequest{Subject: subject, Consumer: consumer, Id: int32(id)})
+	if err != nil {
+		return s.peerError(owner, err)
+	}
+	return nil
+}
+
+func (s *ShardedModule) Request(ctx context.Context, subject string, msg broker.Message, timeout time.Duration) (broker.Message, error) {
+	owner, local := s.owner(ctx, subject)
+	if local {
+		return s.local.Request(ctx, subject, msg, timeout)
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Forward request to the owner")
+	defer span.Finish()
+
+	client, err := s.client(owner)
+	if err != nil {
+		return broker.Message{}, err
+	}
+	response, err := client.Request(s.outgoing(spanCtx), &proto.RequestRequest{
+		Subject:         subject,
+		Body:            []byte(msg.Body),
+		Headers:         msg.Headers,
+		TimeoutMillis:   int32(timeout / time.Millisecond),
+		AcceptEncodings: compression.Encodings(),
+	})
+	if err != nil {
+		return broker.Message{}, s.peerError(owner, err)
+	}
+	return messageFromResponse(response), nil
+}
+
+// SetDeadLetter is set on every peer, the messages of a subject can be
+// dropped on any of them by a subscription made through it.
+func (s *ShardedModule) SetDeadLetter(ctx context.Context, subject string, deadLetter string) error {
+	if err := s.local.SetDeadLetter(ctx, subject, deadLetter); err != nil || middleware.Forwarded(ctx) {
+		return err
+	}
+
+	for _, peer := range s.ring.Peers() {
+		if peer == s.self {
+			continue
+		}
+		client, err := s.client(peer)
+		if err != nil {
+			return err
+		}
+		_, err = client.SetDeadLetter(s.outgoing(ctx), &proto.SetDeadLetterRequest{Subject: subject, DeadLetterSubject: deadLetter})
+		if err != nil {
+			return s.peerError(peer, err)
+		}
+	}
+	return nil
+}
+
+func (s *ShardedModule) DeadLetter(ctx context.Context, subject string, msg broker.Message, reason string, deliveries int) error {
+	return s.local.DeadLetter(ctx, subject, msg, reason, deliveries)
+}
+
+func (s *ShardedModule) Fetch(ctx context.Context, subject string, id int) (broker.Message, error) {
+	owner, local := s.owner(ctx, subject)
+	if local {
+		return s.local.Fetch(ctx, subject, id)
+	}
+
+	span, spanCtx := opentracing.StartSpanFromContext(ctx, "Forward fetch to the owner")
+	defer span.Finish()
+
+	client, err := s.client(owner)
+	if err != nil {
+		return broker.Message{}, err
+	}
+	response, err := client.Fetch(s.outgoing(spanCtx), &proto.FetchRequest{Subject: subject, Id: int32(id), AcceptEncodings: compression.Encodings()})
+	if err != nil {
+		return broker.Message{}, s.peerError(owner, err)
+	}
+	return messageFromResponse(response), nil
+}
+
+// owner returns the peer that owns the subject and whether it is this
+// one. Forwarded calls are always served here.
+func (s *ShardedModule) owner(ctx context.Context, subject string) (string, bool) {
+	if middleware.Forwarded(ctx) {
+		return s.self, true
+	}
+	owner := s.ownerOf(subject)
+	return owner, owner == "" || owner == s.self
+}
+
+func (s *ShardedModule) ownerOf(subject string) string {
+	if strings.HasPrefix(subject, inboxPrefix+".") {
+		tokens := strings.SplitN(subject, ".", 3)
+		if peer, err := hex.DecodeString(tokens[1]); err == nil && s.ring.Has(string(peer)) {
+			return string(peer)
+		}
+	}
+	return s.ring.Owner(subject)
+}
+
+func (s *ShardedModule) client(peer string) (proto.BrokerClient, error) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	if p, ok := s.peers[peer]; ok {
+		return p.client, nil
+	}
+	conn, err := grpc.Dial(peer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, broker.ErrUnavailable
+	}
+	p := &peerClient{conn: conn, client: proto.NewBrokerClient(conn)}
+	s.peers[peer] = p
+	return p.client, nil
+}
+
+// peerError evicts the connection to a peer that could not be reached, so
+// the next call dials it again, and returns the error the peer returned.
+func (s *ShardedModule) peerError(peer string, err error) error {
+	if status.Code(err) == codes.Unavailable {
+		s.evict(peer)
+	}
+	return brokerError(err)
+}
+
+func (s *ShardedModule) evict(peer string) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	if p, ok := s.peers[peer]; ok {
+		_ = p.conn.Close()
+		delete(s.peers, peer)
+	}
+}
+
+// outgoing marks the call as forwarded, the owner serves it itself even if
+// its ring disagrees. The caller was already authorized and counted against
+// its limits here, so the call is made with the token of the broker.
+func (s *ShardedModule) outgoing(ctx context.Context) context.Context {
+	ctx = metadata.AppendToOutgoingContext(ctx, middleware.ForwardedKey, s.self)
+	if s.cfg.Token != "" {
+		return metadata.AppendToOutgoingContext(ctx, auth.MetadataKey, auth.Bearer(s.cfg.Token))
+	}
+	return ctx
+}
+
+func publishRequest(subject string, msg broker.Message) *proto.PublishRequest {
+	request := &proto.PublishRequest{
+		Subject:           subject,
+		Body:              []byte(msg.Body),
+		ExpirationSeconds: int32(database.ExpirationSeconds(msg.Expiration)),
+		Headers:           msg.Headers,
+		IdempotencyKey:    msg.IdempotencyKey,
+		Encoding:          msg.Encoding,
+	}
+	if !msg.DeliverAt.IsZero() {
+		request.DeliverAtUnixMilli = msg.DeliverAt.UnixNano() / int64(time.Millisecond)
+	}
+	return request
+}
+
+func subscribeRequest(subject string, opts broker.SubscribeOptions) *proto.SubscribeRequest {
+	request := &proto.SubscribeRequest{
+		Subject:            subject,
+		Group:              opts.Group,
+		Consumer:           opts.Consumer,
+		AckWaitSeconds:     int32((opts.AckWait + time.Second - 1) / time.Second),
+		AckWaitMillis:      int32((opts.AckWait + time.Millisecond - 1) / time.Millisecond),
+		MaxDeliver:         int32(opts.MaxDeliver),
+		DeliverPolicy:      proto.DeliverPolicy(opts.DeliverPolicy),
+		LastN:              int32(opts.LastN),
+		StartId:            int32(opts.StartID),
+		Backpressure:       proto.Backpressure(opts.Backpressure),
+		BufferSize:         int32(opts.BufferSize),
+		BufferBytes:        int32(opts.BufferBytes),
+		BlockTimeoutMillis: int32(opts.BlockTimeout / time.Millisecond),
+		AcceptEncodings:    compression.Encodings(),
+	}
+	if !opts.StartTime.IsZero() {
+		request.StartTimeUnixMilli = opts.StartTime.UnixNano() / int64(time.Millisecond)
+	}
+	return request
+}
+
+// messageFromResponse keeps the body as the owner has stored it, the peers
+// accept every encoding and the edge decompresses it.
+func messageFromResponse(response *proto.MessageResponse) broker.Message {
+	msg := broker.Message{
+		ID:       int(response.GetId()),
+		Subject:  response.GetSubject(),
+		Body:     string(response.GetBody()),
+		Headers:  response.GetHeaders(),
+		Encoding: response.GetEncoding(),
+	}
+	if millis := response.GetTimestampUnixMilli(); millis != 0 {
+		msg.Timestamp = time.Unix(0, millis*int64(time.Millisecond))
+	}
+	return msg
+}
+
+// brokerError turns the status of a forwarded call back into the error the
+// owner has returned, named in the details of the status. The calls that
+// failed before reaching the broker of the owner are told by their code.
+func brokerError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		if named, ok := detail.(*proto.ErrorDetail); ok {
+			if brokerErr := broker.ErrorOf(named.GetCode()); brokerErr != nil {
+				return brokerErr
+			}
+		}
+	}
+	switch st.Code() {
+	case codes.Unavailable:
+		return broker.ErrUnavailable
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	case codes.Canceled:
+		return context.Canceled
+	default:
+		return err
+	}
+}
@@ -0,0 +1,226 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"therealbroker/api/proto"
+	"therealbroker/api/server"
+	"therealbroker/internal/sharding"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/middleware"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// startShards runs sharded brokers in-process over loopback, the ring of
+// each one has the first active of them.
+func startShards(t *testing.T, size int, active int) []*ShardedModule {
+	shards, _ := startShardServers(t, size, active)
+	return shards
+}
+
+// startShardServers is startShards that also returns the gRPC servers of
+// the shards, which the tests can replace with serveShard.
+func startShardServers(t *testing.T, size int, active int) ([]*ShardedModule, []*grpc.Server) {
+	if middleware.Tracer == nil {
+		middleware.Tracer = opentracing.NoopTracer{}
+	}
+	listeners := make([]net.Listener, size)
+	addresses := make([]string, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[i] = listener
+		addresses[i] = listener.Addr().String()
+	}
+
+	shards := make([]*ShardedModule, size)
+	servers := make([]*grpc.Server, size)
+	for i := range shards {
+		shard, err := NewShardedModule(sharding.Config{Self: addresses[i], Peers: addresses[:active]})
+		assert.Nil(t, err)
+		servers[i] = serveShard(shard, listeners[i])
+		i := i
+		t.Cleanup(func() {
+			_ = shard.Close()
+			servers[i].Stop()
+		})
+		shards[i] = shard
+	}
+	return shards, servers
+}
+
+func serveShard(shard *ShardedModule, listener net.Listener) *grpc.Server {
+	grpcServer := grpc.NewServer()
+	proto.RegisterBrokerServer(grpcServer, server.NewImplementedServer(shard))
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	return grpcServer
+}
+
+// subjectOwnedBy finds a subject the shard owns.
+func subjectOwnedBy(shard *ShardedModule) string {
+	for i := 0; ; i++ {
+		subject := fmt.Sprintf("ali.%d", i)
+		if shard.ownerOf(subject) == shard.self {
+			return subject
+		}
+	}
+}
+
+func receive(t *testing.T, sub <-chan broker.Message) broker.Message {
+	select {
+	case msg := <-sub:
+		return msg
+	case <-time.After(time.Second):
+		assert.Fail(t, "Message was not delivered")
+		return broker.Message{}
+	}
+}
+
+func TestShardsShouldForwardCallsToOwner(t *testing.T) {
+	shards := startShards(t, 3, 3)
+	subject := subjectOwnedBy(shards[2])
+
+	sub, err := shards[0].Subscribe(mainCtx, subject)
+	assert.Nil(t, err)
+	msg := createMessageWithExpire(time.Second * 10)
+	id, err := shards[1].Publish(mainCtx, subject, msg)
+	assert.Nil(t, err)
+
+	received := receive(t, sub)
+	assert.Equal(t, id, received.ID)
+	assert.Equal(t, msg.Body, received.Body)
+
+	fetched, err := shards[0].Fetch(mainCtx, subject, id)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Body, fetched.Body)
+
+	_, err = shards[0].Fetch(mainCtx, subject, id+100)
+	assert.Equal(t, broker.ErrInvalidID, err)
+}
+
+func TestShardsShouldSubscribeToWildcardsOnEveryPeer(t *testing.T) {
+	shards := startShards(t, 3, 3)
+	sub, err := shards[0].Subscribe(mainCtx, "ali.*")
+	assert.Nil(t, err)
+
+	published := make(map[string]bool)
+	for _, shard := range shards {
+		subject := subjectOwnedBy(shard)
+		_, err := shards[1].Publish(mainCtx, subject, createMessage())
+		assert.Nil(t, err)
+		published[subject] = true
+	}
+	for range shards {
+		received := receive(t, sub)
+		assert.True(t, published[received.Subject])
+	}
+}
+
+func TestShardsShouldMoveSubscriptionsToNewOwner(t *testing.T) {
+	shards := startShards(t, 3, 2)
+	subject := subjectOwnedBy(shards[2])
+	sub, err := shards[0].Subscribe(mainCtx, subject)
+	assert.Nil(t, err)
+
+	//	The third shard joins and takes over the subject
+	peers := []string{shards[0].self, shards[1].self, shards[2].self}
+	for _, shard := range shards {
+		shard.SetPeers(peers)
+	}
+	msg := createMessage()
+	_, err = shards[1].Publish(mainCtx, subject, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Body, receive(t, sub).Body)
+}
+
+func TestShardsShouldRouteRepliesToRequester(t *testing.T) {
+	shards := startShards(t, 3, 3)
+	subject := subjectOwnedBy(shards[2])
+	requests, _ := shards[1].Subscribe(mainCtx, subject)
+	go func() {
+		request := <-requests
+		_, _ = broker.Reply(mainCtx, shards[1], request, broker.Message{Body: "re: " + request.Body})
+	}()
+
+	reply, err := shards[0].Request(mainCtx, subject, broker.Message{Body: "ping"}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "re: ping", reply.Body)
+}
+
+func TestShardsShouldSubscribeAgainOnPeerThatCameBack(t *testing.T) {
+	shards, servers := startShardServers(t, 3, 3)
+	subject := subjectOwnedBy(shards[2])
+	sub, err := shards[0].Subscribe(mainCtx, subject)
+	assert.Nil(t, err)
+
+	id, err := shards[1].Publish(mainCtx, subject, createMessageWithExpire(time.Second*10))
+	assert.Nil(t, err)
+	assert.Equal(t, id, receive(t, sub).ID)
+
+	//	The owner goes away for a while, what is published meanwhile is
+	//	stored on it
+	servers[2].Stop()
+	missed, err := shards[2].Publish(mainCtx, subject, createMessageWithExpire(time.Second*10))
+	assert.Nil(t, err)
+	listener, err := net.Listen("tcp", shards[2].self)
+	assert.Nil(t, err)
+	servers[2] = serveShard(shards[2], listener)
+
+	select {
+	case msg := <-sub:
+		assert.Equal(t, missed, msg.ID)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Subscription was not made again")
+	}
+	id, err = shards[0].Publish(mainCtx, subject, createMessageWithExpire(time.Second*10))
+	assert.Nil(t, err)
+	assert.Equal(t, id, receive(t, sub).ID)
+}
+
+func TestShardsBatchShouldReturnTheIdsOfThePartsCommitted(t *testing.T) {
+	shards := startShards(t, 2, 2)
+	local, remote := subjectOwnedBy(shards[0]), subjectOwnedBy(shards[1])
+	assert.Nil(t, shards[1].Close())
+
+	ids, err := shards[0].PublishBatch(mainCtx, []broker.Message{
+		{Subject: remote, Body: "lost", Expiration: time.Second * 10},
+		{Subject: local, Body: "kept", Expiration: time.Second * 10},
+	})
+	assert.Equal(t, broker.ErrUnavailable, err)
+	assert.Equal(t, 0, ids[0])
+	fetched, err := shards[0].Fetch(mainCtx, local, ids[1])
+	assert.Nil(t, err)
+	assert.Equal(t, "kept", fetched.Body)
+}
+
+func TestShardsShouldForwardAckWaitsUnderASecond(t *testing.T) {
+	shards := startShards(t, 2, 2)
+	subject := subjectOwnedBy(shards[1])
+	sub, err := shards[0].SubscribeWithOptions(mainCtx, subject, broker.SubscribeOptions{
+		Consumer: "worker",
+		AckWait:  100 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+
+	id, err := shards[0].Publish(mainCtx, subject, createMessage())
+	assert.Nil(t, err)
+	assert.Equal(t, id, receive(t, sub).ID)
+	assert.Equal(t, id, receive(t, sub).ID)
+}
+
+func TestShardsShouldReturnTheErrorsOfTheOwner(t *testing.T) {
+	shards := startShards(t, 2, 2)
+	subject := subjectOwnedBy(shards[1])
+
+	_, err := shards[0].Publish(mainCtx, subject, broker.Message{Body: "hello", Encoding: "unknown"})
+	assert.Equal(t, broker.ErrInvalidEncoding, err)
+	_, err = shards[0].SubscribeWithOptions(mainCtx, subject, broker.SubscribeOptions{AckWait: time.Second})
+	assert.Equal(t, broker.ErrInvalidConsumer, err)
+}
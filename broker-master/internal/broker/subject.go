@@ -0,0 +1,131 @@
+package broker
+
+import "strings"
+
+const (
+	// singleWildcard matches exactly one token of a subject
+	singleWildcard = "*"
+	// tailWildcard matches one or more tokens at the end of a subject
+	tailWildcard = ">"
+)
+
+// validSubject checks that the subject is made of non-empty tokens separated
+// by dots. Wildcards are only allowed when subscribing, as whole tokens, and
+// the tail wildcard has to be the last token.
+func validSubject(subject string, wildcards bool) bool {
+	if subject == "" {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch token {
+		case "":
+			return false
+		case singleWildcard:
+			if !wildcards {
+				return false
+			}
+		case tailWildcard:
+			if !wildcards || i != len(tokens)-1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hasWildcard(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == singleWildcard || token == tailWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectNode is one token of the subscribed subjects, queue is set when a
+// subscribed subject ends on it.
+type subjectNode struct {
+	children map[string]*subjectNode
+	queue    *Queue
+}
+
+func newSubjectNode() *subjectNode {
+	return &subjectNode{children: make(map[string]*subjectNode)}
+}
+
+// subjectTree keeps the queues of the subscribed subjects by their tokens,
+// so a published subject finds the queues of the wildcard subscriptions
+// that match it without going through every subscribed subject.
+type subjectTree struct {
+	root *subjectNode
+}
+
+func newSubjectTree() *subjectTree {
+	return &subjectTree{root: newSubjectNode()}
+}
+
+func (t *subjectTree) insert(subject string, queue *Queue) {
+	node := t.root
+	for _, token := range strings.Split(subject, ".") {
+		child, ok := node.children[token]
+		if !ok {
+			child = newSubjectNode()
+			node.children[token] = child
+		}
+		node = child
+	}
+	node.queue = queue
+}
+
+// remove drops the queue of the subject and the nodes it leaves unused.
+func (t *subjectTree) remove(subject string) {
+	tokens := strings.Split(subject, ".")
+	path := make([]*subjectNode, 0, len(tokens)+1)
+	node := t.root
+	path = append(path, node)
+	for _, token := range tokens {
+		child, ok := node.children[token]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	node.queue = nil
+
+	for i := len(tokens) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if child.queue != nil || len(child.children) != 0 {
+			return
+		}
+		delete(path[i].children, tokens[i])
+	}
+}
+
+// match returns the queues of every subscribed subject that matches the
+// published one.
+func (t *subjectTree) match(subject string) []*Queue {
+	var queues []*Queue
+	matchTokens(t.root, strings.Split(subject, "."), &queues)
+	return queues
+}
+
+func matchTokens(node *subjectNode, tokens []string, queues *[]*Queue) {
+	if len(tokens) == 0 {
+		if node.queue != nil {
+			*queues = append(*queues, node.queue)
+		}
+		return
+	}
+
+	if tail, ok := node.children[tailWildcard]; ok && tail.queue != nil {
+		*queues = append(*queues, tail.queue)
+	}
+	if child, ok := node.children[tokens[0]]; ok {
+		matchTokens(child, tokens[1:], queues)
+	}
+	if child, ok := node.children[singleWildcard]; ok {
+		matchTokens(child, tokens[1:], queues)
+	}
+}
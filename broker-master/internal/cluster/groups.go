@@ -0,0 +1,110 @@
+package cluster
+
+import (
+	"context"
+	"hash/crc32"
+	"path/filepath"
+	"strconv"
+	"therealbroker/api/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Groups are Raft groups among the same members, the keys are spread over
+// them so every group elects a leader of its own and the leaders are spread
+// over the members. A key is ordered by the leader of its group alone.
+type Groups struct {
+	proto.UnimplementedRaftServer
+	nodes  []*Node
+	byName map[string]*Node
+}
+
+// NewGroups connects the nodes of count groups to the peers, and returns
+// them to be started with Start. Every group keeps its state in a directory
+// of its own under the one of the config, and applies its log to the state
+// machine machine returns for it.
+func NewGroups(cfg Config, count int, machine func(group int) StateMachine) (*Groups, error) {
+	if count < 1 {
+		count = 1
+	}
+	g := &Groups{byName: make(map[string]*Node)}
+	for i := 0; i < count; i++ {
+		groupCfg := cfg
+		groupCfg.Group = strconv.Itoa(i)
+		if cfg.Dir != "" {
+			groupCfg.Dir = filepath.Join(cfg.Dir, "group-"+groupCfg.Group)
+		}
+		node, err := NewNode(groupCfg, machine(i))
+		if err != nil {
+			g.Stop()
+			return nil, err
+		}
+		g.nodes = append(g.nodes, node)
+		g.byName[groupCfg.Group] = node
+	}
+	return g, nil
+}
+
+// Start runs the node of every group.
+func (g *Groups) Start() {
+	for _, node := range g.nodes {
+		node.Start()
+	}
+}
+
+// Stop ends the node of every group.
+func (g *Groups) Stop() {
+	for _, node := range g.nodes {
+		node.Stop()
+	}
+}
+
+// Of returns the node of the group the key belongs to.
+func (g *Groups) Of(key string) *Node {
+	return g.nodes[crc32.ChecksumIEEE([]byte(key))%uint32(len(g.nodes))]
+}
+
+// Leaders returns the leader of every group this node knows of, empty for
+// the groups without one yet.
+func (g *Groups) Leaders() []string {
+	leaders := make([]string, len(g.nodes))
+	for i, node := range g.nodes {
+		leaders[i] = node.Leader()
+	}
+	return leaders
+}
+
+func (g *Groups) RequestVote(ctx context.Context, request *proto.VoteRequest) (*proto.VoteResponse, error) {
+	node, err := g.group(request.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	return node.RequestVote(ctx, request)
+}
+
+func (g *Groups) AppendEntries(ctx context.Context, request *proto.AppendEntriesRequest) (*proto.AppendEntriesResponse, error) {
+	node, err := g.group(request.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	return node.AppendEntries(ctx, request)
+}
+
+func (g *Groups) Forward(ctx context.Context, request *proto.ForwardRequest) (*proto.ForwardResponse, error) {
+	node, err := g.group(request.GetGroup())
+	if err != nil {
+		return nil, err
+	}
+	return node.Forward(ctx, request)
+}
+
+// group is the node of the group a call is for, the members must run the
+// same number of groups.
+func (g *Groups) group(name string) (*Node, error) {
+	node, ok := g.byName[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Group %q is not run by this broker", name)
+	}
+	return node, nil
+}
@@ -0,0 +1,31 @@
+package cluster
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidPeers is returned when the peers are not a list of id=address
+var ErrInvalidPeers = errors.New("peers must be a comma separated list of id=address")
+
+// ParsePeers reads the members of the cluster from a list like
+// "broker-0=broker-0.broker:8080,broker-1=broker-1.broker:8080", leaving
+// out the node itself so the same list can be given to every member.
+func ParsePeers(list string, self string) ([]Peer, error) {
+	peers := make([]Peer, 0)
+	for _, member := range strings.Split(list, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		parts := strings.SplitN(member, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, ErrInvalidPeers
+		}
+		if parts[0] == self {
+			continue
+		}
+		peers = append(peers, Peer{ID: parts[0], Address: parts[1]})
+	}
+	return peers, nil
+}
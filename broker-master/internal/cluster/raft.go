@@ -0,0 +1,805 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"therealbroker/api/proto"
+	"therealbroker/pkg/auth"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// Use this error when no leader is known to take a command
+	ErrNoLeader = errors.New("cluster has no leader")
+	// Use this error when a command is dropped from the log before it is
+	// committed, because its leader has been replaced
+	ErrLostLeadership = errors.New("leadership lost before the command was committed")
+	// Use this error when the node is used after it is stopped
+	ErrStopped = errors.New("cluster node is stopped")
+	// Use this error from Sync when the state machine starts empty after a
+	// restart, the node then applies its whole log again
+	ErrVolatile = errors.New("state machine does not outlive restarts")
+)
+
+// Timings used when the config leaves them out
+const (
+	defaultElectionTimeout   = 300 * time.Millisecond
+	defaultHeartbeatInterval = 50 * time.Millisecond
+)
+
+// maxAppendEntries caps the entries sent in one AppendEntries call
+const maxAppendEntries = 512
+
+// syncEvery is how many entries are applied before the applied index is
+// saved, the ones after it are applied again after a restart
+const syncEvery = 1024
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+type Peer struct {
+	ID      string
+	Address string
+}
+
+type Config struct {
+	// ID of this node, unique within the cluster
+	ID string
+	// The other members of the cluster
+	Peers []Peer
+	// A follower that has not heard of a leader for this long, plus a
+	// random part of up to the same length, starts an election
+	ElectionTimeout time.Duration
+	// How often the leader sends its heartbeat
+	HeartbeatInterval time.Duration
+	// How long a command waits to be committed by a quorum, 0 waits for
+	// the context of the proposer alone
+	ProposeTimeout time.Duration
+	// Token the node sends to its peers when they check callers
+	Token string
+	// Directory the node keeps its term, vote and log in, empty keeps
+	// them in memory and a restarted node starts over
+	Dir string
+	// Group the node is a member of, its calls go to the nodes of the
+	// same group on the peers
+	Group string
+}
+
+// StateMachine is what the committed commands are applied to, on every
+// node in the order of the log.
+type StateMachine interface {
+	// Prepare is called on the leader with every command it proposes, in
+	// the order of the log, and returns the command that is appended. The
+	// leader decides there what a command does, like the ids of the
+	// messages, so applying it again does the same
+	Prepare(command []byte) ([]byte, error)
+	// Lead is called when the node becomes the leader, with the commands
+	// of its log that are not applied yet and are prepared already
+	Lead(commands [][]byte)
+	// Apply runs a committed command and returns its result. A command is
+	// applied again when the node restarts before its index is saved
+	Apply(command []byte) []byte
+	// Sync makes the commands applied so far outlive a restart
+	Sync() error
+}
+
+type entry struct {
+	term    uint64
+	command []byte
+}
+
+// waiter is the proposal waiting for its entry to be applied, it only takes
+// the result when the entry at its index is still of its term.
+type waiter struct {
+	term   uint64
+	result chan []byte
+}
+
+// Node is a member of a Raft group. Commands proposed on any node are
+// forwarded to the leader, which appends them to its log and replicates it.
+// Once a quorum has a command it is committed, and every node hands it to
+// its state machine in the order of the log.
+//
+// The term, the vote and the log are synced to the directory of the node
+// before it answers for them, so a restarted node keeps its promises.
+type Node struct {
+	proto.UnimplementedRaftServer
+	cfg     Config
+	machine StateMachine
+	peers   map[string]proto.RaftClient
+	conns   []*grpc.ClientConn
+	store   *storage
+
+	mu sync.Mutex
+	// term, role, votedFor and leaderID describe what this node knows of
+	// the current election
+	term     uint64
+	role     role
+	votedFor string
+	leaderID string
+	// log[0] is a sentinel at index first, so the entry at index i is
+	// log[i-first]. The entries up to first are applied and dropped
+	log         []entry
+	first       uint64
+	commitIndex uint64
+	// lastApplied is the last entry the state machine has applied, synced
+	// the last one it has synced
+	lastApplied uint64
+	synced      uint64
+	// compactTo is the last entry every member has, as the leader knows
+	compactTo uint64
+	// nextIndex and matchIndex track the log of every follower, only on
+	// the leader
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// heard is the last time a leader or a candidate was heard of
+	heard           time.Time
+	electionTimeout time.Duration
+	waiters         map[uint64]waiter
+
+	committed chan struct{}
+	replicate map[string]chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	stopped   bool
+}
+
+// NewNode connects to the peers and returns a node that is started with
+// Start. The committed commands are applied to the machine, and the result
+// on the leader is returned to the proposer.
+func NewNode(cfg Config, machine StateMachine) (*Node, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	n := &Node{
+		cfg:        cfg,
+		machine:    machine,
+		peers:      make(map[string]proto.RaftClient),
+		log:        []entry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		waiters:    make(map[uint64]waiter),
+		committed:  make(chan struct{}, 1),
+		replicate:  make(map[string]chan struct{}),
+		stop:       make(chan struct{}),
+	}
+	if cfg.Dir != "" {
+		store, state, log, err := openStorage(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		n.store, n.term, n.votedFor, n.log, n.first = store, state.Term, state.VotedFor, log, store.first
+		n.synced = minIndex(state.Applied, n.lastIndex())
+		n.commitIndex, n.lastApplied = n.synced, n.synced
+	}
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if cfg.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(auth.TokenCredentials(cfg.Token)))
+	}
+	for _, peer := range cfg.Peers {
+		conn, err := grpc.Dial(peer.Address, opts...)
+		if err != nil {
+			n.closeConns()
+			_ = n.store.close()
+			return nil, err
+		}
+		n.conns = append(n.conns, conn)
+		n.peers[peer.ID] = proto.NewRaftClient(conn)
+		n.replicate[peer.ID] = make(chan struct{}, 1)
+	}
+	return n, nil
+}
+
+// Start runs the elections, the replication and the applying of the node.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetElectionLocked()
+	n.mu.Unlock()
+
+	go n.tick()
+	go n.applyCommitted()
+	for id, client := range n.peers {
+		go n.replicateTo(id, client)
+	}
+}
+
+// Stop ends the node, the proposals still waiting fail.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		n.mu.Lock()
+		n.stopped = true
+		n.role = follower
+		n.leaderID = ""
+		for index, w := range n.waiters {
+			close(w.result)
+			delete(n.waiters, index)
+		}
+		n.mu.Unlock()
+
+		close(n.stop)
+		n.closeConns()
+		n.syncApplied()
+
+		n.mu.Lock()
+		_ = n.store.close()
+		n.mu.Unlock()
+	})
+}
+
+func (n *Node) closeConns() {
+	for _, conn := range n.conns {
+		_ = conn.Close()
+	}
+}
+
+// Leader returns the id of the leader this node knows of, empty if there
+// is none yet.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID
+}
+
+// Propose commits the command on a quorum of the cluster and returns the
+// result of applying it on the leader. Followers forward it to the leader.
+func (n *Node) Propose(ctx context.Context, command []byte) ([]byte, error) {
+	return n.propose(ctx, command, true)
+}
+
+func (n *Node) propose(ctx context.Context, command []byte, forward bool) ([]byte, error) {
+	if n.cfg.ProposeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.cfg.ProposeTimeout)
+		defer cancel()
+	}
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != leader {
+		client := n.peers[n.leaderID]
+		n.mu.Unlock()
+		if !forward || client == nil {
+			return nil, ErrNoLeader
+		}
+		response, err := client.Forward(ctx, &proto.ForwardRequest{Command: command, Group: n.cfg.Group})
+		if err != nil {
+			return nil, err
+		}
+		return response.GetResult(), nil
+	}
+
+	command, err := n.machine.Prepare(command)
+	if err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	if err := n.appendLocked(entry{term: n.term, command: command}); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	index := n.lastIndex()
+	result := make(chan []byte, 1)
+	n.waiters[index] = waiter{term: n.term, result: result}
+	n.advanceCommitLocked()
+	n.mu.Unlock()
+	n.signalReplicators()
+
+	select {
+	case res, ok := <-result:
+		if !ok {
+			return nil, ErrLostLeadership
+		}
+		return res, nil
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Node) RequestVote(ctx context.Context, request *proto.VoteRequest) (*proto.VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil, status.Errorf(codes.Unavailable, "Node is stopped")
+	}
+
+	if request.GetTerm() > n.term {
+		n.becomeFollowerLocked(request.GetTerm())
+	}
+
+	granted := false
+	if request.GetTerm() == n.term &&
+		(n.votedFor == "" || n.votedFor == request.GetCandidateId()) &&
+		n.upToDateLocked(request.GetLastLogTerm(), request.GetLastLogIndex()) {
+		granted = true
+		n.votedFor = request.GetCandidateId()
+		n.resetElectionLocked()
+	}
+	if err := n.saveStateLocked(); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &proto.VoteResponse{Term: n.term, Granted: granted}, nil
+}
+
+func (n *Node) AppendEntries(ctx context.Context, request *proto.AppendEntriesRequest) (*proto.AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil, status.Errorf(codes.Unavailable, "Node is stopped")
+	}
+
+	if request.GetTerm() < n.term {
+		return &proto.AppendEntriesResponse{Term: n.term, LastLogIndex: n.lastIndex()}, nil
+	}
+	if request.GetTerm() > n.term || n.role != follower {
+		n.becomeFollowerLocked(request.GetTerm())
+	}
+	n.leaderID = request.GetLeaderId()
+	n.resetElectionLocked()
+	if err := n.saveStateLocked(); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	//	The log must hold the entry right before the new ones, otherwise
+	//	the leader goes back to where the logs still agree
+	prev := request.GetPrevLogIndex()
+	if prev > n.lastIndex() {
+		return &proto.AppendEntriesResponse{Term: n.term, LastLogIndex: n.lastIndex()}, nil
+	}
+	if prev >= n.first && n.entryAt(prev).term != request.GetPrevLogTerm() {
+		return &proto.AppendEntriesResponse{Term: n.term, LastLogIndex: prev - 1}, nil
+	}
+
+	//	The entries the log has already, or has applied and dropped, are
+	//	skipped, the ones from the first that differs are stored in place
+	//	of the rest of the log
+	entries := request.GetEntries()
+	from := 0
+	for ; from < len(entries); from++ {
+		index := prev + 1 + uint64(from)
+		if index > n.lastIndex() || (index > n.first && n.entryAt(index).term != entries[from].GetTerm()) {
+			break
+		}
+	}
+	if from < len(entries) {
+		index := prev + 1 + uint64(from)
+		added := make([]entry, 0, len(entries)-from)
+		for _, e := range entries[from:] {
+			added = append(added, entry{term: e.GetTerm(), command: e.GetCommand()})
+		}
+		if err := n.store.append(index, added); err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		if index <= n.lastIndex() {
+			n.truncateLocked(index)
+		}
+		n.log = append(n.log, added...)
+	}
+
+	if request.GetCompactIndex() > n.compactTo {
+		n.compactTo = request.GetCompactIndex()
+	}
+	if last := prev + uint64(len(request.GetEntries())); request.GetLeaderCommit() > n.commitIndex {
+		n.commitIndex = minIndex(request.GetLeaderCommit(), last)
+		n.signalCommitted()
+	}
+	return &proto.AppendEntriesResponse{Term: n.term, Success: true, LastLogIndex: n.lastIndex()}, nil
+}
+
+func (n *Node) Forward(ctx context.Context, request *proto.ForwardRequest) (*proto.ForwardResponse, error) {
+	result, err := n.propose(ctx, request.GetCommand(), false)
+	if err != nil {
+		switch err {
+		case context.DeadlineExceeded, context.Canceled:
+			return nil, status.FromContextError(err).Err()
+		default:
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+	return &proto.ForwardResponse{Result: result}, nil
+}
+
+// tick sends the heartbeats of the leader and starts an election once a
+// follower has not heard of a leader for too long.
+func (n *Node) tick() {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		if n.role == leader {
+			n.mu.Unlock()
+			n.signalReplicators()
+			continue
+		}
+		if time.Since(n.heard) < n.electionTimeout {
+			n.mu.Unlock()
+			continue
+		}
+		n.startElectionLocked()
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) startElectionLocked() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leaderID = ""
+	n.resetElectionLocked()
+	if err := n.saveStateLocked(); err != nil {
+		n.role = follower
+		return
+	}
+
+	term := n.term
+	request := &proto.VoteRequest{
+		Term:         term,
+		CandidateId:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.entryAt(n.lastIndex()).term,
+		Group:        n.cfg.Group,
+	}
+
+	votes := 1
+	if votes > len(n.peers)/2 {
+		n.becomeLeaderLocked()
+		return
+	}
+	for _, client := range n.peers {
+		go func(client proto.RaftClient) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			defer cancel()
+			response, err := client.RequestVote(ctx, request)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if response.GetTerm() > n.term {
+				n.becomeFollowerLocked(response.GetTerm())
+				return
+			}
+			if n.role != candidate || n.term != term || !response.GetGranted() {
+				return
+			}
+			votes++
+			if votes > len(n.peers)/2 {
+				n.becomeLeaderLocked()
+			}
+		}(client)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	n.role = leader
+	n.leaderID = n.cfg.ID
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+	}
+	pending := make([][]byte, 0)
+	for _, e := range n.entries(n.lastApplied+1, n.lastIndex()) {
+		if e.command != nil {
+			pending = append(pending, e.command)
+		}
+	}
+	n.machine.Lead(pending)
+
+	//	An empty entry of the new term lets the entries of earlier terms
+	//	be committed along with it
+	if err := n.appendLocked(entry{term: n.term}); err != nil {
+		n.becomeFollowerLocked(n.term)
+		n.leaderID = ""
+		return
+	}
+	n.advanceCommitLocked()
+	go n.signalReplicators()
+}
+
+func (n *Node) becomeFollowerLocked(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		//	A failed save is tried again before the node answers in the
+		//	new term
+		_ = n.saveStateLocked()
+	}
+	n.role = follower
+}
+
+// saveStateLocked syncs the term and the vote, if they changed since they
+// were last saved.
+func (n *Node) saveStateLocked() error {
+	return n.store.saveState(hardState{Term: n.term, VotedFor: n.votedFor, Applied: n.synced})
+}
+
+// appendLocked syncs the entry to the end of the log of the leader, before
+// it is counted in a quorum.
+func (n *Node) appendLocked(e entry) error {
+	if err := n.store.append(n.lastIndex()+1, []entry{e}); err != nil {
+		return err
+	}
+	n.log = append(n.log, e)
+	return nil
+}
+
+// replicateTo sends the log of the leader to one follower whenever it is
+// signalled, one call at a time so the follower gets them in order.
+func (n *Node) replicateTo(id string, client proto.RaftClient) {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.replicate[id]:
+		}
+
+		n.mu.Lock()
+		if n.role != leader {
+			n.mu.Unlock()
+			continue
+		}
+		//	Every member has the entries that are dropped already
+		term := n.term
+		prev := maxIndex(n.nextIndex[id]-1, n.first)
+		last := minIndex(n.lastIndex(), prev+maxAppendEntries)
+		entries := make([]*proto.LogEntry, 0, last-prev)
+		for _, e := range n.entries(prev+1, last) {
+			entries = append(entries, &proto.LogEntry{Term: e.term, Command: e.command})
+		}
+		request := &proto.AppendEntriesRequest{
+			Term:         term,
+			LeaderId:     n.cfg.ID,
+			PrevLogIndex: prev,
+			PrevLogTerm:  n.entryAt(prev).term,
+			Entries:      entries,
+			LeaderCommit: n.commitIndex,
+			CompactIndex: n.compactIndexLocked(),
+			Group:        n.cfg.Group,
+		}
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+		response, err := client.AppendEntries(ctx, request)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		n.mu.Lock()
+		if response.GetTerm() > n.term {
+			n.becomeFollowerLocked(response.GetTerm())
+			n.mu.Unlock()
+			continue
+		}
+		if n.role != leader || n.term != term {
+			n.mu.Unlock()
+			continue
+		}
+		if response.GetSuccess() {
+			n.matchIndex[id] = last
+			n.nextIndex[id] = last + 1
+			n.advanceCommitLocked()
+		} else {
+			n.nextIndex[id] = maxIndex(1, minIndex(prev, response.GetLastLogIndex()+1))
+		}
+		behind := n.nextIndex[id] <= n.lastIndex()
+		n.mu.Unlock()
+
+		if behind {
+			n.signal(n.replicate[id])
+		}
+	}
+}
+
+// advanceCommitLocked commits the last entry of the current term that a
+// quorum has, along with the ones before it.
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.entryAt(index).term != n.term {
+			return
+		}
+		count := 1
+		for id := range n.peers {
+			if n.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if count > (len(n.peers)+1)/2 {
+			n.commitIndex = index
+			n.signalCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted hands the committed entries to the state machine in the
+// order of the log, outside of the lock so it may take its time. An entry
+// counts as applied once Apply returns.
+func (n *Node) applyCommitted() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.committed:
+		}
+
+		for {
+			n.mu.Lock()
+			if n.stopped || n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			index := n.lastApplied + 1
+			e := n.entryAt(index)
+			w, waiting := n.waiters[index]
+			delete(n.waiters, index)
+			n.mu.Unlock()
+
+			var result []byte
+			if e.command != nil {
+				result = n.machine.Apply(e.command)
+			}
+			n.mu.Lock()
+			n.lastApplied = index
+			n.mu.Unlock()
+			if waiting {
+				if w.term == e.term {
+					w.result <- result
+				} else {
+					close(w.result)
+				}
+			}
+		}
+
+		n.mu.Lock()
+		due := n.lastApplied >= n.synced+syncEvery
+		n.mu.Unlock()
+		if due {
+			n.syncApplied()
+		}
+	}
+}
+
+// syncApplied saves the applied index once the state machine has synced
+// the entries up to it, so a restarted node does not apply them again.
+func (n *Node) syncApplied() {
+	n.mu.Lock()
+	applied, synced := n.lastApplied, n.synced
+	n.mu.Unlock()
+	if n.store == nil || applied <= synced {
+		return
+	}
+	if err := n.machine.Sync(); err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if applied > n.synced {
+		n.synced = applied
+		if n.saveStateLocked() == nil {
+			n.compactLocked()
+		}
+	}
+}
+
+// compactIndexLocked is the last entry every member has, on the leader.
+func (n *Node) compactIndexLocked() uint64 {
+	index := n.commitIndex
+	for id := range n.peers {
+		index = minIndex(index, n.matchIndex[id])
+	}
+	return index
+}
+
+// compactLocked drops the entries every member has and this node has
+// synced, the last of them is kept as the sentinel. A member that is down
+// holds the others back, and one that lost its directory can not catch up
+// from the log and needs a copy of the directory of another member.
+func (n *Node) compactLocked() {
+	if n.role == leader {
+		n.compactTo = maxIndex(n.compactTo, n.compactIndexLocked())
+	}
+	index := minIndex(n.compactTo, n.synced)
+	if index <= n.first {
+		return
+	}
+	kept := append([]entry{{term: n.entryAt(index).term}}, n.entries(index+1, n.lastIndex())...)
+	if err := n.store.compact(index, kept); err != nil {
+		return
+	}
+	n.log, n.first = kept, index
+}
+
+// truncateLocked drops the entries from index on, their proposals fail.
+func (n *Node) truncateLocked(index uint64) {
+	n.log = n.log[:index-n.first]
+	for i, w := range n.waiters {
+		if i >= index {
+			close(w.result)
+			delete(n.waiters, i)
+		}
+	}
+}
+
+func (n *Node) upToDateLocked(lastTerm uint64, lastIndex uint64) bool {
+	ownTerm := n.entryAt(n.lastIndex()).term
+	return lastTerm > ownTerm || (lastTerm == ownTerm && lastIndex >= n.lastIndex())
+}
+
+func (n *Node) resetElectionLocked() {
+	n.heard = time.Now()
+	n.electionTimeout = n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.first + uint64(len(n.log)-1)
+}
+
+// entryAt returns the entry at index, which is first or after it.
+func (n *Node) entryAt(index uint64) entry {
+	return n.log[index-n.first]
+}
+
+// entries returns the entries from index from up to index to.
+func (n *Node) entries(from uint64, to uint64) []entry {
+	return n.log[from-n.first : to-n.first+1]
+}
+
+func (n *Node) signalReplicators() {
+	for _, ch := range n.replicate {
+		n.signal(ch)
+	}
+}
+
+func (n *Node) signalCommitted() {
+	n.signal(n.committed)
+}
+
+func (n *Node) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func minIndex(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxIndex(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,402 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"therealbroker/api/proto"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testMember is a node of a cluster run in-process over loopback, along
+// with the commands it has applied.
+type testMember struct {
+	node    *Node
+	server  *grpc.Server
+	applied [][]byte
+	sync.Mutex
+}
+
+func (tm *testMember) Prepare(command []byte) ([]byte, error) {
+	return command, nil
+}
+
+func (tm *testMember) Lead(commands [][]byte) {}
+
+func (tm *testMember) Apply(command []byte) []byte {
+	tm.Lock()
+	defer tm.Unlock()
+	tm.applied = append(tm.applied, command)
+	return []byte(fmt.Sprint(len(tm.applied)))
+}
+
+func (tm *testMember) Sync() error {
+	return nil
+}
+
+func (tm *testMember) commands() []string {
+	tm.Lock()
+	defer tm.Unlock()
+	commands := make([]string, len(tm.applied))
+	for i, command := range tm.applied {
+		commands[i] = string(command)
+	}
+	return commands
+}
+
+func (tm *testMember) stop() {
+	tm.node.Stop()
+	tm.server.Stop()
+}
+
+func startCluster(t *testing.T, size int) []*testMember {
+	listeners := make([]net.Listener, size)
+	peers := make([]Peer, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listeners[i] = listener
+		peers[i] = Peer{ID: fmt.Sprintf("node-%d", i), Address: listener.Addr().String()}
+	}
+
+	members := make([]*testMember, size)
+	for i := range members {
+		member := &testMember{}
+		others := append(append([]Peer{}, peers[:i]...), peers[i+1:]...)
+		node, err := NewNode(Config{
+			ID:                peers[i].ID,
+			Peers:             others,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+			ProposeTimeout:    time.Second,
+		}, member)
+		assert.Nil(t, err)
+		member.node = node
+		member.server = grpc.NewServer()
+		proto.RegisterRaftServer(member.server, node)
+		go func(listener net.Listener, server *grpc.Server) {
+			_ = server.Serve(listener)
+		}(listeners[i], member.server)
+		node.Start()
+		members[i] = member
+	}
+	t.Cleanup(func() {
+		for _, member := range members {
+			member.stop()
+		}
+	})
+	return members
+}
+
+// waitForLeader returns the member the running ones agree on as leader.
+func waitForLeader(t *testing.T, members []*testMember) *testMember {
+	var found *testMember
+	assert.Eventually(t, func() bool {
+		found = nil
+		leaders := make(map[string]bool)
+		for _, member := range members {
+			leader := member.node.Leader()
+			if leader == "" {
+				return false
+			}
+			leaders[leader] = true
+			if leader == member.node.cfg.ID {
+				found = member
+			}
+		}
+		return len(leaders) == 1 && found != nil
+	}, 5*time.Second, 20*time.Millisecond)
+	return found
+}
+
+func TestClusterShouldElectOneLeader(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	assert.NotNil(t, leader)
+}
+
+func TestProposeShouldBeAppliedOnEveryMember(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+
+	var follower *testMember
+	for _, member := range members {
+		if member != leader {
+			follower = member
+		}
+	}
+
+	result, err := leader.node.Propose(context.Background(), []byte("first"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(result))
+	result, err = follower.node.Propose(context.Background(), []byte("second"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(result))
+
+	for _, member := range members {
+		assert.Eventually(t, func() bool {
+			return len(member.commands()) == 2
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"first", "second"}, member.commands())
+	}
+}
+
+func TestClusterShouldKeepCommittingWithoutItsLeader(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	_, err := leader.node.Propose(context.Background(), []byte("first"))
+	assert.Nil(t, err)
+
+	leader.stop()
+	rest := make([]*testMember, 0, 2)
+	for _, member := range members {
+		if member != leader {
+			rest = append(rest, member)
+		}
+	}
+	newLeader := waitForLeader(t, rest)
+	assert.NotEqual(t, leader, newLeader)
+
+	_, err = rest[0].node.Propose(context.Background(), []byte("second"))
+	assert.Nil(t, err)
+	for _, member := range rest {
+		assert.Eventually(t, func() bool {
+			return len(member.commands()) == 2
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"first", "second"}, member.commands())
+	}
+}
+
+func TestProposeShouldFailWithoutQuorum(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	for _, member := range members {
+		if member != leader {
+			member.stop()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err := leader.node.Propose(ctx, []byte("lost"))
+	assert.NotNil(t, err)
+	assert.Empty(t, leader.commands())
+}
+
+func TestParsePeersShouldLeaveOutSelf(t *testing.T) {
+	peers, err := ParsePeers("a=127.0.0.1:1, b=127.0.0.1:2,c=127.0.0.1:3", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{{ID: "a", Address: "127.0.0.1:1"}, {ID: "c", Address: "127.0.0.1:3"}}, peers)
+
+	_, err = ParsePeers("a=127.0.0.1:1,b", "a")
+	assert.Equal(t, ErrInvalidPeers, err)
+}
+
+func TestRestartedNodeShouldKeepItsVoteAndLog(t *testing.T) {
+	dir := t.TempDir()
+	node, err := NewNode(Config{ID: "node-0", Dir: dir}, &testMember{})
+	assert.Nil(t, err)
+	vote, err := node.RequestVote(context.Background(), &proto.VoteRequest{Term: 5, CandidateId: "node-1"})
+	assert.Nil(t, err)
+	assert.True(t, vote.GetGranted())
+	appended, err := node.AppendEntries(context.Background(), &proto.AppendEntriesRequest{
+		Term:     5,
+		LeaderId: "node-1",
+		Entries:  []*proto.LogEntry{{Term: 4, Command: []byte("first")}, {Term: 5, Command: []byte("second")}},
+	})
+	assert.Nil(t, err)
+	assert.True(t, appended.GetSuccess())
+	//	The second entry is replaced by the one of a later leader
+	appended, err = node.AppendEntries(context.Background(), &proto.AppendEntriesRequest{
+		Term:         6,
+		LeaderId:     "node-2",
+		PrevLogIndex: 1,
+		PrevLogTerm:  4,
+		Entries:      []*proto.LogEntry{{Term: 6, Command: []byte("third")}},
+	})
+	assert.Nil(t, err)
+	assert.True(t, appended.GetSuccess())
+	node.Stop()
+
+	node, err = NewNode(Config{ID: "node-0", Dir: dir}, &testMember{})
+	assert.Nil(t, err)
+	defer node.Stop()
+	assert.Equal(t, uint64(6), node.term)
+	assert.Equal(t, []entry{{}, {term: 4, command: []byte("first")}, {term: 6, command: []byte("third")}}, node.log)
+
+	vote, err = node.RequestVote(context.Background(), &proto.VoteRequest{Term: 6, CandidateId: "node-1", LastLogIndex: 2, LastLogTerm: 6})
+	assert.Nil(t, err)
+	assert.True(t, vote.GetGranted())
+	node.Stop()
+
+	node, err = NewNode(Config{ID: "node-0", Dir: dir}, &testMember{})
+	assert.Nil(t, err)
+	defer node.Stop()
+	vote, err = node.RequestVote(context.Background(), &proto.VoteRequest{Term: 6, CandidateId: "node-2", LastLogIndex: 2, LastLogTerm: 6})
+	assert.Nil(t, err)
+	assert.False(t, vote.GetGranted())
+}
+
+func TestRestartedNodeShouldDropTheRecordCutShort(t *testing.T) {
+	dir := t.TempDir()
+	node, err := NewNode(Config{ID: "node-0", Dir: dir}, &testMember{})
+	assert.Nil(t, err)
+	_, err = node.AppendEntries(context.Background(), &proto.AppendEntriesRequest{
+		Term:     1,
+		LeaderId: "node-1",
+		Entries:  []*proto.LogEntry{{Term: 1, Command: []byte("first")}, {Term: 1, Command: []byte("second")}},
+	})
+	assert.Nil(t, err)
+	node.Stop()
+
+	path := filepath.Join(dir, logFileName)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-3))
+
+	node, err = NewNode(Config{ID: "node-0", Dir: dir}, &testMember{})
+	assert.Nil(t, err)
+	defer node.Stop()
+	assert.Equal(t, []entry{{}, {term: 1, command: []byte("first")}}, node.log)
+}
+
+// volatileMember is a member whose state machine starts empty on restart
+type volatileMember struct {
+	testMember
+}
+
+func (vm *volatileMember) Sync() error {
+	return ErrVolatile
+}
+
+func TestRestartedNodeShouldNotApplyTheSyncedEntriesAgain(t *testing.T) {
+	dir := t.TempDir()
+	first := &testMember{}
+	node, err := NewNode(Config{ID: "node-0", Dir: dir, ElectionTimeout: 20 * time.Millisecond}, first)
+	assert.Nil(t, err)
+	node.Start()
+	assert.Eventually(t, func() bool {
+		return node.Leader() == "node-0"
+	}, time.Second, 5*time.Millisecond)
+	_, err = node.Propose(context.Background(), []byte("first"))
+	assert.Nil(t, err)
+	_, err = node.Propose(context.Background(), []byte("second"))
+	assert.Nil(t, err)
+	node.Stop()
+	assert.Equal(t, []string{"first", "second"}, first.commands())
+
+	second := &volatileMember{}
+	node, err = NewNode(Config{ID: "node-0", Dir: dir, ElectionTimeout: 20 * time.Millisecond}, second)
+	assert.Nil(t, err)
+	node.Start()
+	assert.Eventually(t, func() bool {
+		return node.Leader() == "node-0"
+	}, time.Second, 5*time.Millisecond)
+	result, err := node.Propose(context.Background(), []byte("third"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(result))
+	node.Stop()
+
+	//	A state machine lost on restart gets the whole log again
+	third := &testMember{}
+	node, err = NewNode(Config{ID: "node-0", Dir: dir, ElectionTimeout: 20 * time.Millisecond}, third)
+	assert.Nil(t, err)
+	node.Start()
+	defer node.Stop()
+	assert.Eventually(t, func() bool {
+		return node.Leader() == "node-0"
+	}, time.Second, 5*time.Millisecond)
+	result, err = node.Propose(context.Background(), []byte("fourth"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(result))
+}
+
+func TestNodeShouldDropTheEntriesEveryMemberHasApplied(t *testing.T) {
+	dir := t.TempDir()
+	node, err := NewNode(Config{ID: "node-0", Dir: dir, ElectionTimeout: 20 * time.Millisecond}, &testMember{})
+	assert.Nil(t, err)
+	node.Start()
+	assert.Eventually(t, func() bool {
+		return node.Leader() == "node-0"
+	}, time.Second, 5*time.Millisecond)
+	for _, command := range []string{"first", "second", "third"} {
+		_, err = node.Propose(context.Background(), []byte(command))
+		assert.Nil(t, err)
+	}
+	node.syncApplied()
+	node.mu.Lock()
+	first, last := node.first, node.lastIndex()
+	assert.Equal(t, 1, len(node.log))
+	node.mu.Unlock()
+	assert.Equal(t, last, first)
+	node.Stop()
+
+	member := &testMember{}
+	node, err = NewNode(Config{ID: "node-0", Dir: dir, ElectionTimeout: 20 * time.Millisecond}, member)
+	assert.Nil(t, err)
+	assert.Equal(t, first, node.first)
+	node.Start()
+	defer node.Stop()
+	assert.Eventually(t, func() bool {
+		return node.Leader() == "node-0"
+	}, time.Second, 5*time.Millisecond)
+	_, err = node.Propose(context.Background(), []byte("fourth"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fourth"}, member.commands())
+}
+
+func TestFollowerShouldTakeEntriesAfterTheOnesItDropped(t *testing.T) {
+	node, err := NewNode(Config{ID: "node-0", Dir: t.TempDir()}, &testMember{})
+	assert.Nil(t, err)
+	defer node.Stop()
+	_, err = node.AppendEntries(context.Background(), &proto.AppendEntriesRequest{
+		Term:     1,
+		LeaderId: "node-1",
+		Entries:  []*proto.LogEntry{{Term: 1, Command: []byte("first")}, {Term: 1, Command: []byte("second")}},
+	})
+	assert.Nil(t, err)
+	node.mu.Lock()
+	node.synced, node.compactTo = 2, 2
+	node.compactLocked()
+	node.mu.Unlock()
+
+	appended, err := node.AppendEntries(context.Background(), &proto.AppendEntriesRequest{
+		Term:     1,
+		LeaderId: "node-1",
+		Entries: []*proto.LogEntry{
+			{Term: 1, Command: []byte("first")},
+			{Term: 1, Command: []byte("second")},
+			{Term: 1, Command: []byte("third")},
+		},
+	})
+	assert.Nil(t, err)
+	assert.True(t, appended.GetSuccess())
+	assert.Equal(t, uint64(3), appended.GetLastLogIndex())
+	assert.Equal(t, []entry{{term: 1}, {term: 1, command: []byte("third")}}, node.log)
+}
+
+func TestGroupsShouldHandCallsToTheNodeOfTheirGroup(t *testing.T) {
+	groups, err := NewGroups(Config{ID: "node-0"}, 2, func(group int) StateMachine {
+		return &testMember{}
+	})
+	assert.Nil(t, err)
+	defer groups.Stop()
+
+	vote, err := groups.RequestVote(context.Background(), &proto.VoteRequest{Term: 3, CandidateId: "node-1", Group: "1"})
+	assert.Nil(t, err)
+	assert.True(t, vote.GetGranted())
+	assert.Equal(t, uint64(0), groups.byName["0"].term)
+	assert.Equal(t, uint64(3), groups.byName["1"].term)
+
+	_, err = groups.RequestVote(context.Background(), &proto.VoteRequest{Term: 3, CandidateId: "node-1", Group: "2"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
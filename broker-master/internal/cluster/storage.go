@@ -0,0 +1,281 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files a node keeps in its directory
+const (
+	stateFileName = "state.json"
+	logFileName   = "raft.log"
+)
+
+// Every record of the log file starts with the length of the rest of it and
+// its checksum, the rest is the index and the term of the entry followed by
+// its command
+const (
+	recordHeaderSize = 8
+	entryHeaderSize  = 16
+)
+
+// errCorruptLog is returned when the indexes of the log file do not follow
+// each other
+var errCorruptLog = errors.New("raft log file is corrupt")
+
+// hardState is what a node must not forget across restarts, it is synced
+// before the node answers for it. Applied is the last entry the state
+// machine has synced.
+type hardState struct {
+	Term     uint64
+	VotedFor string
+	Applied  uint64
+}
+
+// storage keeps the state and the log of a node in its directory, so a
+// restarted node keeps its votes and the entries it has acknowledged. Every
+// write is synced before it returns. A nil storage keeps nothing, the node
+// then lives in memory alone.
+//
+// The first record of the log file is the sentinel at log[0], the entries
+// follow it in the order of their index.
+type storage struct {
+	dir  string
+	file *os.File
+	// offsets of the records in the log file, the one at index i is at
+	// offsets[i-first]
+	first   uint64
+	offsets []int64
+	size    int64
+	saved   hardState
+}
+
+// openStorage opens the directory of a node, creating it on the first
+// start, and returns the state and the log it holds. A record cut short by
+// a crash was never acknowledged, so it is dropped along with the ones
+// after it.
+func openStorage(dir string) (*storage, hardState, []entry, error) {
+	var state hardState
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, state, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, state, nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, state, nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, state, nil, err
+	}
+	s := &storage{dir: dir, file: file, saved: state}
+	log, err := s.load()
+	if err != nil {
+		_ = file.Close()
+		return nil, state, nil, err
+	}
+	return s, state, log, nil
+}
+
+func (s *storage) load() ([]entry, error) {
+	data, err := io.ReadAll(s.file)
+	if err != nil {
+		return nil, err
+	}
+
+	var log []entry
+	offset := int64(0)
+	for {
+		index, e, size, ok := decodeEntry(data[offset:])
+		if !ok {
+			break
+		}
+		if len(log) == 0 {
+			s.first = index
+		} else if index != s.first+uint64(len(log)) {
+			return nil, errCorruptLog
+		}
+		log = append(log, e)
+		s.offsets = append(s.offsets, offset)
+		offset += int64(size)
+	}
+	if offset < int64(len(data)) {
+		if err := s.file.Truncate(offset); err != nil {
+			return nil, err
+		}
+	}
+	s.size = offset
+
+	//	A new log starts with the sentinel of index 0
+	if len(log) == 0 {
+		log = []entry{{}}
+		if err := s.write(0, log); err != nil {
+			return nil, err
+		}
+	}
+	return log, nil
+}
+
+// saveState replaces the state file, through a new file so a crash leaves
+// either the old state or the new one.
+func (s *storage) saveState(state hardState) error {
+	if s == nil || state == s.saved {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, stateFileName)
+	if err := writeSynced(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	s.saved = state
+	return nil
+}
+
+// append stores the entries from index on, dropping the ones the log had
+// from there.
+func (s *storage) append(index uint64, entries []entry) error {
+	if s == nil {
+		return nil
+	}
+	if kept := index - s.first; kept < uint64(len(s.offsets)) {
+		if err := s.file.Truncate(s.offsets[kept]); err != nil {
+			return err
+		}
+		s.size = s.offsets[kept]
+		s.offsets = s.offsets[:kept]
+	}
+	return s.write(index, entries)
+}
+
+// write adds the records of the entries to the end of the log file in one
+// write, and cuts off what was written when it fails.
+func (s *storage) write(index uint64, entries []entry) error {
+	data := make([]byte, 0)
+	offsets := make([]int64, len(entries))
+	for i, e := range entries {
+		offsets[i] = s.size + int64(len(data))
+		data = appendEntry(data, index+uint64(i), e)
+	}
+	if _, err := s.file.WriteAt(data, s.size); err != nil {
+		_ = s.file.Truncate(s.size)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Truncate(s.size)
+		return err
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(len(data))
+	return nil
+}
+
+// compact replaces the log file with one that starts at index, through a
+// new file so a crash leaves either the old log or the new one.
+func (s *storage) compact(index uint64, log []entry) error {
+	if s == nil {
+		return nil
+	}
+	path := filepath.Join(s.dir, logFileName)
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	compacted := &storage{dir: s.dir, file: file, first: index}
+	if err := compacted.write(index, log); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	//	Should the rename be lost, the old log only has more entries
+	_ = syncDir(s.dir)
+	_ = s.file.Close()
+	s.file, s.first, s.offsets, s.size = file, index, compacted.offsets, compacted.size
+	return nil
+}
+
+func (s *storage) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func appendEntry(data []byte, index uint64, e entry) []byte {
+	record := make([]byte, recordHeaderSize+entryHeaderSize+len(e.command))
+	binary.BigEndian.PutUint32(record[0:], uint32(entryHeaderSize+len(e.command)))
+	binary.BigEndian.PutUint64(record[8:], index)
+	binary.BigEndian.PutUint64(record[16:], e.term)
+	copy(record[recordHeaderSize+entryHeaderSize:], e.command)
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[recordHeaderSize:]))
+	return append(data, record...)
+}
+
+// decodeEntry reads the record at the start of data, false when it is cut
+// short or does not match its checksum.
+func decodeEntry(data []byte) (uint64, entry, int, bool) {
+	if len(data) < recordHeaderSize+entryHeaderSize {
+		return 0, entry{}, 0, false
+	}
+	length := int(binary.BigEndian.Uint32(data[0:]))
+	if length < entryHeaderSize || len(data)-recordHeaderSize < length {
+		return 0, entry{}, 0, false
+	}
+	body := data[recordHeaderSize : recordHeaderSize+length]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[4:]) {
+		return 0, entry{}, 0, false
+	}
+
+	e := entry{term: binary.BigEndian.Uint64(body[8:])}
+	if length > entryHeaderSize {
+		e.command = append([]byte(nil), body[entryHeaderSize:]...)
+	}
+	return binary.BigEndian.Uint64(body[0:]), e, recordHeaderSize + length, true
+}
+
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
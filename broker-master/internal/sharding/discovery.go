@@ -0,0 +1,50 @@
+package sharding
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// Address of this node as the other peers reach it
+	Self string
+	// Static list of the peers, this node included
+	Peers []string
+	// DNS name the peers are looked up by, instead of the static list
+	DNSName string
+	// Port of the peers found by DNS
+	Port int
+	// How often DNS is looked up again, so peers can join and leave
+	RefreshInterval time.Duration
+	// Token sent with the calls to the other peers, they trust the checks
+	// made on the callers here
+	Token string
+}
+
+// StaticPeers reads a comma separated list of host:port addresses.
+func StaticPeers(list string) []string {
+	peers := make([]string, 0)
+	for _, peer := range strings.Split(list, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// LookupPeers finds the peers behind a DNS name, e.g. the headless service
+// of a StatefulSet, every address it resolves to is a peer on the port.
+func LookupPeers(ctx context.Context, name string, port int) ([]string, error) {
+	addresses, err := net.DefaultResolver.LookupHost(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]string, len(addresses))
+	for i, address := range addresses {
+		peers[i] = net.JoinHostPort(address, strconv.Itoa(port))
+	}
+	return peers, nil
+}
@@ -0,0 +1,111 @@
+package sharding
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// virtualNodes is the number of points every peer has on the ring, more
+// points spread the subjects more evenly
+const virtualNodes = 64
+
+// Ring picks the owner of a subject by consistent hashing, so when a peer
+// joins or leaves only the subjects next to its points change owner.
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+	peers  []string
+	sync.RWMutex
+}
+
+func NewRing(peers []string) *Ring {
+	r := &Ring{}
+	r.Set(peers)
+	return r
+}
+
+// Set replaces the peers of the ring and reports whether they changed.
+func (r *Ring) Set(peers []string) bool {
+	sorted := unique(peers)
+
+	r.Lock()
+	defer r.Unlock()
+	if equal(sorted, r.peers) {
+		return false
+	}
+
+	r.peers = sorted
+	r.points = make([]uint32, 0, len(sorted)*virtualNodes)
+	r.owners = make(map[uint32]string, len(sorted)*virtualNodes)
+	for _, peer := range sorted {
+		for i := 0; i < virtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.points = append(r.points, point)
+			r.owners[point] = peer
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return true
+}
+
+// Owner returns the peer that owns the subject, empty when the ring has
+// no peers.
+func (r *Ring) Owner(subject string) string {
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(subject))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Peers returns the peers of the ring, sorted.
+func (r *Ring) Peers() []string {
+	r.RLock()
+	defer r.RUnlock()
+	return append([]string{}, r.peers...)
+}
+
+// Has reports whether the peer is on the ring.
+func (r *Ring) Has(peer string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	i := sort.SearchStrings(r.peers, peer)
+	return i < len(r.peers) && r.peers[i] == peer
+}
+
+func unique(peers []string) []string {
+	seen := make(map[string]bool, len(peers))
+	sorted := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if peer != "" && !seen[peer] {
+			seen[peer] = true
+			sorted = append(sorted, peer)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
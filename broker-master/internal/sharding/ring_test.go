@@ -0,0 +1,44 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingShouldSpreadSubjectsOverPeers(t *testing.T) {
+	ring := NewRing([]string{"a:1", "b:1", "c:1"})
+
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owned[ring.Owner(fmt.Sprintf("subject.%d", i))]++
+	}
+	assert.Len(t, owned, 3)
+	for _, count := range owned {
+		assert.Greater(t, count, 500)
+	}
+}
+
+func TestRingShouldMoveOnlySubjectsOfJoiningPeer(t *testing.T) {
+	ring := NewRing([]string{"a:1", "b:1"})
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		subject := fmt.Sprintf("subject.%d", i)
+		before[subject] = ring.Owner(subject)
+	}
+
+	assert.True(t, ring.Set([]string{"c:1", "a:1", "b:1"}))
+	assert.False(t, ring.Set([]string{"b:1", "c:1", "a:1"}))
+	for subject, owner := range before {
+		if now := ring.Owner(subject); now != owner {
+			assert.Equal(t, "c:1", now)
+		}
+	}
+}
+
+func TestRingWithoutPeersShouldHaveNoOwner(t *testing.T) {
+	ring := NewRing(nil)
+	assert.Equal(t, "", ring.Owner("ali"))
+	assert.False(t, ring.Has("a:1"))
+}
@@ -4,11 +4,23 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"therealbroker/api/proto"
 	"therealbroker/api/server"
 	"therealbroker/config"
+	brokerModule "therealbroker/internal/broker"
+	"therealbroker/internal/cluster"
+	"therealbroker/internal/sharding"
+	"therealbroker/pkg/auth"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/compression"
 	"therealbroker/pkg/database"
+	"therealbroker/pkg/encryption"
 	"therealbroker/pkg/middleware"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/joho/godotenv"
@@ -61,44 +73,155 @@ func main() {
 	defer closer.Close()
 	opentracing.SetGlobalTracer(middleware.Tracer)
 
-	//	Initial PostgresDB
-	dbInstance, err := database.ConnectToPg(ctx, config.GetConfigInstance(), log)
+	//	Retention of the subjects, every storage enforces it
+	retention, err := database.LoadRetention(config.GetConfigInstance())
 	if err != nil {
-		log.WithError(err).Fatalln("could not connect to the postgres")
+		log.WithError(err).Fatalln("could not read the retention of subjects")
 	}
-	log.Infof("connected to database successfully on port %v\n", cfg.PostgresDB.Port)
-	defer func() {
-		if err := dbInstance.Close(); err != nil {
-			log.WithError(err).Warn("Failed to close postgres database connection")
-		}
-	}()
+	log.Infof("retention is set for %d subjects besides the default\n", len(retention.Subjects))
 
-	//	Initial CassandraDB
-	// cassandraDbInstance, err := database.ConnectToCassandra(log)
-	// if err != nil {
-	// 	log.WithError(err).Fatalln("could not connect to the cassandra")
-	// }
-	// log.Infof("connected to cassandra database successfully on port %v\n", cfg.CassandraDB.Port)
-	// defer func() {
-	// 	cassandraDbInstance.Close()
-	// }()
-
-	//	Initial ScyllaDB
-	scyllaDB, err := database.ConnectToScylla(log)
+	//	Compression of the bodies, applied once when they are published
+	encodings, err := compression.Load(config.GetConfigInstance())
 	if err != nil {
-		log.WithError(err).Warnln("could not connect to the scylla")
+		log.WithError(err).Fatalln("could not read the compression of subjects")
+	}
+	log.Infof("compression is set for %d subjects besides the default\n", len(encodings.Subjects))
+
+	//	Keyring the storages seal the bodies with
+	keyring, err := encryption.Load(config.GetConfigInstance())
+	if err != nil {
+		log.WithError(err).Fatalln("could not read the keyring of the stored bodies")
+	}
+	if keyring != nil {
+		log.Infof("stored bodies are sealed with key %s of %d keys\n", keyring.Active, keyring.Keys())
+	}
+
+	//	Initial the storage the messages are kept in, the others are not
+	//	connected to
+	switch cfg.Broker.StorageType {
+	case brokerModule.POSTGRES:
+		dbInstance, err := database.ConnectToPg(ctx, config.GetConfigInstance(), log)
+		if err != nil {
+			log.WithError(err).Fatalln("could not connect to the postgres")
+		}
+		log.Infof("connected to database successfully on port %v\n", cfg.PostgresDB.Port)
+		defer func() {
+			if err := dbInstance.Close(); err != nil {
+				log.WithError(err).Warn("Failed to close postgres database connection")
+			}
+		}()
+	case brokerModule.CASSANDRA:
+		cassandraDbInstance, err := database.ConnectToCassandra(log)
+		if err != nil {
+			log.WithError(err).Fatalln("could not connect to the cassandra")
+		}
+		log.Infof("connected to cassandra database successfully on port %v\n", cfg.CassandraDB.Port)
+		defer func() {
+			cassandraDbInstance.Close()
+		}()
+	case brokerModule.SCYLLA:
+		scyllaDB, err := database.ConnectToScylla(log)
+		if err != nil {
+			log.WithError(err).Warnln("could not connect to the scylla")
+		}
+		log.Infof("connected to scylla database successfully on port %v\n", cfg.ScyllaDB.Port)
+		defer func() {
+			scyllaDB.Close()
+		}()
+	case brokerModule.FILE_LOG:
+		fileLog, err := database.ConnectToFileLog(config.GetConfigInstance(), log)
+		if err != nil {
+			log.WithError(err).Fatalln("could not open the file log")
+		}
+		log.Infof("file log storage opened successfully in %s\n", cfg.FileLog.Dir)
+		defer func() {
+			if err := fileLog.Close(); err != nil {
+				log.WithError(err).Warn("Failed to close file log storage")
+			}
+		}()
+	}
+
+	//	Callers need a token and grants on their subjects once there is a
+	//	signing key, the brokers use a token of their own between them
+	var authenticator *server.Authenticator
+	var peerToken string
+	if cfg.Auth.SigningKey != "" {
+		acl := auth.ACL{}
+		if cfg.Auth.ACLFile != "" {
+			acl, err = auth.LoadACL(cfg.Auth.ACLFile)
+			if err != nil {
+				log.WithError(err).Fatalln("could not read the acl file")
+			}
+		}
+		authenticator = server.NewAuthenticator([]byte(cfg.Auth.SigningKey), acl)
+		peerToken, err = auth.SignToken(auth.Claims{Subject: "broker", Peer: true}, []byte(cfg.Auth.SigningKey))
+		if err != nil {
+			log.WithError(err).Fatalln("could not sign the token of the broker")
+		}
+		log.Infof("authentication is enabled with grants for %d identities\n", len(acl))
 	}
-	log.Infof("connected to scylla database successfully on port %v\n", cfg.ScyllaDB.Port)
-	defer func() {
-		scyllaDB.Close()
-	}()
 
-	//	Initial Broker Module
-	brokerServer := server.NewImplementedServer()
+	//	Initial Broker Module, replicated when the cluster has peers or
+	//	sharded when the subjects are spread over shards
+	var brokerInstance broker.Broker
+	var raftGroups *cluster.Groups
+	sharded := cfg.Sharding.Peers != "" || cfg.Sharding.DNSName != ""
+	if sharded && cfg.Cluster.Peers != "" {
+		log.Fatalln("a broker can not be both replicated and sharded")
+	}
+	if sharded {
+		brokerInstance, err = brokerModule.NewShardedModule(sharding.Config{
+			Self:            cfg.Sharding.Self,
+			Peers:           sharding.StaticPeers(cfg.Sharding.Peers),
+			DNSName:         cfg.Sharding.DNSName,
+			Port:            cfg.Broker.Port,
+			RefreshInterval: time.Duration(cfg.Sharding.RefreshInterval) * time.Second,
+			Token:           peerToken,
+		})
+		if err != nil {
+			log.WithError(err).Fatalln("could not discover the shards")
+		}
+		log.Infof("broker %s owns its share of the subjects\n", cfg.Sharding.Self)
+	} else if cfg.Cluster.Peers != "" {
+		peers, err := cluster.ParsePeers(cfg.Cluster.Peers, cfg.Cluster.NodeID)
+		if err != nil {
+			log.WithError(err).Fatalln("could not read the cluster peers")
+		}
+		brokerInstance, raftGroups, err = brokerModule.NewClusterModule(cluster.Config{
+			ID:                cfg.Cluster.NodeID,
+			Peers:             peers,
+			ElectionTimeout:   time.Duration(cfg.Cluster.ElectionTimeout) * time.Millisecond,
+			HeartbeatInterval: time.Duration(cfg.Cluster.HeartbeatInterval) * time.Millisecond,
+			ProposeTimeout:    time.Duration(cfg.Cluster.ProposeTimeout) * time.Millisecond,
+			Token:             peerToken,
+			Dir:               cfg.Cluster.Dir,
+		}, cfg.Cluster.Groups)
+		if err != nil {
+			log.WithError(err).Fatalln("could not join the cluster")
+		}
+		log.Infof("broker %s joined a cluster of %d brokers with %d groups\n", cfg.Cluster.NodeID, len(peers)+1, cfg.Cluster.Groups)
+	} else {
+		brokerInstance = brokerModule.NewModule()
+	}
+	brokerServer := server.NewImplementedServer(brokerInstance)
 	log.Infoln("broker server object created successfully")
 
 	//	Initialize RPC APIs
-	grpcServer := server.NewBrokerServer(brokerServer)
+	limiter := server.NewRateLimiter(server.Limits{
+		ClientPublishes:      cfg.RateLimit.ClientPublishes,
+		ClientBytes:          cfg.RateLimit.ClientBytes,
+		ClientSubscriptions:  cfg.RateLimit.ClientSubscriptions,
+		SubjectPublishes:     cfg.RateLimit.SubjectPublishes,
+		SubjectBytes:         cfg.RateLimit.SubjectBytes,
+		SubjectSubscriptions: cfg.RateLimit.SubjectSubscriptions,
+	})
+	grpcServer := server.NewBrokerServer(brokerServer, authenticator, limiter)
+	if raftGroups != nil {
+		proto.RegisterRaftServer(grpcServer, raftGroups)
+	}
+	if admin, ok := brokerInstance.(broker.Admin); ok {
+		proto.RegisterBrokerAdminServer(grpcServer, server.NewAdminServer(admin))
+	}
 	log.Infoln("broker grpc server created successfully")
 
 	// Set up a listener for the gRPC server
@@ -109,15 +232,50 @@ func main() {
 	log.Infof("gRPC server is listening on port %v\n", cfg.Broker.Port)
 
 	// Serve gRPC Server
-	if err := grpcServer.Serve(listener); err != nil {
-		log.WithError(err).Fatalf("Failed to start gRPC server")
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.WithError(err).Fatalf("Failed to start gRPC server")
+		}
+	}()
+
+	//	Serve the HTTP gateway on its own port, with the same broker,
+	//	authentication and limits as the gRPC server
+	gatewayServer := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.Broker.GatewayPort),
+		Handler: server.NewGateway(brokerInstance, authenticator, limiter),
 	}
+	go func() {
+		if err := gatewayServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatalf("Failed to start HTTP gateway")
+		}
+	}()
+	log.Infof("HTTP gateway is listening on port %v\n", cfg.Broker.GatewayPort)
 
 	// Graceful shutdown handling
-	// c := make(chan os.Signal, 1)
-	// signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	// <-c
-	// log.Println("Shutting down gRPC server...")
-	// grpcServer.GracefulStop()
-	// log.Println("Server successfully stopped")
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	log.Infoln("Shutting down gRPC server...")
+
+	//	Stop taking publishes, write the pending batches and end the
+	//	subscriptions, then give the open calls some time to finish
+	if err := brokerServer.Close(); err != nil {
+		log.WithError(err).Warn("Failed to flush pending messages")
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Broker.ShutdownTimeout)*time.Second)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		_ = gatewayServer.Shutdown(shutdownCtx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Infoln("Server successfully stopped")
+	case <-shutdownCtx.Done():
+		grpcServer.Stop()
+		_ = gatewayServer.Close()
+		log.Warnln("Server stopped before every call finished")
+	}
 }
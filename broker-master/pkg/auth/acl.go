@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Action is what a grant allows on its subjects
+type Action string
+
+const (
+	ActionPublish   Action = "publish"
+	ActionSubscribe Action = "subscribe"
+	ActionFetch     Action = "fetch"
+	// ActionAdmin allows the calls of the admin service on the subjects,
+	// the calls that are not about one subject need it on ">"
+	ActionAdmin Action = "admin"
+)
+
+// AnyIdentity names the grants every authenticated identity has
+const AnyIdentity = "*"
+
+// Grant allows its actions on the subjects matching its patterns, which use
+// "*" for one token and ">" for the rest of the subject.
+type Grant struct {
+	Actions  []Action `json:"actions"`
+	Subjects []string `json:"subjects"`
+}
+
+// ACL maps an identity to its grants, anything not granted is denied.
+type ACL map[string][]Grant
+
+// LoadACL reads the ACL from a JSON file like
+// {"team-a": [{"actions": ["publish", "subscribe"], "subjects": ["team-a.>"]}]}
+func LoadACL(path string) (ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	acl := ACL{}
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Allowed reports whether the identity may take the action on the subject.
+// The subject of a subscription may use wildcards, then a grant has to
+// cover every subject it can match.
+func (acl ACL) Allowed(identity string, action Action, subject string) bool {
+	for _, grants := range [][]Grant{acl[identity], acl[AnyIdentity]} {
+		for _, grant := range grants {
+			if grant.allows(action, subject) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (g Grant) allows(action Action, subject string) bool {
+	for _, a := range g.Actions {
+		if a != action {
+			continue
+		}
+		for _, pattern := range g.Subjects {
+			if covers(strings.Split(pattern, "."), strings.Split(subject, ".")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers reports whether every subject matched by the requested tokens is
+// also matched by the pattern tokens.
+func covers(pattern []string, requested []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return i < len(requested)
+		}
+		if i >= len(requested) {
+			return false
+		}
+		switch token {
+		case "*":
+			if requested[i] == ">" {
+				return false
+			}
+		default:
+			if requested[i] != token {
+				return false
+			}
+		}
+	}
+	return len(pattern) == len(requested)
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var key = []byte("secret")
+
+func TestTokenShouldCarryItsClaims(t *testing.T) {
+	claims := Claims{Subject: "team-a", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	token, err := SignToken(claims, key)
+	assert.Nil(t, err)
+
+	parsed, err := ParseToken(token, key)
+	assert.Nil(t, err)
+	assert.Equal(t, claims, parsed)
+}
+
+func TestTokenShouldBeRejectedWhenTamperedOrExpired(t *testing.T) {
+	token, _ := SignToken(Claims{Subject: "team-a"}, key)
+	_, err := ParseToken(token, []byte("other"))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	forged, _ := SignToken(Claims{Subject: "team-b"}, key)
+	_, err = ParseToken(token[:len(token)-10]+forged[len(forged)-10:], key)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = ParseToken("not.a-token", key)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	expired, _ := SignToken(Claims{Subject: "team-a", ExpiresAt: time.Now().Add(-time.Minute).Unix()}, key)
+	_, err = ParseToken(expired, key)
+	assert.Equal(t, ErrExpiredToken, err)
+}
+
+func TestACLShouldAllowOnlyGrantedSubjects(t *testing.T) {
+	acl := ACL{
+		"team-a": {{Actions: []Action{ActionPublish, ActionSubscribe}, Subjects: []string{"team-a.>"}}},
+		"*":      {{Actions: []Action{ActionSubscribe}, Subjects: []string{"public.*"}}},
+	}
+
+	assert.True(t, acl.Allowed("team-a", ActionPublish, "team-a.orders"))
+	assert.True(t, acl.Allowed("team-a", ActionSubscribe, "team-a.*.created"))
+	assert.True(t, acl.Allowed("team-a", ActionSubscribe, "team-a.>"))
+	assert.False(t, acl.Allowed("team-a", ActionFetch, "team-a.orders"))
+	assert.False(t, acl.Allowed("team-a", ActionPublish, "team-b.orders"))
+	assert.False(t, acl.Allowed("team-a", ActionSubscribe, ">"))
+
+	assert.True(t, acl.Allowed("team-b", ActionSubscribe, "public.news"))
+	assert.False(t, acl.Allowed("team-b", ActionSubscribe, "public.>"))
+	assert.False(t, acl.Allowed("team-b", ActionPublish, "public.news"))
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataKey is the gRPC metadata the token is sent in, as "Bearer <token>"
+const MetadataKey = "authorization"
+
+const bearer = "Bearer "
+
+// TokenCredentials sends the token with every call of a gRPC connection.
+type TokenCredentials string
+
+func (t TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{MetadataKey: Bearer(string(t))}, nil
+}
+
+// RequireTransportSecurity is false, the brokers talk over plain gRPC
+// inside the cluster.
+func (t TokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Bearer is the metadata value the token is sent as.
+func Bearer(token string) string {
+	return bearer + token
+}
+
+// TokenFromContext returns the token of an incoming gRPC call.
+func TokenFromContext(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(MetadataKey)
+	if len(values) == 0 || !strings.HasPrefix(values[0], bearer) {
+		return "", false
+	}
+	return strings.TrimPrefix(values[0], bearer), true
+}
+
+type claimsKey struct{}
+
+// NewContext returns a context that carries the claims of the caller.
+func NewContext(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// FromContext returns the claims of the caller once it is authenticated.
+func FromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(Claims)
+	return claims, ok
+}
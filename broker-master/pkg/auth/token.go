@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// Use this error when a token is malformed or its signature is wrong
+	ErrInvalidToken = errors.New("token is not valid")
+	// Use this error when a token has passed its expiration time
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// Claims are what a token says about its holder
+type Claims struct {
+	// Identity the ACL grants are looked up by
+	Subject string `json:"sub"`
+	// Unix time the token expires at, 0 never expires
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// Peer is set on the tokens brokers use between themselves, they are
+	// allowed every call
+	Peer bool `json:"peer,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// SignToken returns a JWT of the claims signed with HS256 by the key.
+func SignToken(claims Claims, key []byte) (string, error) {
+	head, err := json.Marshal(header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := encoding.EncodeToString(head) + "." + encoding.EncodeToString(body)
+	return unsigned + "." + encoding.EncodeToString(sign(unsigned, key)), nil
+}
+
+// ParseToken checks the HS256 signature of the JWT with the key and returns
+// its claims, unless it has expired.
+func ParseToken(token string, key []byte) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var head header
+	if err := decodePart(parts[0], &head); err != nil || head.Alg != "HS256" {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(parts[0]+"."+parts[1], key)) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodePart(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return Claims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func sign(unsigned string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decodePart(part string, v interface{}) error {
+	data, err := encoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,56 @@
+package broker
+
+import "context"
+
+// SubjectInfo describes a subject that has stored messages or subscribers.
+type SubjectInfo struct {
+	Subject string
+	// Messages still stored on the subject
+	Messages int
+	// Subscribers of the subject, wildcard subscriptions are listed on
+	// their own pattern
+	Subscribers int
+}
+
+// SubscriberInfo describes one subscriber of a subject.
+type SubscriberInfo struct {
+	// ID names the subscriber for DescribeSubscriber and
+	// DisconnectSubscriber, it is unique within a broker
+	ID       uint64
+	Subject  string
+	Group    string
+	Consumer string
+	// Messages and bytes of bodies waiting in the buffer of the subscriber,
+	// the bytes are only counted for subscribers that limit them
+	Buffered      int
+	BufferedBytes int
+	// Messages the subscriber has read and the ones dropped for it
+	Delivered uint64
+	Dropped   uint64
+	// Messages waiting for an ack, always 0 without acknowledgements
+	Unacked int
+}
+
+// Admin lets operators look into the broker and manage its subjects and
+// subscribers. It acts on the broker it is called on.
+type Admin interface {
+	// Subjects lists the subjects with stored messages or subscribers
+	Subjects(ctx context.Context) ([]SubjectInfo, error)
+
+	// Subscribers lists the subscribers of the subject
+	Subscribers(ctx context.Context, subject string) ([]SubscriberInfo, error)
+
+	// DescribeSubscriber returns the state of the subscriber with the id
+	DescribeSubscriber(ctx context.Context, id uint64) (SubscriberInfo, error)
+
+	// PurgeSubject removes every stored message of the subject and returns
+	// how many were removed. The subscribers are left as they are.
+	PurgeSubject(ctx context.Context, subject string) (int, error)
+
+	// DeleteMessage removes one stored message, it can not be fetched
+	// anymore.
+	DeleteMessage(ctx context.Context, subject string, id int) error
+
+	// DisconnectSubscriber closes the channel of the subscriber with the id
+	DisconnectSubscriber(ctx context.Context, id uint64) error
+}
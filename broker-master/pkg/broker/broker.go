@@ -7,16 +7,140 @@ import (
 )
 
 type Message struct {
-	// This parameter is optional. If it's not provided,
-	// the Message can't be accessible through Fetch()
-	// id is unique per every subject
-	id int
+	// ID is the sequence of the message on its subject. The broker sets it
+	// when the message is stored, an ID given to Publish is ignored. Every
+	// subject counts from 1 without gaps, so consumers can spot the
+	// messages they missed, and Fetch finds a message by it.
+	ID int
+	// Timestamp is the time the message was published, it is set by
+	// the broker with the millisecond precision every storage keeps
+	Timestamp time.Time
+	// Subject the message was published on, it is filled by the broker
+	// on the messages of wildcard subscriptions
+	Subject string
 	// Body of the message
 	Body string
+	// Headers are stored and sent along with the body, e.g. the
+	// content type, correlation ids or the trace context
+	Headers map[string]string
 	// The time that message can be accessible through Fetch()
 	// with the proper Message id
 	// 0 when there is no need to keep message ( fire & forget mode )
+	// The expiration of a delayed message counts from DeliverAt
 	Expiration time.Duration
+	// DeliverAt holds the message back from the subscribers until then,
+	// it is stored right away. The zero value sends it when it is published
+	DeliverAt time.Time
+	// IdempotencyKey tells the retries of a publish apart from new messages,
+	// publishes with the same key on the subject within the dedup window
+	// get the id of the first one. It is optional
+	IdempotencyKey string
+	// Encoding is the compression of the Body, empty when it is raw. The
+	// broker compresses the bodies of the subjects configured for it when
+	// they are published
+	Encoding string
+}
+
+// Headers set on the messages moved to a dead-letter subject
+const (
+	HeaderOriginalSubject = "Original-Subject"
+	HeaderFailureReason   = "Failure-Reason"
+	HeaderDeliveryCount   = "Delivery-Count"
+)
+
+// HeaderReplyTo names the inbox subject a request expects its reply on
+const HeaderReplyTo = "Reply-To"
+
+// Reasons a message is moved to a dead-letter subject
+const (
+	// ReasonBufferFull is used when the buffer of a subscriber was full
+	ReasonBufferFull = "buffer-full"
+	// ReasonMaxDeliver is used when an acked message reached MaxDeliver
+	ReasonMaxDeliver = "max-deliver"
+	// ReasonSendFailed is used when a message could not be sent to the client
+	ReasonSendFailed = "send-failed"
+)
+
+// DeliverPolicy tells where a new subscriber starts in the messages
+// that are already stored for the subject.
+type DeliverPolicy int
+
+const (
+	// DeliverNew sends only the messages published after subscribing
+	DeliverNew DeliverPolicy = iota
+	// DeliverAll replays every stored message first
+	DeliverAll
+	// DeliverLastN replays the last LastN stored messages first
+	DeliverLastN
+	// DeliverFromID replays the stored messages from StartID on
+	DeliverFromID
+	// DeliverFromTime replays the messages published at StartTime or after
+	DeliverFromTime
+)
+
+// Backpressure decides what happens to a message published while the
+// buffer of a subscriber is full.
+type Backpressure int
+
+const (
+	// DropNewest drops the published message for the subscriber
+	DropNewest Backpressure = iota
+	// DropOldest drops the oldest buffered messages to make room
+	DropOldest
+	// Block makes the publisher wait up to BlockTimeout for room,
+	// the message is dropped once the timeout passes
+	Block
+	// Disconnect unsubscribes the subscriber and closes its channel
+	Disconnect
+)
+
+func (b Backpressure) String() string {
+	switch b {
+	case DropNewest:
+		return "drop_newest"
+	case DropOldest:
+		return "drop_oldest"
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscribeOptions changes the way a subscriber receives the messages
+// of a subject. The zero value behaves exactly like Subscribe.
+type SubscribeOptions struct {
+	// Subscribers that join a subject with the same Group split the
+	// messages between them, so each message goes to exactly one
+	// member of the group. Leave it empty to get every message.
+	Group string
+	// AckWait turns acknowledgements on. Every message sent to the
+	// subscriber must be acked with Ack before AckWait passes, or
+	// it is sent again.
+	AckWait time.Duration
+	// MaxDeliver limits how many times an unacked message is sent,
+	// 0 means it is sent until it is acked.
+	MaxDeliver int
+	// Consumer names the subscriber for Ack. It is required when
+	// AckWait is set and has to be unique on the subject.
+	Consumer string
+	// DeliverPolicy picks the stored messages that are sent before
+	// the new ones, with LastN, StartID and StartTime as its argument.
+	// Groups only support DeliverNew.
+	DeliverPolicy DeliverPolicy
+	LastN         int
+	StartID       int
+	StartTime     time.Time
+	// Backpressure is applied once the subscriber has BufferSize
+	// messages or BufferBytes bytes of bodies waiting to be read.
+	// BufferSize defaults to 200, BufferBytes to no limit and
+	// BlockTimeout to a second.
+	Backpressure Backpressure
+	BufferSize   int
+	BufferBytes  int
+	BlockTimeout time.Duration
 }
 
 // The whole implementation should be thread-safe
@@ -29,13 +153,60 @@ type Broker interface {
 	// A, B and C.
 	Publish(ctx context.Context, subject string, msg Message) (int, error)
 
+	// PublishBatch publishes every message on its Subject in one pass and
+	// returns their ids in the same order. The order within each subject
+	// is preserved, and the whole batch is rejected if a subject is not
+	// valid. A batch spread over several brokers may be committed in part,
+	// the error then comes with the ids of the messages that were, and 0
+	// for the rest.
+	PublishBatch(ctx context.Context, msgs []Message) ([]int, error)
+
 	// Subscribe listens to every publish, and returns the messages to all
 	// subscribed clients ( channels ).
+	// Subjects are tokens separated by dots, a subscription can use "*"
+	// to match any single token and ">" as its last token to match the
+	// rest of the subject, e.g. "orders.*.created" or "orders.>".
 	// If the context is cancelled, you have to stop sending messages
 	// to this subscriber. Do nothing on time-out
 	Subscribe(ctx context.Context, subject string) (<-chan Message, error)
 
+	// SubscribeWithOptions works like Subscribe, with the given options
+	// applied to the new subscriber.
+	SubscribeWithOptions(ctx context.Context, subject string, opts SubscribeOptions) (<-chan Message, error)
+
+	// Ack confirms that the consumer has processed the message with
+	// the given id, so it will not be sent to the consumer again.
+	// Consumers of a wildcard subject ack with the subject the message
+	// was published on, since ids are only unique within a subject.
+	Ack(ctx context.Context, subject string, consumer string, id int) error
+
+	// Request publishes the message with a new inbox subject in its
+	// Reply-To header, and returns the first message replied to it. It
+	// gives up once the timeout passes or the context is done, a zero
+	// timeout waits for the context alone.
+	Request(ctx context.Context, subject string, msg Message, timeout time.Duration) (Message, error)
+
+	// SetDeadLetter names the subject that gets the messages of subject
+	// which could not be delivered. An empty deadLetter turns it off.
+	SetDeadLetter(ctx context.Context, subject string, deadLetter string) error
+
+	// DeadLetter moves a message of subject that could not be handled to
+	// its dead-letter subject, the headers record the reason and the
+	// number of deliveries. It does nothing when no dead-letter subject
+	// is set.
+	DeadLetter(ctx context.Context, subject string, msg Message, reason string, deliveries int) error
+
 	// Fetch enables us to retrieve a message that is already published, if
 	// it's not expired yet.
 	Fetch(ctx context.Context, subject string, id int) (Message, error)
 }
+
+// Reply publishes the reply on the inbox the request asked for in its
+// Reply-To header.
+func Reply(ctx context.Context, b Broker, request Message, reply Message) (int, error) {
+	inbox, ok := request.Headers[HeaderReplyTo]
+	if !ok || inbox == "" {
+		return -1, ErrNoReplyTo
+	}
+	return b.Publish(ctx, inbox, reply)
+}
@@ -11,4 +11,63 @@ var (
 	// Use this error when message had been published, but it is not
 	// available anymore because the expiration time has reached.
 	ErrExpiredID = errors.New("message with id provided is expired")
+	// Use this error when an acknowledged subscription has no consumer
+	// name or its name is already taken on the subject
+	ErrInvalidConsumer = errors.New("consumer name is missing or already subscribed")
+	// Use this error when the subscribe options do not fit together
+	ErrInvalidOptions = errors.New("subscribe options are not valid")
+	// Use this error when the subject is empty, has an empty token or
+	// uses wildcards where they are not allowed
+	ErrInvalidSubject = errors.New("subject is not valid")
+	// Use this error when nobody is subscribed to the subject of a request
+	ErrNoResponders = errors.New("no responders are subscribed to the subject")
+	// Use this error when a request gets no reply before its timeout
+	ErrRequestTimeout = errors.New("request timed out before a reply")
+	// Use this error when replying to a message without a Reply-To header
+	ErrNoReplyTo = errors.New("message has no inbox to reply to")
+	// Use this error when an ack names a consumer that is not subscribed
+	ErrUnknownConsumer = errors.New("consumer is not subscribed to the subject")
+	// Use this error when a subject that rejects new messages reached its
+	// retention limits
+	ErrSubjectFull = errors.New("subject reached its retention limits")
+	// Use this error when no subscriber has the id given to the admin
+	ErrUnknownSubscriber = errors.New("subscriber with id provided is not subscribed")
+	// Use this error when a message is published with an encoding the
+	// broker does not know
+	ErrInvalidEncoding = errors.New("encoding of the message is not known")
 )
+
+// errorCodes names the errors above. Brokers pass the names of the errors
+// between them instead of their messages, which may be reworded.
+var errorCodes = map[error]string{
+	ErrUnavailable:       "unavailable",
+	ErrInvalidID:         "invalid_id",
+	ErrExpiredID:         "expired_id",
+	ErrInvalidConsumer:   "invalid_consumer",
+	ErrInvalidOptions:    "invalid_options",
+	ErrInvalidSubject:    "invalid_subject",
+	ErrNoResponders:      "no_responders",
+	ErrRequestTimeout:    "request_timeout",
+	ErrNoReplyTo:         "no_reply_to",
+	ErrUnknownConsumer:   "unknown_consumer",
+	ErrSubjectFull:       "subject_full",
+	ErrUnknownSubscriber: "unknown_subscriber",
+	ErrInvalidEncoding:   "invalid_encoding",
+}
+
+// ErrorCode returns the name of an error of the broker, empty for any
+// other error.
+func ErrorCode(err error) string {
+	return errorCodes[err]
+}
+
+// ErrorOf returns the error of the broker with the name code, nil when
+// there is none.
+func ErrorOf(code string) error {
+	for err, name := range errorCodes {
+		if name == code {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package compression
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+
+	"github.com/golang/snappy"
+)
+
+// Snappy compresses fast with a fair ratio, it suits large JSON bodies
+const Snappy = "snappy"
+
+// ErrUnknownEncoding is returned for bodies in an encoding that is not known
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+// Known reports whether the bodies in the encoding can be decompressed,
+// the empty encoding is a raw body.
+func Known(encoding string) bool {
+	return encoding == "" || encoding == Snappy
+}
+
+// Encodings are the encodings the broker knows, the brokers that forward
+// messages to each other accept all of them.
+func Encodings() []string {
+	return []string{Snappy}
+}
+
+// Compress returns the body in the encoding.
+func Compress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case Snappy:
+		return snappy.Encode(nil, body), nil
+	}
+	return nil, ErrUnknownEncoding
+}
+
+// Decompress returns the raw body of a body in the encoding.
+func Decompress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case Snappy:
+		return snappy.Decode(nil, body)
+	}
+	return nil, ErrUnknownEncoding
+}
+
+// Decode returns the message with its raw body, unless its encoding is one
+// of the accepted ones.
+func Decode(msg broker.Message, accepted []string) (broker.Message, error) {
+	if msg.Encoding == "" {
+		return msg, nil
+	}
+	for _, encoding := range accepted {
+		if encoding == msg.Encoding {
+			return msg, nil
+		}
+	}
+	body, err := Decompress(msg.Encoding, []byte(msg.Body))
+	if err != nil {
+		return broker.Message{}, err
+	}
+	msg.Body, msg.Encoding = string(body), ""
+	return msg, nil
+}
+
+// Subjects picks the encoding the bodies published on every subject are
+// compressed with, the subjects that are not named get the default one.
+type Subjects struct {
+	Default  string
+	Subjects map[string]string
+	// MinBytes is the size of the smallest body that is compressed
+	MinBytes int
+}
+
+// Load reads the default encoding from the configuration and the encoding
+// of single subjects from its JSON file like {"orders": "snappy"}.
+// A missing configuration compresses nothing.
+func Load(cfg *config.Config) (Subjects, error) {
+	subjects := Subjects{Subjects: make(map[string]string)}
+	if cfg == nil {
+		return subjects, nil
+	}
+
+	subjects.Default = cfg.Compression.Encoding
+	subjects.MinBytes = cfg.Compression.MinBytes
+	if cfg.Compression.File != "" {
+		data, err := os.ReadFile(cfg.Compression.File)
+		if err != nil {
+			return Subjects{}, err
+		}
+		if err := json.Unmarshal(data, &subjects.Subjects); err != nil {
+			return Subjects{}, err
+		}
+	}
+
+	if !Known(subjects.Default) {
+		return Subjects{}, fmt.Errorf("unknown encoding %q", subjects.Default)
+	}
+	for subject, encoding := range subjects.Subjects {
+		if !Known(encoding) {
+			return Subjects{}, fmt.Errorf("encoding of %s: unknown encoding %q", subject, encoding)
+		}
+	}
+	return subjects, nil
+}
+
+// Encoding is the encoding of the subject, empty when its bodies are kept raw.
+func (s Subjects) Encoding(subject string) string {
+	if encoding, ok := s.Subjects[subject]; ok {
+		return encoding
+	}
+	return s.Default
+}
+
+// Compress compresses the body of a message published on the subject.
+// Small bodies, bodies that do not get smaller and messages that have an
+// encoding already are left as they are.
+func (s Subjects) Compress(subject string, msg broker.Message) (broker.Message, error) {
+	if msg.Encoding != "" {
+		if !Known(msg.Encoding) {
+			return broker.Message{}, broker.ErrInvalidEncoding
+		}
+		return msg, nil
+	}
+	encoding := s.Encoding(subject)
+	if encoding == "" || len(msg.Body) < s.MinBytes {
+		return msg, nil
+	}
+	body, err := Compress(encoding, []byte(msg.Body))
+	if err != nil {
+		return broker.Message{}, err
+	}
+	if len(body) < len(msg.Body) {
+		msg.Body, msg.Encoding = string(body), encoding
+	}
+	return msg, nil
+}
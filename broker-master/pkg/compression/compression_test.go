@@ -0,0 +1,61 @@
+package compression
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressShouldOnlyShrinkLargeBodies(t *testing.T) {
+	subjects := Subjects{Subjects: map[string]string{"orders": Snappy}, MinBytes: 64}
+	large := strings.Repeat(`{"item": "book", "count": 1}`, 20)
+
+	compressed, err := subjects.Compress("orders", broker.Message{Body: large})
+	assert.Nil(t, err)
+	assert.Equal(t, Snappy, compressed.Encoding)
+	assert.Less(t, len(compressed.Body), len(large))
+
+	small, _ := subjects.Compress("orders", broker.Message{Body: "small"})
+	assert.Equal(t, broker.Message{Body: "small"}, small)
+	other, _ := subjects.Compress("payments", broker.Message{Body: large})
+	assert.Equal(t, "", other.Encoding)
+
+	_, err = subjects.Compress("orders", broker.Message{Body: large, Encoding: "lz4"})
+	assert.Equal(t, broker.ErrInvalidEncoding, err)
+}
+
+func TestDecodeShouldKeepAcceptedEncodings(t *testing.T) {
+	body := strings.Repeat("hello ", 100)
+	compressed, _ := Subjects{Default: Snappy}.Compress("ali", broker.Message{Body: body})
+
+	kept, err := Decode(compressed, []string{Snappy})
+	assert.Nil(t, err)
+	assert.Equal(t, compressed, kept)
+
+	raw, err := Decode(compressed, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, broker.Message{Body: body}, raw)
+
+	_, err = Decode(broker.Message{Body: "not snappy", Encoding: Snappy}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestLoadShouldReadSubjectsFromFile(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Compression.File = filepath.Join(t.TempDir(), "compression.json")
+	assert.Nil(t, os.WriteFile(cfg.Compression.File, []byte(`{"orders": "snappy"}`), 0644))
+
+	subjects, err := Load(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, Snappy, subjects.Encoding("orders"))
+	assert.Equal(t, "", subjects.Encoding("payments"))
+
+	cfg.Compression.Encoding = "zip"
+	_, err = Load(cfg)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,653 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/encryption"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+)
+
+type batchOperation struct {
+	count      int
+	batch      *gocql.Batch
+	batchMutex sync.Mutex
+}
+
+// cqlDB keeps the messages in Cassandra or ScyllaDB, both speak CQL and
+// only their settings differ.
+type cqlDB struct {
+	// name is the database in the logs and the traces
+	name           string
+	keyspace       string
+	batchSize      int
+	timeThreshold  int
+	cfg            *config.Config
+	log            *logrus.Logger
+	session        *gocql.Session
+	batch          *batchOperation
+	sequences      sequences
+	retention      *retainer
+	keyring        *encryption.Keyring
+	handleMSgMutex sync.Mutex
+}
+
+// cqlSettings are the settings of the CQL database in the configuration
+type cqlSettings struct {
+	name          string
+	host          string
+	port          int
+	keyspace      string
+	username      string
+	password      string
+	batchSize     int
+	timeThreshold int
+}
+
+// connectCQL connects to the database and prepares its keyspace and table,
+// the database is returned along with the last error on the way.
+func connectCQL(cfg *config.Config, settings cqlSettings, log *logrus.Logger) (*cqlDB, error) {
+	var errConn error
+	cluster := gocql.NewCluster(settings.host)
+	cluster.Port = settings.port
+	cluster.Authenticator = gocql.PasswordAuthenticator{
+		Username: settings.username,
+		Password: settings.password,
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	retention, err := LoadRetention(cfg)
+	if err != nil {
+		errConn = err
+	}
+	keyring, err := encryption.Load(cfg)
+	if err != nil {
+		errConn = err
+	}
+	cd := &cqlDB{
+		name:           settings.name,
+		keyspace:       settings.keyspace,
+		batchSize:      settings.batchSize,
+		timeThreshold:  settings.timeThreshold,
+		cfg:            cfg,
+		log:            log,
+		session:        session,
+		sequences:      make(sequences),
+		retention:      newRetainer(retention, keyring),
+		keyring:        keyring,
+		handleMSgMutex: sync.Mutex{},
+		batch: &batchOperation{
+			count:      0,
+			batch:      session.NewBatch(gocql.UnloggedBatch),
+			batchMutex: sync.Mutex{},
+		},
+	}
+
+	err = cd.createKeyspace()
+	if err != nil {
+		errConn = err
+	}
+	cd.log.Infof("%s keyspace %s has been created successfully\n", cd.name, cd.keyspace)
+
+	err = cd.createTable()
+	if err != nil {
+		errConn = err
+	} else {
+		cd.log.Infof("%s messages table has been created successfully", cd.name)
+	}
+
+	err = cd.loadSequences()
+	if err != nil {
+		errConn = err
+	} else {
+		cd.log.Infof("sequences of %d subjects have been found successfully", len(cd.sequences))
+	}
+
+	go cd.scheduledBatchOperation()
+
+	//	The janitor also deletes the removed rows, so it runs even
+	//	without any retention limits
+	cd.enforceRetention(time.Now())
+	go cd.retention.run(cd.enforceRetention)
+	return cd, errConn
+}
+
+func (cd *cqlDB) createKeyspace() error {
+	keyspace := fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };",
+		cd.keyspace)
+	err := cd.session.Query(keyspace).Exec()
+	return err
+
+}
+func (cd *cqlDB) createTable() error {
+	table := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s.messages (
+        id INT,
+        subject TEXT,
+        body BLOB,
+        expiration_time BIGINT,
+        added_time TIMESTAMP,
+        removed BOOLEAN,
+        headers MAP<TEXT, TEXT>,
+        deliver_at TIMESTAMP,
+        idempotency_key TEXT,
+        encoding TEXT,
+        key_id TEXT,
+        PRIMARY KEY (subject, id)
+    );`, cd.keyspace,
+	)
+
+	if err := cd.session.Query(table).Exec(); err != nil {
+		return err
+	}
+
+	//	Tables created before the headers or the delays existed get the
+	//	columns, on the others it fails because the column is already there
+	alter := fmt.Sprintf("ALTER TABLE %s.messages ADD headers MAP<TEXT, TEXT>;", cd.keyspace)
+	_ = cd.session.Query(alter).Exec()
+	alter = fmt.Sprintf("ALTER TABLE %s.messages ADD deliver_at TIMESTAMP;", cd.keyspace)
+	_ = cd.session.Query(alter).Exec()
+	alter = fmt.Sprintf("ALTER TABLE %s.messages ADD idempotency_key TEXT;", cd.keyspace)
+	_ = cd.session.Query(alter).Exec()
+	alter = fmt.Sprintf("ALTER TABLE %s.messages ADD encoding TEXT;", cd.keyspace)
+	_ = cd.session.Query(alter).Exec()
+	alter = fmt.Sprintf("ALTER TABLE %s.messages ADD key_id TEXT;", cd.keyspace)
+	_ = cd.session.Query(alter).Exec()
+	return nil
+}
+
+func (cd *cqlDB) loadSequences() error {
+	query := fmt.Sprintf("SELECT subject, MAX(id) FROM %s.messages GROUP BY subject;", cd.keyspace)
+	rows := cd.session.Query(query).Iter()
+
+	cd.handleMSgMutex.Lock()
+	defer cd.handleMSgMutex.Unlock()
+	var subject string
+	var lastId int
+	for rows.Scan(&subject, &lastId) {
+		cd.sequences.seen(subject, lastId)
+	}
+	return rows.Close()
+}
+
+func (cd *cqlDB) AddMessage(ctx context.Context, newMsg broker.Message, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add new message to "+cd.name)
+	defer span.Finish()
+
+	newMsg.Subject = subject
+	if err := cd.retention.admit([]broker.Message{newMsg}); err != nil {
+		return -1, err
+	}
+	sealed, err := sealBodies(cd.keyring, []broker.Message{newMsg})
+	if err != nil {
+		return -1, err
+	}
+
+	cd.handleMSgMutex.Lock()
+	var newId = cd.sequences.assign(subject, newMsg.ID)
+	cd.handleMSgMutex.Unlock()
+
+	cd.addQueryToBatch(cd.insertQuery(), cd.insertArgs(newId, newMsg, subject, sealed[0])...)
+
+	return newId, nil
+}
+
+func (cd *cqlDB) AddMessages(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add batch of messages to "+cd.name)
+	defer span.Finish()
+
+	if err := cd.retention.admit(msgs); err != nil {
+		return nil, err
+	}
+	sealed, err := sealBodies(cd.keyring, msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	cd.handleMSgMutex.Lock()
+	ids := make([]int, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = cd.sequences.assign(msg.Subject, msg.ID)
+	}
+	cd.handleMSgMutex.Unlock()
+
+	query := cd.insertQuery()
+	cd.batch.batchMutex.Lock()
+	defer cd.batch.batchMutex.Unlock()
+	for i, msg := range msgs {
+		cd.queueQuery(query, cd.insertArgs(ids[i], msg, msg.Subject, sealed[i])...)
+	}
+
+	return ids, nil
+}
+
+func (cd *cqlDB) Admits(msgs []broker.Message) error {
+	return cd.retention.check(msgs)
+}
+
+func (cd *cqlDB) insertQuery() string {
+	return fmt.Sprintf(`
+	INSERT INTO %s.messages (id, subject, body, expiration_time, added_time, removed, headers, deliver_at, idempotency_key, encoding, key_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, cd.keyspace)
+}
+
+// insertArgs stores the message with its sealed body.
+func (cd *cqlDB) insertArgs(id int, msg broker.Message, subject string, sealed sealedBody) []interface{} {
+	var expired = !kept(msg)
+	return []interface{}{id, subject, sealed.body, ExpirationSeconds(msg.Expiration), addedTime(msg), expired, msg.Headers, msg.DeliverAt, msg.IdempotencyKey, msg.Encoding, sealed.keyID}
+}
+
+func (cd *cqlDB) LastID(subject string) int {
+	cd.handleMSgMutex.Lock()
+	defer cd.handleMSgMutex.Unlock()
+	return cd.sequences[subject]
+}
+
+func (cd *cqlDB) FetchMessage(ctx context.Context, id int, subject string) (broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Fetch message from "+cd.name)
+	defer span.Finish()
+
+	row, err := cd.fetchRow(ctx, id, subject)
+	if err != nil {
+		return broker.Message{}, err
+	}
+	if row == nil {
+		cd.handleMSgMutex.Lock()
+		last := cd.sequences[subject]
+		cd.handleMSgMutex.Unlock()
+		if id < 1 || id > last {
+			return broker.Message{}, broker.ErrInvalidID
+		}
+
+		//	The message may still wait in the batch, otherwise its row was
+		//	removed and then deleted by the janitor
+		if err := cd.Flush(); err != nil {
+			return broker.Message{}, err
+		}
+		if row, err = cd.fetchRow(ctx, id, subject); err != nil {
+			return broker.Message{}, err
+		}
+		if row == nil {
+			return broker.Message{}, broker.ErrExpiredID
+		}
+	}
+
+	msg := row.msg
+	if row.removed || (msg.Expiration > 0 && expiresAt(msg.Timestamp, msg.DeliverAt, msg.Expiration).Before(time.Now())) {
+		return broker.Message{}, broker.ErrExpiredID
+	}
+	body, err := cd.keyring.Open(row.keyID, []byte(msg.Body))
+	if err != nil {
+		return broker.Message{}, err
+	}
+	msg.Body = string(body)
+	return msg, nil
+}
+
+// fetchedRow is a stored message with its body still sealed
+type fetchedRow struct {
+	msg     broker.Message
+	keyID   string
+	removed bool
+}
+
+// fetchRow reads the row of the message, it is nil when there is none.
+func (cd *cqlDB) fetchRow(ctx context.Context, id int, subject string) (*fetchedRow, error) {
+	query := fmt.Sprintf(`
+		SELECT body, expiration_time, added_time, removed, headers, deliver_at, encoding, key_id FROM %s.messages WHERE subject = ? AND id = ?;
+	`, cd.keyspace)
+	rows := cd.session.Query(query, subject, id).WithContext(ctx).Iter()
+
+	var row *fetchedRow
+	var body []byte
+	var expirationTime int64
+	var addedTime time.Time
+	var removed bool
+	var headers map[string]string
+	var deliverAt time.Time
+	var encoding string
+	var keyID string
+	if rows.Scan(&body, &expirationTime, &addedTime, &removed, &headers, &deliverAt, &encoding, &keyID) {
+		row = &fetchedRow{
+			msg: broker.Message{
+				ID:         id,
+				Timestamp:  addedTime,
+				Body:       string(body),
+				Headers:    headers,
+				Expiration: time.Duration(expirationTime) * time.Second,
+				DeliverAt:  deliverAt,
+				Encoding:   encoding,
+			},
+			keyID:   keyID,
+			removed: removed,
+		}
+	}
+	return row, rows.Close()
+}
+
+func (cd *cqlDB) DeleteMessage(subject string, id int) {
+	span, _ := opentracing.StartSpanFromContext(context.Background(), "Delete message from "+cd.name)
+	defer span.Finish()
+
+	cd.addQueryToBatch(cd.deleteQuery(), subject, id)
+}
+
+func (cd *cqlDB) DeleteMessages(keys []MessageKey) {
+	span, _ := opentracing.StartSpanFromContext(context.Background(), "Delete messages from "+cd.name)
+	defer span.Finish()
+
+	for _, key := range keys {
+		cd.addQueryToBatch(cd.deleteQuery(), key.Subject, key.ID)
+	}
+}
+
+func (cd *cqlDB) deleteQuery() string {
+	return fmt.Sprintf(`
+	UPDATE %s.messages SET removed = true WHERE subject = ? AND id = ?;
+	`, cd.keyspace)
+}
+
+func (cd *cqlDB) GetMessagesBySubject(ctx context.Context, subject string, filter ReplayFilter) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "GetMessages based on the given subject from "+cd.name)
+	defer span.Finish()
+
+	query := fmt.Sprintf(`
+		SELECT id, body, expiration_time, added_time, removed, headers, deliver_at, encoding, key_id FROM %s.messages WHERE subject = ? AND id >= ?;
+	`, cd.keyspace)
+
+	rows := cd.session.Query(query, subject, filter.FromID).WithContext(ctx).Iter()
+
+	var messages = make([]broker.Message, 0)
+	var id int
+	var body []byte
+	var expration_time int64
+	var addedTime time.Time
+	var removed bool
+	var headers map[string]string
+	var deliverAt time.Time
+	var encoding string
+	var keyID string
+	for rows.Scan(&id, &body, &expration_time, &addedTime, &removed, &headers, &deliverAt, &encoding, &keyID) {
+		if removed || !filter.matches(id, addedTime) {
+			continue
+		}
+		body, err := cd.keyring.Open(keyID, body)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		messages = append(messages, broker.Message{
+			ID:         id,
+			Timestamp:  addedTime,
+			Body:       string(body),
+			Headers:    headers,
+			Expiration: time.Duration(expration_time) * time.Second,
+			DeliverAt:  deliverAt,
+			Encoding:   encoding,
+		})
+	}
+
+	err := rows.Close()
+	return filter.last(messages), err
+}
+
+// DelayedMessages goes through every message like Subjects, the time they
+// are due is not part of the key.
+func (cd *cqlDB) DelayedMessages(ctx context.Context, after time.Time) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Find delayed messages in "+cd.name)
+	defer span.Finish()
+
+	if err := cd.Flush(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`
+		SELECT subject, id, body, expiration_time, added_time, removed, headers, deliver_at, encoding, key_id FROM %s.messages;
+	`, cd.keyspace)
+	rows := cd.session.Query(query).WithContext(ctx).Iter()
+
+	var messages = make([]broker.Message, 0)
+	var subject string
+	var id int
+	var body []byte
+	var expirationTime int64
+	var addedTime time.Time
+	var removed bool
+	var headers map[string]string
+	var deliverAt time.Time
+	var encoding string
+	var keyID string
+	for rows.Scan(&subject, &id, &body, &expirationTime, &addedTime, &removed, &headers, &deliverAt, &encoding, &keyID) {
+		if removed || !deliverAt.After(after) {
+			continue
+		}
+		body, err := cd.keyring.Open(keyID, body)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		messages = append(messages, broker.Message{
+			ID:         id,
+			Subject:    subject,
+			Timestamp:  addedTime,
+			Body:       string(body),
+			Headers:    headers,
+			Expiration: time.Duration(expirationTime) * time.Second,
+			DeliverAt:  deliverAt,
+			Encoding:   encoding,
+		})
+	}
+	return messages, rows.Close()
+}
+
+// KeyedMessages goes through every message like DelayedMessages.
+func (cd *cqlDB) KeyedMessages(ctx context.Context, since time.Time) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Find messages with idempotency keys in "+cd.name)
+	defer span.Finish()
+
+	if err := cd.Flush(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT subject, id, added_time, idempotency_key FROM %s.messages;", cd.keyspace)
+	rows := cd.session.Query(query).WithContext(ctx).Iter()
+
+	var messages = make([]broker.Message, 0)
+	var subject string
+	var id int
+	var addedTime time.Time
+	var key string
+	for rows.Scan(&subject, &id, &addedTime, &key) {
+		if key == "" || addedTime.Before(since) {
+			continue
+		}
+		messages = append(messages, broker.Message{ID: id, Subject: subject, Timestamp: addedTime, IdempotencyKey: key})
+	}
+	return messages, rows.Close()
+}
+
+func (cd *cqlDB) Subjects(ctx context.Context) (map[string]int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Count messages of subjects in "+cd.name)
+	defer span.Finish()
+
+	if err := cd.Flush(); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT subject, removed FROM %s.messages;", cd.keyspace)
+	rows := cd.session.Query(query).WithContext(ctx).Iter()
+
+	counts := make(map[string]int)
+	var subject string
+	var removed bool
+	for rows.Scan(&subject, &removed) {
+		if !removed {
+			counts[subject]++
+		}
+	}
+	return counts, rows.Close()
+}
+
+// PurgeSubject marks the live messages of the subject as removed in one
+// batch, the partition itself is kept like for single deletions.
+func (cd *cqlDB) PurgeSubject(ctx context.Context, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Purge subject in "+cd.name)
+	defer span.Finish()
+
+	cd.batch.batchMutex.Lock()
+	defer cd.batch.batchMutex.Unlock()
+	if err := cd.execBatch(); err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf("SELECT id, removed FROM %s.messages WHERE subject = ?;", cd.keyspace)
+	rows := cd.session.Query(query, subject).WithContext(ctx).Iter()
+	update := fmt.Sprintf("UPDATE %s.messages SET removed = true WHERE subject = ? AND id = ?;", cd.keyspace)
+
+	purged := 0
+	var id int
+	var removed bool
+	for rows.Scan(&id, &removed) {
+		if removed {
+			continue
+		}
+		cd.batch.batch.Query(update, subject, id)
+		cd.batch.count++
+		purged++
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if err := cd.execBatch(); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// enforceRetention removes the messages of every subject that are over its
+// limits, the oldest first, and deletes the rows of the removed messages.
+// The last row of every subject is only marked removed, the sequence goes
+// on from its id after a restart, and so are the rows with an idempotency
+// key within the dedup window.
+func (cd *cqlDB) enforceRetention(now time.Time) {
+	if err := cd.Flush(); err != nil {
+		return
+	}
+	query := fmt.Sprintf("SELECT subject, id, added_time, removed, body, idempotency_key FROM %s.messages;", cd.keyspace)
+	rows := cd.session.Query(query).Iter()
+
+	live := make(map[string][]retained)
+	removed := make(map[string][]int)
+	last := make(map[string]int)
+	keyed := make(map[MessageKey]bool)
+	keyedSince := now.Add(-DedupWindow(cd.cfg))
+	var subject string
+	var id int
+	var addedTime time.Time
+	var isRemoved bool
+	var body []byte
+	var key string
+	for rows.Scan(&subject, &id, &addedTime, &isRemoved, &body, &key) {
+		if key != "" && !addedTime.Before(keyedSince) {
+			keyed[MessageKey{Subject: subject, ID: id}] = true
+		}
+		if isRemoved {
+			removed[subject] = append(removed[subject], id)
+		} else {
+			live[subject] = append(live[subject], retained{id: id, size: len(body), added: addedTime})
+		}
+		if id > last[subject] {
+			last[subject] = id
+		}
+	}
+	if err := rows.Close(); err != nil {
+		cd.log.WithError(err).Warn("can not read the messages to enforce their retention")
+		return
+	}
+
+	remove := fmt.Sprintf("UPDATE %s.messages SET removed = true WHERE subject = ? AND id = ?;", cd.keyspace)
+	drop := fmt.Sprintf("DELETE FROM %s.messages WHERE subject = ? AND id = ?;", cd.keyspace)
+	kept := make(map[string]usage)
+	cd.batch.batchMutex.Lock()
+	defer cd.batch.batchMutex.Unlock()
+	for subject, lastID := range last {
+		discarded, subjectUsage := cd.retention.limits(subject).trim(live[subject], now)
+		kept[subject] = subjectUsage
+		for _, id := range removed[subject] {
+			if id != lastID && !keyed[MessageKey{Subject: subject, ID: id}] {
+				cd.queueQuery(drop, subject, id)
+			}
+		}
+		for _, id := range discarded {
+			if id == lastID || keyed[MessageKey{Subject: subject, ID: id}] {
+				cd.queueQuery(remove, subject, id)
+			} else {
+				cd.queueQuery(drop, subject, id)
+			}
+		}
+	}
+	_ = cd.execBatch()
+	cd.retention.reset(kept)
+}
+
+func (cd *cqlDB) Flush() error {
+	cd.batch.batchMutex.Lock()
+	defer cd.batch.batchMutex.Unlock()
+	return cd.execBatch()
+}
+
+func (cd *cqlDB) Close() error {
+	if cd.session != nil {
+		cd.session.Close()
+	}
+	return nil
+}
+
+func (cd *cqlDB) scheduledBatchOperation() {
+	ticker := time.NewTicker(time.Duration(5 * cd.timeThreshold))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cd.batch.batchMutex.Lock()
+		_ = cd.execBatch()
+		cd.batch.batchMutex.Unlock()
+	}
+}
+
+func (cd *cqlDB) addQueryToBatch(query string, args ...interface{}) {
+	cd.batch.batchMutex.Lock()
+	defer cd.batch.batchMutex.Unlock()
+	cd.queueQuery(query, args...)
+}
+
+// queueQuery adds the query to the batch and runs the batch once it is
+// full, the caller holds the batch mutex.
+func (cd *cqlDB) queueQuery(query string, args ...interface{}) {
+	cd.batch.batch.Query(query, args...)
+	cd.batch.count++
+	if cd.batch.count == cd.batchSize {
+		_ = cd.execBatch()
+	}
+
+}
+
+func (cd *cqlDB) execBatch() error {
+	if cd.batch.count == 0 {
+		return nil
+	}
+
+	err := cd.session.ExecuteBatch(cd.batch.batch)
+	if err != nil {
+		cd.log.WithError(err).Warn("could not execute batch operation")
+		return err
+	}
+	cd.batch.count = 0
+	cd.batch.batch = cd.session.NewBatch(gocql.UnloggedBatch)
+	return nil
+}
@@ -2,13 +2,178 @@ package database
 
 import (
 	"context"
+	"therealbroker/config"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/encryption"
+	"time"
 )
 
+// DB keeps the messages of every subject. The id of a message is its
+// sequence on the subject, every subject counts from 1 on its own and
+// without gaps, and keeps counting across restarts. A message that comes
+// with an ID past the last one of its subject is stored with it instead,
+// the leader of a cluster hands them out.
 type DB interface {
+	// AddMessage stores the message with its headers and timestamp, and
+	// returns the id assigned to it
 	AddMessage(ctx context.Context, msg broker.Message, subject string) (int, error)
+	// AddMessages stores the messages in one pass, each one on its Subject,
+	// and returns their ids in the same order
+	AddMessages(ctx context.Context, msgs []broker.Message) ([]int, error)
+	// Admits fails with ErrSubjectFull when the messages, each one on its
+	// Subject, do not fit in the retention of their subjects. It neither
+	// stores nor counts them, the leader of a cluster admits its publishes
+	// with it before they are stored with their IDs
+	Admits(msgs []broker.Message) error
 	FetchMessage(ctx context.Context, id int, subject string) (broker.Message, error)
+	// LastID returns the id of the last message added to the subject, 0
+	// before the first one
+	LastID(subject string) int
 	DeleteMessage(subject string, id int)
-	GetMessagesBySubject(ctx context.Context, subject string) ([]broker.Message, error)
+	// DeleteMessages removes the messages in one pass, like the ones that
+	// expire at the same time
+	DeleteMessages(keys []MessageKey)
+	// GetMessagesBySubject returns the stored messages of the subject that
+	// pass the filter, ordered by their id and with the id filled in.
+	GetMessagesBySubject(ctx context.Context, subject string, filter ReplayFilter) ([]broker.Message, error)
+	// Subjects counts the messages still stored on every subject, subjects
+	// without any are left out
+	Subjects(ctx context.Context) (map[string]int, error)
+	// PurgeSubject removes every stored message of the subject and returns
+	// how many were removed
+	PurgeSubject(ctx context.Context, subject string) (int, error)
+	// DelayedMessages returns the stored messages held back until after the
+	// time, with their Subject and ID, so they are sent after a restart
+	DelayedMessages(ctx context.Context, after time.Time) ([]broker.Message, error)
+	// KeyedMessages returns the messages published with an IdempotencyKey
+	// at the time or after it, with their Subject, ID, key and Timestamp,
+	// even when they are removed already. The broker fills its dedup
+	// window from them after a restart
+	KeyedMessages(ctx context.Context, since time.Time) ([]broker.Message, error)
+	// Flush writes the messages and deletions still waiting in a batch
+	Flush() error
 	Close() error
 }
+
+// MessageKey names a stored message
+type MessageKey struct {
+	Subject string
+	ID      int
+}
+
+// sequences hands out the ids of the messages, the last one of every
+// subject. The storage holding it does the locking.
+type sequences map[string]int
+
+func (s sequences) next(subject string) int {
+	s[subject]++
+	return s[subject]
+}
+
+// assign returns the id of a new message on the subject, the one it comes
+// with when it is past the last one.
+func (s sequences) assign(subject string, id int) int {
+	if id > s[subject] {
+		s[subject] = id
+		return id
+	}
+	return s.next(subject)
+}
+
+// seen moves the sequence of the subject past an id that is already stored.
+func (s sequences) seen(subject string, id int) {
+	if id > s[subject] {
+		s[subject] = id
+	}
+}
+
+// ExpirationSeconds is the expiration the storages keep and the brokers
+// send to each other, in whole seconds and rounded up so a message that is
+// kept for a moment is still kept.
+func ExpirationSeconds(expiration time.Duration) int64 {
+	return int64((expiration + time.Second - 1) / time.Second)
+}
+
+// delayed reports whether the message is held back after it is stored.
+func delayed(msg broker.Message) bool {
+	return msg.DeliverAt.After(addedTime(msg))
+}
+
+// kept reports whether the storage keeps the message, fire and forget
+// messages are only kept until they are due when they are delayed.
+func kept(msg broker.Message) bool {
+	return msg.Expiration > 0 || delayed(msg)
+}
+
+// expiresAt is the time a stored message expires, the expiration of a
+// delayed message counts from the time it is due.
+func expiresAt(added time.Time, deliverAt time.Time, expiration time.Duration) time.Time {
+	if deliverAt.After(added) {
+		return deliverAt.Add(expiration)
+	}
+	return added.Add(expiration)
+}
+
+// defaultDedupWindow is the dedup window when no configuration is loaded
+const defaultDedupWindow = 2 * time.Minute
+
+// DedupWindow is how long the idempotency keys of the publishes are
+// remembered, the storages keep the keys of removed messages that long.
+func DedupWindow(cfg *config.Config) time.Duration {
+	if cfg == nil {
+		return defaultDedupWindow
+	}
+	return time.Duration(cfg.Broker.DedupWindow) * time.Second
+}
+
+// sealedBody is a body as the storage keeps it, with the id of the key it
+// is sealed with, or without one when the keyring is off.
+type sealedBody struct {
+	keyID string
+	body  []byte
+}
+
+// sealBodies seals the bodies of the messages before any of them is stored,
+// so a batch is stored whole or not at all.
+func sealBodies(keyring *encryption.Keyring, msgs []broker.Message) ([]sealedBody, error) {
+	sealed := make([]sealedBody, len(msgs))
+	for i, msg := range msgs {
+		keyID, body, err := keyring.Seal([]byte(msg.Body))
+		if err != nil {
+			return nil, err
+		}
+		sealed[i] = sealedBody{keyID: keyID, body: body}
+	}
+	return sealed, nil
+}
+
+// addedTime is the time a message is stored with, the broker sets it
+// when the message is published.
+func addedTime(msg broker.Message) time.Time {
+	if msg.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return msg.Timestamp
+}
+
+// ReplayFilter picks the messages of a subject a new subscriber starts
+// from, the zero value picks all of them.
+type ReplayFilter struct {
+	// Only messages with an id greater than or equal to FromID
+	FromID int
+	// Only messages added at FromTime or after it
+	FromTime time.Time
+	// Only the last N messages, 0 means no limit
+	LastN int
+}
+
+func (f ReplayFilter) matches(id int, addedTime time.Time) bool {
+	return id >= f.FromID && !addedTime.Before(f.FromTime)
+}
+
+func (f ReplayFilter) last(messages []broker.Message) []broker.Message {
+	if f.LastN > 0 && len(messages) > f.LastN {
+		return messages[len(messages)-f.LastN:]
+	}
+	return messages
+}
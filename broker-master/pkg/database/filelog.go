@@ -0,0 +1,1053 @@
+package database
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/encryption"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	fileLogDb      = &FileLogDB{}
+	onceFileLog    = sync.Once{}
+	errConnFileLog error
+
+	errCorruptedRecord = errors.New("corrupted log record")
+	// errRecordVersion is returned for add records written by a newer
+	// broker, the segment is left as it is instead of being truncated
+	errRecordVersion = errors.New("unknown log record version")
+)
+
+const (
+	segmentExtension = ".log"
+
+	recordAdd    byte = 1
+	recordDelete byte = 2
+	// recordSequences starts every segment with the last id of every
+	// subject, laid out like headers, so the sequences outlive the
+	// segments that are removed
+	recordSequences byte = 3
+
+	// addRecordVersion is the layout of the fields of add records, new
+	// fields are appended without changing it
+	addRecordVersion byte = 1
+	// addRecordFields are the fields of add records this broker knows
+	addRecordFields = 6
+
+	// length (4 bytes) + crc32 of the payload (4 bytes)
+	recordHeaderSize = 8
+)
+
+// logSegment is one file of the append-only log. Segments are numbered
+// in the order they are written, so sorting by name gives that order.
+type logSegment struct {
+	number int
+	path   string
+	file   *os.File
+	size   int64
+	live   int
+	// keyedUntil is the time the newest message with an idempotency key
+	// was added, the segment is kept until it is past the dedup window
+	keyedUntil time.Time
+}
+
+// logEntry is the in-memory index record pointing to a message on disk.
+type logEntry struct {
+	segment    *logSegment
+	offset     int64
+	addedTime  time.Time
+	expiration time.Duration
+	deliverAt  time.Time
+	key        string
+	// size is the size of the sealed body, which the retention counts
+	size    int
+	removed bool
+}
+
+type logRecord struct {
+	op         byte
+	id         int
+	subject    string
+	addedTime  time.Time
+	expiration time.Duration
+	deliverAt  time.Time
+	key        string
+	encoding   string
+	headers    map[string]string
+	// keyID is the key the body is sealed with, empty for plain bodies
+	keyID string
+	body  []byte
+}
+
+type FileLogDB struct {
+	cfg         *config.Config
+	log         *logrus.Logger
+	dir         string
+	segmentSize int64
+	segments    []*logSegment
+	active      *logSegment
+	index       map[MessageKey]*logEntry
+	subjects    map[string][]int
+	sequences   sequences
+	retention   *retainer
+	keyring     *encryption.Keyring
+	dedupWindow time.Duration
+	dirty       bool
+	closed      bool
+	sync.RWMutex
+}
+
+func ConnectToFileLog(cfg *config.Config, logger *logrus.Logger) (DB, error) {
+	onceFileLog.Do(func() {
+		fileLogDb, errConnFileLog = openFileLog(cfg, logger)
+		if errConnFileLog != nil {
+			logger.WithError(errConnFileLog).Warn("could not open file log storage")
+			return
+		}
+		fileLogDb.log.Infof("file log has been recovered successfully with %d subjects", len(fileLogDb.sequences))
+
+		go fileLogDb.scheduledSync()
+		if fileLogDb.retention.enabled() {
+			go fileLogDb.retention.run(fileLogDb.enforceRetention)
+		}
+	})
+	return fileLogDb, errConnFileLog
+}
+
+func GetFileLogInstance() DB {
+	return fileLogDb
+}
+
+func openFileLog(cfg *config.Config, logger *logrus.Logger) (*FileLogDB, error) {
+	if err := os.MkdirAll(cfg.FileLog.Dir, 0755); err != nil {
+		return nil, err
+	}
+	retention, err := LoadRetention(cfg)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := encryption.Load(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := &FileLogDB{
+		cfg:         cfg,
+		log:         logger,
+		dir:         cfg.FileLog.Dir,
+		segmentSize: cfg.FileLog.SegmentSize,
+		segments:    make([]*logSegment, 0),
+		index:       make(map[MessageKey]*logEntry),
+		subjects:    make(map[string][]int),
+		sequences:   make(sequences),
+		retention:   newRetainer(retention, keyring),
+		keyring:     keyring,
+		dedupWindow: DedupWindow(cfg),
+	}
+
+	if err := fd.recover(); err != nil {
+		fd.closeSegments()
+		return nil, err
+	}
+
+	if fd.active == nil {
+		if err := fd.rollSegment(); err != nil {
+			return nil, err
+		}
+	}
+
+	//	The messages kept before the restart count against the retention
+	if retention.enabled() {
+		fd.enforceRetention(time.Now())
+	}
+	return fd, nil
+}
+
+// recover rebuilds the index by replaying every segment in order. A record
+// that is cut short or fails its checksum marks the end of valid data, the
+// segment is truncated there so that new records are appended after the
+// last complete one.
+func (fd *FileLogDB) recover() error {
+	names, err := filepath.Glob(filepath.Join(fd.dir, "*"+segmentExtension))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var number int
+		if _, err := fmt.Sscanf(filepath.Base(name), "%020d"+segmentExtension, &number); err != nil {
+			fd.log.Warnf("skipping unknown file %s in file log directory", name)
+			continue
+		}
+		fd.segments = append(fd.segments, &logSegment{number: number, path: name})
+	}
+	sort.Slice(fd.segments, func(i, j int) bool {
+		return fd.segments[i].number < fd.segments[j].number
+	})
+
+	for _, segment := range fd.segments {
+		segment.file, err = os.OpenFile(segment.path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		if err = fd.replaySegment(segment); err != nil {
+			return err
+		}
+	}
+
+	if len(fd.segments) > 0 {
+		fd.active = fd.segments[len(fd.segments)-1]
+	}
+
+	for _, entry := range fd.index {
+		if entry.removed {
+			continue
+		}
+		if fd.expired(entry) {
+			fd.markRemoved(entry)
+		}
+	}
+	return nil
+}
+
+func (fd *FileLogDB) replaySegment(segment *logSegment) error {
+	var offset int64
+	for {
+		record, size, err := readRecord(segment.file, offset)
+		if err == io.EOF {
+			break
+		}
+		if err == errRecordVersion {
+			return fmt.Errorf("segment %s at offset %d: %v", segment.path, offset, err)
+		}
+		if err != nil {
+			fd.log.WithError(err).Warnf("truncating segment %s at offset %d", segment.path, offset)
+			if err := segment.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		key := MessageKey{Subject: record.subject, ID: record.id}
+		switch record.op {
+		case recordAdd:
+			entry := &logEntry{
+				segment:    segment,
+				offset:     offset,
+				addedTime:  record.addedTime,
+				expiration: record.expiration,
+				deliverAt:  record.deliverAt,
+				key:        record.key,
+				size:       len(record.body),
+				removed:    record.expiration == 0 && !record.deliverAt.After(record.addedTime),
+			}
+			fd.index[key] = entry
+			fd.subjects[record.subject] = append(fd.subjects[record.subject], record.id)
+			if !entry.removed {
+				segment.live++
+			}
+			segment.keyed(entry)
+			fd.sequences.seen(record.subject, record.id)
+		case recordDelete:
+			if entry, ok := fd.index[key]; ok && !entry.removed {
+				fd.markRemoved(entry)
+			}
+		case recordSequences:
+			for subject, last := range record.headers {
+				id, err := strconv.Atoi(last)
+				if err != nil {
+					return errCorruptedRecord
+				}
+				fd.sequences.seen(subject, id)
+			}
+		}
+		offset += size
+	}
+	segment.size = offset
+	return nil
+}
+
+// read reads the add record of the entry and opens its body.
+func (fd *FileLogDB) read(entry *logEntry) (logRecord, error) {
+	record, _, err := readRecord(entry.segment.file, entry.offset)
+	if err != nil {
+		return logRecord{}, err
+	}
+	record.body, err = fd.keyring.Open(record.keyID, record.body)
+	return record, err
+}
+
+// keyed moves keyedUntil past an entry with an idempotency key.
+func (s *logSegment) keyed(entry *logEntry) {
+	if entry.key != "" && entry.addedTime.After(s.keyedUntil) {
+		s.keyedUntil = entry.addedTime
+	}
+}
+
+// expired checks the time a message was appended, or the time it is due
+// when it is delayed, against its expiration.
+func (fd *FileLogDB) expired(entry *logEntry) bool {
+	return expiresAt(entry.addedTime, entry.deliverAt, entry.expiration).Before(time.Now())
+}
+
+// live reports whether a message can still be read. The expirations are
+// not scheduled again after a restart, so the ones past their time are
+// left out here.
+func (fd *FileLogDB) live(entry *logEntry) bool {
+	return !entry.removed && (entry.expiration == 0 || !fd.expired(entry))
+}
+
+func (fd *FileLogDB) markRemoved(entry *logEntry) {
+	entry.removed = true
+	entry.segment.live--
+}
+
+func (fd *FileLogDB) rollSegment() error {
+	if fd.active != nil {
+		if err := fd.active.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	number := 0
+	if fd.active != nil {
+		number = fd.active.number + 1
+	}
+	path := filepath.Join(fd.dir, fmt.Sprintf("%020d%s", number, segmentExtension))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	segment := &logSegment{number: number, path: path, file: file}
+	fd.segments = append(fd.segments, segment)
+	fd.active = segment
+	fd.log.Infof("file log rolled to a new segment %s", path)
+
+	if len(fd.sequences) == 0 {
+		return nil
+	}
+	last := make(map[string]string, len(fd.sequences))
+	for subject, id := range fd.sequences {
+		last[subject] = strconv.Itoa(id)
+	}
+	_, _, err = fd.append(logRecord{op: recordSequences, headers: last})
+	return err
+}
+
+func (fd *FileLogDB) append(record logRecord) (*logSegment, int64, error) {
+	return fd.write(encodeRecord(record))
+}
+
+// write appends encoded records to the active segment in one write, rolling
+// the segment first when they do not fit. A write that fails is cut off the
+// segment, so none of the records is left behind.
+func (fd *FileLogDB) write(data []byte) (*logSegment, int64, error) {
+	if fd.active.size > 0 && fd.active.size+int64(len(data)) > fd.segmentSize {
+		if err := fd.rollSegment(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	offset := fd.active.size
+	if _, err := fd.active.file.WriteAt(data, offset); err != nil {
+		if truncateErr := fd.active.file.Truncate(offset); truncateErr != nil {
+			fd.log.WithError(truncateErr).Warnf("can not cut failed write off segment %s", fd.active.path)
+		}
+		return nil, 0, err
+	}
+	fd.active.size += int64(len(data))
+	fd.dirty = true
+	return fd.active, offset, nil
+}
+
+func (fd *FileLogDB) AddMessage(ctx context.Context, msg broker.Message, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add new message to file log")
+	defer span.Finish()
+
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.closed {
+		return -1, broker.ErrUnavailable
+	}
+	msg.Subject = subject
+	if err := fd.retention.admit([]broker.Message{msg}); err != nil {
+		return -1, err
+	}
+	sealed, err := sealBodies(fd.keyring, []broker.Message{msg})
+	if err != nil {
+		return -1, err
+	}
+	ids, err := fd.add([]broker.Message{msg}, sealed)
+	if err != nil {
+		return -1, err
+	}
+	return ids[0], nil
+}
+
+func (fd *FileLogDB) AddMessages(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add batch of messages to file log")
+	defer span.Finish()
+
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.closed {
+		return nil, broker.ErrUnavailable
+	}
+	if err := fd.retention.admit(msgs); err != nil {
+		return nil, err
+	}
+	sealed, err := sealBodies(fd.keyring, msgs)
+	if err != nil {
+		return nil, err
+	}
+	return fd.add(msgs, sealed)
+}
+
+func (fd *FileLogDB) Admits(msgs []broker.Message) error {
+	return fd.retention.check(msgs)
+}
+
+// add appends the messages with their sealed bodies to the log in one
+// write and indexes them once it succeeded, the caller holds the lock.
+func (fd *FileLogDB) add(msgs []broker.Message, sealed []sealedBody) ([]int, error) {
+	records := make([]logRecord, len(msgs))
+	encoded := make([][]byte, len(msgs))
+	size := 0
+	next := make(map[string]int)
+	for i, msg := range msgs {
+		last, ok := next[msg.Subject]
+		if !ok {
+			last = fd.sequences[msg.Subject]
+		}
+		id := last + 1
+		if msg.ID > id {
+			id = msg.ID
+		}
+		next[msg.Subject] = id
+
+		records[i] = logRecord{
+			op:         recordAdd,
+			id:         id,
+			subject:    msg.Subject,
+			addedTime:  addedTime(msg),
+			expiration: msg.Expiration,
+			deliverAt:  msg.DeliverAt,
+			key:        msg.IdempotencyKey,
+			encoding:   msg.Encoding,
+			headers:    msg.Headers,
+			keyID:      sealed[i].keyID,
+			body:       sealed[i].body,
+		}
+		encoded[i] = encodeRecord(records[i])
+		size += len(encoded[i])
+	}
+
+	data := make([]byte, 0, size)
+	for _, record := range encoded {
+		data = append(data, record...)
+	}
+	segment, offset, err := fd.write(data)
+	if err != nil {
+		fd.log.WithError(err).Warn("can not append messages to file log")
+		return nil, err
+	}
+
+	ids := make([]int, len(msgs))
+	for i, msg := range msgs {
+		record := records[i]
+		var expired = !kept(msg)
+		entry := &logEntry{
+			segment:    segment,
+			offset:     offset,
+			addedTime:  record.addedTime,
+			expiration: msg.Expiration,
+			deliverAt:  msg.DeliverAt,
+			key:        msg.IdempotencyKey,
+			size:       len(record.body),
+			removed:    expired,
+		}
+		fd.index[MessageKey{Subject: record.subject, ID: record.id}] = entry
+		fd.subjects[record.subject] = append(fd.subjects[record.subject], record.id)
+		if !expired {
+			segment.live++
+		}
+		segment.keyed(entry)
+		fd.sequences.seen(record.subject, record.id)
+		ids[i] = record.id
+		offset += int64(len(encoded[i]))
+	}
+	return ids, nil
+}
+
+func (fd *FileLogDB) LastID(subject string) int {
+	fd.RLock()
+	defer fd.RUnlock()
+	return fd.sequences[subject]
+}
+
+func (fd *FileLogDB) FetchMessage(ctx context.Context, id int, subject string) (broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Fetch message from file log")
+	defer span.Finish()
+
+	fd.RLock()
+	defer fd.RUnlock()
+
+	entry, ok := fd.index[MessageKey{Subject: subject, ID: id}]
+	if !ok {
+		if id >= 1 && id <= fd.sequences[subject] {
+			return broker.Message{}, broker.ErrExpiredID
+		}
+		return broker.Message{}, broker.ErrInvalidID
+	}
+	if !fd.live(entry) {
+		return broker.Message{}, broker.ErrExpiredID
+	}
+
+	record, err := fd.read(entry)
+	if err != nil {
+		fd.log.WithError(err).Warn("failed in reading message from file log")
+		return broker.Message{}, err
+	}
+
+	return broker.Message{
+		ID:         id,
+		Timestamp:  record.addedTime,
+		Body:       string(record.body),
+		Headers:    record.headers,
+		Expiration: record.expiration,
+		DeliverAt:  record.deliverAt,
+		Encoding:   record.encoding,
+	}, nil
+}
+
+func (fd *FileLogDB) GetMessagesBySubject(ctx context.Context, subject string, filter ReplayFilter) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "GetMessages based on the given subject from file log")
+	defer span.Finish()
+
+	fd.RLock()
+	defer fd.RUnlock()
+
+	//	Pick the ids from the index first, so only the records that are
+	//	going to be returned are read from disk
+	var ids = make([]int, 0)
+	for _, id := range fd.subjects[subject] {
+		entry := fd.index[MessageKey{Subject: subject, ID: id}]
+		if entry != nil && fd.live(entry) && filter.matches(id, entry.addedTime) {
+			ids = append(ids, id)
+		}
+	}
+	if filter.LastN > 0 && len(ids) > filter.LastN {
+		ids = ids[len(ids)-filter.LastN:]
+	}
+
+	var messages = make([]broker.Message, 0, len(ids))
+	for _, id := range ids {
+		entry := fd.index[MessageKey{Subject: subject, ID: id}]
+		record, err := fd.read(entry)
+		if err != nil {
+			fd.log.WithError(err).Warn("failed in reading messages with the given subject")
+			return nil, err
+		}
+		messages = append(messages, broker.Message{
+			ID:         id,
+			Timestamp:  record.addedTime,
+			Body:       string(record.body),
+			Headers:    record.headers,
+			Expiration: record.expiration,
+			DeliverAt:  record.deliverAt,
+			Encoding:   record.encoding,
+		})
+	}
+	return messages, nil
+}
+
+func (fd *FileLogDB) DelayedMessages(ctx context.Context, after time.Time) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Find delayed messages in file log")
+	defer span.Finish()
+
+	fd.RLock()
+	defer fd.RUnlock()
+
+	var messages = make([]broker.Message, 0)
+	for key, entry := range fd.index {
+		if entry.removed || !entry.deliverAt.After(after) {
+			continue
+		}
+		record, err := fd.read(entry)
+		if err != nil {
+			fd.log.WithError(err).Warn("failed in reading delayed messages")
+			return nil, err
+		}
+		messages = append(messages, broker.Message{
+			ID:         key.ID,
+			Subject:    key.Subject,
+			Timestamp:  record.addedTime,
+			Body:       string(record.body),
+			Headers:    record.headers,
+			Expiration: record.expiration,
+			DeliverAt:  record.deliverAt,
+			Encoding:   record.encoding,
+		})
+	}
+	return messages, nil
+}
+
+func (fd *FileLogDB) KeyedMessages(ctx context.Context, since time.Time) ([]broker.Message, error) {
+	fd.RLock()
+	defer fd.RUnlock()
+
+	var messages = make([]broker.Message, 0)
+	for key, entry := range fd.index {
+		if entry.key != "" && !entry.addedTime.Before(since) {
+			messages = append(messages, broker.Message{ID: key.ID, Subject: key.Subject, Timestamp: entry.addedTime, IdempotencyKey: entry.key})
+		}
+	}
+	return messages, nil
+}
+
+func (fd *FileLogDB) DeleteMessage(subject string, id int) {
+	span, _ := opentracing.StartSpanFromContext(context.Background(), "Delete message from file log")
+	defer span.Finish()
+
+	fd.Lock()
+	defer fd.Unlock()
+
+	fd.delete(subject, id)
+	fd.dropDeadSegments()
+}
+
+func (fd *FileLogDB) DeleteMessages(keys []MessageKey) {
+	span, _ := opentracing.StartSpanFromContext(context.Background(), "Delete messages from file log")
+	defer span.Finish()
+
+	fd.Lock()
+	defer fd.Unlock()
+
+	for _, key := range keys {
+		fd.delete(key.Subject, key.ID)
+	}
+	fd.dropDeadSegments()
+}
+
+// delete appends the deletion of the message to the log, the segments it
+// empties are left to the caller to drop.
+func (fd *FileLogDB) delete(subject string, id int) {
+	entry, ok := fd.index[MessageKey{Subject: subject, ID: id}]
+	if fd.closed || !ok || entry.removed {
+		return
+	}
+
+	if _, _, err := fd.append(logRecord{op: recordDelete, id: id, subject: subject}); err != nil {
+		fd.log.WithError(err).Warn("can not append deletion to file log")
+		return
+	}
+	fd.markRemoved(entry)
+	fd.retention.released(subject, entry.size)
+}
+
+func (fd *FileLogDB) Subjects(ctx context.Context) (map[string]int, error) {
+	fd.RLock()
+	defer fd.RUnlock()
+
+	counts := make(map[string]int)
+	for subject, ids := range fd.subjects {
+		for _, id := range ids {
+			if entry := fd.index[MessageKey{Subject: subject, ID: id}]; entry != nil && !entry.removed {
+				counts[subject]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// PurgeSubject appends a deletion for every live message of the subject,
+// the segments left without live messages are removed.
+func (fd *FileLogDB) PurgeSubject(ctx context.Context, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Purge subject in file log")
+	defer span.Finish()
+
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.closed {
+		return 0, broker.ErrUnavailable
+	}
+	purged := 0
+	for _, id := range fd.subjects[subject] {
+		entry := fd.index[MessageKey{Subject: subject, ID: id}]
+		if entry == nil || entry.removed {
+			continue
+		}
+		if _, _, err := fd.append(logRecord{op: recordDelete, id: id, subject: subject}); err != nil {
+			fd.log.WithError(err).Warn("can not append deletion to file log")
+			fd.dropDeadSegments()
+			return purged, err
+		}
+		fd.markRemoved(entry)
+		fd.retention.released(subject, entry.size)
+		purged++
+	}
+	fd.dropDeadSegments()
+	return purged, nil
+}
+
+// enforceRetention appends a deletion for the messages of every subject
+// that are over its limits, the oldest first.
+func (fd *FileLogDB) enforceRetention(now time.Time) {
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.closed {
+		return
+	}
+	kept := make(map[string]usage)
+	for subject, ids := range fd.subjects {
+		live := make([]retained, 0)
+		for _, id := range ids {
+			entry := fd.index[MessageKey{Subject: subject, ID: id}]
+			if entry != nil && !entry.removed {
+				live = append(live, retained{id: id, size: entry.size, added: entry.addedTime})
+			}
+		}
+		discarded, subjectUsage := fd.retention.limits(subject).trim(live, now)
+		for _, id := range discarded {
+			fd.delete(subject, id)
+		}
+		kept[subject] = subjectUsage
+	}
+	fd.dropDeadSegments()
+	fd.retention.reset(kept)
+}
+
+// dropDeadSegments removes the oldest sealed segments that have no live
+// message left and no idempotency key within the dedup window. A segment is
+// dropped only once every segment before it is gone, the delete records it
+// holds may cancel adds of the older ones, which a restart would otherwise
+// bring back.
+func (fd *FileLogDB) dropDeadSegments() {
+	kept := fd.segments[:0]
+	dropped := false
+	keyedSince := time.Now().Add(-fd.dedupWindow)
+	for _, segment := range fd.segments {
+		if len(kept) > 0 || segment == fd.active || segment.live > 0 || segment.keyedUntil.After(keyedSince) {
+			kept = append(kept, segment)
+			continue
+		}
+		dropped = true
+
+		segment.file.Close()
+		if err := os.Remove(segment.path); err != nil {
+			fd.log.WithError(err).Warnf("can not remove dead segment %s", segment.path)
+		}
+		for key, entry := range fd.index {
+			if entry.segment == segment {
+				delete(fd.index, key)
+			}
+		}
+		fd.log.Infof("dead segment %s has been removed", segment.path)
+	}
+	fd.segments = kept
+	if !dropped {
+		return
+	}
+
+	for subject, ids := range fd.subjects {
+		alive := ids[:0]
+		for _, id := range ids {
+			if _, ok := fd.index[MessageKey{Subject: subject, ID: id}]; ok {
+				alive = append(alive, id)
+			}
+		}
+		if len(alive) == 0 {
+			delete(fd.subjects, subject)
+		} else {
+			fd.subjects[subject] = alive
+		}
+	}
+}
+
+// Flush syncs the records written since the last scheduled sync.
+func (fd *FileLogDB) Flush() error {
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.closed || !fd.dirty {
+		return nil
+	}
+	if err := fd.active.file.Sync(); err != nil {
+		return err
+	}
+	fd.dirty = false
+	return nil
+}
+
+func (fd *FileLogDB) Close() error {
+	fd.Lock()
+	defer fd.Unlock()
+
+	if fd.closed {
+		return nil
+	}
+	fd.closed = true
+	fd.retention.close()
+	return fd.closeSegments()
+}
+
+func (fd *FileLogDB) closeSegments() error {
+	var firstErr error
+	for _, segment := range fd.segments {
+		if segment.file == nil {
+			continue
+		}
+		if segment == fd.active {
+			if err := segment.file.Sync(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := segment.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (fd *FileLogDB) scheduledSync() {
+	ticker := time.NewTicker(time.Duration(fd.cfg.FileLog.SyncInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fd.Lock()
+		if fd.closed {
+			fd.Unlock()
+			return
+		}
+		if fd.dirty {
+			if err := fd.active.file.Sync(); err != nil {
+				fd.log.WithError(err).Warn("can not sync file log to disk")
+			}
+			fd.dirty = false
+		}
+		fd.Unlock()
+	}
+}
+
+// encodeRecord lays a record out as
+// length | crc32 | op | id | added time | expiration | subject length | subject | fields
+// add records have the version of their layout and then every field of the
+// message with its length
+// version (1 byte) | (field length (4 bytes) | field)...
+// in the order body, due time, idempotency key, encoding, headers and the
+// id of the key the body is sealed with. The
+// fields a message does not have are empty, a newer broker appends its
+// fields after these. Sequence records keep the last ids like headers, by
+// subject.
+func encodeRecord(record logRecord) []byte {
+	var fields []byte
+	switch record.op {
+	case recordAdd:
+		fields = encodeAddFields(record)
+	case recordSequences:
+		fields = encodeHeaders(record.headers)
+	}
+
+	payloadSize := 1 + 8 + 8 + 8 + 2 + len(record.subject) + len(fields)
+	data := make([]byte, recordHeaderSize+payloadSize)
+
+	payload := data[recordHeaderSize:]
+	payload[0] = record.op
+	binary.BigEndian.PutUint64(payload[1:], uint64(record.id))
+	binary.BigEndian.PutUint64(payload[9:], uint64(record.addedTime.UnixNano()))
+	binary.BigEndian.PutUint64(payload[17:], uint64(ExpirationSeconds(record.expiration)))
+	binary.BigEndian.PutUint16(payload[25:], uint16(len(record.subject)))
+	copy(payload[27:], record.subject)
+	copy(payload[27+len(record.subject):], fields)
+
+	binary.BigEndian.PutUint32(data[0:], uint32(payloadSize))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+	return data
+}
+
+// encodeAddFields lays out the version and the fields of an add record.
+func encodeAddFields(record logRecord) []byte {
+	var due, headers []byte
+	if !record.deliverAt.IsZero() {
+		due = make([]byte, 8)
+		binary.BigEndian.PutUint64(due, uint64(record.deliverAt.UnixNano()))
+	}
+	if len(record.headers) > 0 {
+		headers = encodeHeaders(record.headers)
+	}
+	fields := [addRecordFields][]byte{record.body, due, []byte(record.key), []byte(record.encoding), headers, []byte(record.keyID)}
+
+	size := 1
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+	data := make([]byte, size)
+	data[0] = addRecordVersion
+	offset := 1
+	for _, field := range fields {
+		binary.BigEndian.PutUint32(data[offset:], uint32(len(field)))
+		offset += 4 + copy(data[offset+4:], field)
+	}
+	return data
+}
+
+// decodeAddFields fills the record with the fields of an add record, the
+// ones missing are left empty and the ones after those it knows skipped.
+func decodeAddFields(record *logRecord, data []byte) error {
+	if len(data) < 1 {
+		return errCorruptedRecord
+	}
+	if data[0] != addRecordVersion {
+		return errRecordVersion
+	}
+
+	var fields [addRecordFields][]byte
+	data = data[1:]
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-4 {
+			return errCorruptedRecord
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if i < len(fields) {
+			fields[i] = data[4 : 4+size]
+		}
+		data = data[4+size:]
+	}
+
+	body, due, key, encoding, headers, keyID := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+	record.body = body
+	switch len(due) {
+	case 0:
+	case 8:
+		record.deliverAt = time.Unix(0, int64(binary.BigEndian.Uint64(due)))
+	default:
+		return errCorruptedRecord
+	}
+	record.key = string(key)
+	record.encoding = string(encoding)
+	record.keyID = string(keyID)
+	if len(headers) > 0 {
+		decoded, rest, err := decodeHeaders(headers)
+		if err != nil || len(rest) > 0 {
+			return errCorruptedRecord
+		}
+		record.headers = decoded
+	}
+	return nil
+}
+
+func encodeHeaders(headers map[string]string) []byte {
+	size := 4
+	for key, value := range headers {
+		size += 2 + len(key) + 4 + len(value)
+	}
+	data := make([]byte, size)
+	binary.BigEndian.PutUint32(data, uint32(size-4))
+	offset := 4
+	for key, value := range headers {
+		binary.BigEndian.PutUint16(data[offset:], uint16(len(key)))
+		offset += 2 + copy(data[offset+2:], key)
+		binary.BigEndian.PutUint32(data[offset:], uint32(len(value)))
+		offset += 4 + copy(data[offset+4:], value)
+	}
+	return data
+}
+
+// decodeHeaders returns the headers at the start of data and the rest of it.
+func decodeHeaders(data []byte) (map[string]string, []byte, error) {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-4 {
+		return nil, nil, errCorruptedRecord
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	encoded, rest := data[4:4+size], data[4+size:]
+
+	headers := make(map[string]string)
+	for len(encoded) > 0 {
+		if len(encoded) < 2 {
+			return nil, nil, errCorruptedRecord
+		}
+		keyLen := int(binary.BigEndian.Uint16(encoded))
+		if len(encoded) < 2+keyLen+4 {
+			return nil, nil, errCorruptedRecord
+		}
+		key := string(encoded[2 : 2+keyLen])
+		encoded = encoded[2+keyLen:]
+		valueLen := int(binary.BigEndian.Uint32(encoded))
+		if len(encoded) < 4+valueLen {
+			return nil, nil, errCorruptedRecord
+		}
+		headers[key] = string(encoded[4 : 4+valueLen])
+		encoded = encoded[4+valueLen:]
+	}
+	return headers, rest, nil
+}
+
+func readRecord(file *os.File, offset int64) (logRecord, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := file.ReadAt(header, offset)
+	if err == io.EOF && n == 0 {
+		return logRecord{}, 0, io.EOF
+	}
+	if n < recordHeaderSize {
+		return logRecord{}, 0, errCorruptedRecord
+	}
+
+	payloadSize := binary.BigEndian.Uint32(header[0:])
+	if payloadSize < 27 {
+		return logRecord{}, 0, errCorruptedRecord
+	}
+	payload := make([]byte, payloadSize)
+	if n, _ := file.ReadAt(payload, offset+recordHeaderSize); n < int(payloadSize) {
+		return logRecord{}, 0, errCorruptedRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return logRecord{}, 0, errCorruptedRecord
+	}
+
+	subjectLen := int(binary.BigEndian.Uint16(payload[25:]))
+	if 27+subjectLen > len(payload) {
+		return logRecord{}, 0, errCorruptedRecord
+	}
+	record := logRecord{
+		op:         payload[0],
+		id:         int(binary.BigEndian.Uint64(payload[1:])),
+		addedTime:  time.Unix(0, int64(binary.BigEndian.Uint64(payload[9:]))),
+		expiration: time.Duration(binary.BigEndian.Uint64(payload[17:])) * time.Second,
+		subject:    string(payload[27 : 27+subjectLen]),
+		body:       payload[27+subjectLen:],
+	}
+	switch record.op {
+	case recordAdd:
+		fields := record.body
+		record.body = nil
+		if err := decodeAddFields(&record, fields); err != nil {
+			return logRecord{}, 0, err
+		}
+	case recordSequences:
+		headers, _, err := decodeHeaders(record.body)
+		if err != nil {
+			return logRecord{}, 0, err
+		}
+		record.headers, record.body = headers, nil
+	}
+	return record, int64(recordHeaderSize + payloadSize), nil
+}
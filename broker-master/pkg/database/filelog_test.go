@@ -0,0 +1,488 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFileLogConfig(t *testing.T, segmentSize int64) *config.Config {
+	cfg := &config.Config{}
+	cfg.FileLog.Dir = t.TempDir()
+	cfg.FileLog.SegmentSize = segmentSize
+	cfg.FileLog.SyncInterval = 1000
+	return cfg
+}
+
+func TestFileLogAddedMessageShouldBeFetchable(t *testing.T) {
+	fd, err := openFileLog(newFileLogConfig(t, 1<<20), logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	msg := broker.Message{Body: "hello", Expiration: time.Second * 10, Timestamp: time.Now().Truncate(time.Millisecond)}
+	id, err := fd.AddMessage(context.Background(), msg, "ali")
+	assert.Nil(t, err)
+
+	fetched, err := fd.FetchMessage(context.Background(), id, "ali")
+	assert.Nil(t, err)
+	msg.ID = id
+	assert.Equal(t, msg, fetched)
+
+	_, err = fd.FetchMessage(context.Background(), id, "maryam")
+	assert.Equal(t, broker.ErrInvalidID, err)
+}
+
+func TestFileLogShouldKeepHeadersAfterRestart(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	published := time.Now().Truncate(time.Millisecond)
+	plain := broker.Message{Body: "hello", Expiration: time.Second * 10, Timestamp: published}
+	withHeaders := broker.Message{Body: "hello", Expiration: time.Second * 10, Timestamp: published, Headers: map[string]string{"Content-Type": "text/plain", "Empty": ""}}
+	plain.ID, _ = fd.AddMessage(context.Background(), plain, "ali")
+	withHeaders.ID, _ = fd.AddMessage(context.Background(), withHeaders, "ali")
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	fetched, err := fd.FetchMessage(context.Background(), plain.ID, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, plain, fetched)
+
+	fetched, err = fd.FetchMessage(context.Background(), withHeaders.ID, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, withHeaders, fetched)
+}
+
+func TestFileLogAddMessagesShouldReturnIdsInOrder(t *testing.T) {
+	fd, err := openFileLog(newFileLogConfig(t, 1<<20), logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	ids, err := fd.AddMessages(context.Background(), []broker.Message{
+		{Subject: "ali", Body: "first", Expiration: time.Second * 10},
+		{Subject: "maryam", Body: "second", Expiration: time.Second * 10},
+		{Subject: "ali", Body: "third", Expiration: time.Second * 10},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(ids))
+
+	messages, _ := fd.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []int{ids[0], ids[2]}, []int{messages[0].ID, messages[1].ID})
+	assert.Equal(t, "third", messages[1].Body)
+}
+
+func TestFileLogDeletedMessageShouldBeExpired(t *testing.T) {
+	fd, err := openFileLog(newFileLogConfig(t, 1<<20), logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second * 10}, "ali")
+	fd.DeleteMessage("ali", id)
+
+	_, err = fd.FetchMessage(context.Background(), id, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+}
+
+func TestFileLogShouldNotReturnMessagesPastTheirExpiration(t *testing.T) {
+	fd, err := openFileLog(newFileLogConfig(t, 1<<20), logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	published := time.Now().Add(-time.Minute)
+	id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second, Timestamp: published}, "ali")
+
+	_, err = fd.FetchMessage(context.Background(), id, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	messages, err := fd.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestFileLogShouldRollSegments(t *testing.T) {
+	cfg := newFileLogConfig(t, 128)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := fd.AddMessage(context.Background(), broker.Message{Body: "0123456789abcdef", Expiration: time.Second * 10}, "ali")
+		assert.Nil(t, err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(cfg.FileLog.Dir, "*"+segmentExtension))
+	assert.Greater(t, len(segments), 1)
+
+	messages, err := fd.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(messages))
+}
+
+func TestFileLogShouldRecoverAfterRestart(t *testing.T) {
+	cfg := newFileLogConfig(t, 128)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	ids := make([]int, 0)
+	for i := 0; i < 5; i++ {
+		id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "0123456789abcdef", Expiration: time.Second * 10}, "ali")
+		ids = append(ids, id)
+	}
+	fd.DeleteMessage("ali", ids[0])
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	_, err = fd.FetchMessage(context.Background(), ids[0], "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+
+	msg, err := fd.FetchMessage(context.Background(), ids[4], "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", msg.Body)
+
+	id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "next", Expiration: time.Second * 10}, "ali")
+	assert.Equal(t, ids[4]+1, id)
+}
+
+func TestFileLogShouldTruncateTornRecord(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "complete", Expiration: time.Second * 10}, "ali")
+	path := fd.active.path
+	assert.Nil(t, fd.Close())
+
+	//	Simulate a crash in the middle of writing the next record
+	torn := encodeRecord(logRecord{op: recordAdd, id: id + 1, subject: "ali", addedTime: time.Now(), body: []byte("torn")})
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, _ = file.Write(torn[:len(torn)-3])
+	file.Close()
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	msg, err := fd.FetchMessage(context.Background(), id, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "complete", msg.Body)
+
+	newID, err := fd.AddMessage(context.Background(), broker.Message{Body: "after crash", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, id+1, newID)
+
+	msg, err = fd.FetchMessage(context.Background(), newID, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "after crash", msg.Body)
+}
+
+func TestFileLogShouldDropDeadSegments(t *testing.T) {
+	cfg := newFileLogConfig(t, 64)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	ids := make([]int, 0)
+	for i := 0; i < 4; i++ {
+		id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "0123456789abcdef", Expiration: time.Second * 10}, "ali")
+		ids = append(ids, id)
+	}
+	first := fd.segments[0].path
+
+	fd.DeleteMessage("ali", ids[0])
+	_, err = os.Stat(first)
+	assert.True(t, os.IsNotExist(err))
+
+	msg, err := fd.FetchMessage(context.Background(), ids[3], "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", msg.Body)
+}
+
+func TestFileLogShouldKeepDeletionsOfMessagesInOlderSegments(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	deleted, _ := fd.AddMessage(context.Background(), broker.Message{Body: "deleted", Expiration: time.Minute}, "ali")
+	live, _ := fd.AddMessage(context.Background(), broker.Message{Body: "live", Expiration: time.Minute}, "ali")
+	assert.Nil(t, fd.rollSegment())
+	fd.DeleteMessage("ali", deleted)
+
+	//	The segment with the deletion alone has no live message left
+	assert.Nil(t, fd.rollSegment())
+	fd.dropDeadSegments()
+	assert.Equal(t, 3, len(fd.segments))
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	_, err = fd.FetchMessage(context.Background(), deleted, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	msg, err := fd.FetchMessage(context.Background(), live, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "live", msg.Body)
+}
+
+func TestFileLogSequencesShouldOutliveDroppedSegments(t *testing.T) {
+	cfg := newFileLogConfig(t, 64)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	written := make([]string, 0)
+	for i := 1; i <= 3; i++ {
+		id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "0123456789abcdef", Expiration: time.Second * 10}, "ali")
+		assert.Equal(t, i, id)
+		written = append(written, fd.active.path)
+		fd.DeleteMessage("ali", id)
+	}
+	first, _ := fd.AddMessage(context.Background(), broker.Message{Body: "0123456789abcdef", Expiration: time.Second * 10}, "reza")
+	second, _ := fd.AddMessage(context.Background(), broker.Message{Body: "0123456789abcdef", Expiration: time.Second * 10}, "reza")
+	assert.Equal(t, []int{1, 2}, []int{first, second})
+	fd.DeleteMessage("reza", first)
+
+	//	No segment with a record of ali is left
+	for _, path := range written {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	id, err := fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, id)
+	_, err = fd.FetchMessage(context.Background(), 2, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	_, err = fd.FetchMessage(context.Background(), 5, "ali")
+	assert.Equal(t, broker.ErrInvalidID, err)
+	id, _ = fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second * 10}, "reza")
+	assert.Equal(t, 3, id)
+}
+
+func TestFileLogPurgeShouldRemoveMessagesOfSubject(t *testing.T) {
+	fd, err := openFileLog(newFileLogConfig(t, 1<<20), logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	id, _ := fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second * 10}, "ali")
+	_, _ = fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second * 10}, "ali")
+	_, _ = fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Second * 10}, "reza")
+
+	purged, err := fd.PurgeSubject(context.Background(), "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, purged)
+
+	_, err = fd.FetchMessage(context.Background(), id, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	subjects, err := fd.Subjects(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"reza": 1}, subjects)
+}
+
+func TestFileLogDelayedMessagesShouldOutliveRestart(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	published := time.Now().Truncate(time.Millisecond)
+	msg := broker.Message{Body: "hello", Timestamp: published, DeliverAt: published.Add(time.Hour), Headers: map[string]string{"Key": "value"}}
+	id, err := fd.AddMessage(context.Background(), msg, "ali")
+	assert.Nil(t, err)
+	_, _ = fd.AddMessage(context.Background(), broker.Message{Body: "now", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	fetched, err := fd.FetchMessage(context.Background(), id, "ali")
+	assert.Nil(t, err)
+	msg.ID = id
+	assert.Equal(t, msg, fetched)
+
+	delayed, err := fd.DelayedMessages(context.Background(), time.Now())
+	assert.Nil(t, err)
+	msg.Subject = "ali"
+	assert.Equal(t, []broker.Message{msg}, delayed)
+}
+
+func TestFileLogKeyedMessagesShouldOutliveRestart(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	published := time.Now().Truncate(time.Millisecond)
+	kept := broker.Message{Body: "kept", Expiration: time.Second * 10, Timestamp: published, IdempotencyKey: "kept"}
+	keptID, _ := fd.AddMessage(context.Background(), kept, "ali")
+	gone := broker.Message{Body: "gone", Timestamp: published, IdempotencyKey: "gone"}
+	goneID, _ := fd.AddMessage(context.Background(), gone, "ali")
+	_, _ = fd.AddMessage(context.Background(), broker.Message{Body: "plain", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	keyed, err := fd.KeyedMessages(context.Background(), published)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []broker.Message{
+		{ID: keptID, Subject: "ali", Timestamp: published, IdempotencyKey: "kept"},
+		{ID: goneID, Subject: "ali", Timestamp: published, IdempotencyKey: "gone"},
+	}, keyed)
+
+	fetched, err := fd.FetchMessage(context.Background(), keptID, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, broker.Message{ID: keptID, Body: "kept", Expiration: time.Second * 10, Timestamp: published}, fetched)
+	_, err = fd.FetchMessage(context.Background(), goneID, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+}
+
+func TestFileLogShouldKeepEncodingOfBodies(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	msg := broker.Message{Body: "compressed", Expiration: time.Second * 10, Timestamp: time.Now().Truncate(time.Millisecond), Encoding: "snappy"}
+	id, err := fd.AddMessage(context.Background(), msg, "ali")
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	fetched, err := fd.FetchMessage(context.Background(), id, "ali")
+	assert.Nil(t, err)
+	msg.ID = id
+	assert.Equal(t, msg, fetched)
+}
+
+func TestFileLogAddRecordShouldSkipFieldsOfNewerBrokers(t *testing.T) {
+	record := logRecord{
+		deliverAt: time.Now().Add(time.Minute).Truncate(time.Millisecond),
+		key:       "order-1",
+		encoding:  "snappy",
+		headers:   map[string]string{"trace": "abc"},
+		keyID:     "2024-06",
+		body:      []byte("hello"),
+	}
+	fields := append(encodeAddFields(record), 0, 0, 0, 3, 'n', 'e', 'w')
+
+	var decoded logRecord
+	assert.Nil(t, decodeAddFields(&decoded, fields))
+	assert.True(t, record.deliverAt.Equal(decoded.deliverAt))
+	decoded.deliverAt = record.deliverAt
+	assert.Equal(t, record, decoded)
+
+	fields[0] = addRecordVersion + 1
+	assert.Equal(t, errRecordVersion, decodeAddFields(&decoded, fields))
+}
+
+func TestFileLogShouldSealBodiesOnDisk(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	cfg.Encryption.KeyringFile = filepath.Join(t.TempDir(), "keyring.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'k'}, 32))
+	assert.Nil(t, os.WriteFile(cfg.Encryption.KeyringFile, []byte(`{"active": "k1", "keys": {"k1": "`+key+`"}}`), 0600))
+
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	id, err := fd.AddMessage(context.Background(), broker.Message{Body: "personal data", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, err)
+	ids, err := fd.AddMessages(context.Background(), []broker.Message{{Subject: "ali", Body: "more personal data", Expiration: time.Second * 10}})
+	assert.Nil(t, err)
+	path := fd.active.path
+	assert.Nil(t, fd.Close())
+
+	segment, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(segment, []byte("personal data")))
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	msg, err := fd.FetchMessage(context.Background(), id, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "personal data", msg.Body)
+	replayed, err := fd.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(replayed))
+	assert.Equal(t, ids[0], replayed[1].ID)
+	assert.Equal(t, "more personal data", replayed[1].Body)
+}
+
+func TestFileLogFailedBatchShouldLeaveNoMessages(t *testing.T) {
+	fd, err := openFileLog(newFileLogConfig(t, 1<<20), logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	id, err := fd.AddMessage(context.Background(), broker.Message{Body: "first", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, err)
+
+	//	Writes to a read-only handle of the segment fail
+	writable := fd.active.file
+	readOnly, err := os.Open(fd.active.path)
+	assert.Nil(t, err)
+	fd.active.file = readOnly
+	_, err = fd.AddMessages(context.Background(), []broker.Message{
+		{Subject: "ali", Body: "lost", Expiration: time.Second * 10},
+		{Subject: "maryam", Body: "lost", Expiration: time.Second * 10},
+	})
+	assert.NotNil(t, err)
+	fd.active.file = writable
+	readOnly.Close()
+
+	_, err = fd.FetchMessage(context.Background(), id+1, "ali")
+	assert.Equal(t, broker.ErrInvalidID, err)
+	_, err = fd.FetchMessage(context.Background(), 1, "maryam")
+	assert.Equal(t, broker.ErrInvalidID, err)
+
+	newID, err := fd.AddMessage(context.Background(), broker.Message{Body: "after", Expiration: time.Second * 10}, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, id+1, newID)
+}
+
+func TestFileLogShouldKeepIdsGivenByTheLeader(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+
+	ids, err := fd.AddMessages(context.Background(), []broker.Message{
+		{Subject: "ali", ID: 3, Body: "given", Expiration: time.Second * 10},
+		{Subject: "ali", Body: "next", Expiration: time.Second * 10},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3, 4}, ids)
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+	assert.Equal(t, 4, fd.LastID("ali"))
+	msg, err := fd.FetchMessage(context.Background(), 3, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, "given", msg.Body)
+	_, err = fd.FetchMessage(context.Background(), 2, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+}
@@ -0,0 +1,340 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+type memoryMessage struct {
+	msg       broker.Message
+	addedTime time.Time
+	// key is the idempotency key, it is kept after the message is removed
+	key     string
+	removed bool
+}
+
+// memorySubject keeps the messages of a subject in the order of their
+// sequence. The removed messages at its head are dropped, base counts them,
+// so message n is at messages[n-base-1].
+type memorySubject struct {
+	base     int
+	messages []*memoryMessage
+}
+
+// MemoryDB keeps the messages in the process memory, it is the storage
+// behind NOT_PERSISTED and loses everything on restart.
+type MemoryDB struct {
+	subjects    map[string]*memorySubject
+	retention   *retainer
+	dedupWindow time.Duration
+	sync.RWMutex
+}
+
+// NewMemoryDB keeps the messages with the retention of the configuration,
+// which is checked when the broker starts.
+func NewMemoryDB() DB {
+	retention, _ := LoadRetention(config.GetConfigInstance())
+	md := newMemoryDB(retention)
+	md.dedupWindow = DedupWindow(config.GetConfigInstance())
+	return md
+}
+
+func newMemoryDB(retention Retention) *MemoryDB {
+	md := &MemoryDB{
+		subjects:    make(map[string]*memorySubject),
+		retention:   newRetainer(retention, nil),
+		dedupWindow: DedupWindow(nil),
+	}
+	if retention.enabled() {
+		go md.retention.run(md.enforceRetention)
+	}
+	return md
+}
+
+func (md *MemoryDB) AddMessage(ctx context.Context, msg broker.Message, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add new message to memory")
+	defer span.Finish()
+
+	md.Lock()
+	defer md.Unlock()
+
+	msg.Subject = subject
+	if err := md.retention.admit([]broker.Message{msg}); err != nil {
+		return -1, err
+	}
+	return md.add(msg, subject), nil
+}
+
+func (md *MemoryDB) AddMessages(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add batch of messages to memory")
+	defer span.Finish()
+
+	md.Lock()
+	defer md.Unlock()
+
+	if err := md.retention.admit(msgs); err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = md.add(msg, msg.Subject)
+	}
+	return ids, nil
+}
+
+func (md *MemoryDB) Admits(msgs []broker.Message) error {
+	return md.retention.check(msgs)
+}
+
+// add stores one message, the caller holds the lock. The ids skipped by a
+// message that comes with one are kept as removed messages.
+func (md *MemoryDB) add(msg broker.Message, subject string) int {
+	stored, ok := md.subjects[subject]
+	if !ok {
+		stored = &memorySubject{}
+		md.subjects[subject] = stored
+	}
+	newID := stored.last() + 1
+	for ; newID < msg.ID; newID++ {
+		stored.messages = append(stored.messages, &memoryMessage{removed: true})
+	}
+
+	msg.ID = newID
+	msg.Subject = ""
+	msg.Timestamp = addedTime(msg)
+	message := &memoryMessage{
+		msg:       msg,
+		addedTime: msg.Timestamp,
+		key:       msg.IdempotencyKey,
+		removed:   !kept(msg),
+	}
+	message.msg.IdempotencyKey = ""
+	if message.removed {
+		message.msg = broker.Message{}
+	}
+	stored.messages = append(stored.messages, message)
+	md.trim(stored)
+	return newID
+}
+
+// last is the id of the last message of the subject.
+func (s *memorySubject) last() int {
+	return s.base + len(s.messages)
+}
+
+// trim drops the removed messages at the head of the subject. One with an
+// idempotency key is kept until it is past the dedup window, so its key is
+// still found. The caller holds the lock.
+func (md *MemoryDB) trim(stored *memorySubject) {
+	keyedSince := time.Now().Add(-md.dedupWindow)
+	dropped := 0
+	for _, message := range stored.messages {
+		if !message.removed || (message.key != "" && message.addedTime.After(keyedSince)) {
+			break
+		}
+		dropped++
+	}
+	if dropped == 0 {
+		return
+	}
+	for i := 0; i < dropped; i++ {
+		stored.messages[i] = nil
+	}
+	stored.messages = stored.messages[dropped:]
+	stored.base += dropped
+}
+
+func (md *MemoryDB) LastID(subject string) int {
+	md.RLock()
+	defer md.RUnlock()
+	if stored, ok := md.subjects[subject]; ok {
+		return stored.last()
+	}
+	return 0
+}
+
+func (md *MemoryDB) FetchMessage(ctx context.Context, id int, subject string) (broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Fetch message from memory")
+	defer span.Finish()
+
+	md.RLock()
+	defer md.RUnlock()
+
+	stored, ok := md.get(subject, id)
+	if !ok {
+		return broker.Message{}, broker.ErrInvalidID
+	}
+	if stored.removed {
+		return broker.Message{}, broker.ErrExpiredID
+	}
+	return stored.msg, nil
+}
+
+func (md *MemoryDB) DeleteMessage(subject string, id int) {
+	md.Lock()
+	defer md.Unlock()
+
+	md.delete(subject, id)
+}
+
+func (md *MemoryDB) DeleteMessages(keys []MessageKey) {
+	md.Lock()
+	defer md.Unlock()
+
+	for _, key := range keys {
+		md.delete(key.Subject, key.ID)
+	}
+}
+
+func (md *MemoryDB) delete(subject string, id int) {
+	if stored, ok := md.get(subject, id); ok && !stored.removed {
+		md.remove(subject, stored)
+		md.trim(md.subjects[subject])
+	}
+}
+
+func (md *MemoryDB) remove(subject string, stored *memoryMessage) {
+	md.retention.released(subject, len(stored.msg.Body))
+	stored.removed = true
+	stored.msg = broker.Message{}
+}
+
+// removedMessage stands for the messages dropped from the head of their
+// subject
+var removedMessage = &memoryMessage{removed: true}
+
+func (md *MemoryDB) get(subject string, id int) (*memoryMessage, bool) {
+	stored, ok := md.subjects[subject]
+	if !ok || id < 1 || id > stored.last() {
+		return nil, false
+	}
+	if id <= stored.base {
+		return removedMessage, true
+	}
+	return stored.messages[id-stored.base-1], true
+}
+
+func (md *MemoryDB) GetMessagesBySubject(ctx context.Context, subject string, filter ReplayFilter) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "GetMessages based on the given subject from memory")
+	defer span.Finish()
+
+	md.RLock()
+	defer md.RUnlock()
+
+	var messages = make([]broker.Message, 0)
+	if stored, ok := md.subjects[subject]; ok {
+		for i, message := range stored.messages {
+			if message.removed || !filter.matches(stored.base+i+1, message.addedTime) {
+				continue
+			}
+			messages = append(messages, message.msg)
+		}
+	}
+	return filter.last(messages), nil
+}
+
+func (md *MemoryDB) Subjects(ctx context.Context) (map[string]int, error) {
+	md.RLock()
+	defer md.RUnlock()
+
+	counts := make(map[string]int)
+	for subject, stored := range md.subjects {
+		for _, message := range stored.messages {
+			if !message.removed {
+				counts[subject]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (md *MemoryDB) PurgeSubject(ctx context.Context, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Purge subject in memory")
+	defer span.Finish()
+
+	md.Lock()
+	defer md.Unlock()
+
+	stored, ok := md.subjects[subject]
+	if !ok {
+		return 0, nil
+	}
+	purged := 0
+	for _, message := range stored.messages {
+		if !message.removed {
+			md.remove(subject, message)
+			purged++
+		}
+	}
+	md.trim(stored)
+	return purged, nil
+}
+
+func (md *MemoryDB) DelayedMessages(ctx context.Context, after time.Time) ([]broker.Message, error) {
+	md.RLock()
+	defer md.RUnlock()
+
+	var messages = make([]broker.Message, 0)
+	for subject, stored := range md.subjects {
+		for _, message := range stored.messages {
+			if !message.removed && message.msg.DeliverAt.After(after) {
+				msg := message.msg
+				msg.Subject = subject
+				messages = append(messages, msg)
+			}
+		}
+	}
+	return messages, nil
+}
+
+func (md *MemoryDB) KeyedMessages(ctx context.Context, since time.Time) ([]broker.Message, error) {
+	md.RLock()
+	defer md.RUnlock()
+
+	var messages = make([]broker.Message, 0)
+	for subject, stored := range md.subjects {
+		for i, message := range stored.messages {
+			if message.key != "" && !message.addedTime.Before(since) {
+				messages = append(messages, broker.Message{ID: stored.base + i + 1, Subject: subject, Timestamp: message.addedTime, IdempotencyKey: message.key})
+			}
+		}
+	}
+	return messages, nil
+}
+
+// enforceRetention removes the messages of every subject that are over
+// its limits, the oldest first.
+func (md *MemoryDB) enforceRetention(now time.Time) {
+	md.Lock()
+	defer md.Unlock()
+
+	kept := make(map[string]usage)
+	for subject, stored := range md.subjects {
+		live := make([]retained, 0)
+		for i, message := range stored.messages {
+			if !message.removed {
+				live = append(live, retained{id: stored.base + i + 1, size: len(message.msg.Body), added: message.addedTime})
+			}
+		}
+		discarded, subjectUsage := md.retention.limits(subject).trim(live, now)
+		for _, id := range discarded {
+			md.delete(subject, id)
+		}
+		kept[subject] = subjectUsage
+	}
+	md.retention.reset(kept)
+}
+
+func (md *MemoryDB) Flush() error {
+	return nil
+}
+
+func (md *MemoryDB) Close() error {
+	md.retention.close()
+	return nil
+}
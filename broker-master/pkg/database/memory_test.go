@@ -0,0 +1,52 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryShouldDropRemovedMessagesAtTheHead(t *testing.T) {
+	md := newMemoryDB(Retention{})
+	defer md.Close()
+
+	for i := 0; i < 100; i++ {
+		_, err := md.AddMessage(context.Background(), broker.Message{Body: "gone"}, "ali")
+		assert.Nil(t, err)
+	}
+	kept, _ := md.AddMessage(context.Background(), broker.Message{Body: "kept", Expiration: time.Hour}, "ali")
+	expired, _ := md.AddMessage(context.Background(), broker.Message{Body: "expired", Expiration: time.Hour}, "ali")
+	md.DeleteMessage("ali", expired)
+	assert.Equal(t, 2, len(md.subjects["ali"].messages))
+
+	md.DeleteMessage("ali", kept)
+	assert.Equal(t, 0, len(md.subjects["ali"].messages))
+	assert.Equal(t, 102, md.LastID("ali"))
+
+	_, err := md.FetchMessage(context.Background(), 50, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	_, err = md.FetchMessage(context.Background(), 103, "ali")
+	assert.Equal(t, broker.ErrInvalidID, err)
+	id, _ := md.AddMessage(context.Background(), broker.Message{Body: "next", Expiration: time.Hour}, "ali")
+	msg, err := md.FetchMessage(context.Background(), id, "ali")
+	assert.Nil(t, err)
+	assert.Equal(t, 103, msg.ID)
+	assert.Equal(t, "next", msg.Body)
+}
+
+func TestMemoryShouldKeepKeysOfRemovedMessagesWithinTheWindow(t *testing.T) {
+	md := newMemoryDB(Retention{})
+	defer md.Close()
+
+	id, _ := md.AddMessage(context.Background(), broker.Message{Body: "hello", IdempotencyKey: "first"}, "ali")
+	_, _ = md.AddMessage(context.Background(), broker.Message{Body: "hello"}, "ali")
+
+	keyed, err := md.KeyedMessages(context.Background(), time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keyed))
+	assert.Equal(t, id, keyed[0].ID)
+	assert.Equal(t, "first", keyed[0].IdempotencyKey)
+}
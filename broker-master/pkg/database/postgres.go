@@ -3,12 +3,13 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
 	"therealbroker/config"
 	"therealbroker/pkg/broker"
+	"therealbroker/pkg/encryption"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -26,9 +27,12 @@ type PostgresDB struct {
 	cfg          *config.Config
 	log          *logrus.Logger
 	conn         *sql.DB
-	deletionList []string
+	deletionList []MessageKey
+	retention    *retainer
+	keyring      *encryption.Keyring
 
-	lastID         int
+	// sequences is guarded by the insert mutex
+	sequences      sequences
 	insertMutex    sync.Mutex
 	insertMessages []string
 	insertValues   []interface{}
@@ -51,11 +55,25 @@ func ConnectToPg(ctx context.Context, cfg *config.Config, logger *logrus.Logger)
 		conn.SetConnMaxIdleTime(45)
 		conn.SetConnMaxIdleTime(1 * time.Second)
 
+		retention, errConnPg := LoadRetention(cfg)
+		if errConnPg != nil {
+			logger.WithError(errConnPg).Warn("could not read the retention of subjects")
+			return
+		}
+		keyring, errConnPg := encryption.Load(cfg)
+		if errConnPg != nil {
+			logger.WithError(errConnPg).Warn("could not read the keyring of the stored bodies")
+			return
+		}
+
 		pgDatabase = &PostgresDB{
 			cfg:            cfg,
 			log:            logger,
 			conn:           conn,
-			deletionList:   make([]string, 0),
+			deletionList:   make([]MessageKey, 0),
+			retention:      newRetainer(retention, keyring),
+			keyring:        keyring,
+			sequences:      make(sequences),
 			insertMutex:    sync.Mutex{},
 			insertMessages: make([]string, 0),
 			insertValues:   make([]interface{}, 0),
@@ -83,18 +101,23 @@ func ConnectToPg(ctx context.Context, cfg *config.Config, logger *logrus.Logger)
 		}
 		pgDatabase.log.Infoln("expired messages has been marked successfully")
 
-		// lastID
-		errConnPg = pgDatabase.getLastId()
+		//	Sequences of the subjects
+		errConnPg = pgDatabase.loadSequences()
 		if errConnPg != nil {
-			pgDatabase.log.WithError(errConnPg).Warn("could not find the last inserted id")
+			pgDatabase.log.WithError(errConnPg).Warn("could not find the last inserted ids")
 			return
 		}
-		pgDatabase.log.Infof("last id is retrieved successfully %d", pgDatabase.lastID)
+		pgDatabase.log.Infof("sequences of %d subjects are retrieved successfully", len(pgDatabase.sequences))
 
 		// batch insertion
 		go pgDatabase.scheduledBatchInsertion()
 
 		go pgDatabase.scheduledBatchDeletion()
+
+		//	The janitor also deletes the removed rows, so it runs even
+		//	without any retention limits
+		pgDatabase.enforceRetention(time.Now())
+		go pgDatabase.retention.run(pgDatabase.enforceRetention)
 	})
 	return pgDatabase, errConnPg
 }
@@ -103,16 +126,39 @@ func GetDatabaseInstance() DB {
 	return pgDatabase
 }
 
+// createTable keys the messages by their sequence on the subject, tables
+// from before the sequences had one id across the subjects and are moved
+// over to the new key.
 func (pd *PostgresDB) createTable() error {
 	table := `
 	CREATE TABLE IF NOT EXISTS messages (
-		id SERIAL PRIMARY KEY,
+		id INTEGER NOT NULL,
 		subject VARCHAR(255) NOT NULL,
 		body BYTEA,
 		expiration_time BIGINT NOT NULL,
 		added_time TIMESTAMP NOT NULL,
-		removed BOOL
+		removed BOOL,
+		headers JSONB,
+		deliver_at TIMESTAMP,
+		idempotency_key VARCHAR(255),
+		encoding VARCHAR(32),
+		key_id VARCHAR(64),
+		PRIMARY KEY (subject, id)
 	);
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS headers JSONB;
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS deliver_at TIMESTAMP;
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255);
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS encoding VARCHAR(32);
+	ALTER TABLE messages ADD COLUMN IF NOT EXISTS key_id VARCHAR(64);
+	DO $$
+	BEGIN
+		IF EXISTS (SELECT 1 FROM pg_index i JOIN pg_class c ON c.oid = i.indrelid
+			WHERE c.relname = 'messages' AND i.indisprimary AND i.indnatts = 1) THEN
+			ALTER TABLE messages DROP CONSTRAINT messages_pkey;
+			ALTER TABLE messages ALTER COLUMN id DROP DEFAULT;
+			ALTER TABLE messages ADD PRIMARY KEY (subject, id);
+		END IF;
+	END $$;
 	`
 	_, err := pd.conn.Exec(table)
 	return err
@@ -124,30 +170,46 @@ func (pd *PostgresDB) createIndex() error {
 	return err
 }
 
-func (pd *PostgresDB) getLastId() error {
-	query := `SELECT COALESCE(MAX(id), 0) FROM messages;`
-	var lastID int
-
-	err := pd.conn.QueryRow(query).Scan(&lastID)
+func (pd *PostgresDB) loadSequences() error {
+	rows, err := pd.conn.Query(`SELECT subject, MAX(id) FROM messages GROUP BY subject;`)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	pd.lastID = lastID
-	return nil
+	pd.insertMutex.Lock()
+	defer pd.insertMutex.Unlock()
+	for rows.Next() {
+		var subject string
+		var lastID int
+		if err := rows.Scan(&subject, &lastID); err != nil {
+			return err
+		}
+		pd.sequences.seen(subject, lastID)
+	}
+	return rows.Err()
 }
 
 func (pd *PostgresDB) updateExpiredMessages() error {
 	query := `
         UPDATE messages
         SET removed = TRUE
-        WHERE added_time + (expiration_time * INTERVAL '1 second') < NOW()
+        WHERE COALESCE(deliver_at, added_time) + (expiration_time * INTERVAL '1 second') < NOW()
         AND removed = FALSE;
     `
 	_, err := pd.conn.Exec(query)
 	return err
 }
 
+// Flush inserts the pending messages before the pending deletions, which
+// may refer to them.
+func (pd *PostgresDB) Flush() error {
+	if err := pd.execInsertion(); err != nil {
+		return err
+	}
+	return pd.execDeletion()
+}
+
 func (pd *PostgresDB) Close() error {
 	if pd.conn != nil {
 		return pd.conn.Close()
@@ -161,17 +223,66 @@ func (pd *PostgresDB) AddMessage(ctx context.Context, msg broker.Message, subjec
 
 	pd.insertMutex.Lock()
 	defer pd.insertMutex.Unlock()
-	var insertID = pd.lastID
-	var expired = msg.Expiration == time.Duration(0)
-	insertQuery := fmt.Sprintf("($%d, $%d, $%d, NOW(), $%d)",
-		len(pd.insertValues)+1, len(pd.insertValues)+2,
-		len(pd.insertValues)+3, len(pd.insertValues)+4)
+	msg.Subject = subject
+	if err := pd.retention.admit([]broker.Message{msg}); err != nil {
+		return -1, err
+	}
+	sealed, err := sealBodies(pd.keyring, []broker.Message{msg})
+	if err != nil {
+		return -1, err
+	}
+	return pd.queueInsert(msg, subject, sealed[0]), nil
+}
+
+func (pd *PostgresDB) AddMessages(ctx context.Context, msgs []broker.Message) ([]int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Add batch of messages to postgresql")
+	defer span.Finish()
+
+	pd.insertMutex.Lock()
+	defer pd.insertMutex.Unlock()
+	if err := pd.retention.admit(msgs); err != nil {
+		return nil, err
+	}
+	sealed, err := sealBodies(pd.keyring, msgs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = pd.queueInsert(msg, msg.Subject, sealed[i])
+	}
+	return ids, nil
+}
+
+func (pd *PostgresDB) Admits(msgs []broker.Message) error {
+	return pd.retention.check(msgs)
+}
+
+// queueInsert adds the message to the next batch insertion, the caller
+// holds the insert mutex. The message is stored with its sealed body.
+func (pd *PostgresDB) queueInsert(msg broker.Message, subject string, sealed sealedBody) int {
+	var insertID = pd.sequences.assign(subject, msg.ID)
+	var expired = !kept(msg)
+	insertQuery := fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+		len(pd.insertValues)+1, len(pd.insertValues)+2, len(pd.insertValues)+3,
+		len(pd.insertValues)+4, len(pd.insertValues)+5, len(pd.insertValues)+6,
+		len(pd.insertValues)+7, len(pd.insertValues)+8, len(pd.insertValues)+9,
+		len(pd.insertValues)+10, len(pd.insertValues)+11)
 
 	pd.insertMessages = append(pd.insertMessages, insertQuery)
-	pd.insertValues = append(pd.insertValues, subject, []byte(msg.Body), int64(msg.Expiration), expired)
+	pd.insertValues = append(pd.insertValues, insertID, subject, sealed.body, ExpirationSeconds(msg.Expiration),
+		addedTime(msg), expired, encodeJSONHeaders(msg.Headers), sql.NullTime{Time: msg.DeliverAt, Valid: !msg.DeliverAt.IsZero()},
+		sql.NullString{String: msg.IdempotencyKey, Valid: msg.IdempotencyKey != ""},
+		sql.NullString{String: msg.Encoding, Valid: msg.Encoding != ""},
+		sql.NullString{String: sealed.keyID, Valid: sealed.keyID != ""})
+
+	return insertID
+}
 
-	pd.lastID++
-	return insertID, nil
+func (pd *PostgresDB) LastID(subject string) int {
+	pd.insertMutex.Lock()
+	defer pd.insertMutex.Unlock()
+	return pd.sequences[subject]
 }
 
 func (pd *PostgresDB) FetchMessage(ctx context.Context, id int, subject string) (broker.Message, error) {
@@ -179,72 +290,347 @@ func (pd *PostgresDB) FetchMessage(ctx context.Context, id int, subject string)
 	defer span.Finish()
 
 	pd.RLock()
-	stringId := strconv.Itoa(id)
-	for _, delId := range pd.deletionList {
-
-		if delId == stringId {
-
+	for _, deleted := range pd.deletionList {
+		if deleted.ID == id && deleted.Subject == subject {
 			pd.RUnlock()
 			return broker.Message{}, broker.ErrExpiredID
 		}
 	}
 	pd.RUnlock()
 
-	query := fmt.Sprintf("SELECT body, expiration_time, removed FROM messages WHERE id = %d AND subject = '%s';", id, subject)
-	rows, err := pd.conn.Query(query)
+	row, err := pd.fetchRow(ctx, id, subject)
 	if err != nil {
-		pd.log.WithError(err).Warn("failed in retrieving message")
 		return broker.Message{}, err
 	}
+	if row == nil {
+		pd.insertMutex.Lock()
+		last := pd.sequences[subject]
+		pd.insertMutex.Unlock()
+		if id < 1 || id > last {
+			return broker.Message{}, broker.ErrInvalidID
+		}
+
+		//	The message may still wait in the batch, otherwise its row was
+		//	removed and then deleted by the janitor
+		if err := pd.Flush(); err != nil {
+			return broker.Message{}, err
+		}
+		if row, err = pd.fetchRow(ctx, id, subject); err != nil {
+			return broker.Message{}, err
+		}
+		if row == nil {
+			return broker.Message{}, broker.ErrExpiredID
+		}
+	}
+
+	if row.removed {
+		return broker.Message{}, broker.ErrExpiredID
+	}
+	body, err := pd.keyring.Open(row.keyID, []byte(row.msg.Body))
+	if err != nil {
+		pd.log.WithError(err).Warn("failed in opening the sealed body of message")
+		return broker.Message{}, err
+	}
+	msg := row.msg
+	msg.Body = string(body)
+	return msg, nil
+}
+
+// fetchRow reads the row of the message, it is nil when there is none.
+func (pd *PostgresDB) fetchRow(ctx context.Context, id int, subject string) (*fetchedRow, error) {
+	query := "SELECT body, expiration_time, added_time, removed, headers, deliver_at, encoding, key_id FROM messages WHERE id = $1 AND subject = $2;"
+	rows, err := pd.conn.QueryContext(ctx, query, id, subject)
+	if err != nil {
+		pd.log.WithError(err).Warn("failed in retrieving message")
+		return nil, err
+	}
 	defer rows.Close()
 
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
 	var msgBdy []byte
 	var expirationTime int
+	var addedTime time.Time
 	var removed bool
-	if rows.Next() {
-		if err := rows.Scan(&msgBdy, &expirationTime, &removed); err != nil {
-			pd.log.WithError(err).Warn("failed in scanning fetched data from database")
-			return broker.Message{}, err
+	var headers []byte
+	var deliverAt sql.NullTime
+	var encoding sql.NullString
+	var keyID sql.NullString
+	if err := rows.Scan(&msgBdy, &expirationTime, &addedTime, &removed, &headers, &deliverAt, &encoding, &keyID); err != nil {
+		pd.log.WithError(err).Warn("failed in scanning fetched data from database")
+		return nil, err
+	}
+	return &fetchedRow{
+		msg: broker.Message{
+			ID:         id,
+			Timestamp:  addedTime,
+			Body:       string(msgBdy),
+			Headers:    decodeJSONHeaders(headers),
+			Expiration: time.Duration(expirationTime) * time.Second,
+			DeliverAt:  deliverAt.Time,
+			Encoding:   encoding.String,
+		},
+		keyID:   keyID.String,
+		removed: removed,
+	}, rows.Err()
+}
+
+func (pd *PostgresDB) GetMessagesBySubject(ctx context.Context, subject string, filter ReplayFilter) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "GetMessages based on the given subject from postgresql")
+	defer span.Finish()
+
+	var messages = make([]broker.Message, 0)
+	query := `SELECT id, body, expiration_time, added_time, headers, deliver_at, encoding, key_id FROM messages
+		WHERE subject = $1 AND removed = false AND id >= $2 AND added_time >= $3
+		ORDER BY id;`
+	rows, err := pd.conn.QueryContext(ctx, query, subject, filter.FromID, filter.FromTime)
+	if err != nil {
+		pd.log.WithError(err).Warn("failed in retrieving messages with the given subject")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanMessage(rows, nil, pd.keyring)
+		if err != nil {
+			pd.log.WithError(err).Warn("failed in scanning messages with the given subject")
+			return nil, err
 		}
+		messages = append(messages, msg)
+	}
 
-		if err := rows.Err(); err != nil {
-			return broker.Message{}, err
+	return filter.last(messages), rows.Err()
+}
+
+func (pd *PostgresDB) DelayedMessages(ctx context.Context, after time.Time) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Find delayed messages in postgresql")
+	defer span.Finish()
+
+	if err := pd.Flush(); err != nil {
+		return nil, err
+	}
+	query := `SELECT subject, id, body, expiration_time, added_time, headers, deliver_at, encoding, key_id FROM messages
+		WHERE removed = false AND deliver_at > $1;`
+	rows, err := pd.conn.QueryContext(ctx, query, after)
+	if err != nil {
+		pd.log.WithError(err).Warn("failed in retrieving delayed messages")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages = make([]broker.Message, 0)
+	for rows.Next() {
+		var subject string
+		msg, err := scanMessage(rows, &subject, pd.keyring)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		return broker.Message{}, broker.ErrInvalidID
+		msg.Subject = subject
+		messages = append(messages, msg)
 	}
+	return messages, rows.Err()
+}
 
-	if removed {
-		return broker.Message{}, broker.ErrExpiredID
+func (pd *PostgresDB) KeyedMessages(ctx context.Context, since time.Time) ([]broker.Message, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Find messages with idempotency keys in postgresql")
+	defer span.Finish()
+
+	if err := pd.Flush(); err != nil {
+		return nil, err
 	}
+	query := `SELECT subject, id, added_time, idempotency_key FROM messages
+		WHERE idempotency_key IS NOT NULL AND added_time >= $1;`
+	rows, err := pd.conn.QueryContext(ctx, query, since)
+	if err != nil {
+		pd.log.WithError(err).Warn("failed in retrieving messages with idempotency keys")
+		return nil, err
+	}
+	defer rows.Close()
 
+	var messages = make([]broker.Message, 0)
+	for rows.Next() {
+		var msg broker.Message
+		if err := rows.Scan(&msg.Subject, &msg.ID, &msg.Timestamp, &msg.IdempotencyKey); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// scanMessage reads a row of id, body, expiration_time, added_time, headers,
+// deliver_at, encoding and key_id, after the subject when one is given, and
+// opens the sealed body with the keyring.
+func scanMessage(rows *sql.Rows, subject *string, keyring *encryption.Keyring) (broker.Message, error) {
+	var id int
+	var body []byte
+	var expirationTime int64
+	var addedTime time.Time
+	var headers []byte
+	var deliverAt sql.NullTime
+	var encoding sql.NullString
+	var keyID sql.NullString
+	dest := []interface{}{&id, &body, &expirationTime, &addedTime, &headers, &deliverAt, &encoding, &keyID}
+	if subject != nil {
+		dest = append([]interface{}{subject}, dest...)
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return broker.Message{}, err
+	}
+	body, err := keyring.Open(keyID.String, body)
+	if err != nil {
+		return broker.Message{}, err
+	}
 	return broker.Message{
-		Body:       string(msgBdy),
-		Expiration: time.Duration(expirationTime),
+		ID:         id,
+		Timestamp:  addedTime,
+		Body:       string(body),
+		Headers:    decodeJSONHeaders(headers),
+		Expiration: time.Duration(expirationTime) * time.Second,
+		DeliverAt:  deliverAt.Time,
+		Encoding:   encoding.String,
 	}, nil
 }
 
-func (pd *PostgresDB) GetMessagesBySubject(ctx context.Context, subject string) ([]broker.Message, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "GetMessages based on the given subject from postgresql")
+// Subjects writes the pending batches first, so the messages just published
+// are counted.
+func (pd *PostgresDB) Subjects(ctx context.Context) (map[string]int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Count messages of subjects in postgresql")
 	defer span.Finish()
 
-	var messages = make([]broker.Message, 0)
-	query := fmt.Sprintf("SELECT id, body FROM messages WHERE subject = '%s' AND removed = false;", subject)
-	rows, err := pd.conn.Query(query)
+	if err := pd.Flush(); err != nil {
+		return nil, err
+	}
+	rows, err := pd.conn.QueryContext(ctx, `SELECT subject, COUNT(*) FROM messages WHERE removed = false GROUP BY subject;`)
 	if err != nil {
-		pd.log.WithError(err).Warn("failed in retrieving messages with the given subject")
+		pd.log.WithError(err).Warn("failed in counting messages of subjects")
 		return nil, err
 	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
 	for rows.Next() {
-		var id int
-		var body []byte
-		rows.Scan(&id, &body)
-		messages = append(messages, broker.Message{
-			Body: string(body),
-		})
+		var subject string
+		var count int
+		if err := rows.Scan(&subject, &count); err != nil {
+			return nil, err
+		}
+		counts[subject] = count
 	}
+	return counts, rows.Err()
+}
 
-	return messages, nil
+func (pd *PostgresDB) PurgeSubject(ctx context.Context, subject string) (int, error) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "Purge subject in postgresql")
+	defer span.Finish()
+
+	if err := pd.Flush(); err != nil {
+		return 0, err
+	}
+	result, err := pd.conn.ExecContext(ctx, `UPDATE messages SET removed = true WHERE subject = $1 AND removed = false;`, subject)
+	if err != nil {
+		pd.log.WithError(err).Warn("can not purge the messages of subject")
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// discardOldQuery marks the oldest messages of the subject as removed until
+// the newer ones are within the message and byte limits, a limit of 0 is
+// no limit.
+const discardOldQuery = `
+	UPDATE messages SET removed = true WHERE subject = $1 AND id IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER newest AS newer, SUM(COALESCE(octet_length(body), 0)) OVER newest AS bytes
+			FROM messages WHERE subject = $1 AND removed = false
+			WINDOW newest AS (ORDER BY id DESC)
+		) AS live WHERE ($2 > 0 AND newer > $2) OR ($3 > 0 AND bytes > $3)
+	);`
+
+// enforceRetention marks the messages of every subject that are over its
+// limits as removed, then deletes the rows of the removed messages. The
+// last row of every subject is kept, the sequence goes on from its id
+// after a restart, and so are the rows with an idempotency key within the
+// dedup window.
+func (pd *PostgresDB) enforceRetention(now time.Time) {
+	if err := pd.Flush(); err != nil {
+		return
+	}
+	kept, err := pd.keptUsage()
+	if err != nil {
+		pd.log.WithError(err).Warn("can not count the kept messages of subjects")
+		return
+	}
+
+	for subject, subjectUsage := range kept {
+		limits := pd.retention.limits(subject)
+		var err error
+		if limits.MaxAgeSeconds > 0 {
+			_, err = pd.conn.Exec(`UPDATE messages SET removed = true WHERE subject = $1 AND removed = false AND added_time < $2;`,
+				subject, now.Add(-limits.maxAge()))
+		}
+		if err == nil && limits.discards(subjectUsage) {
+			_, err = pd.conn.Exec(discardOldQuery, subject, int64(limits.MaxMessages), limits.MaxBytes)
+		}
+		if err != nil {
+			pd.log.WithError(err).Warnf("can not enforce the retention of subject %s", subject)
+		}
+	}
+
+	_, err = pd.conn.Exec(`DELETE FROM messages AS m WHERE m.removed AND m.id < (SELECT MAX(id) FROM messages WHERE subject = m.subject)
+		AND (m.idempotency_key IS NULL OR m.added_time < $1);`, now.Add(-DedupWindow(pd.cfg)))
+	if err != nil {
+		pd.log.WithError(err).Warn("can not delete the removed messages")
+	}
+
+	kept, err = pd.keptUsage()
+	if err != nil {
+		pd.log.WithError(err).Warn("can not count the kept messages of subjects")
+		return
+	}
+	pd.retention.reset(kept)
+}
+
+func (pd *PostgresDB) keptUsage() (map[string]usage, error) {
+	rows, err := pd.conn.Query(`SELECT subject, COUNT(*), COALESCE(SUM(octet_length(body)), 0) FROM messages WHERE removed = false GROUP BY subject;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	kept := make(map[string]usage)
+	for rows.Next() {
+		var subject string
+		var subjectUsage usage
+		if err := rows.Scan(&subject, &subjectUsage.messages, &subjectUsage.bytes); err != nil {
+			return nil, err
+		}
+		kept[subject] = subjectUsage
+	}
+	return kept, rows.Err()
+}
+
+// encodeJSONHeaders keeps the headers as a JSON object, messages without
+// headers get NULL.
+func encodeJSONHeaders(headers map[string]string) []byte {
+	if len(headers) == 0 {
+		return nil
+	}
+	encoded, _ := json.Marshal(headers)
+	return encoded
+}
+
+func decodeJSONHeaders(encoded []byte) map[string]string {
+	if len(encoded) == 0 {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal(encoded, &headers); err != nil {
+		return nil
+	}
+	return headers
 }
 
 func (pd *PostgresDB) DeleteMessage(subject string, id int) {
@@ -252,7 +638,16 @@ func (pd *PostgresDB) DeleteMessage(subject string, id int) {
 	defer span.Finish()
 
 	pd.Lock()
-	pd.deletionList = append(pd.deletionList, strconv.Itoa(id))
+	pd.deletionList = append(pd.deletionList, MessageKey{Subject: subject, ID: id})
+	pd.Unlock()
+}
+
+func (pd *PostgresDB) DeleteMessages(keys []MessageKey) {
+	span, _ := opentracing.StartSpanFromContext(context.Background(), "Delete messages from postgresql")
+	defer span.Finish()
+
+	pd.Lock()
+	pd.deletionList = append(pd.deletionList, keys...)
 	pd.Unlock()
 }
 
@@ -260,32 +655,53 @@ func (pd *PostgresDB) scheduledBatchDeletion() {
 	ticker := time.NewTicker(time.Duration(5 * time.Second))
 
 	for range ticker.C {
-		pd.Lock()
-		if len(pd.deletionList) > 0 {
-			query := fmt.Sprintf("UPDATE messages SET removed = true WHERE id in (%v)", strings.Join(pd.deletionList, ", "))
-			_, err := pd.conn.Exec(query)
-			if err != nil {
-				pd.log.WithError(err).Warn("can not update 'removed' field for items in deletion list")
-			}
-			pd.deletionList = pd.deletionList[:0]
-		}
-		pd.Unlock()
+		_ = pd.execDeletion()
+	}
+}
+
+func (pd *PostgresDB) execDeletion() error {
+	pd.Lock()
+	defer pd.Unlock()
+	if len(pd.deletionList) == 0 {
+		return nil
 	}
+
+	keys := make([]string, len(pd.deletionList))
+	values := make([]interface{}, 0, 2*len(pd.deletionList))
+	for i, deleted := range pd.deletionList {
+		keys[i] = fmt.Sprintf("($%d, $%d)", 2*i+1, 2*i+2)
+		values = append(values, deleted.Subject, deleted.ID)
+	}
+	query := fmt.Sprintf("UPDATE messages SET removed = true WHERE (subject, id) IN (%v)", strings.Join(keys, ", "))
+	_, err := pd.conn.Exec(query, values...)
+	if err != nil {
+		pd.log.WithError(err).Warn("can not update 'removed' field for items in deletion list")
+	}
+	pd.deletionList = pd.deletionList[:0]
+	return err
 }
+
 func (pd *PostgresDB) scheduledBatchInsertion() {
 	ticker := time.NewTicker(time.Duration(5 * time.Second))
 
 	for range ticker.C {
-		pd.insertMutex.Lock()
-		if len(pd.insertMessages) > 0 {
-			query := `INSERT INTO messages (subject, body, expiration_time, added_time, removed) VALUES ` + strings.Join(pd.insertMessages, ", ")
-			_, err := pd.conn.Query(query, pd.insertValues...)
-			if err != nil {
-				pd.log.WithError(err).Warn("can not insert to postgres correctly")
-			}
-			pd.insertMessages = pd.insertMessages[:0]
-			pd.insertValues = pd.insertValues[:0]
-		}
-		pd.insertMutex.Unlock()
+		_ = pd.execInsertion()
+	}
+}
+
+func (pd *PostgresDB) execInsertion() error {
+	pd.insertMutex.Lock()
+	defer pd.insertMutex.Unlock()
+	if len(pd.insertMessages) == 0 {
+		return nil
+	}
+
+	query := `INSERT INTO messages (id, subject, body, expiration_time, added_time, removed, headers, deliver_at, idempotency_key, encoding, key_id) VALUES ` + strings.Join(pd.insertMessages, ", ")
+	_, err := pd.conn.Exec(query, pd.insertValues...)
+	if err != nil {
+		pd.log.WithError(err).Warn("can not insert to postgres correctly")
 	}
+	pd.insertMessages = pd.insertMessages[:0]
+	pd.insertValues = pd.insertValues[:0]
+	return err
 }
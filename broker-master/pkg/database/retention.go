@@ -0,0 +1,320 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"therealbroker/config"
+	"therealbroker/pkg/broker"
+	"therealbroker/pkg/encryption"
+	"time"
+)
+
+// RetentionPolicy decides what happens to a subject that reached its
+// message or byte limit
+type RetentionPolicy string
+
+const (
+	// DiscardOld removes the oldest messages of the subject until it is
+	// within its limits again
+	DiscardOld RetentionPolicy = "DISCARD_OLD"
+	// RejectNew fails the publishes on the subject until it has room again
+	RejectNew RetentionPolicy = "REJECT_NEW"
+)
+
+// defaultRetentionInterval is how often the janitor runs when the
+// configuration does not say.
+const defaultRetentionInterval = time.Minute
+
+// RetentionLimits is what one subject keeps, a zero limit is no limit.
+// Messages older than MaxAge are removed whatever the policy is.
+type RetentionLimits struct {
+	MaxMessages   int             `json:"max_messages"`
+	MaxBytes      int64           `json:"max_bytes"`
+	MaxAgeSeconds int             `json:"max_age_seconds"`
+	Policy        RetentionPolicy `json:"policy"`
+}
+
+// Retention keeps the limits of every subject, the subjects that are not
+// named get the default ones.
+type Retention struct {
+	Default  RetentionLimits
+	Subjects map[string]RetentionLimits
+	// Interval is how often the janitor enforces the limits
+	Interval time.Duration
+}
+
+// LoadRetention reads the default limits from the configuration and the
+// limits of single subjects from its JSON file like
+// {"orders": {"max_messages": 1000, "max_age_seconds": 86400, "policy": "REJECT_NEW"}}
+// A missing configuration keeps every message.
+func LoadRetention(cfg *config.Config) (Retention, error) {
+	retention := Retention{Subjects: make(map[string]RetentionLimits), Interval: defaultRetentionInterval}
+	if cfg == nil {
+		return retention, nil
+	}
+
+	retention.Default = RetentionLimits{
+		MaxMessages:   cfg.Retention.MaxMessages,
+		MaxBytes:      cfg.Retention.MaxBytes,
+		MaxAgeSeconds: cfg.Retention.MaxAge,
+		Policy:        RetentionPolicy(cfg.Retention.Policy),
+	}
+	if cfg.Retention.Interval > 0 {
+		retention.Interval = time.Duration(cfg.Retention.Interval) * time.Second
+	}
+	if cfg.Retention.File != "" {
+		data, err := os.ReadFile(cfg.Retention.File)
+		if err != nil {
+			return Retention{}, err
+		}
+		if err := json.Unmarshal(data, &retention.Subjects); err != nil {
+			return Retention{}, err
+		}
+	}
+
+	if err := retention.Default.validate(); err != nil {
+		return Retention{}, err
+	}
+	for subject, limits := range retention.Subjects {
+		if err := limits.validate(); err != nil {
+			return Retention{}, fmt.Errorf("retention of %s: %w", subject, err)
+		}
+	}
+	return retention, nil
+}
+
+func (l RetentionLimits) validate() error {
+	switch l.Policy {
+	case "", DiscardOld, RejectNew:
+	default:
+		return fmt.Errorf("unknown retention policy %q", l.Policy)
+	}
+	if l.MaxMessages < 0 || l.MaxBytes < 0 || l.MaxAgeSeconds < 0 {
+		return fmt.Errorf("retention limits can not be negative")
+	}
+	return nil
+}
+
+func (r Retention) limits(subject string) RetentionLimits {
+	if limits, ok := r.Subjects[subject]; ok {
+		return limits
+	}
+	return r.Default
+}
+
+// enabled reports whether any subject has a limit at all.
+func (r Retention) enabled() bool {
+	if r.Default.limited() {
+		return true
+	}
+	for _, limits := range r.Subjects {
+		if limits.limited() {
+			return true
+		}
+	}
+	return false
+}
+
+func (l RetentionLimits) limited() bool {
+	return l.MaxMessages > 0 || l.MaxBytes > 0 || l.MaxAgeSeconds > 0
+}
+
+// rejects reports whether publishes are failed once the subject is full.
+func (l RetentionLimits) rejects() bool {
+	return l.Policy == RejectNew && (l.MaxMessages > 0 || l.MaxBytes > 0)
+}
+
+func (l RetentionLimits) maxAge() time.Duration {
+	return time.Duration(l.MaxAgeSeconds) * time.Second
+}
+
+// discards reports whether the oldest messages are removed from a subject
+// that keeps this much.
+func (l RetentionLimits) discards(kept usage) bool {
+	return l.Policy != RejectNew &&
+		((l.MaxMessages > 0 && kept.messages > l.MaxMessages) || (l.MaxBytes > 0 && kept.bytes > l.MaxBytes))
+}
+
+// usage is what a subject keeps against its limits, the bytes are the
+// bytes of the bodies as the storage keeps them, sealed when the keyring
+// is on.
+type usage struct {
+	messages int
+	bytes    int64
+}
+
+// retained is a live message of a subject as the janitor sees it.
+type retained struct {
+	id    int
+	size  int
+	added time.Time
+}
+
+// trim picks the messages of the subject the janitor removes, the live
+// messages are given oldest first. It returns what the subject keeps.
+func (l RetentionLimits) trim(live []retained, now time.Time) ([]int, usage) {
+	var discarded []int
+	kept := usage{}
+	for _, msg := range live {
+		kept.messages++
+		kept.bytes += int64(msg.size)
+	}
+
+	for len(live) > 0 {
+		msg := live[0]
+		old := l.MaxAgeSeconds > 0 && now.Sub(msg.added) > l.maxAge()
+		if !old && !l.discards(kept) {
+			break
+		}
+		discarded = append(discarded, msg.id)
+		kept.messages--
+		kept.bytes -= int64(msg.size)
+		live = live[1:]
+	}
+	return discarded, kept
+}
+
+// retainer enforces the retention of one storage. It counts what the
+// subjects that reject new messages keep, the storage tells it about the
+// messages it removes and the janitor corrects the counts on every run.
+type retainer struct {
+	Retention
+	// keyring seals the bodies, the messages are counted with their
+	// sealed size before they are sealed
+	keyring *encryption.Keyring
+	usage   map[string]usage
+	stop    chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+func newRetainer(retention Retention, keyring *encryption.Keyring) *retainer {
+	if retention.Interval <= 0 {
+		retention.Interval = defaultRetentionInterval
+	}
+	return &retainer{
+		Retention: retention,
+		keyring:   keyring,
+		usage:     make(map[string]usage),
+		stop:      make(chan struct{}),
+	}
+}
+
+// admit counts the messages against their subjects, or fails all of them
+// with ErrSubjectFull when one of them does not fit. Messages that are not
+// kept always fit, and so do the ones that come with an ID, the leader of
+// a cluster has admitted them already.
+func (r *retainer) admit(msgs []broker.Message) error {
+	r.Lock()
+	defer r.Unlock()
+
+	added, checked := r.adds(msgs)
+	for subject := range checked {
+		if r.overLocked(subject, added[subject]) {
+			return broker.ErrSubjectFull
+		}
+	}
+	for subject, next := range added {
+		current := r.usage[subject]
+		r.usage[subject] = usage{messages: current.messages + next.messages, bytes: current.bytes + next.bytes}
+	}
+	return nil
+}
+
+// check fails with ErrSubjectFull when the messages do not all fit, it
+// counts none of them.
+func (r *retainer) check(msgs []broker.Message) error {
+	r.Lock()
+	defer r.Unlock()
+
+	added, _ := r.adds(msgs)
+	for subject, next := range added {
+		if r.overLocked(subject, next) {
+			return broker.ErrSubjectFull
+		}
+	}
+	return nil
+}
+
+// adds sums the messages on the subjects that reject new messages, and
+// names the subjects with a message that comes without an ID. The caller
+// holds the lock.
+func (r *retainer) adds(msgs []broker.Message) (map[string]usage, map[string]bool) {
+	added := make(map[string]usage)
+	checked := make(map[string]bool)
+	for _, msg := range msgs {
+		if !kept(msg) || !r.limits(msg.Subject).rejects() {
+			continue
+		}
+		next := added[msg.Subject]
+		next.messages++
+		next.bytes += int64(r.keyring.SealedSize(len(msg.Body)))
+		added[msg.Subject] = next
+		if msg.ID == 0 {
+			checked[msg.Subject] = true
+		}
+	}
+	return added, checked
+}
+
+// overLocked reports whether the subject goes over its limits with next
+// added to what it keeps.
+func (r *retainer) overLocked(subject string, next usage) bool {
+	limits, current := r.limits(subject), r.usage[subject]
+	return (limits.MaxMessages > 0 && current.messages+next.messages > limits.MaxMessages) ||
+		(limits.MaxBytes > 0 && current.bytes+next.bytes > limits.MaxBytes)
+}
+
+// released gives back the room of a message that is removed.
+func (r *retainer) released(subject string, size int) {
+	r.Lock()
+	defer r.Unlock()
+
+	current, ok := r.usage[subject]
+	if !ok {
+		return
+	}
+	current.messages--
+	current.bytes -= int64(size)
+	if current.messages <= 0 {
+		delete(r.usage, subject)
+		return
+	}
+	r.usage[subject] = current
+}
+
+// reset replaces the counts with the ones the janitor has found.
+func (r *retainer) reset(kept map[string]usage) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.usage = make(map[string]usage)
+	for subject, u := range kept {
+		if u.messages > 0 && r.limits(subject).rejects() {
+			r.usage[subject] = u
+		}
+	}
+}
+
+// run calls enforce every interval until the retainer is closed.
+func (r *retainer) run(enforce func(now time.Time)) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			enforce(now)
+		}
+	}
+}
+
+func (r *retainer) close() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"therealbroker/pkg/broker"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionShouldDiscardOldMessages(t *testing.T) {
+	md := newMemoryDB(Retention{
+		Default:  RetentionLimits{MaxMessages: 2},
+		Subjects: map[string]RetentionLimits{"reza": {MaxBytes: 10}},
+	})
+	defer md.Close()
+
+	for _, body := range []string{"first", "second", "third"} {
+		_, err := md.AddMessage(context.Background(), broker.Message{Body: body, Expiration: time.Hour}, "ali")
+		assert.Nil(t, err)
+		_, err = md.AddMessage(context.Background(), broker.Message{Body: body, Expiration: time.Hour}, "reza")
+		assert.Nil(t, err)
+	}
+	md.enforceRetention(time.Now())
+
+	_, err := md.FetchMessage(context.Background(), 1, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	messages, _ := md.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Equal(t, 2, len(messages))
+
+	//	"second" and "third" take 11 bytes, only "third" fits
+	messages, _ = md.GetMessagesBySubject(context.Background(), "reza", ReplayFilter{})
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "third", messages[0].Body)
+}
+
+func TestRetentionShouldDiscardMessagesByAge(t *testing.T) {
+	md := newMemoryDB(Retention{Default: RetentionLimits{MaxAgeSeconds: 60, Policy: RejectNew}})
+	defer md.Close()
+
+	old, _ := md.AddMessage(context.Background(), broker.Message{Body: "old", Expiration: time.Hour, Timestamp: time.Now().Add(-2 * time.Minute)}, "ali")
+	recent, _ := md.AddMessage(context.Background(), broker.Message{Body: "recent", Expiration: time.Hour}, "ali")
+	md.enforceRetention(time.Now())
+
+	_, err := md.FetchMessage(context.Background(), old, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	_, err = md.FetchMessage(context.Background(), recent, "ali")
+	assert.Nil(t, err)
+}
+
+func TestRetentionShouldRejectNewMessages(t *testing.T) {
+	md := newMemoryDB(Retention{Default: RetentionLimits{MaxMessages: 2, Policy: RejectNew}})
+	defer md.Close()
+
+	first, err := md.AddMessage(context.Background(), broker.Message{Body: "first", Expiration: time.Hour}, "ali")
+	assert.Nil(t, err)
+	_, err = md.AddMessages(context.Background(), []broker.Message{
+		{Subject: "ali", Body: "second", Expiration: time.Hour},
+		{Subject: "ali", Body: "third", Expiration: time.Hour},
+	})
+	assert.Equal(t, broker.ErrSubjectFull, err)
+
+	_, err = md.AddMessage(context.Background(), broker.Message{Body: "second", Expiration: time.Hour}, "ali")
+	assert.Nil(t, err)
+	_, err = md.AddMessage(context.Background(), broker.Message{Body: "third", Expiration: time.Hour}, "ali")
+	assert.Equal(t, broker.ErrSubjectFull, err)
+
+	//	Messages that are not kept and other subjects still fit
+	_, err = md.AddMessage(context.Background(), broker.Message{Body: "gone"}, "ali")
+	assert.Nil(t, err)
+	_, err = md.AddMessage(context.Background(), broker.Message{Body: "other", Expiration: time.Hour}, "reza")
+	assert.Nil(t, err)
+
+	md.DeleteMessage("ali", first)
+	_, err = md.AddMessage(context.Background(), broker.Message{Body: "third", Expiration: time.Hour}, "ali")
+	assert.Nil(t, err)
+
+	md.enforceRetention(time.Now())
+	messages, _ := md.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Equal(t, 2, len(messages))
+}
+
+func TestFileLogShouldEnforceRetentionAfterRestart(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Hour}, "ali")
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, fd.Close())
+
+	cfg.Retention.MaxMessages = 2
+	cfg.Retention.Policy = string(RejectNew)
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	_, err = fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Hour}, "ali")
+	assert.Equal(t, broker.ErrSubjectFull, err)
+
+	cfg.Retention.Policy = string(DiscardOld)
+	assert.Nil(t, fd.Close())
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+
+	_, err = fd.FetchMessage(context.Background(), 1, "ali")
+	assert.Equal(t, broker.ErrExpiredID, err)
+	messages, _ := fd.GetMessagesBySubject(context.Background(), "ali", ReplayFilter{})
+	assert.Equal(t, 2, len(messages))
+}
+
+func TestFileLogShouldCountSealedBodiesAfterRestart(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	cfg.Encryption.KeyringFile = filepath.Join(t.TempDir(), "keyring.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'k'}, 32))
+	assert.Nil(t, os.WriteFile(cfg.Encryption.KeyringFile, []byte(`{"active": "k1", "keys": {"k1": "`+key+`"}}`), 0600))
+	cfg.Retention.MaxBytes = 1 << 20
+	cfg.Retention.Policy = string(RejectNew)
+
+	fd, err := openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := fd.AddMessage(context.Background(), broker.Message{Body: "hello", Expiration: time.Hour}, "ali")
+		assert.Nil(t, err)
+	}
+	added := fd.retention.usage["ali"]
+	assert.Equal(t, int64(3*fd.keyring.SealedSize(len("hello"))), added.bytes)
+	assert.Nil(t, fd.Close())
+
+	fd, err = openFileLog(cfg, logrus.New())
+	assert.Nil(t, err)
+	defer fd.Close()
+	assert.Equal(t, added, fd.retention.usage["ali"])
+}
+
+func TestLoadRetentionShouldReadSubjectsFromFile(t *testing.T) {
+	cfg := newFileLogConfig(t, 1<<20)
+	cfg.Retention.MaxAge = 3600
+	cfg.Retention.File = filepath.Join(t.TempDir(), "retention.json")
+	assert.Nil(t, os.WriteFile(cfg.Retention.File, []byte(`{"orders": {"max_messages": 10, "policy": "REJECT_NEW"}}`), 0644))
+
+	retention, err := LoadRetention(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, RetentionLimits{MaxMessages: 10, Policy: RejectNew}, retention.limits("orders"))
+	assert.Equal(t, RetentionLimits{MaxAgeSeconds: 3600}, retention.limits("payments"))
+
+	assert.Nil(t, os.WriteFile(cfg.Retention.File, []byte(`{"orders": {"policy": "KEEP_ALL"}}`), 0644))
+	_, err = LoadRetention(cfg)
+	assert.NotNil(t, err)
+}
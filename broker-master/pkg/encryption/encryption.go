@@ -0,0 +1,186 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"therealbroker/config"
+)
+
+// dataKeySize is the size of the key every body is sealed with, AES-256
+const dataKeySize = 32
+
+var (
+	// ErrUnknownKey is returned for bodies sealed with a key the keyring
+	// does not have, like one that was removed too early after a rotation
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrSealedBody is returned for sealed bodies that are cut short or
+	// were changed after they were sealed
+	ErrSealedBody = errors.New("invalid sealed body")
+)
+
+// keyringFile is the JSON file of the keyring like
+// {"active": "2024-06", "keys": {"2024-01": "<base64>", "2024-06": "<base64>"}}
+// The keys are 16, 24 or 32 random bytes.
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// Keyring seals the bodies the storages keep with envelope encryption: every
+// body gets a random data key, and the data key is sealed with the active key
+// of the keyring. The id of that key is stored next to the body, so the keys
+// rotate by making a new one active and keeping the old ones until the
+// bodies sealed with them are gone.
+// A nil keyring keeps the bodies as they are.
+type Keyring struct {
+	Active string
+	keys   map[string]cipher.AEAD
+}
+
+// Load reads the keyring from the file in the configuration, a missing
+// configuration or file gives a nil keyring.
+func Load(cfg *config.Config) (*Keyring, error) {
+	if cfg == nil || cfg.Encryption.KeyringFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(cfg.Encryption.KeyringFile)
+	if err != nil {
+		return nil, err
+	}
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	keyring := &Keyring{Active: file.Active, keys: make(map[string]cipher.AEAD)}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		keyring.keys[id] = aead
+	}
+	if _, ok := keyring.keys[keyring.Active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", keyring.Active)
+	}
+	return keyring, nil
+}
+
+// Keys counts the keys of the keyring.
+func (k *Keyring) Keys() int {
+	if k == nil {
+		return 0
+	}
+	return len(k.keys)
+}
+
+// Seal seals the body with a new data key and returns the id of the key
+// that data key is sealed with. The sealed body is the nonce and the sealed
+// data key, then the nonce and the sealed body.
+func (k *Keyring) Seal(body []byte) (string, []byte, error) {
+	if k == nil {
+		return "", body, nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	//	The key id is sealed along, so a body can not be opened with a key
+	//	it names falsely
+	sealed, err := seal(k.keys[k.Active], nil, dataKey, []byte(k.Active))
+	if err != nil {
+		return "", nil, err
+	}
+	sealed, err = seal(dataAEAD, sealed, body, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.Active, sealed, nil
+}
+
+// SealedSize is the size a body of size bytes has once it is sealed, the
+// same whichever key of the keyring seals it.
+func (k *Keyring) SealedSize(size int) int {
+	if k == nil {
+		return size
+	}
+	aead := k.keys[k.Active]
+	return 2*(aead.NonceSize()+aead.Overhead()) + dataKeySize + size
+}
+
+// Open returns the body sealed with the key, a body without a key id was
+// stored before the encryption was turned on and is returned as it is.
+func (k *Keyring) Open(keyID string, sealed []byte) ([]byte, error) {
+	if keyID == "" {
+		return sealed, nil
+	}
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	dataKeyLength := aead.NonceSize() + dataKeySize + aead.Overhead()
+	if len(sealed) < dataKeyLength {
+		return nil, ErrSealedBody
+	}
+	dataKey, err := open(aead, sealed[:dataKeyLength], []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataAEAD, sealed[dataKeyLength:], nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal appends a random nonce and the sealed plaintext to dst.
+func seal(aead cipher.AEAD, dst []byte, plaintext []byte, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, data), nil
+}
+
+// open opens a nonce followed by its sealed plaintext.
+func open(aead cipher.AEAD, sealed []byte, data []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrSealedBody
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], data)
+	if err != nil {
+		return nil, ErrSealedBody
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,88 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"therealbroker/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newKeyringConfig(t *testing.T, keyring string) *config.Config {
+	cfg := &config.Config{}
+	cfg.Encryption.KeyringFile = filepath.Join(t.TempDir(), "keyring.json")
+	assert.Nil(t, os.WriteFile(cfg.Encryption.KeyringFile, []byte(keyring), 0600))
+	return cfg
+}
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestSealedBodyShouldOpenAfterRotation(t *testing.T) {
+	before, err := Load(newKeyringConfig(t, `{"active": "k1", "keys": {"k1": "`+key('a')+`"}}`))
+	assert.Nil(t, err)
+	keyID, sealed, err := before.Seal([]byte("personal data"))
+	assert.Nil(t, err)
+	assert.Equal(t, "k1", keyID)
+	assert.NotContains(t, string(sealed), "personal data")
+
+	after, err := Load(newKeyringConfig(t, `{"active": "k2", "keys": {"k1": "`+key('a')+`", "k2": "`+key('b')+`"}}`))
+	assert.Nil(t, err)
+	body, err := after.Open(keyID, sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, "personal data", string(body))
+
+	keyID, _, _ = after.Seal([]byte("personal data"))
+	assert.Equal(t, "k2", keyID)
+}
+
+func TestOpenShouldRejectChangedBodies(t *testing.T) {
+	keyring, _ := Load(newKeyringConfig(t, `{"active": "k1", "keys": {"k1": "`+key('a')+`", "k2": "`+key('b')+`"}}`))
+	keyID, sealed, _ := keyring.Seal([]byte("personal data"))
+
+	sealed[len(sealed)-1] ^= 1
+	_, err := keyring.Open(keyID, sealed)
+	assert.Equal(t, ErrSealedBody, err)
+
+	_, err = keyring.Open("k2", sealed[:10])
+	assert.Equal(t, ErrSealedBody, err)
+	_, err = keyring.Open("k3", sealed)
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestNilKeyringShouldKeepBodies(t *testing.T) {
+	keyring, err := Load(nil)
+	assert.Nil(t, err)
+	keyID, body, err := keyring.Seal([]byte("plain"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", keyID)
+	assert.Equal(t, "plain", string(body))
+
+	opened, err := keyring.Open("", body)
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", string(opened))
+	_, err = keyring.Open("k1", body)
+	assert.Equal(t, ErrUnknownKey, err)
+}
+
+func TestLoadShouldRejectInvalidKeyrings(t *testing.T) {
+	_, err := Load(newKeyringConfig(t, `{"active": "k2", "keys": {"k1": "`+key('a')+`"}}`))
+	assert.NotNil(t, err)
+	_, err = Load(newKeyringConfig(t, `{"active": "k1", "keys": {"k1": "c2hvcnQ="}}`))
+	assert.NotNil(t, err)
+}
+
+func TestSealedSizeShouldMatchSealedBodies(t *testing.T) {
+	keyring, _ := Load(newKeyringConfig(t, `{"active": "k1", "keys": {"k1": "`+key('a')+`"}}`))
+	for _, body := range []string{"", "personal data"} {
+		_, sealed, err := keyring.Seal([]byte(body))
+		assert.Nil(t, err)
+		assert.Equal(t, len(sealed), keyring.SealedSize(len(body)))
+	}
+	var plain *Keyring
+	assert.Equal(t, 5, plain.SealedSize(5))
+}
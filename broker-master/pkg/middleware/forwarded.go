@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// ForwardedKey marks the calls one broker forwards to another, its value is
+// the address of the broker that forwarded the call.
+const ForwardedKey = "x-broker-forwarded-by"
+
+// Forwarded tells whether an incoming call was forwarded by another broker.
+func Forwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(ForwardedKey)) > 0
+}
@@ -16,6 +16,18 @@ var (
 		Name: "active_subscribers",
 	})
 
+	DroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropped_messages",
+	}, []string{"policy"})
+
+	DisconnectedSubscribers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "disconnected_slow_subscribers",
+	})
+
+	RateLimitedCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limited_calls",
+	}, []string{"limit"})
+
 	MethodCount = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "method_count",
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// idleBuckets is the number of buckets a Limiter keeps before it forgets
+// the ones that are full again, so keys that come and go do not pile up.
+const idleBuckets = 1024
+
+// Limiter is a token bucket for every key, like a client or a subject.
+// The buckets refill at rate tokens a second up to burst tokens.
+type Limiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter that allows rate tokens a second for every
+// key, burst defaults to one second worth of tokens. A rate of zero or less
+// allows everything.
+func NewLimiter(rate float64, burst float64) *Limiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes n tokens from the bucket of the key. More than burst tokens
+// are allowed from a full bucket, the bucket then owes the rest so the
+// rate still holds for large requests.
+func (l *Limiter) Allow(key string, n float64) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= idleBuckets {
+			l.forget(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	need := n
+	if need > l.burst {
+		need = l.burst
+	}
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Refund puts back tokens that were taken for a request that was refused
+// by another limit after all.
+func (l *Limiter) Refund(key string, n float64) {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens += n
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+}
+
+// forget drops the buckets that have refilled, they are the same as new
+// ones.
+func (l *Limiter) forget(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import "sync"
+
+// Counter limits how many things, like subscriptions, every key holds at
+// the same time.
+type Counter struct {
+	max    int
+	counts map[string]int
+	sync.Mutex
+}
+
+// NewCounter returns a Counter that allows max things for every key, a max
+// of zero or less allows everything.
+func NewCounter(max int) *Counter {
+	return &Counter{max: max, counts: make(map[string]int)}
+}
+
+// Acquire takes one of the things of the key, it must be released once it
+// is not held anymore.
+func (c *Counter) Acquire(key string) bool {
+	if c == nil || c.max <= 0 {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.counts[key] >= c.max {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+func (c *Counter) Release(key string) {
+	if c == nil || c.max <= 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+	} else {
+		c.counts[key]--
+	}
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterShouldRefillAtRate(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(2, 0)
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.Allow("a", 1))
+	assert.True(t, l.Allow("a", 1))
+	assert.False(t, l.Allow("a", 1))
+	assert.True(t, l.Allow("b", 1))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow("a", 1))
+	assert.False(t, l.Allow("a", 1))
+}
+
+func TestLimiterShouldLetLargeRequestsOweTokens(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(100, 0)
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.Allow("a", 300))
+	now = now.Add(2 * time.Second)
+	assert.False(t, l.Allow("a", 1))
+	now = now.Add(time.Second)
+	assert.True(t, l.Allow("a", 1))
+}
+
+func TestLimiterShouldAllowEverythingWithoutRate(t *testing.T) {
+	l := NewLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		assert.True(t, l.Allow("a", 1000))
+	}
+}
+
+func TestCounterShouldLimitHeldThings(t *testing.T) {
+	c := NewCounter(2)
+
+	assert.True(t, c.Acquire("a"))
+	assert.True(t, c.Acquire("a"))
+	assert.False(t, c.Acquire("a"))
+	assert.True(t, c.Acquire("b"))
+
+	c.Release("a")
+	assert.True(t, c.Acquire("a"))
+}
+
+func TestLimiterShouldRefundTokens(t *testing.T) {
+	l := NewLimiter(1, 0)
+
+	assert.True(t, l.Allow("a", 1))
+	l.Refund("a", 1)
+	assert.True(t, l.Allow("a", 1))
+	assert.False(t, l.Allow("a", 1))
+}